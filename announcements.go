@@ -0,0 +1,289 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Moderators publish site-wide announcements, shown as a banner above the
+// thread list and threads until they expire or the reader dismisses them.
+// Dismissals of signed-in users are stored; guests dismiss with a cookie.
+
+// Limits of announcements, in characters.
+const (
+	maxAnnouncementTitle = 200
+	maxAnnouncementBody  = 2000
+)
+
+// dismissedCookie holds the ids of the announcements a guest dismissed, separated by dots.
+const dismissedCookie = "dismissed_announcements"
+
+type Announcement struct {
+	ID        int        `json:"id"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	Author    string     `json:"author"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the announcement is no longer shown.
+func (a Announcement) Expired() bool {
+	return a.ExpiresAt != nil && !a.ExpiresAt.After(time.Now())
+}
+
+// createAnnouncement publishes an announcement of userID and returns its id.
+func createAnnouncement(userID int, title, body string, expiresAt *time.Time) (int, error) {
+	title = strings.TrimSpace(title)
+	body = strings.TrimSpace(body)
+	switch {
+	case title == "":
+		return 0, fieldError("An announcement needs a title")
+	case utf8.RuneCountInString(title) > maxAnnouncementTitle:
+		return 0, fieldError(fmt.Sprintf("The title can be at most %d characters", maxAnnouncementTitle))
+	case utf8.RuneCountInString(body) > maxAnnouncementBody:
+		return 0, fieldError(fmt.Sprintf("The text can be at most %d characters", maxAnnouncementBody))
+	case expiresAt != nil && !expiresAt.After(time.Now()):
+		return 0, fieldError("The expiry must be in the future")
+	}
+
+	result, err := db.Exec("INSERT INTO announcements (title, body, user_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		title, body, userID, time.Now(), expiresAt)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// deleteAnnouncement removes an announcement and its dismissals.
+func deleteAnnouncement(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM announcement_dismissals WHERE announcement_id = ?", id); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM announcements WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	return tx.Commit()
+}
+
+// listAnnouncements returns every announcement, newest first, including expired ones.
+func listAnnouncements() ([]Announcement, error) {
+	rows, err := db.Query(`
+        SELECT a.id, a.title, a.body, u.username, a.created_at, a.expires_at
+        FROM announcements a JOIN users u ON u.id = a.user_id
+        ORDER BY a.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		var a Announcement
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&a.ID, &a.Title, &a.Body, &a.Author, &a.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			a.ExpiresAt = &expiresAt.Time
+		}
+		announcements = append(announcements, a)
+	}
+	return announcements, rows.Err()
+}
+
+// activeAnnouncements returns the unexpired announcements the reader has not
+// dismissed: userID's stored dismissals, or the cookie of a guest.
+func activeAnnouncements(r *http.Request, userID int) ([]Announcement, error) {
+	all, err := listAnnouncements()
+	if err != nil {
+		return nil, err
+	}
+	dismissed := map[int]bool{}
+	if userID == 0 {
+		for _, id := range cookieDismissals(r) {
+			dismissed[id] = true
+		}
+	} else {
+		rows, err := db.Query("SELECT announcement_id FROM announcement_dismissals WHERE user_id = ?", userID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			dismissed[id] = true
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var active []Announcement
+	for _, a := range all {
+		if !a.Expired() && !dismissed[a.ID] {
+			active = append(active, a)
+		}
+	}
+	return active, nil
+}
+
+// cookieDismissals returns the announcement ids in the guest's cookie.
+func cookieDismissals(r *http.Request) []int {
+	cookie, err := r.Cookie(dismissedCookie)
+	if err != nil {
+		return nil
+	}
+	var ids []int
+	for _, v := range strings.Split(cookie.Value, ".") {
+		if id, err := strconv.Atoi(v); err == nil && id > 0 {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// dismissAnnouncement hides an announcement from userID, or from the guest
+// sending r by adding it to their cookie.
+func dismissAnnouncement(w http.ResponseWriter, r *http.Request, userID, id int) error {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM announcements WHERE id = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errNotFound
+	}
+	if userID != 0 {
+		_, err := db.Exec("INSERT OR IGNORE INTO announcement_dismissals (user_id, announcement_id, dismissed_at) VALUES (?, ?, ?)", userID, id, time.Now())
+		return err
+	}
+
+	// Only announcements that still exist are kept, so the cookie stays small
+	ids := []string{strconv.Itoa(id)}
+	for _, old := range cookieDismissals(r) {
+		var kept bool
+		if old != id && db.QueryRow("SELECT EXISTS (SELECT 1 FROM announcements WHERE id = ?)", old).Scan(&kept) == nil && kept {
+			ids = append(ids, strconv.Itoa(old))
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:    dismissedCookie,
+		Value:   strings.Join(ids, "."),
+		Path:    "/",
+		Expires: time.Now().AddDate(1, 0, 0),
+	})
+	return nil
+}
+
+// /announcements/dismiss: hides the announcement id and goes back to redirect
+func handleDismissAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid announcement", http.StatusBadRequest)
+		return
+	}
+	_, userID := sessionUser(r)
+	switch err := dismissAnnouncement(w, r, userID, id); err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Announcement not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to dismiss announcement: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	back := r.FormValue("redirect")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/index"
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// /admin/announcements: moderators list, publish and remove announcements
+func serveAdminAnnouncements(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || !isModerator(role) {
+		http.Error(w, "Only moderators can manage announcements", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err := updateAnnouncements(r, userID)
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case nil:
+		case errNotFound:
+			http.Error(w, "Announcement not found", http.StatusNotFound)
+			return
+		default:
+			log.Printf("Failed to save announcement: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/announcements", http.StatusSeeOther)
+		return
+	}
+
+	announcements, err := listAnnouncements()
+	if err != nil {
+		http.Error(w, "Failed to fetch announcements", http.StatusInternalServerError)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/admin_announcements.html"))
+	tmpl.Execute(w, announcements)
+}
+
+// updateAnnouncements applies a moderator form: action is create or delete.
+func updateAnnouncements(r *http.Request, userID int) error {
+	switch r.FormValue("action") {
+	case "create":
+		var expiresAt *time.Time
+		if v := r.FormValue("expires_at"); v != "" {
+			t, err := parseUserTime(userID, v)
+			if err != nil {
+				return fieldError("Invalid expiry")
+			}
+			expiresAt = &t
+		}
+		_, err := createAnnouncement(userID, r.FormValue("title"), r.FormValue("body"), expiresAt)
+		return err
+	case "delete":
+		id, err := strconv.Atoi(r.FormValue("id"))
+		if err != nil {
+			return fieldError("Invalid announcement")
+		}
+		return deleteAnnouncement(id)
+	}
+	return fieldError("Unknown action")
+}
@@ -0,0 +1,2172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// JSON API, versioned under /api/v1. Every response is either
+// {"data": ..., "next_cursor": "..."} or {"error": {"code": "...", "message": "..."}}.
+
+const (
+	apiDefaultLimit = 20
+	apiMaxLimit     = 100
+)
+
+var errUnauthenticated = errors.New("authentication required")
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type apiEnvelope struct {
+	Data       interface{} `json:"data,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Error      *apiError   `json:"error,omitempty"`
+}
+
+// registerAPIRoutes passes every API route to handle, which is http.HandleFunc
+// for the server.
+func registerAPIRoutes(handle func(pattern string, handler func(http.ResponseWriter, *http.Request))) {
+	handle("GET /api/v1/openapi.json", serveOpenAPI)
+	handle("POST /api/v1/auth/token", apiCreateToken)
+
+	handle("GET /api/v1/threads", apiListThreads)
+	handle("POST /api/v1/threads", apiCreateThread)
+	handle("POST /api/v1/threads/read", apiMarkAllRead)
+	handle("GET /api/v1/threads/{id}", apiGetThread)
+	handle("PATCH /api/v1/threads/{id}", apiUpdateThread)
+	handle("DELETE /api/v1/threads/{id}", apiDeleteThread)
+	handle("GET /api/v1/threads/{id}/revisions", apiListThreadRevisions)
+	handle("POST /api/v1/threads/{id}/read", apiMarkThreadRead)
+	handle("GET /api/v1/threads/{id}/watch", apiGetThreadWatch)
+	handle("PUT /api/v1/threads/{id}/watch", apiSetWatch(setThreadWatch, true))
+	handle("DELETE /api/v1/threads/{id}/watch", apiSetWatch(setThreadWatch, false))
+	handle("POST /api/v1/threads/{id}/votes", apiVoteThread)
+	handle("GET /api/v1/threads/{id}/poll", apiGetPoll)
+	handle("PUT /api/v1/threads/{id}/poll/vote", apiVotePoll(true))
+	handle("DELETE /api/v1/threads/{id}/poll/vote", apiVotePoll(false))
+	handle("POST /api/v1/threads/{id}/move", apiMoveThread)
+	handle("POST /api/v1/threads/{id}/merge", apiMergeThread)
+	handle("POST /api/v1/threads/{id}/split", apiSplitThread)
+	handle("PUT /api/v1/threads/{id}/pin", apiSetThreadState(threadPinned, true))
+	handle("DELETE /api/v1/threads/{id}/pin", apiSetThreadState(threadPinned, false))
+	handle("PUT /api/v1/threads/{id}/lock", apiSetThreadState(threadLocked, true))
+	handle("DELETE /api/v1/threads/{id}/lock", apiSetThreadState(threadLocked, false))
+	handle("PUT /api/v1/threads/{id}/archive", apiSetThreadState(threadArchived, true))
+	handle("DELETE /api/v1/threads/{id}/archive", apiSetThreadState(threadArchived, false))
+	handle("GET /api/v1/threads/{id}/reactions", apiItemReactions(threadVotes))
+	handle("PUT /api/v1/threads/{id}/reactions/{name}", apiSetReaction(threadVotes, true))
+	handle("DELETE /api/v1/threads/{id}/reactions/{name}", apiSetReaction(threadVotes, false))
+
+	handle("GET /api/v1/threads/{id}/comments", apiListComments)
+	handle("POST /api/v1/threads/{id}/comments", apiCreateComment)
+	handle("GET /api/v1/comments/{id}", apiGetComment)
+	handle("PATCH /api/v1/comments/{id}", apiUpdateComment)
+	handle("DELETE /api/v1/comments/{id}", apiDeleteComment)
+	handle("GET /api/v1/comments/{id}/revisions", apiListCommentRevisions)
+	handle("POST /api/v1/comments/{id}/votes", apiVoteComment)
+	handle("GET /api/v1/comments/{id}/reactions", apiItemReactions(commentVotes))
+	handle("PUT /api/v1/comments/{id}/reactions/{name}", apiSetReaction(commentVotes, true))
+	handle("DELETE /api/v1/comments/{id}/reactions/{name}", apiSetReaction(commentVotes, false))
+
+	handle("GET /api/v1/messages/{id}/reactions", apiItemReactions(messageReactions))
+	handle("PUT /api/v1/messages/{id}/reactions/{name}", apiSetReaction(messageReactions, true))
+	handle("DELETE /api/v1/messages/{id}/reactions/{name}", apiSetReaction(messageReactions, false))
+	handle("GET /api/v1/reactions", apiListReactions)
+
+	handle("GET /api/v1/categories", apiListCategories)
+	handle("POST /api/v1/categories", apiCreateCategory)
+	handle("GET /api/v1/categories/{id}", apiGetCategory)
+	handle("PATCH /api/v1/categories/{id}", apiUpdateCategory)
+	handle("DELETE /api/v1/categories/{id}", apiDeleteCategory)
+	handle("GET /api/v1/tags", apiListTags)
+	handle("GET /api/v1/tags/{name}", apiGetTag)
+	handle("DELETE /api/v1/tags/{name}", apiDeleteTag)
+	handle("POST /api/v1/tags/{name}/merge", apiMergeTag)
+	handle("PUT /api/v1/tags/{name}/follow", apiFollowTag(true))
+	handle("DELETE /api/v1/tags/{name}/follow", apiFollowTag(false))
+	handle("GET /api/v1/moderation/log", apiModerationLog)
+	handle("GET /api/v1/announcements", apiListAnnouncements)
+	handle("POST /api/v1/announcements", apiCreateAnnouncement)
+	handle("DELETE /api/v1/announcements/{id}", apiDeleteAnnouncement)
+	handle("POST /api/v1/announcements/{id}/dismiss", apiDismissAnnouncement)
+	handle("POST /api/v1/markdown/preview", apiPreviewMarkdown)
+	handle("POST /api/v1/attachments", apiUploadAttachment)
+	handle("GET /api/v1/attachments/{id}", apiGetAttachment)
+	handle("DELETE /api/v1/attachments/{id}", apiDeleteAttachment)
+	handle("GET /api/v1/users", apiListUsers)
+	handle("GET /api/v1/users/{username}", apiGetUser)
+	handle("PATCH /api/v1/users/{username}", apiUpdateUser)
+	handle("PUT /api/v1/users/{username}/avatar", apiPutAvatar)
+	handle("DELETE /api/v1/users/{username}/avatar", apiDeleteAvatar)
+	handle("GET /api/v1/users/{username}/{section}", apiListProfileSection)
+	handle("PUT /api/v1/users/{username}/follow", apiSetUserRelation(userFollows, true))
+	handle("DELETE /api/v1/users/{username}/follow", apiSetUserRelation(userFollows, false))
+	handle("PUT /api/v1/users/{username}/mute", apiSetUserRelation(userMutes, true))
+	handle("DELETE /api/v1/users/{username}/mute", apiSetUserRelation(userMutes, false))
+	handle("PUT /api/v1/categories/{id}/follow", apiFollowCategory(true))
+	handle("DELETE /api/v1/categories/{id}/follow", apiFollowCategory(false))
+	handle("PUT /api/v1/categories/{id}/watch", apiSetWatch(setCategoryWatch, true))
+	handle("DELETE /api/v1/categories/{id}/watch", apiSetWatch(setCategoryWatch, false))
+	handle("GET /api/v1/feed", apiFeed)
+	handle("GET /api/v1/notifications", apiListNotifications)
+	handle("GET /api/v1/notifications/unread_count", apiUnreadNotifications)
+	handle("POST /api/v1/notifications/read", apiMarkNotificationsRead)
+	handle("GET /api/v1/notifications/preferences", apiNotificationPreferences)
+	handle("PATCH /api/v1/notifications/preferences", apiUpdateNotificationPreferences)
+	handle("GET /api/v1/notifications/email", apiEmailSettings)
+	handle("PATCH /api/v1/notifications/email", apiUpdateEmailSettings)
+	handle("GET /api/v1/search", apiSearch)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("JSON encoding error: %v", err)
+	}
+}
+
+func writeAPIData(w http.ResponseWriter, status int, data interface{}, nextCursor string) {
+	writeJSON(w, status, apiEnvelope{Data: data, NextCursor: nextCursor})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiEnvelope{Error: &apiError{Code: code, Message: message}})
+}
+
+// writeAPIStoreError maps data layer errors onto API error responses.
+func writeAPIStoreError(w http.ResponseWriter, err error) {
+	if fe, ok := err.(fieldError); ok {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", fe.Error())
+		return
+	}
+	switch err {
+	case errNotFound:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Resource not found")
+	case errInvalidLikeType:
+		writeAPIError(w, http.StatusBadRequest, "invalid_like_type", "like_type must be 1, -1 or 0")
+	case errForbidden:
+		writeAPIError(w, http.StatusForbidden, "forbidden", "You are not allowed to do this")
+	case errEditWindowClosed:
+		writeAPIError(w, http.StatusForbidden, "edit_window_closed", "The edit window for this thread has closed")
+	case errNeedsReputation:
+		writeAPIError(w, http.StatusForbidden, "insufficient_reputation", "You do not have enough reputation to do this")
+	case errInvalidImage:
+		writeAPIError(w, http.StatusUnprocessableEntity, "invalid_image", errInvalidImage.Error())
+	case errImageTooLarge:
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "image_too_large", fmt.Sprintf("Avatars may be at most %d MB and %d pixels per side", maxAvatarUploadMiB, maxAvatarPixels))
+	case errInvalidParent:
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "parent_id must be a comment of this thread")
+	case errCannotFollowSelf:
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", errCannotFollowSelf.Error())
+	case errThreadLocked:
+		writeAPIError(w, http.StatusForbidden, "thread_locked", "The thread is locked")
+	case errThreadArchived:
+		writeAPIError(w, http.StatusForbidden, "thread_archived", "The thread is archived and read-only")
+	default:
+		log.Printf("API error: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+	}
+}
+
+// apiUser resolves the caller from a bearer token or the session cookie.
+// Guests are treated as unauthenticated. A browser sends the cookie along with
+// forms posted from other sites too, so it only counts for writes that carry
+// the X-Requested-With header, which such forms cannot set.
+func apiUser(r *http.Request) (string, int, error) {
+	var tokenString string
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		tokenString = strings.TrimPrefix(header, "Bearer ")
+	} else if cookie, err := r.Cookie("session_token"); err == nil && (isSafeMethod(r.Method) || r.Header.Get("X-Requested-With") != "") {
+		tokenString = cookie.Value
+	}
+	if tokenString == "" {
+		return "", 0, errUnauthenticated
+	}
+
+	username, userID, err := getUserFromSession(tokenString)
+	if err != nil || username == "" || username == "guest" {
+		return "", 0, errUnauthenticated
+	}
+	return username, userID, nil
+}
+
+// isSafeMethod reports whether method only reads.
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// apiViewerID returns the id of the caller, or 0 when they are not logged in.
+func apiViewerID(r *http.Request) int {
+	_, userID, _ := apiUser(r)
+	return userID
+}
+
+// requireAPIUser writes a 401 and returns false when the caller is not logged in.
+func requireAPIUser(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	username, userID, err := apiUser(r)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "Authentication required")
+		return "", 0, false
+	}
+	return username, userID, true
+}
+
+func pathID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_id", "Invalid id")
+		return 0, false
+	}
+	return id, true
+}
+
+// decodeJSON reads a JSON request body into v. Bodies of any other type are
+// refused, as forms of other sites could send them with the user's cookie.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "The request body must be application/json")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// pageParams reads the limit and cursor query parameters. Cursors are opaque
+// to clients and hold the id of the last item of the previous page.
+func pageParams(w http.ResponseWriter, r *http.Request) (limit int, after int, ok bool) {
+	if limit, ok = limitParam(w, r); !ok {
+		return 0, 0, false
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		var err error
+		if after, err = decodeCursor(v); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+			return 0, 0, false
+		}
+	}
+	return limit, after, true
+}
+
+// limitParam reads the limit query parameter, for listings with their own cursors.
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return apiDefaultLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "invalid_limit", "limit must be a positive integer")
+		return 0, false
+	}
+	if n > apiMaxLimit {
+		n = apiMaxLimit
+	}
+	return n, true
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id <= 0 {
+		return 0, errInvalidCursor
+	}
+	return id, nil
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, "openapi.json")
+}
+
+// apiCreateToken exchanges a username and password for a bearer token.
+func apiCreateToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+
+	var hashedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE username = ?", body.Username).Scan(&hashedPassword)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(body.Password))
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "invalid_credentials", "Invalid username or password")
+		return
+	}
+
+	token, err := generateJWT(body.Username)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, map[string]string{"token": token}, "")
+}
+
+// queryThreads runs a thread listing query and builds the next page cursor.
+// The query must select id, title, description, likes, dislikes, user_id,
+// username, a comma separated list of category names and the pinned, locked
+// and archived times, as apiThreadSelect does.
+func queryThreads(query string, limit int, args ...interface{}) ([]Thread, string, error) {
+	rows, err := db.Query(query, append(args, limit+1)...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	threads := []Thread{}
+	for rows.Next() {
+		var t Thread
+		var categories sql.NullString
+		var pinnedAt, lockedAt, archivedAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Likes, &t.Dislikes, &t.UserID, &t.Username, &categories, &pinnedAt, &lockedAt, &archivedAt); err != nil {
+			return nil, "", err
+		}
+		setThreadStates(&t, pinnedAt, lockedAt, archivedAt)
+		if categories.String != "" {
+			t.Categories = strings.Split(categories.String, ",")
+		}
+		threads = append(threads, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(threads) > limit {
+		threads = threads[:limit]
+		next = encodeCursor(threads[limit-1].ID)
+	}
+	return threads, next, nil
+}
+
+const apiThreadSelect = `
+    SELECT t.id, t.title, t.description, t.likes, t.dislikes, t.user_id, u.username,
+        (SELECT GROUP_CONCAT(c.name) FROM categories c JOIN thread_categories tc ON tc.category_id = c.id WHERE tc.thread_id = t.id),
+        t.pinned_at, t.locked_at, t.archived_at
+    FROM threads t
+    JOIN users u ON u.id = t.user_id
+`
+
+// apiListThreads lists threads newest first, optionally filtered by category, tags or author.
+func apiListThreads(w http.ResponseWriter, r *http.Request) {
+	limit, after, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+
+	whereClauses := []string{}
+	var args []interface{}
+	if after > 0 {
+		whereClauses = append(whereClauses, "t.id < ?")
+		args = append(args, after)
+	}
+	if category := r.URL.Query().Get("category"); category != "" {
+		whereClauses = append(whereClauses, "EXISTS (SELECT 1 FROM thread_categories tc WHERE tc.thread_id = t.id AND tc.category_id IN ("+categoryTreeQuery+"))")
+		args = append(args, category, category)
+	}
+	for _, tag := range r.URL.Query()["tag"] {
+		whereClauses = append(whereClauses, tagFilterClause)
+		args = append(args, normalizeTag(tag))
+	}
+	if author := r.URL.Query().Get("author"); author != "" {
+		whereClauses = append(whereClauses, "u.username = ?")
+		args = append(args, author)
+	}
+
+	query := apiThreadSelect
+	if len(whereClauses) > 0 {
+		query += " WHERE " + strings.Join(whereClauses, " AND ")
+	}
+	query += " ORDER BY t.id DESC LIMIT ?"
+
+	threads, next, err := queryThreads(query, limit, args...)
+	if err == nil {
+		err = attachUnread(apiViewerID(r), threads)
+	}
+	if err == nil {
+		err = loadThreadAttachments(threads)
+	}
+	if err == nil {
+		err = loadThreadTags(threads)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, threads, next)
+}
+
+type apiThreadInput struct {
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	Categories    []int      `json:"categories"`
+	Tags          []string   `json:"tags"`
+	AttachmentIDs []int      `json:"attachment_ids"` // uploads to attach
+	Poll          *PollInput `json:"poll"`
+}
+
+func apiCreateThread(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+
+	var input apiThreadInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if strings.TrimSpace(input.Title) == "" || strings.TrimSpace(input.Description) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "title and description are required")
+		return
+	}
+
+	categoryIDs := make([]string, len(input.Categories))
+	for i, id := range input.Categories {
+		categoryIDs[i] = strconv.Itoa(id)
+	}
+
+	threadID, err := createThread(userID, ThreadInput{
+		Title:         input.Title,
+		Description:   input.Description,
+		CategoryIDs:   categoryIDs,
+		Tags:          input.Tags,
+		AttachmentIDs: input.AttachmentIDs,
+		Poll:          input.Poll,
+	})
+	if err == errForbidden {
+		writeAPIError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("You need %d reputation to create a poll", privilegeThreshold(privilegeCreatePoll)))
+		return
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	thread, err := getThread(int(threadID))
+	if err == nil {
+		threads := []Thread{thread}
+		err = loadThreadAttachments(threads)
+		thread = threads[0]
+	}
+	if err == nil {
+		thread.Poll, err = getPoll(thread.ID, userID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, thread, "")
+}
+
+func apiGetThread(w http.ResponseWriter, r *http.Request) {
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+
+	thread, err := getThread(threadID)
+	if err == errNotFound {
+		// Merged threads lead to the thread they were merged into
+		if newID, redirectErr := threadRedirect(threadID); redirectErr == nil {
+			http.Redirect(w, r, fmt.Sprintf("/api/v1/threads/%d", newID), http.StatusMovedPermanently)
+			return
+		}
+	}
+	if err == nil {
+		threads := []Thread{thread}
+		if err = attachUnread(apiViewerID(r), threads); err == nil {
+			err = loadThreadAttachments(threads)
+		}
+		thread = threads[0]
+	}
+	if err == nil {
+		thread.Poll, err = getPoll(threadID, apiViewerID(r))
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, thread, "")
+}
+
+// apiGetPoll returns the poll of the thread in the path as the caller sees it.
+func apiGetPoll(w http.ResponseWriter, r *http.Request) {
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	poll, err := getPoll(threadID, apiViewerID(r))
+	if err == nil && poll == nil {
+		err = errNotFound
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, poll, "")
+}
+
+// apiVotePoll sets the caller's vote on the poll of the thread in the path to
+// the option_ids of the body, or withdraws it when on is false.
+func apiVotePoll(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		threadID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		body := struct {
+			OptionIDs []int `json:"option_ids"`
+		}{OptionIDs: []int{}}
+		if on {
+			if !decodeJSON(w, r, &body) {
+				return
+			}
+			if len(body.OptionIDs) == 0 {
+				writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "option_ids must not be empty")
+				return
+			}
+		}
+
+		err := votePoll(threadID, userID, body.OptionIDs)
+		var poll *Poll
+		if err == nil {
+			poll, err = getPoll(threadID, userID)
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, poll, "")
+	}
+}
+
+// apiMarkThreadRead marks the thread in the path as read up to the comment_id
+// of the body, or up to its latest comment without one.
+func apiMarkThreadRead(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		CommentID int `json:"comment_id"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &input) {
+		return
+	}
+
+	var last int
+	err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM comments WHERE thread_id = ?", threadID).Scan(&last)
+	if err == nil {
+		_, err = getThread(threadID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	if input.CommentID == 0 || input.CommentID > last {
+		input.CommentID = last
+	}
+	if err := markThreadRead(userID, threadID, input.CommentID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiMarkAllRead marks every thread, or those of the category_id of the body, as read.
+func apiMarkAllRead(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		CategoryID int `json:"category_id"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &input) {
+		return
+	}
+	if err := markAllRead(userID, input.CategoryID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadOwnThread fetches a thread and checks that the caller wrote it.
+func loadOwnThread(w http.ResponseWriter, r *http.Request) (Thread, bool) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return Thread{}, false
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return Thread{}, false
+	}
+
+	thread, err := getThread(threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return Thread{}, false
+	}
+	if thread.UserID != userID {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Only the author can change this thread")
+		return Thread{}, false
+	}
+	return thread, true
+}
+
+// apiUpdateThread edits a thread and records a revision. Fields left out of
+// the body keep their current value.
+func apiUpdateThread(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	thread, err := getThread(threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	if err := checkThreadEdit(thread, userID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	var input struct {
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Categories  *[]int    `json:"categories"`
+		Tags        *[]string `json:"tags"`
+	}
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if input.Title != nil {
+		thread.Title = *input.Title
+	}
+	if input.Description != nil {
+		thread.Description = *input.Description
+	}
+	if strings.TrimSpace(thread.Title) == "" || strings.TrimSpace(thread.Description) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "title and description cannot be empty")
+		return
+	}
+
+	var categoryIDs []string
+	if input.Categories != nil {
+		for _, id := range *input.Categories {
+			categoryIDs = append(categoryIDs, strconv.Itoa(id))
+		}
+	} else if categoryIDs, err = listThreadCategoryIDs(db, threadID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	tags := thread.Tags
+	if input.Tags != nil {
+		tags = *input.Tags
+	}
+
+	if err := editThread(thread, userID, thread.Title, thread.Description, categoryIDs, tags); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	thread, err = getThread(threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, thread, "")
+}
+
+func apiListThreadRevisions(w http.ResponseWriter, r *http.Request) {
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getThread(threadID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	revisions, err := listThreadRevisions(threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, revisions, "")
+}
+
+func apiDeleteThread(w http.ResponseWriter, r *http.Request) {
+	thread, ok := loadOwnThread(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteThread(thread.ID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// voteInput sets the caller's vote: 1 likes, -1 dislikes and 0 retracts it.
+type voteInput struct {
+	LikeType *int `json:"like_type"`
+}
+
+// apiCastVote records a vote decoded from the request body and responds with the new totals.
+func apiCastVote(w http.ResponseWriter, r *http.Request, target voteTarget) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	itemID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input voteInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if input.LikeType == nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "like_type is required")
+		return
+	}
+
+	totals, err := castVote(target, itemID, userID, *input.LikeType)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, totals, "")
+}
+
+func apiVoteThread(w http.ResponseWriter, r *http.Request) {
+	apiCastVote(w, r, threadVotes)
+}
+
+func apiListComments(w http.ResponseWriter, r *http.Request) {
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getThread(threadID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	comments, err := queryComments(commentSelect+" WHERE c.thread_id = ? AND c.id > ? ORDER BY c.id LIMIT ?", threadID, after, limit+1)
+	if err == nil {
+		err = loadCommentAttachments(comments)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	var next string
+	if len(comments) > limit {
+		comments = comments[:limit]
+		next = encodeCursor(comments[limit-1].ID)
+	}
+	writeAPIData(w, http.StatusOK, comments, next)
+}
+
+type commentInput struct {
+	Content       string `json:"content"`
+	ParentID      int    `json:"parent_id"`      // only used when creating a reply
+	AttachmentIDs []int  `json:"attachment_ids"` // only used when creating a comment
+}
+
+func apiCreateComment(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input commentInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if strings.TrimSpace(input.Content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "content is required")
+		return
+	}
+
+	commentID, err := createComment(userID, threadID, input.ParentID, input.Content, input.AttachmentIDs)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	comment, err := getCommentWithAttachments(int(commentID))
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, comment, "")
+}
+
+func apiGetComment(w http.ResponseWriter, r *http.Request) {
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	comment, err := getCommentWithAttachments(commentID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, comment, "")
+}
+
+// loadCommentForAPIChange fetches a comment and checks that the caller may edit
+// or delete it.
+func loadCommentForAPIChange(w http.ResponseWriter, r *http.Request) (Comment, int, bool) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return Comment{}, 0, false
+	}
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return Comment{}, 0, false
+	}
+
+	comment, err := getComment(commentID)
+	if err == nil {
+		err = checkCommentChange(comment, userID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return Comment{}, 0, false
+	}
+	return comment, userID, true
+}
+
+func apiUpdateComment(w http.ResponseWriter, r *http.Request) {
+	comment, userID, ok := loadCommentForAPIChange(w, r)
+	if !ok {
+		return
+	}
+	var input commentInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if strings.TrimSpace(input.Content) == "" {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "content is required")
+		return
+	}
+
+	if err := editComment(comment, userID, input.Content); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	comment, err := getComment(comment.ID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, comment, "")
+}
+
+// apiDeleteComment soft deletes a comment. Moderators can remove it
+// permanently with ?hard=true.
+func apiDeleteComment(w http.ResponseWriter, r *http.Request) {
+	comment, userID, ok := loadCommentForAPIChange(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.URL.Query().Get("hard") == "true" {
+		role, roleErr := getUserRole(userID)
+		if roleErr != nil || !isModerator(role) {
+			writeAPIError(w, http.StatusForbidden, "forbidden", "Only moderators can permanently delete comments")
+			return
+		}
+		err = hardDeleteComment(comment.ID)
+	} else {
+		err = softDeleteComment(comment.ID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	notifyCommentDeleted(comment, userID, r.URL.Query().Get("hard") == "true")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListCommentRevisions returns the edit history of a comment to moderators.
+func apiListCommentRevisions(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	if role, err := getUserRole(userID); err != nil || !isModerator(role) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Only moderators can view comment history")
+		return
+	}
+	commentID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getComment(commentID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	revisions, err := listCommentRevisions(commentID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, revisions, "")
+}
+
+func apiVoteComment(w http.ResponseWriter, r *http.Request) {
+	apiCastVote(w, r, commentVotes)
+}
+
+func apiListReactions(w http.ResponseWriter, r *http.Request) {
+	reactions, err := listReactions(false)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, reactions, "")
+}
+
+// apiItemReactions returns the reaction counts of an item. Reactions on
+// messages are only visible to the sender and the recipient.
+func apiItemReactions(target voteTarget) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, err := apiUser(r)
+		if err != nil && target == messageReactions {
+			writeAPIError(w, http.StatusUnauthorized, "unauthenticated", "Authentication required")
+			return
+		}
+		itemID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		if err := checkReactionAccess(target, itemID, userID); err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		state, err := reactionState(target, itemID, userID)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, state, "")
+	}
+}
+
+// apiSetReaction adds (on) or removes the caller's reaction named in the path
+// and responds with the new state of the item.
+func apiSetReaction(target voteTarget, on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, userID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		itemID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		reaction, err := getReaction(0, r.PathValue("name"))
+		if err == nil {
+			err = checkReactionAccess(target, itemID, userID)
+		}
+		if err == nil {
+			_, err = setReaction(target, itemID, userID, reaction, on)
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		state, err := reactionState(target, itemID, userID)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, state, "")
+	}
+}
+
+func apiListCategories(w http.ResponseWriter, r *http.Request) {
+	categories, err := listCategories()
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, categories, "")
+}
+
+func apiGetCategory(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	category, err := getCategory(categoryID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, category, "")
+}
+
+// requireAPIAdmin is requireAPIUser for admin only endpoints.
+func requireAPIAdmin(w http.ResponseWriter, r *http.Request) (int, bool) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return 0, false
+	}
+	if role, err := getUserRole(userID); err != nil || role != roleAdmin {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "Only admins can manage categories")
+		return 0, false
+	}
+	return userID, true
+}
+
+// apiCreateCategory adds a category, admins only.
+func apiCreateCategory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIAdmin(w, r); !ok {
+		return
+	}
+	var input CategoryInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if input.Name == nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "name is required")
+		return
+	}
+	categoryID, err := createCategory(input)
+	var category Category
+	if err == nil {
+		category, err = getCategory(categoryID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, category, "")
+}
+
+// apiUpdateCategory changes the fields of a category given in the body, admins only.
+func apiUpdateCategory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIAdmin(w, r); !ok {
+		return
+	}
+	categoryID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var input CategoryInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	err := updateCategory(categoryID, input)
+	var category Category
+	if err == nil {
+		category, err = getCategory(categoryID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, category, "")
+}
+
+// apiDeleteCategory removes a category without threads or subcategories, admins only.
+func apiDeleteCategory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIAdmin(w, r); !ok {
+		return
+	}
+	categoryID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteCategory(categoryID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListUsers suggests users to mention whose name starts with q.
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	q := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("q")), "@")
+	if q == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing_query", "q is required")
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	if limit > maxMentionSuggestions {
+		limit = maxMentionSuggestions
+	}
+
+	users, err := suggestMentions(userID, q, limit)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, users, "")
+}
+
+// apiPreviewMarkdown renders markdown the way a thread or comment would be
+// shown, for the preview of the composer.
+func apiPreviewMarkdown(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := requireAPIUser(w, r); !ok {
+		return
+	}
+	var body struct {
+		Markdown string `json:"markdown"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxPreviewLength)
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if len(body.Markdown) > maxPreviewLength {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("markdown must be at most %d bytes", maxPreviewLength))
+		return
+	}
+
+	mentioned, err := resolveMentions(body.Markdown)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	html, err := renderPost(body.Markdown, mentioned)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, map[string]string{"html": string(html)}, "")
+}
+
+// apiUploadAttachment stores the file of a multipart form, to be attached with
+// the attachment_ids of a new thread, comment or message.
+func apiUploadAttachment(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	role, err := getUserRole(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(attachmentLimitFor(role).MaxMiB+1)<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", errAttachmentTooLarge.Error())
+			return
+		}
+		writeAPIError(w, http.StatusBadRequest, "missing_file", "a multipart form with a file field is required")
+		return
+	}
+	defer file.Close()
+
+	attachment, err := saveAttachment(userID, header.Filename, file)
+	switch err {
+	case nil:
+		writeAPIData(w, http.StatusCreated, attachment, "")
+	case errAttachmentTooLarge:
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "too_large", err.Error())
+	case errAttachmentType:
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_type", err.Error())
+	case errInvalidAttachmentImage:
+		writeAPIError(w, http.StatusUnprocessableEntity, "invalid_image", err.Error())
+	default:
+		writeAPIStoreError(w, err)
+	}
+}
+
+// loadAttachmentForAPI fetches the attachment in the path if the caller may see it.
+func loadAttachmentForAPI(w http.ResponseWriter, r *http.Request) (Attachment, bool) {
+	id, ok := pathID(w, r)
+	if !ok {
+		return Attachment{}, false
+	}
+	username, userID, _ := apiUser(r)
+	attachment, err := getAttachment(id)
+	if err == nil {
+		var allowed bool
+		if allowed, err = canViewAttachment(userID, username, attachment); err == nil && !allowed {
+			err = errNotFound
+		}
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return Attachment{}, false
+	}
+	return attachment, true
+}
+
+func apiGetAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment, ok := loadAttachmentForAPI(w, r)
+	if !ok {
+		return
+	}
+	writeAPIData(w, http.StatusOK, attachment, "")
+}
+
+// apiDeleteAttachment removes an attachment. Only its uploader and moderators may.
+func apiDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	attachment, ok := loadAttachmentForAPI(w, r)
+	if !ok {
+		return
+	}
+	if attachment.UserID != userID {
+		role, err := getUserRole(userID)
+		if err == nil && !isModerator(role) {
+			err = errForbidden
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+	}
+	if err := deleteAttachment(attachment.ID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiGetUser returns the public part of a user's profile.
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	var user struct {
+		ID           int    `json:"id"`
+		Username     string `json:"username"`
+		Reputation   int    `json:"reputation"`
+		ThreadCount  int    `json:"thread_count"`
+		CommentCount int    `json:"comment_count"`
+		AvatarURL    string `json:"avatar_url"`
+		UserDetails
+		FollowCounts
+	}
+	err := db.QueryRow(`
+        SELECT u.id, u.username, u.reputation,
+            (SELECT COUNT(*) FROM threads WHERE user_id = u.id),
+            (SELECT COUNT(*) FROM comments WHERE user_id = u.id AND deleted_at IS NULL)
+        FROM users u WHERE u.username = ?`, r.PathValue("username")).Scan(&user.ID, &user.Username, &user.Reputation, &user.ThreadCount, &user.CommentCount)
+	if err == sql.ErrNoRows {
+		writeAPIStoreError(w, errNotFound)
+		return
+	}
+	if err == nil {
+		user.UserDetails, err = getUserDetails(user.ID)
+	}
+	if err == nil {
+		user.FollowCounts, err = countFollows(user.ID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	user.AvatarURL = "/avatar/" + url.PathEscape(user.Username)
+	writeAPIData(w, http.StatusOK, user, "")
+}
+
+// requireProfileOwner checks that the caller is the user named in the path.
+func requireProfileOwner(w http.ResponseWriter, r *http.Request) (int, bool) {
+	username, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return 0, false
+	}
+	if username != r.PathValue("username") {
+		writeAPIStoreError(w, errForbidden)
+		return 0, false
+	}
+	return userID, true
+}
+
+// profileInput changes the fields that are set and keeps the others.
+type profileInput struct {
+	DisplayName *string     `json:"display_name"`
+	Bio         *string     `json:"bio"`
+	Signature   *string     `json:"signature"`
+	Location    *string     `json:"location"`
+	Timezone    *string     `json:"timezone"`
+	Links       *[]UserLink `json:"links"`
+}
+
+func apiUpdateUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireProfileOwner(w, r)
+	if !ok {
+		return
+	}
+	var input profileInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	details, err := getUserDetails(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	for _, f := range []struct {
+		value *string
+		field *string
+	}{
+		{input.DisplayName, &details.DisplayName},
+		{input.Bio, &details.Bio},
+		{input.Signature, &details.Signature},
+		{input.Location, &details.Location},
+		{input.Timezone, &details.Timezone},
+	} {
+		if f.value != nil {
+			*f.field = *f.value
+		}
+	}
+	if input.Links != nil {
+		details.Links = *input.Links
+	}
+	if err := details.normalize(); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	if err := updateUserDetails(userID, details); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	apiGetUser(w, r)
+}
+
+// apiPutAvatar replaces the caller's avatar with the image in the request body.
+func apiPutAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireProfileOwner(w, r)
+	if !ok {
+		return
+	}
+	avatar, err := processAvatar(r.Body)
+	if err == nil {
+		err = saveAvatar(userID, avatar)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiDeleteAvatar switches the caller back to their identicon.
+func apiDeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireProfileOwner(w, r)
+	if !ok {
+		return
+	}
+	if err := removeAvatar(userID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiListProfileSection pages through one section of a profile: the threads or
+// comments of a user, their followers and followed users, or the threads and
+// comments they liked or disliked. Likes and dislikes are only visible to the
+// user themselves.
+func apiListProfileSection(w http.ResponseWriter, r *http.Request) {
+	limit, after, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", r.PathValue("username")).Scan(&userID)
+	if err == sql.ErrNoRows {
+		err = errNotFound
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+
+	section := r.PathValue("section")
+	if privateProfileSections[section] {
+		_, callerID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		if callerID != userID {
+			writeAPIStoreError(w, errForbidden)
+			return
+		}
+	}
+
+	var items interface{}
+	var next string
+	switch section {
+	case profileThreads:
+		items, next, err = fetchUserThreads(db, userID, limit, after)
+	case profileComments:
+		items, next, err = fetchUserComments(db, userID, limit, after)
+	case profileLikedThreads:
+		items, next, err = fetchThreadsByLikeType(db, userID, 1, limit, after)
+	case profileDislikedThreads:
+		items, next, err = fetchThreadsByLikeType(db, userID, -1, limit, after)
+	case profileLikedComments:
+		items, next, err = fetchCommentsByLikeType(db, userID, 1, limit, after)
+	case profileDislikedComments:
+		items, next, err = fetchCommentsByLikeType(db, userID, -1, limit, after)
+	case profileFollowers:
+		items, next, err = listFollowUsers(userID, true, limit, after)
+	case profileFollowing:
+		items, next, err = listFollowUsers(userID, false, limit, after)
+	case profileWatching:
+		items, next, err = listWatchedThreads(userID, limit, after)
+	case profileWatchedCategories:
+		items, err = listWatchedCategories(userID, false)
+	default:
+		err = errNotFound
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, items, next)
+}
+
+// apiSetUserRelation follows, unfollows, mutes or unmutes the user in the path.
+func apiSetUserRelation(rel relation, on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, callerID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		var targetID int
+		err := db.QueryRow("SELECT id FROM users WHERE username = ?", r.PathValue("username")).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			err = errNotFound
+		}
+		if err == nil {
+			err = setRelation(rel, callerID, targetID, on)
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiFollowCategory follows or unfollows the category in the path.
+func apiFollowCategory(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, callerID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		categoryID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		if err := setRelation(categoryFollows, callerID, categoryID, on); err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiListTags suggests tags whose name starts with q, most used first, or
+// lists the most used tags without q.
+func apiListTags(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	if limit > maxTagSuggestions {
+		limit = maxTagSuggestions
+	}
+	tags, err := suggestTags(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, tags, "")
+}
+
+// apiGetTag returns the tag in the path, or the tag it is a synonym of.
+func apiGetTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := getTag(r.PathValue("name"), apiViewerID(r))
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, tag, "")
+}
+
+// requireAPIModerator is requireAPIUser for endpoints of moderators and admins.
+func requireAPIModerator(w http.ResponseWriter, r *http.Request, message string) (int, bool) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return 0, false
+	}
+	if role, err := getUserRole(userID); err != nil || !isModerator(role) {
+		writeAPIError(w, http.StatusForbidden, "forbidden", message)
+		return 0, false
+	}
+	return userID, true
+}
+
+// apiMergeTag moves the threads and followers of the tag in the path to
+// another tag, keeping its name as a synonym if asked. Moderators only.
+func apiMergeTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAPIModerator(w, r, "Only moderators can merge tags")
+	if !ok {
+		return
+	}
+	var body struct {
+		Into    string `json:"into"`
+		Synonym bool   `json:"synonym"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if err := mergeTag(userID, r.PathValue("name"), body.Into, body.Synonym); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	tag, err := getTag(body.Into, userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, tag, "")
+}
+
+// apiDeleteTag removes a tag with its synonyms, or only the synonym named in
+// the path. Moderators only.
+func apiDeleteTag(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIModerator(w, r, "Only moderators can delete tags"); !ok {
+		return
+	}
+	if err := deleteTag(r.PathValue("name")); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiFollowTag(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, callerID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		tag, err := findTag(r.PathValue("name"))
+		if err == nil {
+			err = setRelation(tagFollows, callerID, tag.ID, on)
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiGetThreadWatch returns how the caller watches the thread in the path.
+func apiGetThreadWatch(w http.ResponseWriter, r *http.Request) {
+	_, callerID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if _, err := getThread(threadID); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	watch, err := getThreadWatch(callerID, threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, watch, "")
+}
+
+// apiMoveThread puts the thread in the path in the categories of a
+// {"categories"} body instead of its current ones. Moderators only.
+func apiMoveThread(w http.ResponseWriter, r *http.Request) {
+	moderatorID, ok := requireAPIModerator(w, r, "Only moderators can move threads")
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Categories []int `json:"categories"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	categoryIDs := make([]string, len(body.Categories))
+	for i, id := range body.Categories {
+		categoryIDs[i] = strconv.Itoa(id)
+	}
+	if err := moveThread(moderatorID, threadID, categoryIDs); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	thread, err := getThread(threadID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, thread, "")
+}
+
+// apiMergeThread merges the thread in the path into the thread of an
+// {"into"} body and returns that thread. The old id redirects to it.
+// Moderators only.
+func apiMergeThread(w http.ResponseWriter, r *http.Request) {
+	moderatorID, ok := requireAPIModerator(w, r, "Only moderators can merge threads")
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Into int `json:"into"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if err := mergeThreads(moderatorID, threadID, body.Into); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	thread, err := getThread(body.Into)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, thread, "")
+}
+
+// apiSplitThread moves the comments of a {"comment_ids", "title",
+// "description", "categories"} body, with their replies, from the thread in
+// the path to a new thread and returns it. Moderators only.
+func apiSplitThread(w http.ResponseWriter, r *http.Request) {
+	moderatorID, ok := requireAPIModerator(w, r, "Only moderators can split threads")
+	if !ok {
+		return
+	}
+	threadID, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		CommentIDs  []int  `json:"comment_ids"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Categories  []int  `json:"categories"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var categoryIDs []string
+	for _, id := range body.Categories {
+		categoryIDs = append(categoryIDs, strconv.Itoa(id))
+	}
+	newID, err := splitThread(moderatorID, threadID, body.CommentIDs, body.Title, body.Description, categoryIDs)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	thread, err := getThread(newID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusCreated, thread, "")
+}
+
+// apiModerationLog returns the moderation log, newest first, of one thread
+// with ?thread_id=. Moderators only.
+func apiModerationLog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIModerator(w, r, "Only moderators can see the moderation log"); !ok {
+		return
+	}
+	limit, before, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	threadID := 0
+	if v := r.URL.Query().Get("thread_id"); v != "" {
+		var err error
+		if threadID, err = strconv.Atoi(v); err != nil || threadID <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_id", "Invalid thread_id")
+			return
+		}
+	}
+	entries, err := listModerationLog(threadID, before, limit+1)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	var next string
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = encodeCursor(entries[limit-1].ID)
+	}
+	writeAPIData(w, http.StatusOK, entries, next)
+}
+
+// apiListAnnouncements returns the announcements the caller has not
+// dismissed. Moderators get every announcement with ?all=true.
+func apiListAnnouncements(w http.ResponseWriter, r *http.Request) {
+	viewerID := apiViewerID(r)
+	var announcements []Announcement
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		if _, ok := requireAPIModerator(w, r, "Only moderators can list every announcement"); !ok {
+			return
+		}
+		announcements, err = listAnnouncements()
+	} else {
+		announcements, err = activeAnnouncements(r, viewerID)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	if announcements == nil {
+		announcements = []Announcement{}
+	}
+	writeAPIData(w, http.StatusOK, announcements, "")
+}
+
+// apiCreateAnnouncement publishes an announcement from a {"title", "body",
+// "expires_at"} body. Moderators only.
+func apiCreateAnnouncement(w http.ResponseWriter, r *http.Request) {
+	userID, ok := requireAPIModerator(w, r, "Only moderators can publish announcements")
+	if !ok {
+		return
+	}
+	var body struct {
+		Title     string     `json:"title"`
+		Body      string     `json:"body"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	id, err := createAnnouncement(userID, body.Title, body.Body, body.ExpiresAt)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	announcements, err := listAnnouncements()
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	for _, a := range announcements {
+		if a.ID == id {
+			writeAPIData(w, http.StatusCreated, a, "")
+			return
+		}
+	}
+	writeAPIStoreError(w, errNotFound)
+}
+
+// apiDeleteAnnouncement removes the announcement in the path. Moderators only.
+func apiDeleteAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAPIModerator(w, r, "Only moderators can remove announcements"); !ok {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := deleteAnnouncement(id); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiDismissAnnouncement hides the announcement in the path from the caller.
+func apiDismissAnnouncement(w http.ResponseWriter, r *http.Request) {
+	_, callerID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	id, ok := pathID(w, r)
+	if !ok {
+		return
+	}
+	if err := dismissAnnouncement(w, r, callerID, id); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiSetThreadState pins, locks or archives the thread in the path, or
+// undoes it. A pin with a category_id query parameter is only in that
+// category. Moderators only.
+func apiSetThreadState(state string, on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderatorID, ok := requireAPIModerator(w, r, "Only moderators can do this")
+		if !ok {
+			return
+		}
+		threadID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		var err error
+		if v := r.URL.Query().Get("category_id"); v != "" && state == threadPinned {
+			categoryID, convErr := strconv.Atoi(v)
+			if convErr != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_id", "Invalid category_id")
+				return
+			}
+			err = pinThreadInCategory(moderatorID, threadID, categoryID, on)
+		} else {
+			err = setThreadState(moderatorID, threadID, state, on)
+		}
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiSetWatch sets the level at which the caller watches the thread or
+// category in the path from a {"level"} body, or stops watching it.
+func apiSetWatch(set func(userID, targetID int, level string) error, on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, callerID, ok := requireAPIUser(w, r)
+		if !ok {
+			return
+		}
+		targetID, ok := pathID(w, r)
+		if !ok {
+			return
+		}
+		var body struct {
+			Level string `json:"level"`
+		}
+		if on {
+			if !decodeJSON(w, r, &body) {
+				return
+			}
+			if body.Level == "" {
+				body.Level = watchAll
+			}
+		}
+		if err := set(callerID, targetID, body.Level); err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiFeed returns the caller's feed, newest first.
+func apiFeed(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	items, next, err := listFeed(userID, limit, r.URL.Query().Get("cursor"))
+	if err == errInvalidCursor {
+		writeAPIError(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+		return
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, items, next)
+}
+
+// apiListNotifications returns the caller's notifications, newest first, or
+// only the unread ones with unread=true.
+func apiListNotifications(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	limit, after, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	notifications, next, err := listNotifications(userID, r.URL.Query().Get("unread") == "true", limit, after)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, notifications, next)
+}
+
+func apiUnreadNotifications(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, map[string]int{"unread": unread}, "")
+}
+
+// markReadInput selects the notifications to mark as read: the listed ids, or all.
+type markReadInput struct {
+	IDs []int `json:"ids"`
+	All bool  `json:"all"`
+}
+
+func apiMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	var input markReadInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	if input.All == (len(input.IDs) > 0) {
+		writeAPIError(w, http.StatusUnprocessableEntity, "validation_failed", "Either ids or all is required")
+		return
+	}
+	if err := markNotificationsRead(userID, input.IDs); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiNotificationPreferences returns which notification types the caller gets.
+func apiNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := notificationPreferences(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, prefs, "")
+}
+
+// apiUpdateNotificationPreferences turns the given types on or off and keeps the others.
+func apiUpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	var prefs map[string]bool
+	if !decodeJSON(w, r, &prefs) {
+		return
+	}
+	if err := setNotificationPreferences(userID, prefs); err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	apiNotificationPreferences(w, r)
+}
+
+// emailSettings are the email notifications and the digest frequency of a user.
+type emailSettings struct {
+	Types  map[string]bool `json:"types"`
+	Digest string          `json:"digest"`
+}
+
+// apiEmailSettings returns which notifications the caller gets by email.
+func apiEmailSettings(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	prefs, err := emailPreferences(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	digest, err := getDigest(userID)
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	writeAPIData(w, http.StatusOK, emailSettings{Types: prefs, Digest: digest}, "")
+}
+
+// apiUpdateEmailSettings changes the given email types and the digest if set.
+func apiUpdateEmailSettings(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := requireAPIUser(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Types  map[string]bool `json:"types"`
+		Digest *string         `json:"digest"`
+	}
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	err := setEmailPreferences(userID, input.Types)
+	if err == nil && input.Digest != nil {
+		err = setDigest(userID, *input.Digest)
+	}
+	if err != nil {
+		writeAPIStoreError(w, err)
+		return
+	}
+	apiEmailSettings(w, r)
+}
+
+// apiSearch matches the query against thread titles and descriptions, or
+// against comment content when type=comments.
+func apiSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing_query", "q is required")
+		return
+	}
+	limit, after, ok := pageParams(w, r)
+	if !ok {
+		return
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+
+	switch r.URL.Query().Get("type") {
+	case "", "threads":
+		query := apiThreadSelect + ` WHERE (t.title LIKE ? ESCAPE '\' OR t.description LIKE ? ESCAPE '\')`
+		args := []interface{}{pattern, pattern}
+		if after > 0 {
+			query += " AND t.id < ?"
+			args = append(args, after)
+		}
+		query += " ORDER BY t.id DESC LIMIT ?"
+
+		threads, next, err := queryThreads(query, limit, args...)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		writeAPIData(w, http.StatusOK, threads, next)
+	case "comments":
+		query := `
+            SELECT c.id, c.content, c.user_id, u.username, c.thread_id
+            FROM comments c
+            JOIN users u ON u.id = c.user_id
+            WHERE c.content LIKE ? ESCAPE '\' AND c.deleted_at IS NULL`
+		args := []interface{}{pattern}
+		if after > 0 {
+			query += " AND c.id < ?"
+			args = append(args, after)
+		}
+		query += " ORDER BY c.id DESC LIMIT ?"
+
+		rows, err := db.Query(query, append(args, limit+1)...)
+		if err != nil {
+			writeAPIStoreError(w, err)
+			return
+		}
+		defer rows.Close()
+
+		comments := []Comment{}
+		for rows.Next() {
+			var c Comment
+			if err := rows.Scan(&c.ID, &c.Content, &c.UserID, &c.Username, &c.ThreadID); err != nil {
+				writeAPIStoreError(w, err)
+				return
+			}
+			comments = append(comments, c)
+		}
+
+		var next string
+		if len(comments) > limit {
+			comments = comments[:limit]
+			next = encodeCursor(comments[limit-1].ID)
+		}
+		writeAPIData(w, http.StatusOK, comments, next)
+	default:
+		writeAPIError(w, http.StatusBadRequest, "invalid_type", "type must be threads or comments")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newAPIMux registers the API routes on a mux of their own and returns it
+// with the registered patterns.
+func newAPIMux() (*http.ServeMux, []string) {
+	mux := http.NewServeMux()
+	var patterns []string
+	registerAPIRoutes(func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+		patterns = append(patterns, pattern)
+		mux.HandleFunc(pattern, handler)
+	})
+	return mux, patterns
+}
+
+// apiResponse is the envelope every API response is wrapped in.
+type apiResponse struct {
+	Data       json.RawMessage `json:"data"`
+	NextCursor string          `json:"next_cursor"`
+	Error      *apiError       `json:"error"`
+}
+
+// apiGet sends a GET to mux and decodes the envelope.
+func apiGet(t *testing.T, mux http.Handler, path string) (int, apiResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var body apiResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET %s: invalid JSON %q: %v", path, w.Body, err)
+	}
+	return w.Code, body
+}
+
+// openAPIOperations returns the "METHOD /path" of every operation in openapi.json,
+// with paths relative to /api/v1.
+func openAPIOperations(t *testing.T, mux http.Handler) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("openapi.json: status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("openapi.json: Content-Type %q", ct)
+	}
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("openapi.json does not parse: %v", err)
+	}
+	if doc.OpenAPI == "" || len(doc.Paths) == 0 {
+		t.Fatalf("openapi.json has no version or paths")
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != "/api/v1" {
+		t.Fatalf("openapi.json servers = %+v, want /api/v1", doc.Servers)
+	}
+
+	var operations []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			switch method {
+			case "get", "post", "put", "patch", "delete":
+				operations = append(operations, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	return operations
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	mux, patterns := newAPIMux()
+	documented := map[string]bool{}
+	for _, op := range openAPIOperations(t, mux) {
+		documented[op] = true
+	}
+
+	routed := map[string]bool{}
+	for _, pattern := range patterns {
+		op := strings.Replace(pattern, " /api/v1", " ", 1)
+		routed[op] = true
+		if !documented[op] {
+			t.Errorf("route %s is missing from openapi.json", pattern)
+		}
+	}
+	var missing []string
+	for op := range documented {
+		if !routed[op] {
+			missing = append(missing, op)
+		}
+	}
+	sort.Strings(missing)
+	for _, op := range missing {
+		t.Errorf("openapi.json documents %s, which has no route", op)
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	newTestDB(t)
+	mux, _ := newAPIMux()
+
+	tests := []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{http.MethodGet, "/api/v1/threads/12345", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/api/v1/threads/abc", http.StatusBadRequest, "invalid_id"},
+		{http.MethodGet, "/api/v1/threads?limit=0", http.StatusBadRequest, "invalid_limit"},
+		{http.MethodGet, "/api/v1/threads?cursor=!!", http.StatusBadRequest, "invalid_cursor"},
+		{http.MethodPost, "/api/v1/threads", http.StatusUnauthorized, "unauthenticated"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}")))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: invalid JSON %q", tt.method, tt.path, w.Body)
+			continue
+		}
+		if _, ok := body["data"]; ok || len(body) != 1 {
+			t.Errorf("%s %s: body %s, want only an error", tt.method, tt.path, w.Body)
+		}
+		var e apiError
+		if err := json.Unmarshal(body["error"], &e); err != nil || e.Code != tt.code || e.Message == "" {
+			t.Errorf("%s %s: error %s, want code %q and a message", tt.method, tt.path, body["error"], tt.code)
+		}
+	}
+}
+
+func TestAPIThreadsCursorPagination(t *testing.T) {
+	newTestDB(t)
+	mux, _ := newAPIMux()
+	author := createTestUser(t, "alice")
+	var want []int
+	for i := 0; i < 5; i++ {
+		id, err := createThread(author, ThreadInput{Title: fmt.Sprintf("Thread %d", i), Description: "Description"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append([]int{int(id)}, want...)
+	}
+
+	var got []int
+	path := "/api/v1/threads?limit=2"
+	for pages := 0; ; pages++ {
+		if pages == len(want) {
+			t.Fatalf("pagination did not end after %d pages", pages)
+		}
+		status, body := apiGet(t, mux, path)
+		if status != http.StatusOK || body.Error != nil {
+			t.Fatalf("GET %s: status %d, error %+v", path, status, body.Error)
+		}
+		var threads []struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(body.Data, &threads); err != nil {
+			t.Fatal(err)
+		}
+		if len(threads) > 2 {
+			t.Fatalf("GET %s: %d threads, want at most 2", path, len(threads))
+		}
+		for _, thread := range threads {
+			got = append(got, thread.ID)
+		}
+		if body.NextCursor == "" {
+			break
+		}
+		path = "/api/v1/threads?limit=2&cursor=" + body.NextCursor
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged thread ids = %v, want %v", got, want)
+	}
+}
+
+func TestAPIWritesRefuseCrossSiteForms(t *testing.T) {
+	newTestDB(t)
+	mux, _ := newAPIMux()
+	createTestUser(t, "alice")
+	cookie := login(t, "alice")
+	const body = `{"title": "Forged", "description": "Posted by another site"}`
+
+	tests := []struct {
+		name        string
+		contentType string
+		cookie      bool
+		requested   bool // sends X-Requested-With
+		bearer      bool
+		status      int
+	}{
+		{"cookie with a text/plain form", "text/plain", true, false, false, http.StatusUnauthorized},
+		{"cookie with an urlencoded form", "application/x-www-form-urlencoded", true, false, false, http.StatusUnauthorized},
+		{"cookie without X-Requested-With", "application/json", true, false, false, http.StatusUnauthorized},
+		{"cookie with text/plain", "text/plain", true, true, false, http.StatusUnsupportedMediaType},
+		{"bearer with text/plain", "text/plain", false, false, true, http.StatusUnsupportedMediaType},
+		{"bearer without a content type", "", false, false, true, http.StatusUnsupportedMediaType},
+		{"cookie with JSON", "application/json", true, true, false, http.StatusCreated},
+		{"bearer with JSON", "application/json; charset=utf-8", false, false, true, http.StatusCreated},
+	}
+	created := 0
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/threads", strings.NewReader(body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.cookie {
+			r.AddCookie(cookie)
+		}
+		if tt.requested {
+			r.Header.Set("X-Requested-With", "fetch")
+		}
+		if tt.bearer {
+			r.Header.Set("Authorization", "Bearer "+cookie.Value)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if tt.status == http.StatusCreated {
+			created++
+		}
+	}
+
+	var threads int
+	if err := db.QueryRow("SELECT COUNT(*) FROM threads").Scan(&threads); err != nil {
+		t.Fatal(err)
+	}
+	if threads != created {
+		t.Errorf("%d threads created, want %d", threads, created)
+	}
+
+	// Reads keep taking the cookie alone
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/notifications/unread_count", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET with the cookie: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/image/draw"
+)
+
+// Files are uploaded on their own and attached to the thread, comment or
+// message they are posted with. The type of a file is sniffed from its
+// content, whatever its name or the client claims, and must be allowed for
+// the role of the uploader. Images are decoded and encoded again, which drops
+// EXIF and every other kind of metadata after the EXIF orientation has been
+// applied, and get a thumbnail when they are larger than thumbnailSize.
+//
+// Files of threads and comments can be seen by anyone, those of messages only
+// by the sender and the recipient, and files not attached yet only by their
+// uploader. Uploads never attached are removed after a day.
+
+const (
+	maxAttachmentsPerPost = 10
+	maxAttachmentPixels   = 40_000_000 // decoded, all frames of a GIF together
+	thumbnailSize         = 320        // longest side
+	maxFilenameLength     = 255
+	unattachedLifetime    = 24 * time.Hour
+)
+
+var (
+	errAttachmentTooLarge     = errors.New("the file is too large")
+	errAttachmentType         = errors.New("this type of file is not allowed")
+	errInvalidAttachmentImage = errors.New("the image could not be read")
+)
+
+// Sniffed content types that can be attached. Nothing that a browser would
+// run, such as HTML or SVG, may ever be added here.
+var (
+	imageTypes    = []string{"image/png", "image/jpeg", "image/gif"}
+	documentTypes = []string{"application/pdf", "text/plain", "application/zip"}
+)
+
+// attachmentLimit is what a role may upload.
+type attachmentLimit struct {
+	MaxMiB int      // per file
+	Types  []string // sniffed content types
+}
+
+// defaultAttachmentLimits are the limits of each role.
+var defaultAttachmentLimits = map[string]attachmentLimit{
+	roleUser:      {5, imageTypes},
+	roleModerator: {25, append(append([]string{}, imageTypes...), documentTypes...)},
+	roleAdmin:     {25, append(append([]string{}, imageTypes...), documentTypes...)},
+}
+
+// attachmentLimitFor returns the limits of a role. They can be overridden with
+// ATTACHMENT_MAX_MIB_USER and ATTACHMENT_TYPES_USER, a comma separated list of
+// content types, and likewise for MODERATOR and ADMIN. Only image and document
+// types known to be safe are accepted.
+func attachmentLimitFor(role string) attachmentLimit {
+	limit := defaultAttachmentLimits[role]
+	suffix := strings.ToUpper(role)
+	limit.MaxMiB = envInt("ATTACHMENT_MAX_MIB_"+suffix, limit.MaxMiB)
+	if value := os.Getenv("ATTACHMENT_TYPES_" + suffix); value != "" {
+		limit.Types = nil
+		for _, t := range strings.Split(value, ",") {
+			t = strings.TrimSpace(t)
+			if containsString(imageTypes, t) || containsString(documentTypes, t) {
+				limit.Types = append(limit.Types, t)
+			} else {
+				log.Printf("Ignoring attachment type %q in ATTACHMENT_TYPES_%s", t, suffix)
+			}
+		}
+	}
+	return limit
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Attachment is a file uploaded to be shown with a thread, comment or message.
+type Attachment struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	Filename     string    `json:"filename"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	blobKey, thumbKey              string
+	threadID, commentID, messageID int
+}
+
+// IsImage reports whether the attachment is shown as an image.
+func (a Attachment) IsImage() bool {
+	return containsString(imageTypes, a.ContentType)
+}
+
+// Thumbnail returns the address of the image to show inline.
+func (a Attachment) Thumbnail() string {
+	if a.ThumbnailURL != "" {
+		return a.ThumbnailURL
+	}
+	return a.URL
+}
+
+func (a *Attachment) setURLs() {
+	a.URL = "/attachments/" + strconv.Itoa(a.ID)
+	if a.thumbKey != "" {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+}
+
+const attachmentSelect = `
+    SELECT id, user_id, filename, content_type, size, width, height, created_at,
+        blob_key, thumb_key, COALESCE(thread_id, 0), COALESCE(comment_id, 0), COALESCE(message_id, 0)
+    FROM attachments`
+
+func scanAttachment(row scanner) (Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.ID, &a.UserID, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height, &a.CreatedAt,
+		&a.blobKey, &a.thumbKey, &a.threadID, &a.commentID, &a.messageID)
+	a.setURLs()
+	return a, err
+}
+
+// getAttachment loads an attachment.
+func getAttachment(id int) (Attachment, error) {
+	a, err := scanAttachment(db.QueryRow(attachmentSelect+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return a, errNotFound
+	}
+	return a, err
+}
+
+// attachmentTargets are the columns that attach a file, by kind of post.
+var attachmentTargets = map[string]string{
+	"thread":  "thread_id",
+	"comment": "comment_id",
+	"message": "message_id",
+}
+
+// listAttachments returns the attachments of threads, comments or messages
+// (kind) by id, in upload order.
+func listAttachments(kind string, ids []int) (map[int][]Attachment, error) {
+	attachments := map[int][]Attachment{}
+	if len(ids) == 0 {
+		return attachments, nil
+	}
+	column := attachmentTargets[kind]
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query(attachmentSelect+" WHERE "+column+" IN (?"+strings.Repeat(", ?", len(ids)-1)+") ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		target := map[string]int{"thread": a.threadID, "comment": a.commentID, "message": a.messageID}[kind]
+		attachments[target] = append(attachments[target], a)
+	}
+	return attachments, rows.Err()
+}
+
+// loadThreadAttachments sets the attachments of each thread.
+func loadThreadAttachments(threads []Thread) error {
+	ids := make([]int, len(threads))
+	for i, t := range threads {
+		ids[i] = t.ID
+	}
+	attachments, err := listAttachments("thread", ids)
+	if err != nil {
+		return err
+	}
+	for i := range threads {
+		threads[i].Attachments = attachments[threads[i].ID]
+	}
+	return nil
+}
+
+// loadCommentAttachments sets the attachments of each comment that is not deleted.
+func loadCommentAttachments(comments []Comment) error {
+	var ids []int
+	for _, c := range comments {
+		if !c.Deleted {
+			ids = append(ids, c.ID)
+		}
+	}
+	attachments, err := listAttachments("comment", ids)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		comments[i].Attachments = attachments[comments[i].ID]
+	}
+	return nil
+}
+
+// getCommentWithAttachments loads a comment with its attachments.
+func getCommentWithAttachments(commentID int) (Comment, error) {
+	comment, err := getComment(commentID)
+	if err != nil {
+		return comment, err
+	}
+	comments := []Comment{comment}
+	err = loadCommentAttachments(comments)
+	return comments[0], err
+}
+
+// saveAttachment checks and stores a file uploaded by userID. It is not
+// attached to anything until linkAttachments.
+func saveAttachment(userID int, filename string, r io.Reader) (Attachment, error) {
+	role, err := getUserRole(userID)
+	if err != nil {
+		return Attachment{}, err
+	}
+	limit := attachmentLimitFor(role)
+	maxBytes := int64(limit.MaxMiB) << 20
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return Attachment{}, err
+	}
+	if int64(len(data)) > maxBytes {
+		return Attachment{}, errAttachmentTooLarge
+	}
+
+	a := Attachment{UserID: userID, Filename: cleanFilename(filename), ContentType: sniffContentType(data), CreatedAt: time.Now()}
+	if !containsString(limit.Types, a.ContentType) {
+		return Attachment{}, errAttachmentType
+	}
+	var thumb []byte
+	if a.IsImage() {
+		if data, thumb, a.Width, a.Height, err = processImage(data, a.ContentType); err != nil {
+			return Attachment{}, err
+		}
+	}
+
+	a.Size = len(data)
+	a.blobKey = blobKey(data)
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	if err := blobs.Put(a.blobKey, a.ContentType, data); err != nil {
+		return Attachment{}, err
+	}
+	if thumb != nil {
+		a.thumbKey = blobKey(thumb)
+		if err := blobs.Put(a.thumbKey, thumbnailType(a.ContentType), thumb); err != nil {
+			return Attachment{}, err
+		}
+	}
+	result, err := db.Exec(`
+        INSERT INTO attachments (user_id, blob_key, thumb_key, filename, content_type, size, width, height, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.UserID, a.blobKey, a.thumbKey, a.Filename, a.ContentType, a.Size, a.Width, a.Height, a.CreatedAt)
+	if err != nil {
+		return Attachment{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Attachment{}, err
+	}
+	a.ID = int(id)
+	a.setURLs()
+	return a, nil
+}
+
+// sniffContentType returns the type of data without parameters, such as the charset of text.
+func sniffContentType(data []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(data))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+// cleanFilename keeps the base name of an uploaded file without control
+// characters, shortened to maxFilenameLength bytes.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	for len(name) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// processImage decodes an image and encodes it again in the same format,
+// which leaves all metadata behind. JPEG images are turned upright first as
+// their EXIF orientation says. A thumbnail is returned for images larger than
+// thumbnailSize, or nil.
+func processImage(data []byte, contentType string) (stored, thumb []byte, width, height int, err error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, 0, 0, errInvalidAttachmentImage
+	}
+	frames := 1
+	if contentType == "image/gif" {
+		if frames, err = gifFrameCount(data); err != nil {
+			return nil, nil, 0, 0, errInvalidAttachmentImage
+		}
+	}
+	if config.Width*config.Height*frames > maxAttachmentPixels {
+		return nil, nil, 0, 0, errAttachmentTooLarge
+	}
+
+	var buf bytes.Buffer
+	var first image.Image
+	switch contentType {
+	case "image/gif":
+		anim, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, 0, 0, errInvalidAttachmentImage
+		}
+		// Only the frames, their timing and the loop count are kept
+		clean := &gif.GIF{Image: anim.Image, Delay: anim.Delay, Disposal: anim.Disposal, LoopCount: anim.LoopCount, Config: anim.Config, BackgroundIndex: anim.BackgroundIndex}
+		if err := gif.EncodeAll(&buf, clean); err != nil {
+			return nil, nil, 0, 0, err
+		}
+		first = anim.Image[0]
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, 0, 0, errInvalidAttachmentImage
+		}
+		first = orient(img, jpegOrientation(data))
+		if err := jpeg.Encode(&buf, first, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, nil, 0, 0, err
+		}
+	default:
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, 0, 0, errInvalidAttachmentImage
+		}
+		first = img
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, nil, 0, 0, err
+		}
+	}
+
+	b := first.Bounds()
+	width, height = b.Dx(), b.Dy()
+	if contentType == "image/gif" {
+		width, height = config.Width, config.Height
+	}
+	if width > thumbnailSize || height > thumbnailSize {
+		if thumb, err = thumbnail(first, contentType); err != nil {
+			return nil, nil, 0, 0, err
+		}
+	}
+	return buf.Bytes(), thumb, width, height, nil
+}
+
+// thumbnailType returns the type of the thumbnails of images of contentType.
+func thumbnailType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return contentType
+	}
+	return "image/png"
+}
+
+// thumbnail scales img to fit in thumbnailSize, as JPEG for JPEG images and PNG otherwise.
+func thumbnail(img image.Image, contentType string) ([]byte, error) {
+	b := img.Bounds()
+	w, h := thumbnailSize, thumbnailSize
+	if b.Dx() > b.Dy() {
+		h = max(1, b.Dy()*thumbnailSize/b.Dx())
+	} else {
+		w = max(1, b.Dx()*thumbnailSize/b.Dy())
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	var err error
+	if thumbnailType(contentType) == "image/jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	return buf.Bytes(), err
+}
+
+// gifFrameCount counts the frames of a GIF by walking its blocks, without
+// decoding them.
+func gifFrameCount(data []byte) (int, error) {
+	errFormat := errors.New("malformed GIF")
+	if len(data) < 13 {
+		return 0, errFormat
+	}
+	pos := 13
+	if data[10]&0x80 != 0 { // global color table
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	// skipSubBlocks moves past a sequence of sub-blocks ended by an empty one
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: label, then sub-blocks
+			pos += 2
+			if !skipSubBlocks() {
+				return 0, errFormat
+			}
+		case 0x2C: // image descriptor, optional local color table, LZW code size, sub-blocks
+			if pos+10 > len(data) {
+				return 0, errFormat
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			pos++
+			if !skipSubBlocks() {
+				return 0, errFormat
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, errFormat
+		}
+	}
+	// A missing trailer is tolerated, as by most decoders
+	return frames, nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, 1 when it has none.
+func jpegOrientation(data []byte) int {
+	pos := 2 // after the start of image marker
+	for pos+4 <= len(data) && data[pos] == 0xFF {
+		marker := data[pos+1]
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if marker == 0xDA || size < 2 || pos+2+size > len(data) { // start of scan: no more metadata
+			break
+		}
+		segment := data[pos+4 : pos+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of TIFF data.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 { // orientation, a SHORT
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient turns an image upright according to an EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	dw, dh := w, h
+	if orientation >= 5 { // turned by a quarter
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning counterclockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, src.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// linkAttachments attaches files userID uploaded and has not attached yet to
+// the thread, comment or message (kind) targetID.
+func linkAttachments(tx *sql.Tx, userID int, ids []int, kind string, targetID int) error {
+	if len(ids) > maxAttachmentsPerPost {
+		return fieldError(fmt.Sprintf("at most %d attachments can be added", maxAttachmentsPerPost))
+	}
+	for _, id := range ids {
+		result, err := tx.Exec(fmt.Sprintf(`
+            UPDATE attachments SET %s = ? WHERE id = ? AND user_id = ?
+                AND thread_id IS NULL AND comment_id IS NULL AND message_id IS NULL`, attachmentTargets[kind]),
+			targetID, id, userID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fieldError(fmt.Sprintf("attachment %d does not exist or is attached already", id))
+		}
+	}
+	return nil
+}
+
+// canViewAttachment reports whether the user with userID and username may see a file.
+func canViewAttachment(userID int, username string, a Attachment) (bool, error) {
+	switch {
+	case a.messageID != 0:
+		if userID == 0 {
+			return false, nil
+		}
+		var participants int
+		err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ? AND (username = ?2 OR recipient = ?2)", a.messageID, username).Scan(&participants)
+		return participants > 0, err
+	case a.commentID != 0:
+		// The files of a deleted comment go with it, except for its author
+		var deleted bool
+		err := db.QueryRow("SELECT deleted_at IS NOT NULL FROM comments WHERE id = ?", a.commentID).Scan(&deleted)
+		return !deleted || userID == a.UserID, err
+	case a.threadID != 0:
+		return true, nil
+	}
+	return userID != 0 && userID == a.UserID, nil
+}
+
+// deleteAttachment removes an attachment, and its blobs when nothing else uses them.
+func deleteAttachment(id int) error {
+	a, err := getAttachment(id)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM attachments WHERE id = ?", id); err != nil {
+		return err
+	}
+	releaseBlobs(a.blobKey, a.thumbKey)
+	return nil
+}
+
+// attachmentKeys returns the blob keys of the attachments matching where.
+func attachmentKeys(q queryer, where string, args ...interface{}) ([]string, error) {
+	rows, err := q.Query("SELECT blob_key, thumb_key FROM attachments WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key, thumb string
+		if err := rows.Scan(&key, &thumb); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key, thumb)
+	}
+	return keys, rows.Err()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// blobsMu is held while an upload stores its blobs and adds its attachment,
+// and while releaseBlobs counts the users of a blob and deletes it. Otherwise
+// a release could delete a blob that an upload of the same content found in
+// the store a moment before.
+var blobsMu sync.Mutex
+
+// releaseBlobs deletes the blobs of keys no attachment uses any more. Failures
+// are only logged: a blob left behind costs space but nothing else.
+func releaseBlobs(keys ...string) {
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		var users int
+		if err := db.QueryRow("SELECT COUNT(*) FROM attachments WHERE blob_key = ?1 OR thumb_key = ?1", key).Scan(&users); err != nil {
+			log.Printf("Failed to check blob %s: %v", key, err)
+			continue
+		}
+		if users > 0 {
+			continue
+		}
+		if err := blobs.Delete(key); err != nil && err != errNotFound {
+			log.Printf("Failed to delete blob %s: %v", key, err)
+		}
+	}
+}
+
+// removeUnattached removes the uploads that were never attached within unattachedLifetime.
+func removeUnattached(now time.Time) (int, error) {
+	where := "thread_id IS NULL AND comment_id IS NULL AND message_id IS NULL AND created_at < ?"
+	cutoff := now.Add(-unattachedLifetime)
+	keys, err := attachmentKeys(db, where, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec("DELETE FROM attachments WHERE "+where, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	releaseBlobs(keys...)
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// startAttachmentJanitor removes unattached uploads every hour until the process exits.
+func startAttachmentJanitor() {
+	go func() {
+		for {
+			if n, err := removeUnattached(time.Now()); err != nil {
+				log.Printf("Failed to remove unattached uploads: %v", err)
+			} else if n > 0 {
+				log.Printf("Removed %d unattached uploads", n)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// uploadFormAttachments stores the files of the attachments field of a
+// multipart form posted by userID and returns their ids. It must run before
+// anything else reads the form.
+func uploadFormAttachments(w http.ResponseWriter, r *http.Request, userID int) ([]int, error) {
+	role, err := getUserRole(userID)
+	if err != nil {
+		return nil, err
+	}
+	maxBytes := int64(attachmentLimitFor(role).MaxMiB)<<20*maxAttachmentsPerPost + 1<<20
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errAttachmentTooLarge
+		}
+		return nil, err
+	}
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+
+	var files []*multipart.FileHeader
+	for _, f := range r.MultipartForm.File["attachments"] {
+		if f.Filename != "" || f.Size > 0 { // browsers send an empty part when no file is chosen
+			files = append(files, f)
+		}
+	}
+	if len(files) > maxAttachmentsPerPost {
+		return nil, fieldError(fmt.Sprintf("at most %d attachments can be added", maxAttachmentsPerPost))
+	}
+	var ids []int
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		a, err := saveAttachment(userID, f.Filename, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, a.ID)
+	}
+	return ids, nil
+}
+
+// writeUploadError answers a failed upload of an HTML form.
+func writeUploadError(w http.ResponseWriter, err error) {
+	if _, ok := err.(fieldError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case errAttachmentTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errAttachmentType:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errInvalidAttachmentImage:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Failed to store attachment: %v", err)
+		http.Error(w, "Failed to store attachment", http.StatusInternalServerError)
+	}
+}
+
+// /attachments/{id} and /attachments/{id}/thumbnail: the file of an
+// attachment, or its thumbnail, to those allowed to see it
+func serveAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid attachment", http.StatusBadRequest)
+		return
+	}
+	a, err := getAttachment(id)
+	if err == errNotFound {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load attachment: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	username, userID, _ := apiUser(r)
+	allowed, err := canViewAttachment(userID, username, a)
+	if err != nil {
+		log.Printf("Failed to check attachment access: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		// Not told apart from a missing file, so ids of private files are not confirmed
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	key, contentType := a.blobKey, a.ContentType
+	if strings.HasSuffix(r.URL.Path, "/thumbnail") && a.thumbKey != "" {
+		key, contentType = a.thumbKey, thumbnailType(a.ContentType)
+	}
+	w.Header().Set("ETag", `"`+key+`"`)
+	if a.messageID != 0 || (a.threadID == 0 && a.commentID == 0) {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	if r.Header.Get("If-None-Match") == `"`+key+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	blob, err := blobs.Open(key)
+	if err != nil {
+		log.Printf("Failed to open blob %s: %v", key, err)
+		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// Files are never run or sniffed as anything else, and only images show inline
+	disposition := "attachment"
+	if a.IsImage() {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	io.Copy(w, blob)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useDiskBlobs stores blobs in a temporary directory until the test ends and returns it.
+func useDiskBlobs(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous := blobs
+	blobs = diskStore{dir: dir}
+	t.Cleanup(func() { blobs = previous })
+	return dir
+}
+
+// blobFiles returns the paths of the blobs stored under dir.
+func blobFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// testImage returns a w×h image with a different color in each half, so
+// turning it shows.
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{200, 30, 30, 255}
+			if x >= w/2 {
+				c = color.RGBA{30, 30, 200, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// exifJPEG encodes img as JPEG with an EXIF segment holding orientation and,
+// after the IFD, secret, as a camera would store the location.
+func exifJPEG(t *testing.T, img image.Image, orientation uint16, secret string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)           // entries
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)      // orientation
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)           // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)           // count
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation) // value
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)                   // padding and no next IFD
+	tiff = append(tiff, secret...)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...) // start of image
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestAttachmentsAreContentAddressed(t *testing.T) {
+	newTestDB(t)
+	dir := useDiskBlobs(t)
+	userID := createTestUser(t, "alice")
+	data := encodePNG(t, testImage(40, 20))
+
+	first, err := saveAttachment(userID, "one.png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := saveAttachment(userID, "two.png", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID || first.blobKey != second.blobKey {
+		t.Fatalf("same content saved as %d/%s and %d/%s, want two attachments sharing a blob", first.ID, first.blobKey, second.ID, second.blobKey)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 || filepath.Base(files[0]) != first.blobKey {
+		t.Fatalf("blobs on disk %v, want only %s", files, first.blobKey)
+	}
+	stored, err := os.ReadFile(blobFiles(t, dir)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobKey(stored) != first.blobKey {
+		t.Errorf("blob %s holds content with key %s", first.blobKey, blobKey(stored))
+	}
+
+	if err := deleteAttachment(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Errorf("blob removed while attachment %d still uses it", second.ID)
+	}
+	if err := deleteAttachment(second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if files := blobFiles(t, dir); len(files) != 0 {
+		t.Errorf("blobs left after deleting every attachment: %v", files)
+	}
+}
+
+// pausingStore stops after each Put until resume is closed, once put has been closed.
+type pausingStore struct {
+	blobStore
+	put, resume chan struct{}
+}
+
+func (s pausingStore) Put(key, contentType string, data []byte) error {
+	err := s.blobStore.Put(key, contentType, data)
+	close(s.put)
+	<-s.resume
+	return err
+}
+
+func TestReleaseWaitsForUploadOfTheSameBlob(t *testing.T) {
+	newTestDB(t)
+	dir := useDiskBlobs(t)
+	userID := createTestUser(t, "alice")
+	setTestRole(t, userID, roleModerator) // may upload text
+	data := []byte("the same text twice")
+	first, err := saveAttachment(userID, "one.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As when the comment holding it was deleted, before its blobs are released
+	if _, err := db.Exec("DELETE FROM attachments WHERE id = ?", first.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	store := pausingStore{blobs, make(chan struct{}), make(chan struct{})}
+	blobs = store
+	uploaded := make(chan error)
+	go func() {
+		_, err := saveAttachment(userID, "two.txt", bytes.NewReader(data))
+		uploaded <- err
+	}()
+	<-store.put // the upload found the blob in the store
+
+	released := make(chan struct{})
+	go func() {
+		releaseBlobs(first.blobKey)
+		close(released)
+	}()
+	select {
+	case <-released:
+		t.Error("the blob was released while an upload of it was under way")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.resume)
+	if err := <-uploaded; err != nil {
+		t.Fatal(err)
+	}
+	<-released
+
+	if files := blobFiles(t, dir); len(files) != 1 {
+		t.Errorf("blobs on disk %v, want the one the second upload uses", files)
+	}
+}
+
+func TestImageAttachments(t *testing.T) {
+	newTestDB(t)
+	useDiskBlobs(t)
+	userID := createTestUser(t, "alice")
+	const secret = "GPS 41.0082N 28.9784E"
+
+	tests := []struct {
+		name           string
+		filename       string
+		data           []byte
+		contentType    string
+		width, height  int
+		thumbW, thumbH int // 0 when no thumbnail is made
+		thumbType      string
+	}{
+		{"small png", "small.png", encodePNG(t, testImage(100, 50)), "image/png", 100, 50, 0, 0, ""},
+		{"large png", "large.png", encodePNG(t, testImage(640, 200)), "image/png", 640, 200, 320, 100, "image/png"},
+		{"jpeg without orientation", "plain.jpg", exifJPEG(t, testImage(400, 200), 1, secret), "image/jpeg", 400, 200, 320, 160, "image/jpeg"},
+		{"jpeg turned clockwise", "turned.jpg", exifJPEG(t, testImage(400, 200), 6, secret), "image/jpeg", 200, 400, 160, 320, "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := saveAttachment(userID, tt.filename, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.ContentType != tt.contentType || a.Width != tt.width || a.Height != tt.height {
+				t.Errorf("saved as %s %d×%d, want %s %d×%d", a.ContentType, a.Width, a.Height, tt.contentType, tt.width, tt.height)
+			}
+
+			stored := readBlob(t, blobs, a.blobKey)
+			if bytes.Contains(stored, []byte("Exif")) || bytes.Contains(stored, []byte(secret)) {
+				t.Error("stored image still holds its EXIF data")
+			}
+			img, _, err := image.Decode(bytes.NewReader(stored))
+			if err != nil {
+				t.Fatalf("stored image does not decode: %v", err)
+			}
+			if b := img.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Errorf("stored image is %d×%d, want %d×%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+
+			if tt.thumbW == 0 {
+				if a.thumbKey != "" || a.ThumbnailURL != "" {
+					t.Errorf("thumbnail %q made for a small image", a.thumbKey)
+				}
+				return
+			}
+			if a.thumbKey == "" || a.ThumbnailURL == "" {
+				t.Fatal("no thumbnail made for a large image")
+			}
+			thumb := readBlob(t, blobs, a.thumbKey)
+			config, format, err := image.DecodeConfig(bytes.NewReader(thumb))
+			if err != nil {
+				t.Fatalf("thumbnail does not decode: %v", err)
+			}
+			if "image/"+format != tt.thumbType || config.Width != tt.thumbW || config.Height != tt.thumbH {
+				t.Errorf("thumbnail is %s %d×%d, want %s %d×%d", format, config.Width, config.Height, tt.thumbType, tt.thumbW, tt.thumbH)
+			}
+		})
+	}
+}
+
+func TestOrientTurnsImagesUpright(t *testing.T) {
+	// The left half of testImage is red; after turning clockwise it is the top
+	img := orient(testImage(4, 2), 6)
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 4 {
+		t.Fatalf("turned image is %d×%d, want 2×4", b.Dx(), b.Dy())
+	}
+	red := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA)
+	blue := color.RGBAModel.Convert(img.At(0, 3)).(color.RGBA)
+	if red.R < red.B || blue.B < blue.R {
+		t.Errorf("turned image has %v at the top and %v at the bottom, want red above blue", red, blue)
+	}
+}
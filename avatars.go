@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // decoders for uploaded avatars
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/image/draw"
+)
+
+// Uploaded avatars are cropped to a square, scaled to avatarSize and stored
+// as PNG in the avatar directory. Users without one get an identicon
+// generated from their username. Both are served from /avatar/{username}.
+
+const (
+	avatarSize         = 128
+	maxAvatarUploadMiB = 2
+	maxAvatarPixels    = 4096 // per side, checked before the image is decoded
+)
+
+var (
+	errInvalidImage  = errors.New("the avatar must be a PNG, JPEG or GIF image")
+	errImageTooLarge = errors.New("the avatar is too large")
+)
+
+// avatarDir returns where avatars are stored. It can be overridden with AVATAR_DIR.
+func avatarDir() string {
+	if dir := os.Getenv("AVATAR_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("uploads", "avatars")
+}
+
+// processAvatar decodes an uploaded image and returns it as a square PNG of avatarSize.
+func processAvatar(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarUploadMiB<<20+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAvatarUploadMiB<<20 {
+		return nil, errImageTooLarge
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+	if config.Width > maxAvatarPixels || config.Height > maxAvatarPixels {
+		return nil, errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidImage
+	}
+
+	// Crop the largest centered square
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	if side == 0 {
+		return nil, errInvalidImage
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// saveAvatar stores a processed avatar for a user and removes the one it replaces.
+func saveAvatar(userID int, data []byte) error {
+	var old string
+	if err := db.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&old); err != nil {
+		return err
+	}
+
+	// A new name for every upload keeps browsers from showing a cached old avatar
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := hex.EncodeToString(suffix) + ".png"
+	if err := os.MkdirAll(avatarDir(), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(avatarDir(), name), data, 0o644); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET avatar = ? WHERE id = ?", name, userID); err != nil {
+		os.Remove(filepath.Join(avatarDir(), name))
+		return err
+	}
+	removeAvatarFile(old)
+	return nil
+}
+
+// removeAvatar switches a user back to their identicon.
+func removeAvatar(userID int) error {
+	var old string
+	if err := db.QueryRow("SELECT avatar FROM users WHERE id = ?", userID).Scan(&old); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET avatar = '' WHERE id = ?", userID); err != nil {
+		return err
+	}
+	removeAvatarFile(old)
+	return nil
+}
+
+func removeAvatarFile(name string) {
+	if name != "" {
+		os.Remove(filepath.Join(avatarDir(), filepath.Base(name)))
+	}
+}
+
+// identicon draws a symmetric 5x5 pattern in a color derived from the username.
+func identicon(username string) ([]byte, error) {
+	sum := sha256.Sum256([]byte(username))
+	fg := color.RGBA{sum[0], sum[1], sum[2], 255}
+	bg := color.RGBA{240, 240, 240, 255}
+
+	const cells, padding = 5, 14
+	cell := (avatarSize - 2*padding) / cells
+	img := image.NewRGBA(image.Rect(0, 0, avatarSize, avatarSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+	for y := 0; y < cells; y++ {
+		for x := 0; x < (cells+1)/2; x++ {
+			if sum[3+y*3+x]%2 == 0 {
+				continue
+			}
+			for _, col := range []int{x, cells - 1 - x} {
+				r := image.Rect(padding+col*cell, padding+y*cell, padding+(col+1)*cell, padding+(y+1)*cell)
+				draw.Draw(img, r, &image.Uniform{fg}, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// /avatar/{username}: the uploaded avatar of a user or their identicon
+func serveAvatar(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	var avatar string
+	err := db.QueryRow("SELECT avatar FROM users WHERE username = ?", username).Scan(&avatar)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if avatar != "" {
+		http.ServeFile(w, r, filepath.Join(avatarDir(), filepath.Base(avatar)))
+		return
+	}
+	data, err := identicon(username)
+	if err != nil {
+		http.Error(w, "Failed to draw avatar", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(data)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodedImage returns a w by h image split into a red left and a blue right half.
+func encodedImage(t *testing.T, format string, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessAvatar(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"png", encodedImage(t, "png", 300, 200), nil},
+		{"jpeg", encodedImage(t, "jpeg", 64, 64), nil},
+		{"gif", encodedImage(t, "gif", 40, 90), nil},
+		{"tiny", encodedImage(t, "png", 1, 1), nil},
+		{"not an image", []byte("<svg></svg>"), errInvalidImage},
+		{"too many pixels", encodedImage(t, "png", maxAvatarPixels+1, 1), errImageTooLarge},
+		{"too many bytes", bytes.Repeat([]byte{0}, maxAvatarUploadMiB<<20+1), errImageTooLarge},
+	}
+	for _, tt := range tests {
+		data, err := processAvatar(bytes.NewReader(tt.data))
+		if err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: the avatar is not a PNG: %v", tt.name, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != avatarSize || b.Dy() != avatarSize {
+			t.Errorf("%s: avatar is %dx%d, want %dx%d", tt.name, b.Dx(), b.Dy(), avatarSize, avatarSize)
+		}
+	}
+
+	// A wide image is cropped to its centre, which keeps both halves
+	data, err := processAvatar(bytes.NewReader(encodedImage(t, "png", 400, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _ := png.Decode(bytes.NewReader(data))
+	if r, _, b, _ := img.At(4, avatarSize/2).RGBA(); r < b {
+		t.Error("left edge of the cropped avatar is not red")
+	}
+	if r, _, b, _ := img.At(avatarSize-5, avatarSize/2).RGBA(); b < r {
+		t.Error("right edge of the cropped avatar is not blue")
+	}
+}
+
+func TestAvatars(t *testing.T) {
+	newTestDB(t)
+	dir := t.TempDir()
+	t.Setenv("AVATAR_DIR", dir)
+	alice := createTestUser(t, "alice")
+
+	// getAvatar fetches /avatar/{username}
+	getAvatar := func(username string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/avatar/"+username, nil)
+		r.SetPathValue("username", username)
+		w := httptest.NewRecorder()
+		serveAvatar(w, r)
+		return w
+	}
+	files := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "*"))
+		return names
+	}
+
+	steps := []struct {
+		name  string
+		do    func() error
+		files int
+	}{
+		{"upload", func() error {
+			data, err := processAvatar(bytes.NewReader(encodedImage(t, "png", 50, 50)))
+			if err != nil {
+				return err
+			}
+			return saveAvatar(alice, data)
+		}, 1},
+		{"replace", func() error {
+			data, err := processAvatar(bytes.NewReader(encodedImage(t, "jpeg", 60, 60)))
+			if err != nil {
+				return err
+			}
+			return saveAvatar(alice, data)
+		}, 1},
+		{"remove", func() error { return removeAvatar(alice) }, 0},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := files(); len(got) != step.files {
+			t.Errorf("%s: avatar files %v, want %d", step.name, got, step.files)
+		}
+		details, err := getUserDetails(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := getAvatar("alice")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", step.name, w.Code)
+		}
+		if details.Avatar != "" {
+			stored, err := os.ReadFile(filepath.Join(dir, details.Avatar))
+			if err != nil || !bytes.Equal(w.Body.Bytes(), stored) {
+				t.Errorf("%s: served avatar differs from the stored one (%v)", step.name, err)
+			}
+		} else if want, _ := identicon("alice"); !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("%s: served avatar is not the identicon", step.name)
+		}
+	}
+
+	// Users without an avatar, and names nobody has, get a stable identicon of their own
+	a, _ := identicon("alice")
+	again, _ := identicon("alice")
+	b, _ := identicon("bob")
+	if !bytes.Equal(a, again) || bytes.Equal(a, b) {
+		t.Error("identicons are not stable per username")
+	}
+	if w := getAvatar("nobody"); w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("avatar of an unknown user: status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
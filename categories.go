@@ -0,0 +1,567 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Categories form a tree: each can have a parent, and siblings are shown in
+// the order of their position, then by name. Admins manage them at
+// /admin/categories or through the API. Archived categories keep their
+// threads but take no new ones and are left out of the category pickers.
+
+// Limits of the category fields, in characters.
+const (
+	maxCategoryNameLength        = 50
+	maxCategorySlugLength        = 64
+	maxCategoryDescriptionLength = 500
+	maxCategoryIconLength        = 8 // an emoji or two
+)
+
+var (
+	categorySlugPattern  = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+	categoryColorPattern = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+)
+
+// categorySelect selects categories with the number of threads filed directly under them.
+const categorySelect = `
+    SELECT c.id, c.name, c.slug, c.description, c.parent_id, c.position, c.color, c.icon,
+        c.archived_at IS NOT NULL,
+        (SELECT COUNT(*) FROM thread_categories tc WHERE tc.category_id = c.id)
+    FROM categories c`
+
+// categoryTreeQuery selects the ids of the category with a slug or name,
+// given twice, and of all its subcategories.
+const categoryTreeQuery = `
+    WITH RECURSIVE tree(id) AS (
+        SELECT id FROM categories WHERE slug = ? OR name = ?
+        UNION SELECT sub.id FROM categories sub JOIN tree ON sub.parent_id = tree.id)
+    SELECT id FROM tree`
+
+func scanCategory(row scanner) (Category, error) {
+	var c Category
+	var parentID sql.NullInt64
+	err := row.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &parentID, &c.Position, &c.Color, &c.Icon, &c.Archived, &c.ThreadCount)
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		c.ParentID = &id
+	}
+	return c, err
+}
+
+// Indent returns the prefix that shows how deep a category is nested in pickers.
+func (c Category) Indent() string {
+	return strings.Repeat("— ", c.Depth)
+}
+
+// Parent returns the id of the parent category, 0 for top level categories.
+func (c Category) Parent() int {
+	if c.ParentID == nil {
+		return 0
+	}
+	return *c.ParentID
+}
+
+// listCategories returns every category in tree order: each category is
+// followed by its subcategories, and siblings are ordered by position and name.
+func listCategories() ([]Category, error) {
+	rows, err := db.Query(categorySelect + " ORDER BY c.position, c.name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var all []Category
+	known := map[int]bool{}
+	for rows.Next() {
+		c, err := scanCategory(rows)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, c)
+		known[c.ID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	children := map[int][]Category{}
+	for _, c := range all {
+		parent := 0
+		if c.ParentID != nil && known[*c.ParentID] {
+			parent = *c.ParentID
+		}
+		children[parent] = append(children[parent], c)
+	}
+	categories := []Category{}
+	var walk func(parent, depth int)
+	walk = func(parent, depth int) {
+		for _, c := range children[parent] {
+			c.Depth = depth
+			categories = append(categories, c)
+			walk(c.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return categories, nil
+}
+
+// getCategory loads a single category.
+func getCategory(id int) (Category, error) {
+	c, err := scanCategory(db.QueryRow(categorySelect+" WHERE c.id = ?", id))
+	if err == sql.ErrNoRows {
+		return c, errNotFound
+	}
+	return c, err
+}
+
+// findCategory returns the category with the given slug or, for links from
+// before slugs existed, name.
+func findCategory(key string) (Category, error) {
+	c, err := scanCategory(db.QueryRow(categorySelect+" WHERE c.slug = ?1 OR c.name = ?1 ORDER BY c.slug = ?1 DESC LIMIT 1", key))
+	if err == sql.ErrNoRows {
+		return c, errNotFound
+	}
+	return c, err
+}
+
+// CategoryInput holds the fields of a category to create or change; nil
+// fields are left as they are. A ParentID of 0 moves a category to the top.
+type CategoryInput struct {
+	Name        *string `json:"name"`
+	Slug        *string `json:"slug"` // made from the name when empty
+	Description *string `json:"description"`
+	ParentID    *int    `json:"parent_id"`
+	Position    *int    `json:"position"`
+	Color       *string `json:"color"` // #rrggbb or empty
+	Icon        *string `json:"icon"`
+	Archived    *bool   `json:"archived"`
+}
+
+// apply copies the given fields of in onto c and checks the result. The
+// errors it returns are meant to be shown to the admin.
+func (in CategoryInput) apply(q queryRower, c *Category) error {
+	if in.Name != nil {
+		c.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Slug != nil {
+		c.Slug = strings.TrimSpace(*in.Slug)
+	}
+	if in.Description != nil {
+		c.Description = strings.TrimSpace(*in.Description)
+	}
+	if in.ParentID != nil {
+		c.ParentID = nil
+		if *in.ParentID != 0 {
+			parentID := *in.ParentID
+			c.ParentID = &parentID
+		}
+	}
+	if in.Position != nil {
+		c.Position = *in.Position
+	}
+	if in.Color != nil {
+		c.Color = strings.ToLower(strings.TrimSpace(*in.Color))
+	}
+	if in.Icon != nil {
+		c.Icon = strings.TrimSpace(*in.Icon)
+	}
+	if in.Archived != nil {
+		c.Archived = *in.Archived
+	}
+
+	if c.Name == "" {
+		return fieldError("Name is required")
+	}
+	if utf8.RuneCountInString(c.Name) > maxCategoryNameLength {
+		return fieldError("Name is too long")
+	}
+	if utf8.RuneCountInString(c.Description) > maxCategoryDescriptionLength {
+		return fieldError("Description is too long")
+	}
+	if utf8.RuneCountInString(c.Icon) > maxCategoryIconLength {
+		return fieldError("Icon is too long")
+	}
+	if c.Color != "" && !categoryColorPattern.MatchString(c.Color) {
+		return fieldError("Color must look like #3366ff")
+	}
+
+	var taken int
+	if err := q.QueryRow("SELECT COUNT(*) FROM categories WHERE name = ? AND id != ?", c.Name, c.ID).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return fieldError("A category named " + c.Name + " already exists")
+	}
+	if c.Slug == "" {
+		slug, err := uniqueCategorySlug(q, slugify(c.Name), c.ID)
+		if err != nil {
+			return err
+		}
+		c.Slug = slug
+	} else {
+		if len(c.Slug) > maxCategorySlugLength || !categorySlugPattern.MatchString(c.Slug) {
+			return fieldError("Slug must be lowercase letters and digits separated by dashes")
+		}
+		if err := q.QueryRow("SELECT COUNT(*) FROM categories WHERE slug = ? AND id != ?", c.Slug, c.ID).Scan(&taken); err != nil {
+			return err
+		}
+		if taken > 0 {
+			return fieldError("Slug " + c.Slug + " is taken")
+		}
+	}
+
+	// The parent must exist and must not be the category or one of its subcategories
+	for id := c.ParentID; id != nil; {
+		if *id == c.ID {
+			return fieldError("A category cannot be placed under itself or its subcategories")
+		}
+		var parentID sql.NullInt64
+		err := q.QueryRow("SELECT parent_id FROM categories WHERE id = ?", *id).Scan(&parentID)
+		if err == sql.ErrNoRows {
+			return fieldError(fmt.Sprintf("Parent category %d does not exist", *id))
+		}
+		if err != nil {
+			return err
+		}
+		id = nil
+		if parentID.Valid {
+			next := int(parentID.Int64)
+			id = &next
+		}
+	}
+	return nil
+}
+
+// slugFolds spells letters common in category names with ASCII ones for slugs.
+var slugFolds = strings.NewReplacer("ç", "c", "ğ", "g", "ı", "i", "ö", "o", "ş", "s", "ü", "u", "ä", "a", "é", "e", "ß", "ss")
+
+// slugify turns a name into a slug: lowercase letters and digits separated by dashes.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range slugFolds.Replace(strings.ToLower(name)) {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	slug := b.String()
+	if len(slug) > maxCategorySlugLength-4 {
+		slug = strings.TrimRight(slug[:maxCategorySlugLength-4], "-")
+	}
+	if slug == "" {
+		slug = "category"
+	}
+	return slug
+}
+
+// uniqueCategorySlug returns base, or base with a number appended if another
+// category than id has it already.
+func uniqueCategorySlug(q queryRower, base string, id int) (string, error) {
+	slug := base
+	for n := 2; ; n++ {
+		var taken int
+		if err := q.QueryRow("SELECT COUNT(*) FROM categories WHERE slug = ? AND id != ?", slug, id).Scan(&taken); err != nil {
+			return "", err
+		}
+		if taken == 0 {
+			return slug, nil
+		}
+		slug = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// archivedAt returns the archive time to store for a category.
+func archivedAt(archived bool) interface{} {
+	if archived {
+		return time.Now()
+	}
+	return nil
+}
+
+// createCategory adds a category; in.Name is required.
+func createCategory(in CategoryInput) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var c Category
+	if in.Position == nil {
+		// New categories go after their siblings
+		if err := tx.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM categories").Scan(&c.Position); err != nil {
+			return 0, err
+		}
+	}
+	if err := in.apply(tx, &c); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`
+        INSERT INTO categories (name, slug, description, parent_id, position, color, icon, archived_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.Name, c.Slug, c.Description, c.ParentID, c.Position, c.Color, c.Icon, archivedAt(c.Archived))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// updateCategory changes the given fields of a category.
+func updateCategory(id int, in CategoryInput) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	c, err := scanCategory(tx.QueryRow(categorySelect+" WHERE c.id = ?", id))
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	wasArchived := c.Archived
+	if err := in.apply(tx, &c); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+        UPDATE categories SET name = ?, slug = ?, description = ?, parent_id = ?, position = ?, color = ?, icon = ?
+        WHERE id = ?`, c.Name, c.Slug, c.Description, c.ParentID, c.Position, c.Color, c.Icon, id); err != nil {
+		return err
+	}
+	if c.Archived != wasArchived {
+		if _, err := tx.Exec("UPDATE categories SET archived_at = ? WHERE id = ?", archivedAt(c.Archived), id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteCategory removes an empty category with its follows and watches.
+// Categories with threads or subcategories are archived or emptied first.
+func deleteCategory(id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var threads, children int
+	err = tx.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM thread_categories WHERE category_id = ?1),
+            (SELECT COUNT(*) FROM categories WHERE parent_id = ?1)
+        FROM categories WHERE id = ?1`, id).Scan(&threads, &children)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if threads > 0 {
+		return fieldError("The category has threads; archive it instead")
+	}
+	if children > 0 {
+		return fieldError("The category has subcategories; move or delete them first")
+	}
+	for _, stmt := range []string{
+		"DELETE FROM category_follows WHERE category_id = ?",
+		"DELETE FROM category_watches WHERE category_id = ?",
+		"DELETE FROM categories WHERE id = ?",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkCategoryIDs checks the category ids sent with a thread and returns
+// them without repeats. Each must be a category that exists and is not
+// archived, except archived categories in current, the thread's categories
+// before an edit, which it may stay in.
+func checkCategoryIDs(q queryRower, ids, current []string) ([]string, error) {
+	keep := map[string]bool{}
+	for _, id := range current {
+		keep[id] = true
+	}
+	checked := []string{}
+	seen := map[int]bool{}
+	for _, v := range ids {
+		id, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fieldError("Invalid category " + v)
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		var name string
+		var archived bool
+		err = q.QueryRow("SELECT name, archived_at IS NOT NULL FROM categories WHERE id = ?", id).Scan(&name, &archived)
+		if err == sql.ErrNoRows {
+			return nil, fieldError(fmt.Sprintf("Category %d does not exist", id))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if archived && !keep[strconv.Itoa(id)] {
+			return nil, fieldError("Category " + name + " is archived")
+		}
+		checked = append(checked, strconv.Itoa(id))
+	}
+	return checked, nil
+}
+
+// fillCategorySlugs gives a slug to the categories without one, such as
+// those from before slugs existed or inserted into the database by hand.
+func fillCategorySlugs(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, name FROM categories WHERE slug = '' ORDER BY id")
+	if err != nil {
+		return err
+	}
+	type unnamed struct {
+		id   int
+		name string
+	}
+	var missing []unnamed
+	for rows.Next() {
+		var c unnamed
+		if err := rows.Scan(&c.id, &c.name); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range missing {
+		slug, err := uniqueCategorySlug(db, slugify(c.name), c.id)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE categories SET slug = ? WHERE id = ?", slug, c.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// /admin/categories: list, add, change, archive and delete categories, admins only
+func serveAdminCategories(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || role != roleAdmin {
+		http.Error(w, "Only admins can manage categories", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err := updateCategories(r)
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case nil:
+		case errNotFound:
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		default:
+			log.Printf("Failed to save category: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+		return
+	}
+
+	categories, err := listCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/admin_categories.html"))
+	tmpl.Execute(w, categories)
+}
+
+// updateCategories applies an admin form: action is create, update, archive,
+// unarchive or delete.
+func updateCategories(r *http.Request) error {
+	action := r.FormValue("action")
+	if action == "create" {
+		in, err := categoryForm(r)
+		if err != nil {
+			return err
+		}
+		_, err = createCategory(in)
+		return err
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return fieldError("Invalid category")
+	}
+	switch action {
+	case "update":
+		in, err := categoryForm(r)
+		if err != nil {
+			return err
+		}
+		return updateCategory(id, in)
+	case "archive", "unarchive":
+		archived := action == "archive"
+		return updateCategory(id, CategoryInput{Archived: &archived})
+	case "delete":
+		return deleteCategory(id)
+	}
+	return fieldError("Unknown action")
+}
+
+// categoryForm reads the fields of a category from an admin form. An empty
+// position keeps the current one, or puts a new category last.
+func categoryForm(r *http.Request) (CategoryInput, error) {
+	name, slug, description := r.FormValue("name"), r.FormValue("slug"), r.FormValue("description")
+	color, icon := r.FormValue("color"), r.FormValue("icon")
+	parentID := 0
+	if v := r.FormValue("parent_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return CategoryInput{}, fieldError("Invalid parent category")
+		}
+		parentID = id
+	}
+	in := CategoryInput{Name: &name, Slug: &slug, Description: &description, ParentID: &parentID, Color: &color, Icon: &icon}
+	if v := r.FormValue("position"); v != "" {
+		position, err := strconv.Atoi(v)
+		if err != nil {
+			return in, fieldError("Invalid position")
+		}
+		in.Position = &position
+	}
+	return in, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// categoryNamed returns the input of a category with just a name.
+func categoryNamed(name string) CategoryInput {
+	return CategoryInput{Name: &name}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"News", "news"},
+		{"  Off topic!  ", "off-topic"},
+		{"Çay & Şeker", "cay-seker"},
+		{"Größe", "grosse"},
+		{"C++ / Go", "c-go"},
+		{"日本語", "category"},
+		{strings.Repeat("long ", 30), strings.TrimRight(strings.Repeat("long-", 12), "-")},
+	}
+	for _, tt := range tests {
+		got := slugify(tt.name)
+		if got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if !categorySlugPattern.MatchString(got) || len(got) > maxCategorySlugLength-4 {
+			t.Errorf("slugify(%q) = %q is not a valid slug with room for a number", tt.name, got)
+		}
+	}
+}
+
+func TestCreateCategory(t *testing.T) {
+	newTestDB(t)
+	str := func(s string) *string { return &s }
+	missingParent := 999
+
+	tests := []struct {
+		name string
+		in   CategoryInput
+		err  bool
+		slug string
+	}{
+		{"name only", categoryNamed(" News "), false, "news"},
+		{"same slug", CategoryInput{Name: str("News!")}, false, "news-2"},
+		{"same name", categoryNamed("News"), true, ""},
+		{"no name", categoryNamed("  "), true, ""},
+		{"long name", categoryNamed(strings.Repeat("n", maxCategoryNameLength+1)), true, ""},
+		{"own slug", CategoryInput{Name: str("Sport"), Slug: str("games")}, false, "games"},
+		{"slug taken", CategoryInput{Name: str("Games"), Slug: str("games")}, true, ""},
+		{"bad slug", CategoryInput{Name: str("Games"), Slug: str("Big Games")}, true, ""},
+		{"color", CategoryInput{Name: str("Red"), Color: str(" #FF0000 ")}, false, "red"},
+		{"bad color", CategoryInput{Name: str("Blue"), Color: str("blue")}, true, ""},
+		{"long icon", CategoryInput{Name: str("Icons"), Icon: str(strings.Repeat("*", maxCategoryIconLength+1))}, true, ""},
+		{"long description", CategoryInput{Name: str("Long"), Description: str(strings.Repeat("d", maxCategoryDescriptionLength+1))}, true, ""},
+		{"missing parent", CategoryInput{Name: str("Orphan"), ParentID: &missingParent}, true, ""},
+	}
+	for _, tt := range tests {
+		id, err := createCategory(tt.in)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		c, err := getCategory(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Slug != tt.slug {
+			t.Errorf("%s: slug %q, want %q", tt.name, c.Slug, tt.slug)
+		}
+	}
+	if red, err := findCategory("red"); err != nil || red.Color != "#ff0000" {
+		t.Errorf("red category %+v, %v", red, err)
+	}
+	if _, err := findCategory("nothing"); err != errNotFound {
+		t.Errorf("unknown slug: %v, want errNotFound", err)
+	}
+}
+
+func TestCategoryCycleCheck(t *testing.T) {
+	newTestDB(t)
+	create := func(name string, parentID int) int {
+		t.Helper()
+		in := categoryNamed(name)
+		in.ParentID = &parentID
+		id, err := createCategory(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	top := create("Top", 0)
+	middle := create("Middle", top)
+	bottom := create("Bottom", middle)
+	other := create("Other", 0)
+
+	tests := []struct {
+		name     string
+		id       int
+		parentID int
+		err      bool
+	}{
+		{"under itself", top, top, true},
+		{"under its child", top, middle, true},
+		{"under its grandchild", top, bottom, true},
+		{"under a missing category", middle, bottom + other, true},
+		{"under another tree", middle, other, false},
+		{"to the top", bottom, 0, false},
+		{"under its former grandchild, now elsewhere", top, bottom, false},
+	}
+	for _, tt := range tests {
+		err := updateCategory(tt.id, CategoryInput{ParentID: &tt.parentID})
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+
+	categories, err := listCategories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree []string
+	for _, c := range categories {
+		tree = append(tree, c.Indent()+c.Name)
+	}
+	if want := []string{"Bottom", "— Top", "Other", "— Middle"}; !reflect.DeepEqual(tree, want) {
+		t.Errorf("tree %q, want %q", tree, want)
+	}
+}
+
+func TestListCategoriesOrder(t *testing.T) {
+	newTestDB(t)
+	for _, c := range []struct {
+		name     string
+		position int
+	}{{"Zebra", 1}, {"Apple", 2}, {"Mango", 1}} {
+		in := categoryNamed(c.name)
+		in.Position = &c.position
+		if _, err := createCategory(in); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Categories added without a position go last
+	last, err := createCategory(categoryNamed("Last"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := 0
+	if err := updateCategory(last, CategoryInput{Position: &first}); err != nil {
+		t.Fatal(err)
+	}
+
+	categories, err := listCategories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range categories {
+		names = append(names, c.Name)
+	}
+	if want := []string{"Last", "Mango", "Zebra", "Apple"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("order %v, want %v", names, want)
+	}
+}
+
+func TestDeleteCategory(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	withThread, _ := createCategory(categoryNamed("With a thread"))
+	parent, _ := createCategory(categoryNamed("Parent"))
+	child := categoryNamed("Child")
+	child.ParentID = &parent
+	childID, _ := createCategory(child)
+	if _, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: []string{strconv.Itoa(withThread)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setCategoryWatch(alice, childID, watchAll); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		id   int
+		err  bool
+	}{
+		{"with a thread", withThread, true},
+		{"with a subcategory", parent, true},
+		{"watched", childID, false},
+		{"emptied", parent, false},
+	}
+	for _, tt := range tests {
+		err := deleteCategory(tt.id)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+	if err := deleteCategory(parent); err != errNotFound {
+		t.Errorf("deleting twice: %v, want errNotFound", err)
+	}
+	if categories, _ := listWatchedCategories(alice, false); len(categories) != 0 {
+		t.Errorf("watches of a deleted category: %+v", categories)
+	}
+}
+
+func TestCheckCategoryIDs(t *testing.T) {
+	newTestDB(t)
+	open, _ := createCategory(categoryNamed("Open"))
+	archived, _ := createCategory(categoryNamed("Archived"))
+	yes := true
+	if err := updateCategory(archived, CategoryInput{Archived: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	o, a := strconv.Itoa(open), strconv.Itoa(archived)
+
+	tests := []struct {
+		name    string
+		ids     []string
+		current []string
+		want    []string
+		err     bool
+	}{
+		{"none", nil, nil, []string{}, false},
+		{"repeated", []string{o, " " + o + " "}, nil, []string{o}, false},
+		{"not a number", []string{"news"}, nil, nil, true},
+		{"missing", []string{strconv.Itoa(archived + 1)}, nil, nil, true},
+		{"archived", []string{o, a}, nil, nil, true},
+		{"archived but already in it", []string{o, a}, []string{a}, []string{o, a}, false},
+	}
+	for _, tt := range tests {
+		got, err := checkCategoryIDs(db, tt.ids, tt.current)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAdminCategories(t *testing.T) {
+	newTestDB(t)
+	admin := createTestUser(t, "admin")
+	setTestRole(t, admin, roleAdmin)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	adminCookie, modCookie := login(t, "admin"), login(t, "mod")
+
+	tests := []struct {
+		form   url.Values
+		cookie *http.Cookie
+		status int
+	}{
+		{url.Values{"action": {"create"}, "name": {"News"}}, modCookie, http.StatusForbidden},
+		{url.Values{"action": {"create"}, "name": {"News"}, "color": {"#336699"}}, adminCookie, http.StatusSeeOther},
+		{url.Values{"action": {"create"}, "name": {"Sub"}, "parent_id": {"x"}}, adminCookie, http.StatusBadRequest},
+		{url.Values{"action": {"update"}, "id": {"1"}, "name": {"World news"}, "position": {"3"}}, adminCookie, http.StatusSeeOther},
+		{url.Values{"action": {"archive"}, "id": {"1"}}, adminCookie, http.StatusSeeOther},
+		{url.Values{"action": {"archive"}, "id": {"2"}}, adminCookie, http.StatusNotFound},
+		{url.Values{"action": {"rename"}, "id": {"1"}}, adminCookie, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := postForm(serveAdminCategories, "/admin/categories", tt.form, tt.cookie); w.Code != tt.status {
+			t.Errorf("%v: status %d, want %d: %s", tt.form, w.Code, tt.status, w.Body)
+		}
+	}
+	c, err := getCategory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The update form sends every field, so the color it left out is cleared
+	if c.Name != "World news" || c.Slug != "world-news" || c.Position != 3 || c.Color != "" || !c.Archived {
+		t.Errorf("category %+v", c)
+	}
+}
@@ -24,7 +24,7 @@ func messageHandler(db *sql.DB) http.HandlerFunc {
         case "GET":
             handleGetMessages(w, db, currentUser)
         case "POST":
-            handlePostMessage(w, r, db)
+            handlePostMessage(w, r, db, currentUser)
         default:
             http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
         }
@@ -50,6 +50,35 @@ func handleGetMessages(w http.ResponseWriter, db *sql.DB, currentUser string) {
         messages = append(messages, message)
     }
 
+    // Attach the reactions of each message
+    var userID int
+    if err := db.QueryRow("SELECT id FROM users WHERE username = ?", currentUser).Scan(&userID); err != nil && err != sql.ErrNoRows {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    ids := make([]int, len(messages))
+    for i, message := range messages {
+        ids[i] = message.ID
+    }
+    reactions, err := listItemReactions(messageReactions, ids, userID)
+    if err != nil {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    attachments, err := listAttachments("message", ids)
+    if err != nil {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for i := range messages {
+        messages[i].Reactions = unscoredReactions(reactions[messages[i].ID])
+        messages[i].Attachments = attachments[messages[i].ID]
+    }
+    if err := attachMentions(messages); err != nil {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+
     w.Header().Set("Content-Type", "application/json")
     if err := json.NewEncoder(w).Encode(messages); err != nil {
         http.Error(w, "JSON encoding error: "+err.Error(), http.StatusInternalServerError)
@@ -57,20 +86,61 @@ func handleGetMessages(w http.ResponseWriter, db *sql.DB, currentUser string) {
     }
 }
 
-func handlePostMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+func handlePostMessage(w http.ResponseWriter, r *http.Request, db *sql.DB, currentUser string) {
     var message Message
     if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
         http.Error(w, "JSON decode error: "+err.Error(), http.StatusBadRequest)
         return
     }
+    // The sender is whoever is logged in, whatever the body says, as only the
+    // sender and the recipient may see the attachments
+    message.Username = currentUser
     message.Time = time.Now()
 
-    _, err := db.Exec("INSERT INTO messages (Username, recipient, content, time) VALUES (?, ?, ?, ?)",
+    var senderID int
+    if err := db.QueryRow("SELECT id FROM users WHERE username = ?", currentUser).Scan(&senderID); err != nil {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    tx, err := db.Begin()
+    if err != nil {
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+    result, err := tx.Exec("INSERT INTO messages (Username, recipient, content, time) VALUES (?, ?, ?, ?)",
         message.Username, message.Recipient, message.Content, message.Time)
     if err != nil {
         http.Error(w, "Insert error: "+err.Error(), http.StatusInternalServerError)
         return
     }
+    id, err := result.LastInsertId()
+    if err != nil {
+        http.Error(w, "Insert error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    message.ID = int(id)
+    if err := linkAttachments(tx, senderID, message.AttachmentIDs, "message", message.ID); err != nil {
+        if _, ok := err.(fieldError); ok {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        http.Error(w, "Insert error: "+err.Error(), http.StatusInternalServerError)
+        return
+    }
+    notifyNewMessage(message)
+    message.AttachmentIDs = nil
+    if attachments, err := listAttachments("message", []int{message.ID}); err == nil {
+        message.Attachments = attachments[message.ID]
+    }
+    messages := []Message{message}
+    if err := attachMentions(messages); err == nil {
+        message = messages[0]
+    }
 
     w.WriteHeader(http.StatusCreated)
     if err := json.NewEncoder(w).Encode(message); err != nil {
@@ -78,3 +148,24 @@ func handlePostMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
         return
     }
 }
+
+// attachMentions fills in the users mentioned in each message, so the client
+// can link them without guessing which names exist.
+func attachMentions(messages []Message) error {
+    texts := make([]string, len(messages))
+    for i, message := range messages {
+        texts[i] = message.Content
+    }
+    users, err := resolveMentions(texts...)
+    if err != nil {
+        return err
+    }
+    for i := range messages {
+        for _, name := range parseMentions(messages[i].Content) {
+            if _, ok := users[name]; ok {
+                messages[i].Mentions = append(messages[i].Mentions, name)
+            }
+        }
+    }
+    return nil
+}
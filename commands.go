@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Maintenance commands run instead of the server when the binary is started
+// with a command name, e.g. "./forum reconcile-votes -dry-run".
+
+var commands = map[string]func(args []string) error{
+	"reconcile-votes":        reconcileVotesCommand,
+	"recalculate-reputation": recalculateReputationCommand,
+	"check-markdown":         checkMarkdownCommand,
+	"check-storage":          checkStorageCommand,
+	"archive-threads":        archiveThreadsCommand,
+}
+
+// runCommand runs the command named by args[0] and returns the exit code.
+func runCommand(args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(os.Stderr, "commands: "+strings.Join(names, ", "))
+		return 2
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// reconcile-votes: recompute the vote counters, report drift and fix it
+func reconcileVotesCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile-votes", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only report drift, do not fix it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	drifts, err := reconcileVoteCounts(db, !*dryRun)
+	if err != nil {
+		return err
+	}
+	for _, d := range drifts {
+		fmt.Printf("%s %d: likes %d -> %d, dislikes %d -> %d\n", d.Table, d.ID, d.Likes, d.ActualLikes, d.Dislikes, d.ActualDislikes)
+	}
+	switch {
+	case len(drifts) == 0:
+		fmt.Println("All vote counters are consistent.")
+	case *dryRun:
+		fmt.Printf("%d counters drifted, run without -dry-run to fix them.\n", len(drifts))
+	default:
+		fmt.Printf("Fixed %d drifted counters.\n", len(drifts))
+	}
+	return nil
+}
+
+// recalculate-reputation: recompute every user's reputation from the current votes and weights
+func recalculateReputationCommand(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+	changes, err := recalculateReputation(db)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		fmt.Printf("%s: %d -> %d\n", c.Username, c.Stored, c.Actual)
+	}
+	fmt.Printf("Updated the reputation of %d users.\n", len(changes))
+	return nil
+}
+
+// archive-threads: archive the threads without new comments for -days days
+func archiveThreadsCommand(args []string) error {
+	flags := flag.NewFlagSet("archive-threads", flag.ContinueOnError)
+	days := flags.Int("days", 365, "archive threads inactive for this many days")
+	dryRun := flags.Bool("dry-run", false, "only count the threads, do not archive them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *days < 1 {
+		return fmt.Errorf("-days must be at least 1")
+	}
+
+	ids, err := archiveInactiveThreads(db, time.Now().AddDate(0, 0, -*days), *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%d threads would be archived, run without -dry-run to archive them.\n", len(ids))
+	} else {
+		fmt.Printf("Archived %d threads.\n", len(ids))
+	}
+	return nil
+}
+
+// check-storage: store, read back and delete a blob in the configured attachment store
+func checkStorageCommand(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %v", args)
+	}
+	data := []byte(fmt.Sprintf("forum storage check %d\n", time.Now().UnixNano()))
+	key := blobKey(data)
+	fmt.Printf("Using %T\n", blobs)
+
+	if err := blobs.Put(key, "text/plain", data); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	blob, err := blobs.Open(key)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	stored, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("read back %q instead of %q", stored, data)
+	}
+	if err := blobs.Delete(key); err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if _, err := blobs.Open(key); err != errNotFound {
+		return fmt.Errorf("open after delete: want errNotFound, got %v", err)
+	}
+	fmt.Println("The attachment store works.")
+	return nil
+}
+
+// check-markdown: render the XSS corpus and report any unsafe markup that survives sanitizing
+func checkMarkdownCommand(args []string) error {
+	flags := flag.NewFlagSet("check-markdown", flag.ContinueOnError)
+	corpus := flags.String("corpus", "testdata/markdown_xss.txt", "file of markdown cases separated by ---- lines")
+	verbose := flags.Bool("v", false, "print the HTML of every case")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cases, err := readMarkdownCases(*corpus)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, source := range cases {
+		rendered, problems, err := checkMarkdownCase(source)
+		if err != nil {
+			return fmt.Errorf("case %d: %w", i+1, err)
+		}
+		if *verbose || len(problems) > 0 {
+			fmt.Printf("case %d: %q\n  -> %s\n", i+1, source, rendered)
+		}
+		for _, p := range problems {
+			fmt.Printf("  unsafe: %s\n", p)
+		}
+		if len(problems) > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d cases rendered unsafe markup", failed, len(cases))
+	}
+	fmt.Printf("All %d cases rendered safely.\n", len(cases))
+	return nil
+}
+
+// readMarkdownCases reads a file of markdown cases separated by ---- lines,
+// leaving out the comment lines starting with ;;.
+func readMarkdownCases(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, ";;") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Split(strings.Join(lines, "\n"), "\n----\n"), nil
+}
+
+// checkMarkdownCase renders source as a post and returns the HTML with the
+// unsafe markup found in it. Mentions of alice are linked so the mention
+// links are checked too.
+func checkMarkdownCase(source string) (template.HTML, []string, error) {
+	rendered, err := renderPost(source, map[string]int{"alice": 1})
+	if err != nil {
+		return "", nil, err
+	}
+	problems, err := unsafeMarkup(string(rendered))
+	return rendered, problems, err
+}
+
+// unsafeElements must never come out of the markdown renderer.
+var unsafeElements = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "object": true, "embed": true,
+	"form": true, "button": true, "textarea": true, "select": true, "meta": true, "base": true,
+	"link": true, "svg": true, "math": true, "noscript": true, "template": true,
+}
+
+// unsafeMarkup lists the elements and attributes of fragment that could run
+// script or change the page around it.
+func unsafeMarkup(fragment string) ([]string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(fragment), &html.Node{Type: html.ElementNode, Data: "div", DataAtom: atom.Div})
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if unsafeElements[n.Data] {
+				problems = append(problems, "<"+n.Data+">")
+			}
+			for _, a := range n.Attr {
+				key := strings.ToLower(a.Key)
+				switch {
+				case strings.HasPrefix(key, "on"), key == "style", key == "srcdoc", key == "formaction":
+					problems = append(problems, fmt.Sprintf("%s %s=%q", n.Data, a.Key, a.Val))
+				case key == "href" || key == "src":
+					if !safeURL(a.Val) {
+						problems = append(problems, fmt.Sprintf("%s %s=%q", n.Data, a.Key, a.Val))
+					}
+				case n.Data == "input" && key == "type" && a.Val != "checkbox":
+					problems = append(problems, fmt.Sprintf("input type=%q", a.Val))
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	for _, n := range nodes {
+		walk(n)
+	}
+	return problems, nil
+}
+
+// safeURL reports whether a link is relative or uses http, https or mailto.
+func safeURL(raw string) bool {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CommentRevision is one saved version of a comment.
+type CommentRevision struct {
+	ID         int       `json:"id"`
+	CommentID  int       `json:"comment_id"`
+	EditorID   int       `json:"editor_id"`
+	EditorName string    `json:"editor"`
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// checkCommentChange reports whether userID may edit or delete a comment.
+// Authors may change their own comments unless the thread is archived,
+// moderators may change any.
+func checkCommentChange(comment Comment, userID int) error {
+	if comment.Deleted {
+		return errNotFound
+	}
+	role, err := getUserRole(userID)
+	if err != nil {
+		return err
+	}
+	if isModerator(role) {
+		return nil
+	}
+	if comment.UserID != userID {
+		return errForbidden
+	}
+	return checkNotArchived(db, comment.ThreadID)
+}
+
+// insertCommentRevision snapshots the current content of a comment.
+func insertCommentRevision(tx *sql.Tx, commentID, editorID int) error {
+	_, err := tx.Exec(`
+        INSERT INTO comment_revisions (comment_id, editor_id, content, created_at)
+        SELECT id, ?, content, ? FROM comments WHERE id = ?`, editorID, time.Now(), commentID)
+	return err
+}
+
+// editComment saves new content for a comment and records it as a revision.
+func editComment(comment Comment, editorID int, content string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Comments created before revisions existed get their original version saved first
+	var revisions int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM comment_revisions WHERE comment_id = ?", comment.ID).Scan(&revisions); err != nil {
+		return err
+	}
+	if revisions == 0 {
+		if err := insertCommentRevision(tx, comment.ID, comment.UserID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE comments SET content = ?, edited_at = ? WHERE id = ?", content, time.Now(), comment.ID); err != nil {
+		return err
+	}
+	if err := insertCommentRevision(tx, comment.ID, editorID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notifyModerator(editorID, comment.UserID, comment.ThreadID, comment.ID, "edited your comment")
+	notifyMentions(editorID, comment.Content, content, comment.ThreadID, comment.ID)
+	return nil
+}
+
+// softDeleteComment hides the content of a comment but keeps its place in the thread.
+func softDeleteComment(commentID int) error {
+	result, err := db.Exec("UPDATE comments SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL", time.Now(), commentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	// Notifications about the comment stay but no longer quote it
+	_, err = db.Exec("UPDATE notifications SET text = '' WHERE comment_id = ? AND type != ?", commentID, notifyModeration)
+	return err
+}
+
+// hardDeleteComment removes a comment with its votes, revisions and
+// attachments. Its author loses the reputation the votes earned.
+func hardDeleteComment(commentID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keys, err := attachmentKeys(tx, "comment_id = ?", commentID)
+	if err != nil {
+		return err
+	}
+	if err := takeBackVoteReputation(tx, commentVotes, "ir.item_id = ?", commentID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM item_reactions WHERE item_type = 'comment' AND item_id = ?",
+		"DELETE FROM comment_revisions WHERE comment_id = ?",
+		"DELETE FROM notifications WHERE comment_id = ?",
+		"DELETE FROM attachments WHERE comment_id = ?",
+	} {
+		if _, err := tx.Exec(stmt, commentID); err != nil {
+			return err
+		}
+	}
+	// Replies move up to the parent of the removed comment
+	if _, err := tx.Exec("UPDATE comments SET parent_id = (SELECT parent_id FROM comments WHERE id = ?) WHERE parent_id = ?", commentID, commentID); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM comments WHERE id = ?", commentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	releaseBlobs(keys...)
+	return nil
+}
+
+// listCommentRevisions returns the revisions of a comment, oldest first.
+func listCommentRevisions(commentID int) ([]CommentRevision, error) {
+	rows, err := db.Query(`
+        SELECT r.id, r.comment_id, r.editor_id, u.username, r.content, r.created_at
+        FROM comment_revisions r
+        JOIN users u ON u.id = r.editor_id
+        WHERE r.comment_id = ?
+        ORDER BY r.id`, commentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []CommentRevision{}
+	for rows.Next() {
+		var rev CommentRevision
+		if err := rows.Scan(&rev.ID, &rev.CommentID, &rev.EditorID, &rev.EditorName, &rev.Content, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// loadCommentForChange reads the comment id from the form and checks that the
+// logged in user may change it. It writes the error response itself.
+func loadCommentForChange(w http.ResponseWriter, r *http.Request) (Comment, int, bool) {
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return Comment{}, 0, false
+	}
+
+	commentID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Comment ID is required", http.StatusBadRequest)
+		return Comment{}, 0, false
+	}
+	comment, err := getComment(commentID)
+	if err == nil {
+		err = checkCommentChange(comment, userID)
+	}
+	switch err {
+	case nil:
+		return comment, userID, true
+	case errNotFound:
+		http.Error(w, "Comment not found", http.StatusNotFound)
+	case errForbidden:
+		http.Error(w, "You cannot change this comment", http.StatusForbidden)
+	case errThreadArchived:
+		http.Error(w, closedThreadMessage(err), http.StatusForbidden)
+	default:
+		log.Printf("Failed to load comment: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+	}
+	return Comment{}, 0, false
+}
+
+// /comment/edit: form to edit a comment and the handler saving it
+func serveEditComment(w http.ResponseWriter, r *http.Request) {
+	comment, userID, ok := loadCommentForChange(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		content := strings.TrimSpace(r.FormValue("comment"))
+		if content == "" {
+			http.Error(w, "Comment cannot be empty", http.StatusBadRequest)
+			return
+		}
+		if err := editComment(comment, userID, content); err != nil {
+			log.Printf("Failed to edit comment: %v", err)
+			http.Error(w, "Failed to edit comment", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/thread?id="+strconv.Itoa(comment.ThreadID), http.StatusSeeOther)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/edit_comment.html"))
+	tmpl.Execute(w, comment)
+}
+
+// /comment/delete: soft delete, or hard delete for moderators with hard=1
+func serveDeleteComment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	comment, userID, ok := loadCommentForChange(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	if r.FormValue("hard") == "1" {
+		role, roleErr := getUserRole(userID)
+		if roleErr != nil || !isModerator(role) {
+			http.Error(w, "Only moderators can permanently delete comments", http.StatusForbidden)
+			return
+		}
+		err = hardDeleteComment(comment.ID)
+	} else {
+		err = softDeleteComment(comment.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to delete comment: %v", err)
+		http.Error(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	notifyCommentDeleted(comment, userID, r.FormValue("hard") == "1")
+	http.Redirect(w, r, "/thread?id="+strconv.Itoa(comment.ThreadID), http.StatusSeeOther)
+}
+
+// /comment/revisions: edit history of a comment, moderators only
+func serveCommentRevisions(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || !isModerator(role) {
+		http.Error(w, "Only moderators can view comment history", http.StatusForbidden)
+		return
+	}
+
+	commentID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Comment ID is required", http.StatusBadRequest)
+		return
+	}
+	comment, err := getComment(commentID)
+	if err == errNotFound {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch comment", http.StatusInternalServerError)
+		return
+	}
+	revisions, err := listCommentRevisions(commentID)
+	if err != nil {
+		log.Printf("Failed to fetch comment revisions: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	// Show each revision as a diff against the one before it
+	type revisionView struct {
+		CommentRevision
+		Diff []diffOp
+	}
+	views := make([]revisionView, len(revisions))
+	previous := ""
+	for i, rev := range revisions {
+		views[i] = revisionView{CommentRevision: rev, Diff: diffWords(previous, rev.Content)}
+		previous = rev.Content
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/comment_revisions.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Comment":   comment,
+		"Revisions": views,
+	})
+}
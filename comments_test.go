@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCheckCommentChange(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	other := createTestUser(t, "bob")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment, err := getComment(int(commentID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := comment
+	deleted.Deleted = true
+
+	tests := []struct {
+		name     string
+		comment  Comment
+		userID   int
+		archived bool
+		want     error
+	}{
+		{"author", comment, author, false, nil},
+		{"other user", comment, other, false, errForbidden},
+		{"moderator", comment, moderator, false, nil},
+		{"deleted", deleted, author, false, errNotFound},
+		{"deleted by moderator", deleted, moderator, false, errNotFound},
+		{"author of archived thread", comment, author, true, errThreadArchived},
+		{"moderator of archived thread", comment, moderator, true, nil},
+	}
+	for _, tt := range tests {
+		var archivedAt interface{}
+		if tt.archived {
+			archivedAt = time.Now()
+		}
+		if _, err := db.Exec("UPDATE threads SET archived_at = ? WHERE id = ?", archivedAt, threadID); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkCommentChange(tt.comment, tt.userID); err != tt.want {
+			t.Errorf("%s: checkCommentChange = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEditCommentKeepsRevisions(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "First", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A comment from before revisions existed has no history of its own
+	result, err := db.Exec("INSERT INTO comments (content, user_id, thread_id) VALUES (?, ?, ?)", "Old", author, threadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, _ := result.LastInsertId()
+
+	tests := []struct {
+		commentID int
+		editorID  int
+		content   string
+		want      []string // contents of the revisions after the edit
+		editors   []int
+	}{
+		{int(commentID), author, "Second", []string{"First", "Second"}, []int{author, author}},
+		{int(commentID), moderator, "Third", []string{"First", "Second", "Third"}, []int{author, author, moderator}},
+		{int(oldID), moderator, "New", []string{"Old", "New"}, []int{author, moderator}},
+	}
+	for _, tt := range tests {
+		comment, err := getComment(tt.commentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := editComment(comment, tt.editorID, tt.content); err != nil {
+			t.Fatalf("editComment(%d, %q): %v", tt.commentID, tt.content, err)
+		}
+		edited, err := getComment(tt.commentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edited.Content != tt.content || edited.EditedAt == nil {
+			t.Errorf("comment %d after edit: content %q, edited at %v", tt.commentID, edited.Content, edited.EditedAt)
+		}
+		revisions, err := listCommentRevisions(tt.commentID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revisions) != len(tt.want) {
+			t.Fatalf("comment %d: %d revisions, want %d", tt.commentID, len(revisions), len(tt.want))
+		}
+		for i, rev := range revisions {
+			if rev.Content != tt.want[i] || rev.EditorID != tt.editors[i] {
+				t.Errorf("comment %d revision %d: %q by %d, want %q by %d", tt.commentID, i, rev.Content, rev.EditorID, tt.want[i], tt.editors[i])
+			}
+		}
+	}
+}
+
+func TestDeleteComment(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newComment := func(parentID int) int {
+		t.Helper()
+		id, err := createComment(author, int(threadID), parentID, "A comment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	soft := newComment(0)
+	softReply := newComment(soft)
+	hard := newComment(soft)
+	hardReply := newComment(hard)
+	forbidden := newComment(0)
+
+	tests := []struct {
+		name      string
+		user      string
+		commentID int
+		hard      bool
+		status    int
+	}{
+		{"other user", "bob", forbidden, false, http.StatusForbidden},
+		{"hard delete by author", "alice", forbidden, true, http.StatusForbidden},
+		{"soft delete by author", "alice", soft, false, http.StatusSeeOther},
+		{"soft delete again", "alice", soft, false, http.StatusNotFound},
+		{"hard delete by moderator", "mod", hard, true, http.StatusSeeOther},
+		{"missing comment", "mod", hard, true, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		form := url.Values{"id": {fmt.Sprint(tt.commentID)}}
+		if tt.hard {
+			form.Set("hard", "1")
+		}
+		w := postForm(serveDeleteComment, "/comment/delete", form, login(t, tt.user))
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	// A soft deleted comment keeps its place and its replies
+	comment, err := getComment(soft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comment.Deleted || comment.Content != "[deleted]" {
+		t.Errorf("soft deleted comment: deleted %v, content %q", comment.Deleted, comment.Content)
+	}
+	if _, parent := threadOfComment(t, softReply); parent != soft {
+		t.Errorf("reply of the soft deleted comment has parent %d, want %d", parent, soft)
+	}
+
+	// A hard deleted comment is gone and its replies move up to its parent
+	if _, err := getComment(hard); err != errNotFound {
+		t.Errorf("hard deleted comment: %v, want errNotFound", err)
+	}
+	if _, parent := threadOfComment(t, hardReply); parent != soft {
+		t.Errorf("reply of the hard deleted comment has parent %d, want %d", parent, soft)
+	}
+	var revisions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM comment_revisions WHERE comment_id = ?", hard).Scan(&revisions); err != nil {
+		t.Fatal(err)
+	}
+	if revisions != 0 {
+		t.Errorf("%d revisions left of the hard deleted comment", revisions)
+	}
+}
+
+func TestCommentRevisionsAreForModerators(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user   string
+		id     string
+		status int
+	}{
+		{"", fmt.Sprint(commentID), http.StatusForbidden},
+		{"alice", fmt.Sprint(commentID), http.StatusForbidden},
+		{"mod", fmt.Sprint(commentID), http.StatusOK},
+		{"mod", "x", http.StatusBadRequest},
+		{"mod", fmt.Sprint(commentID + 1), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/comment/revisions?id="+tt.id, nil)
+		if tt.user != "" {
+			r.AddCookie(login(t, tt.user))
+		}
+		w := httptest.NewRecorder()
+		serveCommentRevisions(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%q viewing revisions of %s: status %d, want %d", tt.user, tt.id, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Shared data access for the HTML handlers and the JSON API.
+
+var (
+	errNotFound        = errors.New("not found")
+	errInvalidLikeType = errors.New("invalid like type")
+	errForbidden       = errors.New("forbidden")
+)
+
+// getThread loads a single thread together with its author, categories, tags and states.
+func getThread(threadID int) (Thread, error) {
+	var thread Thread
+	var createdAt, editedAt, pinnedAt, lockedAt, archivedAt sql.NullTime
+	err := db.QueryRow(`
+        SELECT t.id, t.title, t.description, t.likes, t.dislikes, t.user_id, u.username, t.created_at, t.edited_at,
+            t.pinned_at, t.locked_at, t.archived_at
+        FROM threads t
+        JOIN users u ON t.user_id = u.id
+        WHERE t.id = ?`, threadID).Scan(&thread.ID, &thread.Title, &thread.Description, &thread.Likes, &thread.Dislikes, &thread.UserID, &thread.Username, &createdAt, &editedAt,
+		&pinnedAt, &lockedAt, &archivedAt)
+	if err == sql.ErrNoRows {
+		return thread, errNotFound
+	}
+	if err != nil {
+		return thread, err
+	}
+	if createdAt.Valid {
+		thread.CreatedAt = &createdAt.Time
+	}
+	if editedAt.Valid {
+		thread.EditedAt = &editedAt.Time
+	}
+	setThreadStates(&thread, pinnedAt, lockedAt, archivedAt)
+
+	thread.Categories, err = listThreadCategories(threadID)
+	if err != nil {
+		return thread, err
+	}
+	if thread.PinnedIn, err = listPinnedCategories(threadID); err != nil {
+		return thread, err
+	}
+	threads := []Thread{thread}
+	if err := loadThreadTags(threads); err != nil {
+		return thread, err
+	}
+	return threads[0], nil
+}
+
+// listThreadCategories returns the category names assigned to a thread.
+func listThreadCategories(threadID int) ([]string, error) {
+	rows, err := db.Query("SELECT c.name FROM categories c JOIN thread_categories tc ON c.id = tc.category_id WHERE tc.thread_id = ?", threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		categories = append(categories, name)
+	}
+	return categories, rows.Err()
+}
+
+// listThreadCategoryIDs returns the ids of the categories assigned to a thread.
+func listThreadCategoryIDs(q queryer, threadID int) ([]string, error) {
+	rows, err := q.Query("SELECT category_id FROM thread_categories WHERE thread_id = ?", threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ThreadInput is a thread as it is asked for when creating one.
+type ThreadInput struct {
+	Title         string
+	Description   string
+	CategoryIDs   []string
+	Tags          []string
+	AttachmentIDs []int      // uploads to attach
+	Poll          *PollInput // nil for a thread without a poll
+}
+
+// createThread inserts a thread with its category associations, tags,
+// attachments and poll in one transaction. A poll needs the create_poll privilege.
+func createThread(userID int, in ThreadInput) (int64, error) {
+	if in.Poll != nil {
+		if err := in.Poll.normalize(time.Now()); err != nil {
+			return 0, err
+		}
+		allowed, err := hasPrivilege(db, userID, privilegeCreatePoll)
+		if err != nil {
+			return 0, err
+		}
+		if !allowed {
+			return 0, errForbidden
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO threads (title, description, user_id, created_at) VALUES (?, ?, ?, ?)", in.Title, in.Description, userID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	threadID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	categoryIDs, err := checkCategoryIDs(tx, in.CategoryIDs, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, catID := range categoryIDs {
+		if _, err := tx.Exec("INSERT INTO thread_categories (thread_id, category_id) VALUES (?, ?)", threadID, catID); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := setThreadTags(tx, userID, int(threadID), in.Tags); err != nil {
+		return 0, err
+	}
+	if err := linkAttachments(tx, userID, in.AttachmentIDs, "thread", int(threadID)); err != nil {
+		return 0, err
+	}
+	if in.Poll != nil {
+		if err := createPoll(tx, int(threadID), *in.Poll); err != nil {
+			return 0, err
+		}
+	}
+
+	// The first revision is the thread as it was created
+	if err := insertThreadRevision(tx, int(threadID), userID); err != nil {
+		return 0, err
+	}
+	if err := autoWatchThread(tx, userID, int(threadID)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	notifyMentions(userID, "", in.Description, int(threadID), 0)
+	notifyCategoryWatchers(userID, int(threadID), in.Description)
+	return threadID, nil
+}
+
+// deleteThread removes a thread with its comments, votes, category and tag links, attachments and poll.
+// The authors lose the reputation the votes earned.
+func deleteThread(threadID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keys, err := attachmentKeys(tx, "thread_id = ?1 OR comment_id IN (SELECT id FROM comments WHERE thread_id = ?1)", threadID)
+	if err != nil {
+		return err
+	}
+	if err := takeBackVoteReputation(tx, commentVotes, "t.thread_id = ?", threadID); err != nil {
+		return err
+	}
+	if err := takeBackVoteReputation(tx, threadVotes, "ir.item_id = ?", threadID); err != nil {
+		return err
+	}
+	statements := []string{
+		"DELETE FROM attachments WHERE thread_id = ?1 OR comment_id IN (SELECT id FROM comments WHERE thread_id = ?1)",
+		"DELETE FROM item_reactions WHERE item_type = 'comment' AND item_id IN (SELECT id FROM comments WHERE thread_id = ?)",
+		"DELETE FROM comment_revisions WHERE comment_id IN (SELECT id FROM comments WHERE thread_id = ?)",
+		"DELETE FROM comments WHERE thread_id = ?",
+		"DELETE FROM item_reactions WHERE item_type = 'thread' AND item_id = ?",
+		"DELETE FROM thread_categories WHERE thread_id = ?",
+		"DELETE FROM thread_tags WHERE thread_id = ?",
+		"DELETE FROM thread_revisions WHERE thread_id = ?",
+		"DELETE FROM notifications WHERE thread_id = ?",
+		"DELETE FROM thread_watches WHERE thread_id = ?",
+		"DELETE FROM thread_reads WHERE thread_id = ?",
+		"DELETE FROM poll_votes WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = ?)",
+		"DELETE FROM poll_options WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = ?)",
+		"DELETE FROM polls WHERE thread_id = ?",
+		"DELETE FROM thread_redirects WHERE thread_id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, threadID); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM threads WHERE id = ?", threadID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	releaseBlobs(keys...)
+	return nil
+}
+
+// commentSelect selects comments with their author and vote counts. The
+// content of soft deleted comments is replaced with a placeholder.
+const commentSelect = `
+    SELECT c.id, CASE WHEN c.deleted_at IS NULL THEN c.content ELSE '[deleted]' END, c.user_id, u.username, c.thread_id,
+        COALESCE(c.likes, 0), COALESCE(c.dislikes, 0),
+        c.created_at, c.edited_at, c.deleted_at IS NOT NULL, c.parent_id
+    FROM comments c
+    JOIN users u ON u.id = c.user_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanComment(row scanner) (Comment, error) {
+	var comment Comment
+	var createdAt, editedAt sql.NullTime
+	var parentID sql.NullInt64
+	err := row.Scan(&comment.ID, &comment.Content, &comment.UserID, &comment.Username, &comment.ThreadID, &comment.Likes, &comment.Dislikes, &createdAt, &editedAt, &comment.Deleted, &parentID)
+	if err != nil {
+		return comment, err
+	}
+	if createdAt.Valid {
+		comment.CreatedAt = &createdAt.Time
+	}
+	if editedAt.Valid {
+		comment.EditedAt = &editedAt.Time
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		comment.ParentID = &id
+	}
+	return comment, nil
+}
+
+// queryComments runs a commentSelect based query.
+func queryComments(query string, args ...interface{}) ([]Comment, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+// getComment loads a single comment with its author and vote counts.
+func getComment(commentID int) (Comment, error) {
+	comment, err := scanComment(db.QueryRow(commentSelect+" WHERE c.id = ?", commentID))
+	if err == sql.ErrNoRows {
+		return comment, errNotFound
+	}
+	return comment, err
+}
+
+// createComment adds a comment with its attachments to an existing thread. A
+// non zero parentID makes it a reply to that comment. Locked and archived
+// threads only take comments of moderators.
+func createComment(userID, threadID, parentID int, content string, attachmentIDs []int) (int64, error) {
+	if err := checkCanComment(threadID, userID); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var parent interface{}
+	if parentID != 0 {
+		parentID, err = replyParent(tx, threadID, parentID)
+		if err != nil {
+			return 0, err
+		}
+		if parentID != 0 {
+			parent = parentID
+		}
+	}
+
+	result, err := tx.Exec("INSERT INTO comments (content, user_id, thread_id, parent_id, created_at) VALUES (?, ?, ?, ?, ?)", content, userID, threadID, parent, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := linkAttachments(tx, userID, attachmentIDs, "comment", int(commentID)); err != nil {
+		return 0, err
+	}
+	if err := insertCommentRevision(tx, int(commentID), userID); err != nil {
+		return 0, err
+	}
+	if err := autoWatchThread(tx, userID, threadID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Notify GraphQL subscribers, the author being replied to, mentioned users
+	// and then the watchers of the thread who have not heard of it yet
+	if comment, err := getComment(int(commentID)); err == nil {
+		commentEvents.publish(comment)
+		notifyNewComment(comment)
+		notifyMentions(userID, "", content, threadID, comment.ID)
+		notifyWatchers(comment)
+	}
+	return commentID, nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Users get some notifications by email right away and can subscribe to a
+// daily or weekly digest. Every email links to a signed unsubscribe URL that
+// works without logging in.
+
+// emailNotificationDefaults are the notification types that can be sent by
+// email, with whether they are on for users who did not choose.
+var emailNotificationDefaults = map[string]bool{
+	notifyMessage:  true,
+	notifyMention:  true,
+	notifyWatching: false,
+}
+
+// Digest frequencies stored in users.digest. The empty string means no digest.
+const (
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+var digestPeriods = map[string]time.Duration{
+	digestDaily:  24 * time.Hour,
+	digestWeekly: 7 * 24 * time.Hour,
+}
+
+// Unsubscribe scopes besides the email notification types.
+const (
+	unsubscribeDigest = "digest"
+	unsubscribeAll    = "all"
+)
+
+var errInvalidUnsubscribe = errors.New("invalid unsubscribe token")
+
+// emailPreferences returns which notification types a user gets by email, by type.
+func emailPreferences(userID int) (map[string]bool, error) {
+	prefs := map[string]bool{}
+	for kind, on := range emailNotificationDefaults {
+		prefs[kind] = on
+	}
+	rows, err := db.Query("SELECT type, email FROM notification_preferences WHERE user_id = ? AND email IS NOT NULL", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var on bool
+		if err := rows.Scan(&kind, &on); err != nil {
+			return nil, err
+		}
+		if _, known := prefs[kind]; known {
+			prefs[kind] = on
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// setEmailPreferences saves the given types and keeps the others.
+func setEmailPreferences(userID int, prefs map[string]bool) error {
+	for kind := range prefs {
+		if _, known := emailNotificationDefaults[kind]; !known {
+			return fieldError("Notification type " + kind + " cannot be sent by email")
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for kind, on := range prefs {
+		if _, err := tx.Exec(`
+            INSERT INTO notification_preferences (user_id, type, email) VALUES (?, ?, ?)
+            ON CONFLICT (user_id, type) DO UPDATE SET email = excluded.email`, userID, kind, on); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// getDigest returns the digest frequency of a user.
+func getDigest(userID int) (string, error) {
+	var digest string
+	err := db.QueryRow("SELECT digest FROM users WHERE id = ?", userID).Scan(&digest)
+	return digest, err
+}
+
+// setDigest changes the digest frequency of a user. The first digest after a
+// change covers one full period from now.
+func setDigest(userID int, digest string) error {
+	if _, ok := digestPeriods[digest]; !ok && digest != "" {
+		return fieldError("Digest must be daily, weekly or off")
+	}
+	_, err := db.Exec(`
+        UPDATE users SET digest_sent_at = CASE WHEN digest = ?1 THEN digest_sent_at ELSE ?2 END, digest = ?1
+        WHERE id = ?3`, digest, time.Now(), userID)
+	return err
+}
+
+// mailSecret returns the key signing unsubscribe links. It can be set with
+// UNSUBSCRIBE_SECRET; otherwise one is generated and kept in app_secrets.
+func mailSecret() ([]byte, error) {
+	if secret := os.Getenv("UNSUBSCRIBE_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	generated := make([]byte, 32)
+	if _, err := rand.Read(generated); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO app_secrets (name, value) VALUES ('unsubscribe', ?)", generated); err != nil {
+		return nil, err
+	}
+	var secret []byte
+	err := db.QueryRow("SELECT value FROM app_secrets WHERE name = 'unsubscribe'").Scan(&secret)
+	return secret, err
+}
+
+// unsubscribeToken signs the user id and scope of an unsubscribe link.
+func unsubscribeToken(userID int, scope string) (string, error) {
+	secret, err := mailSecret()
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.Itoa(userID) + ":" + scope
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseUnsubscribeToken checks the signature of a token and returns what it unsubscribes.
+func parseUnsubscribeToken(token string) (int, string, error) {
+	encodedPayload, encodedSum, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", errInvalidUnsubscribe
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, "", errInvalidUnsubscribe
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encodedSum)
+	if err != nil {
+		return 0, "", errInvalidUnsubscribe
+	}
+	secret, err := mailSecret()
+	if err != nil {
+		return 0, "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return 0, "", errInvalidUnsubscribe
+	}
+
+	id, scope, _ := strings.Cut(string(payload), ":")
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, "", errInvalidUnsubscribe
+	}
+	return userID, scope, nil
+}
+
+// unsubscribeURL returns the absolute unsubscribe link for a user and scope.
+func unsubscribeURL(userID int, scope string) (string, error) {
+	token, err := unsubscribeToken(userID, scope)
+	if err != nil {
+		return "", err
+	}
+	return siteURL() + "/unsubscribe?token=" + url.QueryEscape(token), nil
+}
+
+// applyUnsubscribe turns off the emails of a scope.
+func applyUnsubscribe(userID int, scope string) error {
+	switch {
+	case scope == unsubscribeDigest:
+		return setDigest(userID, "")
+	case scope == unsubscribeAll:
+		prefs := map[string]bool{}
+		for kind := range emailNotificationDefaults {
+			prefs[kind] = false
+		}
+		if err := setEmailPreferences(userID, prefs); err != nil {
+			return err
+		}
+		return setDigest(userID, "")
+	}
+	if _, ok := emailNotificationDefaults[scope]; !ok {
+		return errInvalidUnsubscribe
+	}
+	return setEmailPreferences(userID, map[string]bool{scope: false})
+}
+
+// unsubscribeLabel describes a scope for the unsubscribe page.
+func unsubscribeLabel(scope string) string {
+	switch scope {
+	case unsubscribeDigest:
+		return "digest emails"
+	case unsubscribeAll:
+		return "all emails"
+	}
+	for _, t := range notificationTypes {
+		if t.Type == scope {
+			return "emails about " + strings.ToLower(t.Label)
+		}
+	}
+	return scope
+}
+
+// renderEmail executes templates/email/{name}.txt and {name}.html with data.
+func renderEmail(name string, data interface{}) (string, string, error) {
+	textTmpl, err := texttemplate.ParseFiles("templates/email/" + name + ".txt")
+	if err != nil {
+		return "", "", err
+	}
+	htmlTmpl, err := htmltemplate.ParseFiles("templates/email/" + name + ".html")
+	if err != nil {
+		return "", "", err
+	}
+	var text, html bytes.Buffer
+	if err := textTmpl.Execute(&text, data); err != nil {
+		return "", "", err
+	}
+	if err := htmlTmpl.Execute(&html, data); err != nil {
+		return "", "", err
+	}
+	return text.String(), html.String(), nil
+}
+
+// emailRecipient is who an email goes to.
+type emailRecipient struct {
+	ID       int
+	Username string
+	Email    string
+}
+
+func getEmailRecipient(userID int) (emailRecipient, error) {
+	u := emailRecipient{ID: userID}
+	err := db.QueryRow("SELECT username, email FROM users WHERE id = ?", userID).Scan(&u.Username, &u.Email)
+	return u, err
+}
+
+// queueNotificationEmail emails a notification when its type goes out by
+// email and the user did not turn that off.
+func queueNotificationEmail(n Notification) error {
+	if mailer == nil {
+		return nil
+	}
+	if _, ok := emailNotificationDefaults[n.Type]; !ok {
+		return nil
+	}
+	prefs, err := emailPreferences(n.userID)
+	if err != nil || !prefs[n.Type] {
+		return err
+	}
+	to, err := getEmailRecipient(n.userID)
+	if err != nil {
+		return err
+	}
+	unsubscribe, err := unsubscribeURL(n.userID, n.Type)
+	if err != nil {
+		return err
+	}
+	unsubscribeAllURL, err := unsubscribeURL(n.userID, unsubscribeAll)
+	if err != nil {
+		return err
+	}
+
+	text, html, err := renderEmail("notification", map[string]interface{}{
+		"Username":          to.Username,
+		"Summary":           n.Summary(),
+		"Text":              n.Text,
+		"URL":               siteURL() + n.URL(),
+		"SettingsURL":       siteURL() + "/settings/notifications",
+		"UnsubscribeURL":    unsubscribe,
+		"UnsubscribeLabel":  unsubscribeLabel(n.Type),
+		"UnsubscribeAllURL": unsubscribeAllURL,
+	})
+	if err != nil {
+		return err
+	}
+	return queueMail(outgoingMail{
+		To:             to.Email,
+		Subject:        n.Summary(),
+		Text:           text,
+		HTML:           html,
+		UnsubscribeURL: unsubscribe,
+	})
+}
+
+// digestThread is a thread listed in a digest.
+type digestThread struct {
+	Title    string
+	Author   string
+	Comments int // new comments for watched threads, all comments for top threads
+	Likes    int
+	URL      string
+}
+
+// digestActivityQuery selects the threads a user watches at the all level
+// that got comments from others since ?2, leaving out muted users. Like
+// watcherQuery, a category watch only counts when the thread has no watch.
+const digestActivityQuery = `
+    SELECT t.id, t.title, COUNT(c.id) FROM comments c JOIN threads t ON t.id = c.thread_id
+    WHERE c.created_at > ?2 AND c.user_id != ?1 AND c.deleted_at IS NULL
+        AND (t.id IN (SELECT thread_id FROM thread_watches WHERE user_id = ?1 AND level = 'all')
+            OR (t.id IN (SELECT tc.thread_id FROM thread_categories tc
+                    JOIN category_watches cw ON cw.category_id = tc.category_id
+                    WHERE cw.user_id = ?1 AND cw.level = 'all')
+                AND t.id NOT IN (SELECT thread_id FROM thread_watches WHERE user_id = ?1)))
+        AND c.user_id NOT IN (SELECT muted_id FROM user_mutes WHERE user_id = ?1)
+    GROUP BY t.id, t.title
+    ORDER BY COUNT(c.id) DESC, t.id DESC LIMIT 10`
+
+// digestTopQuery selects the most liked threads started since ?2, except
+// the ones the user muted.
+const digestTopQuery = `
+    SELECT t.id, t.title, u.username, COALESCE(t.likes, 0),
+        (SELECT COUNT(*) FROM comments WHERE thread_id = t.id AND deleted_at IS NULL)
+    FROM threads t JOIN users u ON u.id = t.user_id
+    WHERE t.created_at > ?2 AND t.user_id NOT IN (SELECT muted_id FROM user_mutes WHERE user_id = ?1)
+        AND t.id NOT IN (SELECT thread_id FROM thread_watches WHERE user_id = ?1 AND level = 'muted')
+    ORDER BY COALESCE(t.likes, 0) DESC, t.id DESC LIMIT 5`
+
+// listDigestThreads returns the activity on the threads a user watches and
+// the top threads since a time.
+func listDigestThreads(userID int, since time.Time) ([]digestThread, []digestThread, error) {
+	var activity, top []digestThread
+	rows, err := db.Query(digestActivityQuery, userID, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id int
+		var t digestThread
+		if err := rows.Scan(&id, &t.Title, &t.Comments); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		t.URL = siteURL() + "/thread?id=" + strconv.Itoa(id)
+		activity = append(activity, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(digestTopQuery, userID, since)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var t digestThread
+		if err := rows.Scan(&id, &t.Title, &t.Author, &t.Likes, &t.Comments); err != nil {
+			return nil, nil, err
+		}
+		t.URL = siteURL() + "/thread?id=" + strconv.Itoa(id)
+		top = append(top, t)
+	}
+	return activity, top, rows.Err()
+}
+
+// queueDueDigests queues the digests whose period has passed. Digests with
+// nothing to report are skipped but still count as sent.
+func queueDueDigests(now time.Time) error {
+	rows, err := db.Query("SELECT id, digest, digest_sent_at FROM users WHERE digest != '' AND email != ''")
+	if err != nil {
+		return err
+	}
+	type dueDigest struct {
+		userID int
+		digest string
+		since  time.Time
+	}
+	var due []dueDigest
+	for rows.Next() {
+		var d dueDigest
+		var sentAt sql.NullTime
+		if err := rows.Scan(&d.userID, &d.digest, &sentAt); err != nil {
+			rows.Close()
+			return err
+		}
+		period, ok := digestPeriods[d.digest]
+		if !ok || (sentAt.Valid && now.Sub(sentAt.Time) < period) {
+			continue
+		}
+		d.since = now.Add(-period)
+		if sentAt.Valid {
+			d.since = sentAt.Time
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		if err := queueDigest(d.userID, d.digest, d.since); err != nil {
+			log.Printf("Failed to queue digest for user %d: %v", d.userID, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE users SET digest_sent_at = ? WHERE id = ?", now, d.userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueDigest queues the digest of a user covering the time since since.
+func queueDigest(userID int, digest string, since time.Time) error {
+	activity, top, err := listDigestThreads(userID, since)
+	if err != nil || (len(activity) == 0 && len(top) == 0) {
+		return err
+	}
+	to, err := getEmailRecipient(userID)
+	if err != nil {
+		return err
+	}
+	unsubscribe, err := unsubscribeURL(userID, unsubscribeDigest)
+	if err != nil {
+		return err
+	}
+	unsubscribeAllURL, err := unsubscribeURL(userID, unsubscribeAll)
+	if err != nil {
+		return err
+	}
+
+	subject := "Your daily forum digest"
+	if digest == digestWeekly {
+		subject = "Your weekly forum digest"
+	}
+	text, html, err := renderEmail("digest", map[string]interface{}{
+		"Username":          to.Username,
+		"Subject":           subject,
+		"Activity":          activity,
+		"Top":               top,
+		"SettingsURL":       siteURL() + "/settings/notifications",
+		"UnsubscribeURL":    unsubscribe,
+		"UnsubscribeLabel":  unsubscribeLabel(unsubscribeDigest),
+		"UnsubscribeAllURL": unsubscribeAllURL,
+	})
+	if err != nil {
+		return err
+	}
+	return queueMail(outgoingMail{
+		To:             to.Email,
+		Subject:        subject,
+		Text:           text,
+		HTML:           html,
+		UnsubscribeURL: unsubscribe,
+	})
+}
+
+// /unsubscribe?token=...: confirms and applies an unsubscribe link. Mail
+// clients may also post to it directly (RFC 8058 one-click unsubscribe).
+func serveUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	userID, scope, err := parseUnsubscribeToken(token)
+	if err == nil {
+		_, err = getDigest(userID) // the user must still exist
+	}
+	if err == errInvalidUnsubscribe || err == sql.ErrNoRows {
+		http.Error(w, "This unsubscribe link is invalid", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	done := false
+	if r.Method == http.MethodPost {
+		err := applyUnsubscribe(userID, scope)
+		if err == errInvalidUnsubscribe {
+			http.Error(w, "This unsubscribe link is invalid", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to unsubscribe: %v", err)
+			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+			return
+		}
+		done = true
+	}
+
+	tmpl := htmltemplate.Must(htmltemplate.ParseFiles("templates/unsubscribe.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Token": token,
+		"Label": unsubscribeLabel(scope),
+		"Done":  done,
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFileMailer sends email to .eml files in a temporary directory until the
+// test ends and returns the directory.
+func useFileMailer(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	previous := mailer
+	mailer = fileSender{dir: dir}
+	t.Cleanup(func() { mailer = previous })
+	return dir
+}
+
+// mailedFiles returns the messages written by the file mailer to dir.
+func mailedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]string, len(paths))
+	for i, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages[i] = string(data)
+	}
+	return messages
+}
+
+// queuedSubjects returns the subjects of the emails queued for recipient.
+func queuedSubjects(t *testing.T, recipient string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT subject FROM mail_queue WHERE recipient = ? ORDER BY id", recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var subjects []string
+	for rows.Next() {
+		var subject string
+		if err := rows.Scan(&subject); err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects
+}
+
+func TestNotificationEmailsFollowTheirOwnSetting(t *testing.T) {
+	newTestDB(t)
+	dir := useFileMailer(t)
+	alice := createTestUser(t, "alice")
+	threadID, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		inApp, email bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+	mailed := 0
+	for i, tt := range tests {
+		username := fmt.Sprintf("user%d", i)
+		userID := createTestUser(t, username)
+		if err := setNotificationPreferences(userID, map[string]bool{notifyMention: tt.inApp}); err != nil {
+			t.Fatal(err)
+		}
+		if err := setEmailPreferences(userID, map[string]bool{notifyMention: tt.email}); err != nil {
+			t.Fatal(err)
+		}
+		notify(Notification{Type: notifyMention, ThreadID: int(threadID), Text: "Hello @" + username, userID: userID, actorID: alice})
+
+		var stored int
+		if err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ?", userID).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if (stored == 1) != tt.inApp {
+			t.Errorf("in app %v, email %v: %d notifications stored", tt.inApp, tt.email, stored)
+		}
+		subjects := queuedSubjects(t, username+"@example.com")
+		if (len(subjects) == 1) != tt.email {
+			t.Errorf("in app %v, email %v: %d emails queued", tt.inApp, tt.email, len(subjects))
+		}
+		if len(subjects) == 1 && subjects[0] != `alice mentioned you on "A thread"` {
+			t.Errorf("in app %v, email %v: subject %q", tt.inApp, tt.email, subjects[0])
+		}
+		if tt.email {
+			mailed++
+		}
+	}
+
+	if err := sendDueMail(); err != nil {
+		t.Fatal(err)
+	}
+	messages := mailedFiles(t, dir)
+	if len(messages) != mailed {
+		t.Fatalf("%d emails written, want %d", len(messages), mailed)
+	}
+	for _, message := range messages {
+		if !strings.Contains(message, "List-Unsubscribe: <"+siteURL()+"/unsubscribe?token=") {
+			t.Errorf("email without a List-Unsubscribe header:\n%s", message)
+		}
+	}
+}
+
+func TestUnsubscribeLinks(t *testing.T) {
+	newTestDB(t)
+	userID := createTestUser(t, "alice")
+
+	token, err := unsubscribeToken(userID, notifyMention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, scope, err := parseUnsubscribeToken(token); err != nil || id != userID || scope != notifyMention {
+		t.Errorf("token read back as %d, %q, %v", id, scope, err)
+	}
+	payload, sum, _ := strings.Cut(token, ".")
+	forged, _ := unsubscribeToken(userID+1, notifyMention)
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	for _, bad := range []string{"", "nodot", payload + ".", forgedPayload + "." + sum, payload + "." + sum + "x"} {
+		if _, _, err := parseUnsubscribeToken(bad); err != errInvalidUnsubscribe {
+			t.Errorf("parseUnsubscribeToken(%q) = %v, want errInvalidUnsubscribe", bad, err)
+		}
+	}
+
+	send := func(method, scope string) int {
+		token, err := unsubscribeToken(userID, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(method, "/unsubscribe?token="+url.QueryEscape(token), nil)
+		w := httptest.NewRecorder()
+		serveUnsubscribe(w, r)
+		return w.Code
+	}
+	state := func() string {
+		prefs, err := emailPreferences(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := getDigest(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("message %v, mention %v, digest %q", prefs[notifyMessage], prefs[notifyMention], digest)
+	}
+	if err := setDigest(userID, digestDaily); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, scope string
+		status        int
+		want          string
+	}{
+		{http.MethodGet, notifyMention, http.StatusOK, `message true, mention true, digest "daily"`}, // only asks
+		{http.MethodPost, notifyMention, http.StatusOK, `message true, mention false, digest "daily"`},
+		{http.MethodPost, unsubscribeDigest, http.StatusOK, `message true, mention false, digest ""`},
+		{http.MethodPost, notifyVote, http.StatusBadRequest, `message true, mention false, digest ""`}, // never emailed
+		{http.MethodPost, unsubscribeAll, http.StatusOK, `message false, mention false, digest ""`},
+	}
+	for _, tt := range tests {
+		if status := send(tt.method, tt.scope); status != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.scope, status, tt.status)
+		}
+		if got := state(); got != tt.want {
+			t.Errorf("after %s %s: %s, want %s", tt.method, tt.scope, got, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serveUnsubscribe(w, httptest.NewRequest(http.MethodPost, "/unsubscribe?token="+url.QueryEscape(forged), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("link of a user that does not exist: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	newTestDB(t)
+	dir := useFileMailer(t)
+	t.Setenv("MAIL_MAX_ATTEMPTS", "3")
+
+	// A file where the outbox directory should be makes every send fail
+	blocked := filepath.Join(t.TempDir(), "outbox")
+	if err := os.WriteFile(blocked, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mailer = fileSender{dir: blocked}
+
+	for _, to := range []string{"gives-up@example.com", "recovers@example.com"} {
+		if err := queueMail(outgoingMail{To: to, Subject: "Hello", Text: "Hello", HTML: "<p>Hello</p>"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type attempt struct {
+		attempts int
+		sent     bool
+		failed   bool
+		next     time.Time
+	}
+	state := func(to string) attempt {
+		var a attempt
+		var lastError string
+		var sentAt *time.Time
+		if err := db.QueryRow("SELECT attempts, sent_at, last_error, next_attempt_at FROM mail_queue WHERE recipient = ?", to).
+			Scan(&a.attempts, &sentAt, &lastError, &a.next); err != nil {
+			t.Fatal(err)
+		}
+		a.sent, a.failed = sentAt != nil, lastError != ""
+		return a
+	}
+	makeDue := func() {
+		if _, err := db.Exec("UPDATE mail_queue SET next_attempt_at = ?", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := sendDueMail(); err != nil {
+		t.Fatal(err)
+	}
+	a := state("gives-up@example.com")
+	if a.attempts != 1 || a.sent || !a.failed || time.Until(a.next) < 30*time.Second {
+		t.Fatalf("after a failure: %+v, want one attempt, an error and a retry later", a)
+	}
+	// Not due yet, so nothing is tried
+	if err := sendDueMail(); err != nil {
+		t.Fatal(err)
+	}
+	if a := state("gives-up@example.com"); a.attempts != 1 {
+		t.Fatalf("a mail was retried before it was due: %+v", a)
+	}
+
+	for i := 0; i < 4; i++ {
+		makeDue()
+		if err := sendDueMail(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a := state("gives-up@example.com"); a.attempts != 3 || a.sent {
+		t.Errorf("after MAIL_MAX_ATTEMPTS failures: %+v, want 3 attempts and no more", a)
+	}
+
+	if _, err := db.Exec("UPDATE mail_queue SET attempts = 1 WHERE recipient = 'recovers@example.com'"); err != nil {
+		t.Fatal(err)
+	}
+	mailer = fileSender{dir: dir}
+	makeDue()
+	if err := sendDueMail(); err != nil {
+		t.Fatal(err)
+	}
+	if a := state("recovers@example.com"); !a.sent || a.failed || a.attempts != 2 {
+		t.Errorf("after the sender recovered: %+v, want sent on the second attempt", a)
+	}
+	if messages := mailedFiles(t, dir); len(messages) != 1 || !strings.Contains(messages[0], "To: recovers@example.com") {
+		t.Errorf("emails written: %q, want only the one that recovered", messages)
+	}
+}
+
+func TestMailRetryDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		9:  256 * time.Minute,
+		10: 6 * time.Hour,
+		64: 6 * time.Hour,
+	}
+	for attempts, want := range tests {
+		if got := mailRetryDelay(attempts); got != want {
+			t.Errorf("mailRetryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestDigests(t *testing.T) {
+	newTestDB(t)
+	useFileMailer(t)
+	alice := createTestUser(t, "alice")
+	daily := createTestUser(t, "daily")
+	weekly := createTestUser(t, "weekly")
+	quiet := createTestUser(t, "quiet")
+	for userID, digest := range map[int]string{daily: digestDaily, weekly: digestWeekly, quiet: digestDaily} {
+		if err := setDigest(userID, digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	// Nothing happened after quiet's last digest
+	if _, err := db.Exec("UPDATE users SET digest_sent_at = ? WHERE id = ?", now.Add(time.Hour), quiet); err != nil {
+		t.Fatal(err)
+	}
+
+	threadID, err := createThread(alice, ThreadInput{Title: "Watched thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setThreadWatch(daily, int(threadID), "all"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := createComment(alice, int(threadID), 0, "News", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		at                   time.Time
+		daily, weekly, quiet int // emails queued so far
+	}{
+		{now, 0, 0, 0},
+		{now.Add(25 * time.Hour), 1, 0, 0},
+		{now.Add(26 * time.Hour), 1, 0, 0},
+		{now.Add(8 * 24 * time.Hour), 1, 1, 0},
+	}
+	for _, step := range steps {
+		if err := queueDueDigests(step.at); err != nil {
+			t.Fatal(err)
+		}
+		for username, want := range map[string]int{"daily": step.daily, "weekly": step.weekly, "quiet": step.quiet} {
+			if got := len(queuedSubjects(t, username+"@example.com")); got != want {
+				t.Errorf("at %v: %d digests for %s, want %d", step.at.Sub(now), got, username, want)
+			}
+		}
+	}
+
+	var text string
+	if err := db.QueryRow("SELECT text_body FROM mail_queue WHERE recipient = 'daily@example.com'").Scan(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Watched thread (2 new)", "Unsubscribe from digest emails: " + siteURL() + "/unsubscribe?token="} {
+		if !strings.Contains(text, want) {
+			t.Errorf("daily digest does not contain %q:\n%s", want, text)
+		}
+	}
+	var sentAt time.Time
+	if err := db.QueryRow("SELECT digest_sent_at FROM users WHERE id = ?", quiet).Scan(&sentAt); err != nil {
+		t.Fatal(err)
+	}
+	if !sentAt.Equal(now.Add(8 * 24 * time.Hour)) {
+		t.Errorf("an empty digest left digest_sent_at at %v, want it counted as sent", sentAt)
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Users follow other users, categories and tags. Nothing is copied when something
+// is posted; the feed is queried from threads, comments and item_reactions
+// whenever it is read, with the authors of muted users left out.
+
+var errCannotFollowSelf = errors.New("you cannot follow or mute yourself")
+
+// relation is a user to user, category or tag table such as user_follows.
+type relation struct {
+	table  string
+	column string // the column of the followed or muted side
+}
+
+var (
+	userFollows     = relation{"user_follows", "followee_id"}
+	categoryFollows = relation{"category_follows", "category_id"}
+	tagFollows      = relation{"tag_follows", "tag_id"}
+	userMutes       = relation{"user_mutes", "muted_id"}
+)
+
+// ownerColumn returns the column of the user the relation belongs to.
+func (rel relation) ownerColumn() string {
+	if rel == userFollows {
+		return "follower_id"
+	}
+	return "user_id"
+}
+
+// setRelation adds (on) or removes a follow or mute. Repeating a request changes nothing.
+func setRelation(rel relation, userID, targetID int, on bool) error {
+	if (rel == userFollows || rel == userMutes) && userID == targetID {
+		return errCannotFollowSelf
+	}
+	if !on {
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND %s = ?", rel.table, rel.ownerColumn(), rel.column), userID, targetID)
+		return err
+	}
+
+	targetTable := "users"
+	switch rel {
+	case categoryFollows:
+		targetTable = "categories"
+	case tagFollows:
+		targetTable = "tags"
+	}
+	var exists int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", targetTable), targetID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errNotFound
+	}
+	_, err := db.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (%s, %s, created_at) VALUES (?, ?, ?)", rel.table, rel.ownerColumn(), rel.column), userID, targetID, time.Now())
+	return err
+}
+
+// hasRelation reports whether userID follows or muted targetID.
+func hasRelation(rel relation, userID, targetID int) (bool, error) {
+	if userID == 0 {
+		return false, nil
+	}
+	var count int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s = ? AND %s = ?", rel.table, rel.ownerColumn(), rel.column), userID, targetID).Scan(&count)
+	return count > 0, err
+}
+
+// FollowCounts is how many users follow a user and how many they follow.
+type FollowCounts struct {
+	Followers int `json:"followers"`
+	Following int `json:"following"`
+}
+
+func countFollows(userID int) (FollowCounts, error) {
+	var c FollowCounts
+	err := db.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM user_follows WHERE followee_id = ?),
+            (SELECT COUNT(*) FROM user_follows WHERE follower_id = ?)`, userID, userID).Scan(&c.Followers, &c.Following)
+	return c, err
+}
+
+// listFollowUsers returns the followers (followers set) or the followed users
+// of a user, most recent first, paged by follow time.
+func listFollowUsers(userID int, followers bool, limit, after int) ([]string, string, error) {
+	match, other := "followee_id", "follower_id"
+	if !followers {
+		match, other = other, match
+	}
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT f.rowid, u.username FROM user_follows f JOIN users u ON u.id = f.%s
+        WHERE f.%s = ? AND (? = 0 OR f.rowid < ?)
+        ORDER BY f.rowid DESC LIMIT ?`, other, match), userID, after, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var ids []int
+	usernames := []string{}
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, id)
+		usernames = append(usernames, username)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+		next = encodeCursor(ids[limit-1])
+	}
+	return usernames, next, nil
+}
+
+// listMutedUsers returns the usernames a user muted.
+func listMutedUsers(userID int) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT u.username FROM user_mutes m JOIN users u ON u.id = m.muted_id
+        WHERE m.user_id = ? ORDER BY u.username`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// listFollowedCategories returns the ids of the categories a user follows.
+func listFollowedCategories(userID int) (map[int]bool, error) {
+	rows, err := db.Query("SELECT category_id FROM category_follows WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	followed := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		followed[id] = true
+	}
+	return followed, rows.Err()
+}
+
+// Kinds of feed items.
+const (
+	feedThread      = "thread"       // new thread by a followed user or in a followed category or tag
+	feedComment     = "comment"      // new comment by a followed user
+	feedThreadVote  = "thread_vote"  // likes on a thread of a followed user
+	feedCommentVote = "comment_vote" // likes on a comment of a followed user
+)
+
+// FeedItem is one entry of a feed. Votes on the same item are grouped into
+// one entry dated by the latest like, so voters are not disclosed.
+type FeedItem struct {
+	Kind        string    `json:"kind"`
+	ItemID      int       `json:"item_id"` // thread or comment id, depending on kind
+	ThreadID    int       `json:"thread_id"`
+	ThreadTitle string    `json:"thread_title"`
+	Author      string    `json:"author"`
+	Text        string    `json:"text"`
+	Likes       int       `json:"likes,omitempty"` // for vote items
+	At          time.Time `json:"at"`
+
+	cursor string
+}
+
+// URL returns the path of the page showing the item.
+func (item FeedItem) URL() string {
+	switch item.Kind {
+	case feedComment, feedCommentVote:
+		return fmt.Sprintf("/thread?id=%d&comment=%d#comment-%d", item.ThreadID, item.ItemID, item.ItemID)
+	}
+	return fmt.Sprintf("/thread?id=%d", item.ThreadID)
+}
+
+// Summary describes the item in one line.
+func (item FeedItem) Summary() string {
+	switch item.Kind {
+	case feedThread:
+		return fmt.Sprintf("%s started \"%s\"", item.Author, item.ThreadTitle)
+	case feedComment:
+		return fmt.Sprintf("%s commented on \"%s\"", item.Author, item.ThreadTitle)
+	case feedThreadVote:
+		return fmt.Sprintf("%s's thread \"%s\" has %d likes", item.Author, item.ThreadTitle, item.Likes)
+	case feedCommentVote:
+		return fmt.Sprintf("%s's comment on \"%s\" has %d likes", item.Author, item.ThreadTitle, item.Likes)
+	}
+	return item.Kind
+}
+
+// feedQuery selects the feed of a user in one query. Each branch of the union
+// is limited to what the user follows through the indexes on author,
+// category and tag, so the cost grows with the followed activity and not with the
+// size of the forum. Items without a timestamp (from before timestamps were
+// recorded) cannot be placed and are left out.
+const feedQuery = `
+    WITH followed_users AS (SELECT followee_id FROM user_follows WHERE follower_id = ?1),
+        followed_categories AS (SELECT category_id FROM category_follows WHERE user_id = ?1),
+        followed_tags AS (SELECT tag_id FROM tag_follows WHERE user_id = ?1)
+    SELECT f.kind, f.item_id, f.thread_id, t.title, u.username,
+        CASE WHEN f.kind IN ('comment', 'comment_vote') THEN c.content ELSE t.description END,
+        f.likes, CAST(f.at AS TEXT)
+    FROM (
+        SELECT 'thread' AS kind, t.id AS item_id, t.id AS thread_id, t.user_id AS author_id, t.created_at AS at, 0 AS likes
+        FROM threads t
+        WHERE t.created_at IS NOT NULL AND t.id IN (
+            SELECT id FROM threads WHERE user_id IN followed_users
+            UNION
+            SELECT thread_id FROM thread_categories WHERE category_id IN followed_categories
+            UNION
+            SELECT thread_id FROM thread_tags WHERE tag_id IN followed_tags)
+        UNION ALL
+        SELECT 'comment', c.id, c.thread_id, c.user_id, c.created_at, 0
+        FROM comments c
+        WHERE c.created_at IS NOT NULL AND c.deleted_at IS NULL AND c.user_id IN followed_users
+        UNION ALL
+        SELECT 'thread_vote', t.id, t.id, t.user_id, MAX(ir.created_at), COUNT(*)
+        FROM threads t
+        JOIN item_reactions ir ON ir.item_type = 'thread' AND ir.item_id = t.id
+        JOIN reactions r ON r.id = ir.reaction_id AND r.score > 0
+        WHERE t.user_id IN followed_users
+        GROUP BY t.id
+        UNION ALL
+        SELECT 'comment_vote', c.id, c.thread_id, c.user_id, MAX(ir.created_at), COUNT(*)
+        FROM comments c
+        JOIN item_reactions ir ON ir.item_type = 'comment' AND ir.item_id = c.id
+        JOIN reactions r ON r.id = ir.reaction_id AND r.score > 0
+        WHERE c.deleted_at IS NULL AND c.user_id IN followed_users
+        GROUP BY c.id
+    ) f
+    JOIN threads t ON t.id = f.thread_id
+    JOIN users u ON u.id = f.author_id
+    LEFT JOIN comments c ON c.id = f.item_id AND f.kind IN ('comment', 'comment_vote')
+    WHERE f.author_id != ?1
+        AND f.author_id NOT IN (SELECT muted_id FROM user_mutes WHERE user_id = ?1)
+        AND (?2 = '' OR f.at < ?2 OR (f.at = ?2 AND (f.kind > ?3 OR (f.kind = ?3 AND f.item_id < ?4))))
+    ORDER BY f.at DESC, f.kind, f.item_id DESC
+    LIMIT ?5`
+
+// listFeed returns a page of the feed of userID, newest first. The cursor
+// is the one returned with the previous page, or "" for the first page.
+func listFeed(userID, limit int, cursor string) ([]FeedItem, string, error) {
+	var at, kind string
+	var itemID int
+	if cursor != "" {
+		var err error
+		if at, kind, itemID, err = decodeFeedCursor(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	rows, err := db.Query(feedQuery, userID, at, kind, itemID, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	items := []FeedItem{}
+	for rows.Next() {
+		var item FeedItem
+		var at string
+		if err := rows.Scan(&item.Kind, &item.ItemID, &item.ThreadID, &item.ThreadTitle, &item.Author, &item.Text, &item.Likes, &at); err != nil {
+			return nil, "", err
+		}
+		// The time is read as stored so the cursor compares the same text
+		item.At = parseStoredTime(at)
+		item.cursor = encodeFeedCursor(at, item.Kind, item.ItemID)
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(items) > limit {
+		items = items[:limit]
+		next = items[limit-1].cursor
+	}
+	return items, next, nil
+}
+
+// parseStoredTime reads a DATETIME value in one of the formats the SQLite driver writes.
+func parseStoredTime(value string) time.Time {
+	value = strings.TrimSuffix(value, "Z")
+	for _, format := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(format, value, time.UTC); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Feed cursors hold the stored time, kind and id of the last item of a page.
+func encodeFeedCursor(at, kind string, itemID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(at + "|" + kind + "|" + strconv.Itoa(itemID)))
+}
+
+func decodeFeedCursor(cursor string) (string, string, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", 0, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return "", "", 0, errInvalidCursor
+	}
+	itemID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", "", 0, errInvalidCursor
+	}
+	return parts[0], parts[1], itemID, nil
+}
+
+// feedToken returns the secret that gives access to the Atom feed of a user,
+// creating it on first use.
+func feedToken(userID int) (string, error) {
+	var token string
+	if err := db.QueryRow("SELECT feed_token FROM users WHERE id = ?", userID).Scan(&token); err != nil || token != "" {
+		return token, err
+	}
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(buf)
+	_, err := db.Exec("UPDATE users SET feed_token = ? WHERE id = ? AND feed_token = ''", token, userID)
+	if err != nil {
+		return "", err
+	}
+	// Another request may have created one first
+	err = db.QueryRow("SELECT feed_token FROM users WHERE id = ?", userID).Scan(&token)
+	return token, err
+}
+
+// feedPageSize is how many items the feed page and the Atom feed show.
+const feedPageSize = 30
+
+// /feed: activity from followed users, categories and tags
+func serveFeed(w http.ResponseWriter, r *http.Request) {
+	username, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	items, next, err := listFeed(userID, feedPageSize, r.URL.Query().Get("cursor"))
+	if err == errInvalidCursor {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load feed: %v", err)
+		http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+		return
+	}
+	categories, err := listCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+	followed, err := listFollowedCategories(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+	followedTags, err := listFollowedTags(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+	muted, err := listMutedUsers(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch muted users", http.StatusInternalServerError)
+		return
+	}
+	token, err := feedToken(userID)
+	if err != nil {
+		log.Printf("Failed to create feed token: %v", err)
+		http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/feed.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Username":           username,
+		"Items":              items,
+		"NextCursor":         next,
+		"Categories":         categories,
+		"FollowedCategories": followed,
+		"FollowedTags":       followedTags,
+		"Muted":              muted,
+		"AtomURL":            "/feed.atom?token=" + url.QueryEscape(token),
+	})
+}
+
+// /follow and /mute: form posts changing a follow or mute. The target is
+// username, category_id or tag; on=0 undoes it.
+func handleFollow(w http.ResponseWriter, r *http.Request) {
+	handleRelationForm(w, r, userFollows)
+}
+
+func handleMute(w http.ResponseWriter, r *http.Request) {
+	handleRelationForm(w, r, userMutes)
+}
+
+func handleRelationForm(w http.ResponseWriter, r *http.Request, rel relation) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	var targetID int
+	var err error
+	if categoryID := r.FormValue("category_id"); categoryID != "" && rel == userFollows {
+		rel = categoryFollows
+		if targetID, err = strconv.Atoi(categoryID); err != nil {
+			http.Error(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+	} else if name := r.FormValue("tag"); name != "" && rel == userFollows {
+		rel = tagFollows
+		var tag Tag
+		tag, err = findTag(name)
+		targetID = tag.ID
+	} else {
+		err = db.QueryRow("SELECT id FROM users WHERE username = ?", r.FormValue("username")).Scan(&targetID)
+		if err == sql.ErrNoRows {
+			err = errNotFound
+		}
+	}
+	if err == nil {
+		err = setRelation(rel, userID, targetID, r.FormValue("on") != "0")
+	}
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errCannotFollowSelf:
+		http.Error(w, "You cannot follow or mute yourself", http.StatusBadRequest)
+		return
+	default:
+		log.Printf("Failed to save %s: %v", rel.table, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	back := r.FormValue("redirect")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/feed"
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// Atom documents as served by /feed.atom.
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Author  string   `xml:"author>name"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// /feed.atom?token=...: the feed of the user owning the token, for feed readers
+func serveFeedAtom(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	var userID int
+	var username string
+	err := db.QueryRow("SELECT id, username FROM users WHERE feed_token = ? AND feed_token != ''", token).Scan(&userID, &username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown feed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	items, _, err := listFeed(userID, feedPageSize, "")
+	if err != nil {
+		log.Printf("Failed to load feed: %v", err)
+		http.Error(w, "Failed to load feed", http.StatusInternalServerError)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	feed := atomFeed{
+		ID:      base + "/feed/" + url.PathEscape(username),
+		Title:   "Forum feed of " + username,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: base + "/feed"},
+	}
+	if len(items) > 0 {
+		feed.Updated = items[0].At.UTC().Format(time.RFC3339)
+	}
+	for _, item := range items {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("%s/%s/%d/%d", base, item.Kind, item.ItemID, item.At.Unix()),
+			Title:   item.Summary(),
+			Updated: item.At.UTC().Format(time.RFC3339),
+			Author:  item.Author,
+			Link:    atomLink{Href: base + item.URL(), Rel: "alternate"},
+			Summary: item.Text,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.Printf("Atom encoding error: %v", err)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSetRelation(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	categoryID, _ := strconv.Atoi(createTestCategory(t, "News"))
+
+	tests := []struct {
+		name     string
+		rel      relation
+		targetID int
+		on       bool
+		err      error
+		want     bool
+	}{
+		{"follow", userFollows, bob, true, nil, true},
+		{"follow again", userFollows, bob, true, nil, true},
+		{"unfollow", userFollows, bob, false, nil, false},
+		{"unfollow again", userFollows, bob, false, nil, false},
+		{"follow yourself", userFollows, alice, true, errCannotFollowSelf, false},
+		{"mute yourself", userMutes, alice, true, errCannotFollowSelf, false},
+		{"follow a missing user", userFollows, bob + 100, true, errNotFound, false},
+		{"mute", userMutes, bob, true, nil, true},
+		{"follow a category", categoryFollows, categoryID, true, nil, true},
+		{"follow a missing category", categoryFollows, categoryID + 100, true, errNotFound, false},
+	}
+	for _, tt := range tests {
+		if err := setRelation(tt.rel, alice, tt.targetID, tt.on); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+		if got, err := hasRelation(tt.rel, alice, tt.targetID); err != nil || got != tt.want {
+			t.Errorf("%s: hasRelation = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+
+	if muted, err := listMutedUsers(alice); err != nil || !reflect.DeepEqual(muted, []string{"bob"}) {
+		t.Errorf("muted users %v, %v, want [bob]", muted, err)
+	}
+	if followed, err := listFollowedCategories(alice); err != nil || !followed[categoryID] {
+		t.Errorf("followed categories %v, %v", followed, err)
+	}
+}
+
+func TestListFollowUsers(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	var names []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("user%d", i)
+		id := createTestUser(t, name)
+		if err := setRelation(userFollows, id, alice, true); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := setRelation(userFollows, alice, createTestUser(t, "zed"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Followers are listed most recent first, two at a time
+	var got []string
+	after := 0
+	for page := 0; ; page++ {
+		usernames, next, err := listFollowUsers(alice, true, 2, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, usernames...)
+		if next == "" {
+			break
+		}
+		if after, err = decodeCursor(next); err != nil {
+			t.Fatal(err)
+		}
+		if page > 5 {
+			t.Fatal("paging does not end")
+		}
+	}
+	want := []string{"user4", "user3", "user2", "user1", "user0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("followers %v, want %v", got, want)
+	}
+	if following, _, err := listFollowUsers(alice, false, 10, 0); err != nil || !reflect.DeepEqual(following, []string{"zed"}) {
+		t.Errorf("following %v, %v, want [zed]", following, err)
+	}
+	if counts, err := countFollows(alice); err != nil || counts != (FollowCounts{Followers: len(names), Following: 1}) {
+		t.Errorf("counts %+v, %v", counts, err)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	newTestDB(t)
+	reader := createTestUser(t, "reader")
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	noisy := createTestUser(t, "noisy")
+	stranger := createTestUser(t, "stranger")
+	setTestRole(t, bob, roleModerator) // may create new tags
+	news := createTestCategory(t, "News")
+	newsID, _ := strconv.Atoi(news)
+
+	newThread := func(userID int, in ThreadInput) int {
+		t.Helper()
+		id, err := createThread(userID, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	aliceThread := newThread(alice, ThreadInput{Title: "By alice", Description: "Followed author"})
+	newsThread := newThread(stranger, ThreadInput{Title: "In news", Description: "Followed category", CategoryIDs: []string{news}})
+	taggedThread := newThread(bob, ThreadInput{Title: "Tagged", Description: "Followed tag", Tags: []string{"golang"}})
+	newThread(stranger, ThreadInput{Title: "Elsewhere", Description: "Nothing followed"})
+	newThread(noisy, ThreadInput{Title: "Noisy news", Description: "Muted author", CategoryIDs: []string{news}})
+	newThread(reader, ThreadInput{Title: "Own news", Description: "Own thread", CategoryIDs: []string{news}})
+	aliceComment, err := createComment(alice, newsThread, 0, "A comment by alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedComment, err := createComment(alice, newsThread, 0, "Deleted later", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := softDeleteComment(int(deletedComment)); err != nil {
+		t.Fatal(err)
+	}
+	for _, voter := range []int{bob, stranger} {
+		if _, err := castVote(threadVotes, aliceThread, voter, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := castVote(commentVotes, int(aliceComment), bob, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := findTag("golang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, follow := range []struct {
+		rel      relation
+		targetID int
+	}{{userFollows, alice}, {categoryFollows, newsID}, {tagFollows, tag.ID}, {userMutes, noisy}} {
+		if err := setRelation(follow.rel, reader, follow.targetID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, next, err := listFeed(reader, 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "" {
+		t.Errorf("next cursor %q after the only page", next)
+	}
+	var got []string
+	for _, item := range items {
+		got = append(got, fmt.Sprintf("%s %d likes=%d", item.Kind, item.ItemID, item.Likes))
+	}
+	sort.Strings(got)
+	want := []string{
+		fmt.Sprintf("comment %d likes=0", aliceComment),
+		fmt.Sprintf("comment_vote %d likes=1", aliceComment),
+		fmt.Sprintf("thread %d likes=0", aliceThread),
+		fmt.Sprintf("thread %d likes=0", newsThread),
+		fmt.Sprintf("thread %d likes=0", taggedThread),
+		fmt.Sprintf("thread_vote %d likes=2", aliceThread),
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("feed\n%v\nwant\n%v", got, want)
+	}
+
+	// Paging one item at a time returns the same items in the same order
+	var paged []FeedItem
+	cursor := ""
+	for i := 0; i <= len(items); i++ {
+		page, next, err := listFeed(reader, 1, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged = append(paged, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(paged) != len(items) {
+		t.Fatalf("paging returned %d items, want %d", len(paged), len(items))
+	}
+	for i := range items {
+		if paged[i].Kind != items[i].Kind || paged[i].ItemID != items[i].ItemID {
+			t.Errorf("page %d: %s %d, want %s %d", i, paged[i].Kind, paged[i].ItemID, items[i].Kind, items[i].ItemID)
+		}
+	}
+	if _, _, err := listFeed(reader, 1, "not a cursor!"); err != errInvalidCursor {
+		t.Errorf("bad cursor: %v, want errInvalidCursor", err)
+	}
+}
+
+func TestFeedAtom(t *testing.T) {
+	newTestDB(t)
+	reader := createTestUser(t, "reader")
+	alice := createTestUser(t, "alice")
+	if _, err := createThread(alice, ThreadInput{Title: "By alice", Description: "Its description"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setRelation(userFollows, reader, alice, true); err != nil {
+		t.Fatal(err)
+	}
+	token, err := feedToken(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := feedToken(reader); again != token || token == "" {
+		t.Errorf("feed token changed from %q to %q", token, again)
+	}
+
+	tests := []struct {
+		token   string
+		status  int
+		entries int
+	}{
+		{token, http.StatusOK, 1},
+		{"", http.StatusNotFound, 0},
+		{"wrong", http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		serveFeedAtom(w, httptest.NewRequest(http.MethodGet, "/feed.atom?token="+url.QueryEscape(tt.token), nil))
+		if w.Code != tt.status {
+			t.Errorf("token %q: status %d, want %d", tt.token, w.Code, tt.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var feed atomFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatal(err)
+		}
+		if len(feed.Entries) != tt.entries || feed.Entries[0].Title != `alice started "By alice"` {
+			t.Errorf("token %q: entries %+v", tt.token, feed.Entries)
+		}
+	}
+}
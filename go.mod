@@ -3,16 +3,26 @@ module forum
 go 1.22.3
 
 require (
+	github.com/alecthomas/chroma/v2 v2.2.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/gorilla/sessions v1.3.0
+	github.com/graphql-go/graphql v0.8.1
+	github.com/joho/godotenv v1.5.1
 	github.com/mattn/go-sqlite3 v1.14.22
+	github.com/microcosm-cc/bluemonday v1.0.26
+	github.com/yuin/goldmark v1.7.8
+	github.com/yuin/goldmark-highlighting/v2 v2.0.0-20230729083705-37449abec8cc
 	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.21.0
+	golang.org/x/oauth2 v0.21.0
 )
 
 require (
 	cloud.google.com/go/compute/metadata v0.3.0 // indirect
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/dlclark/regexp2 v1.7.0 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
 	github.com/gorilla/securecookie v1.1.2 // indirect
-	github.com/gorilla/sessions v1.3.0 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/markbates/goth v1.80.0 // indirect
-	golang.org/x/oauth2 v0.21.0 // indirect
 )
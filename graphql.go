@@ -0,0 +1,781 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// GraphQL endpoint over the forum data model. Queries go to /graphql, and
+// subscriptions are streamed as server-sent events from /graphql/subscriptions.
+
+const (
+	graphqlMaxDepth      = 8
+	graphqlMaxComplexity = 2000
+	// graphqlListCost is the assumed size of a list field without a "first" argument.
+	graphqlListCost = 20
+)
+
+// graphqlListFields are the fields that return lists; their children are
+// multiplied by the list size when computing query complexity.
+var graphqlListFields = map[string]bool{
+	"threads":    true,
+	"comments":   true,
+	"categories": true,
+	"messages":   true,
+}
+
+type graphqlContextKey int
+
+const (
+	graphqlLoadersKey graphqlContextKey = iota
+	graphqlUserKey
+)
+
+// batchLoader collects keys requested by sibling resolvers and loads them with
+// a single query the first time any of their results is needed.
+type batchLoader struct {
+	mu      sync.Mutex
+	fetch   func(ids []int) (map[int]interface{}, error)
+	pending []int
+	cache   map[int]interface{}
+	errs    map[int]error
+}
+
+func newBatchLoader(fetch func(ids []int) (map[int]interface{}, error)) *batchLoader {
+	return &batchLoader{fetch: fetch, cache: map[int]interface{}{}, errs: map[int]error{}}
+}
+
+// load queues id and returns a thunk that resolves it.
+func (l *batchLoader) load(id int) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, ok := l.cache[id]; !ok {
+		l.pending = append(l.pending, id)
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, ok := l.cache[id]; !ok && len(l.pending) > 0 {
+			ids := l.pending
+			l.pending = nil
+			results, err := l.fetch(ids)
+			for _, pendingID := range ids {
+				l.cache[pendingID] = results[pendingID]
+				if err != nil {
+					l.errs[pendingID] = err
+				}
+			}
+		}
+		return l.cache[id], l.errs[id]
+	}
+}
+
+// listLoader batches the lists of several keys like batchLoader, with a
+// batchLoader for each "first" value so the query applies the limit.
+type listLoader struct {
+	mu      sync.Mutex
+	fetch   func(ids []int, first int) (map[int]interface{}, error)
+	loaders map[int]*batchLoader
+}
+
+func newListLoader(fetch func(ids []int, first int) (map[int]interface{}, error)) *listLoader {
+	return &listLoader{fetch: fetch, loaders: map[int]*batchLoader{}}
+}
+
+// load queues id for the "first" argument in args and returns a thunk that resolves it.
+func (l *listLoader) load(id int, args map[string]interface{}) func() (interface{}, error) {
+	first, _ := args["first"].(int)
+	first = graphqlFirst(first)
+
+	l.mu.Lock()
+	loader, ok := l.loaders[first]
+	if !ok {
+		loader = newBatchLoader(func(ids []int) (map[int]interface{}, error) {
+			return l.fetch(ids, first)
+		})
+		l.loaders[first] = loader
+	}
+	l.mu.Unlock()
+	return loader.load(id)
+}
+
+type graphqlLoaders struct {
+	users              *batchLoader
+	threads            *batchLoader
+	categoriesByThread *batchLoader
+	commentsByThread   *listLoader
+	threadsByUser      *listLoader
+	commentsByUser     *listLoader
+	threadsByCategory  *listLoader
+}
+
+func newGraphqlLoaders() *graphqlLoaders {
+	return &graphqlLoaders{
+		users: newBatchLoader(func(ids []int) (map[int]interface{}, error) {
+			return loadGrouped(ids, false, `SELECT id, id, username FROM users WHERE id IN (%s)`, func(rows scanner) (int, interface{}, error) {
+				var id int
+				var u graphqlUser
+				err := rows.Scan(&id, &u.ID, &u.Username)
+				return id, u, err
+			})
+		}),
+		threads: newBatchLoader(func(ids []int) (map[int]interface{}, error) {
+			return loadGrouped(ids, false, `SELECT id, id, title, description, likes, dislikes, user_id FROM threads WHERE id IN (%s)`, scanGraphqlThread)
+		}),
+		categoriesByThread: newBatchLoader(func(ids []int) (map[int]interface{}, error) {
+			return loadGrouped(ids, true, `
+                SELECT tc.thread_id, c.id, c.name, c.slug, c.description
+                FROM thread_categories tc JOIN categories c ON c.id = tc.category_id
+                WHERE tc.thread_id IN (%s) ORDER BY c.name`, func(rows scanner) (int, interface{}, error) {
+				var threadID int
+				var c Category
+				err := rows.Scan(&threadID, &c.ID, &c.Name, &c.Slug, &c.Description)
+				return threadID, c, err
+			})
+		}),
+		commentsByThread: newListLoader(func(ids []int, first int) (map[int]interface{}, error) {
+			return loadGrouped(ids, true, firstPerKey("c.thread_id", graphqlCommentColumns, "comments c WHERE c.thread_id IN (%s)", "c.id"), scanFirstPerKey(scanGraphqlComment), first)
+		}),
+		threadsByUser: newListLoader(func(ids []int, first int) (map[int]interface{}, error) {
+			return loadGrouped(ids, true, firstPerKey("t.user_id", graphqlThreadColumns, "threads t WHERE t.user_id IN (%s)", "t.id DESC"), scanFirstPerKey(scanGraphqlThread), first)
+		}),
+		commentsByUser: newListLoader(func(ids []int, first int) (map[int]interface{}, error) {
+			return loadGrouped(ids, true, firstPerKey("c.user_id", graphqlCommentColumns, "comments c WHERE c.user_id IN (%s)", "c.id DESC"), scanFirstPerKey(scanGraphqlComment), first)
+		}),
+		threadsByCategory: newListLoader(func(ids []int, first int) (map[int]interface{}, error) {
+			return loadGrouped(ids, true, firstPerKey("tc.category_id", graphqlThreadColumns,
+				"thread_categories tc JOIN threads t ON t.id = tc.thread_id WHERE tc.category_id IN (%s)", "t.id DESC"), scanFirstPerKey(scanGraphqlThread), first)
+		}),
+	}
+}
+
+// firstPerKey returns a query selecting key and columns from the rows of
+// from, keeping the first rows of each key in the given order. The number of
+// rows is its last parameter, and every row ends with its position.
+func firstPerKey(key, columns, from, order string) string {
+	return fmt.Sprintf(`
+        SELECT * FROM (
+            SELECT %s, %s, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s) AS position
+            FROM %s)
+        WHERE position <= ? ORDER BY 1, position`, key, columns, key, order, from)
+}
+
+// scanFirstPerKey scans rows of a firstPerKey query with scan, leaving out their position.
+func scanFirstPerKey(scan func(scanner) (int, interface{}, error)) func(scanner) (int, interface{}, error) {
+	return func(rows scanner) (int, interface{}, error) {
+		return scan(positionedRow{rows})
+	}
+}
+
+// positionedRow scans a row followed by its position, which is dropped.
+type positionedRow struct {
+	scanner
+}
+
+func (r positionedRow) Scan(dest ...interface{}) error {
+	var position int
+	return r.scanner.Scan(append(dest, &position)...)
+}
+
+// graphqlUser is the public view of a user; it never carries email or password.
+type graphqlUser struct {
+	ID       int
+	Username string
+}
+
+// Columns scanned by scanGraphqlComment and scanGraphqlThread after the key.
+const (
+	graphqlCommentColumns = `c.id, CASE WHEN c.deleted_at IS NULL THEN c.content ELSE '[deleted]' END, c.user_id, c.thread_id,
+        COALESCE(c.likes, 0), COALESCE(c.dislikes, 0)`
+	graphqlThreadColumns = `t.id, t.title, t.description, t.likes, t.dislikes, t.user_id`
+)
+
+func scanGraphqlThread(rows scanner) (int, interface{}, error) {
+	var key int
+	var t Thread
+	err := rows.Scan(&key, &t.ID, &t.Title, &t.Description, &t.Likes, &t.Dislikes, &t.UserID)
+	return key, t, err
+}
+
+func scanGraphqlComment(rows scanner) (int, interface{}, error) {
+	var key int
+	var c Comment
+	err := rows.Scan(&key, &c.ID, &c.Content, &c.UserID, &c.ThreadID, &c.Likes, &c.Dislikes)
+	return key, c, err
+}
+
+// loadGrouped runs query with the ids substituted into its IN clause, followed
+// by args. The first scanned column is the key; with many set, values are
+// grouped into slices.
+func loadGrouped(ids []int, many bool, query string, scan func(scanner) (int, interface{}, error), args ...interface{}) (map[int]interface{}, error) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	idArgs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		idArgs[i] = id
+	}
+	args = append(idArgs, args...)
+
+	rows, err := db.Query(fmt.Sprintf(query, placeholders), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := map[int]interface{}{}
+	if many {
+		for _, id := range ids {
+			results[id] = []interface{}{}
+		}
+	}
+	for rows.Next() {
+		key, value, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if many {
+			results[key] = append(results[key].([]interface{}), value)
+		} else {
+			results[key] = value
+		}
+	}
+	return results, rows.Err()
+}
+
+func loadersFrom(ctx context.Context) *graphqlLoaders {
+	return ctx.Value(graphqlLoadersKey).(*graphqlLoaders)
+}
+
+// graphqlFirst returns how many items a list field returns for its "first"
+// argument: apiMaxLimit when it is not positive or larger than that.
+func graphqlFirst(first int) int {
+	if first <= 0 || first > apiMaxLimit {
+		return apiMaxLimit
+	}
+	return first
+}
+
+var firstArg = graphql.FieldConfigArgument{
+	"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlListCost},
+}
+
+var graphqlSchema graphql.Schema
+
+func init() {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"username": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	categoryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Category",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"slug":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	commentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Comment",
+		Fields: graphql.Fields{
+			"id":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"content":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"likes":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"dislikes": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"author": &graphql.Field{
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loadersFrom(p.Context).users.load(p.Source.(Comment).UserID), nil
+				},
+			},
+		},
+	})
+	threadType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Thread",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"title":       &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"description": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"likes":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"dislikes":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"author": &graphql.Field{
+				Type: userType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loadersFrom(p.Context).users.load(p.Source.(Thread).UserID), nil
+				},
+			},
+			"categories": &graphql.Field{
+				Type: graphql.NewList(categoryType),
+				Args: firstArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					first, _ := p.Args["first"].(int)
+					first = graphqlFirst(first)
+					load := loadersFrom(p.Context).categoriesByThread.load(p.Source.(Thread).ID)
+					return func() (interface{}, error) {
+						v, err := load()
+						if list, ok := v.([]interface{}); ok && len(list) > first {
+							v = list[:first]
+						}
+						return v, err
+					}, nil
+				},
+			},
+			"comments": &graphql.Field{
+				Type: graphql.NewList(commentType),
+				Args: firstArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loadersFrom(p.Context).commentsByThread.load(p.Source.(Thread).ID, p.Args), nil
+				},
+			},
+		},
+	})
+	commentType.AddFieldConfig("thread", &graphql.Field{
+		Type: threadType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return loadersFrom(p.Context).threads.load(p.Source.(Comment).ThreadID), nil
+		},
+	})
+	userType.AddFieldConfig("threads", &graphql.Field{
+		Type: graphql.NewList(threadType),
+		Args: firstArg,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return loadersFrom(p.Context).threadsByUser.load(p.Source.(graphqlUser).ID, p.Args), nil
+		},
+	})
+	userType.AddFieldConfig("comments", &graphql.Field{
+		Type: graphql.NewList(commentType),
+		Args: firstArg,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return loadersFrom(p.Context).commentsByUser.load(p.Source.(graphqlUser).ID, p.Args), nil
+		},
+	})
+	categoryType.AddFieldConfig("threads", &graphql.Field{
+		Type: graphql.NewList(threadType),
+		Args: firstArg,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return loadersFrom(p.Context).threadsByCategory.load(p.Source.(Category).ID, p.Args), nil
+		},
+	})
+	messageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Message",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"username":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"recipient": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"content":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"time":      &graphql.Field{Type: graphql.DateTime},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"thread": &graphql.Field{
+				Type: threadType,
+				Args: graphql.FieldConfigArgument{"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return loadersFrom(p.Context).threads.load(p.Args["id"].(int)), nil
+				},
+			},
+			"threads": &graphql.Field{
+				Type: graphql.NewList(threadType),
+				Args: graphql.FieldConfigArgument{
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlListCost},
+					"after": &graphql.ArgumentConfig{Type: graphql.Int, Description: "Return threads older than this thread id"},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					first, _ := p.Args["first"].(int)
+					first = graphqlFirst(first)
+					query := `SELECT id, id, title, description, likes, dislikes, user_id FROM threads`
+					args := []interface{}{}
+					if after, ok := p.Args["after"].(int); ok {
+						query += " WHERE id < ?"
+						args = append(args, after)
+					}
+					query += " ORDER BY id DESC LIMIT ?"
+					return graphqlQueryList(query, scanGraphqlThread, append(args, first)...)
+				},
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{"username": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					var u graphqlUser
+					err := db.QueryRow("SELECT id, username FROM users WHERE username = ?", p.Args["username"]).Scan(&u.ID, &u.Username)
+					if err == sql.ErrNoRows {
+						return nil, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					return u, nil
+				},
+			},
+			"categories": &graphql.Field{
+				Type: graphql.NewList(categoryType),
+				Args: firstArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					first, _ := p.Args["first"].(int)
+					return graphqlQueryList("SELECT id, id, name, slug, description FROM categories ORDER BY position, name LIMIT ?", func(rows scanner) (int, interface{}, error) {
+						var key int
+						var c Category
+						err := rows.Scan(&key, &c.ID, &c.Name, &c.Slug, &c.Description)
+						return key, c, err
+					}, graphqlFirst(first))
+				},
+			},
+			"messages": &graphql.Field{
+				Type:        graphql.NewList(messageType),
+				Description: "Messages sent to the logged in user",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					username, _ := p.Context.Value(graphqlUserKey).(string)
+					if username == "" {
+						return nil, errUnauthenticated
+					}
+					return graphqlQueryList("SELECT id, id, username, recipient, content, time FROM messages WHERE recipient = ? ORDER BY id", func(rows scanner) (int, interface{}, error) {
+						var key int
+						var m Message
+						err := rows.Scan(&key, &m.ID, &m.Username, &m.Recipient, &m.Content, &m.Time)
+						return key, m, err
+					}, username)
+				},
+			},
+		},
+	})
+
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"commentAdded": &graphql.Field{
+				Type: commentType,
+				Args: graphql.FieldConfigArgument{"threadId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					events := commentEvents.subscribe(p.Args["threadId"].(int))
+					out := make(chan interface{})
+					go func() {
+						defer close(out)
+						defer commentEvents.unsubscribe(events)
+						for {
+							select {
+							case <-p.Context.Done():
+								return
+							case comment := <-events:
+								select {
+								case out <- comment:
+								case <-p.Context.Done():
+									return
+								}
+							}
+						}
+					}()
+					return out, nil
+				},
+			},
+		},
+	})
+
+	var err error
+	graphqlSchema, err = graphql.NewSchema(graphql.SchemaConfig{
+		Query:        queryType,
+		Subscription: subscriptionType,
+	})
+	if err != nil {
+		log.Fatalf("Error building GraphQL schema: %v", err)
+	}
+}
+
+func graphqlQueryList(query string, scan func(scanner) (int, interface{}, error), args ...interface{}) (interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []interface{}{}
+	for rows.Next() {
+		_, v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// commentBroker fans new comments out to subscribers of their thread.
+type commentBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan Comment]int
+}
+
+var commentEvents = &commentBroker{subscribers: map[chan Comment]int{}}
+
+func (b *commentBroker) subscribe(threadID int) chan Comment {
+	ch := make(chan Comment, 8)
+	b.mu.Lock()
+	b.subscribers[ch] = threadID
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *commentBroker) unsubscribe(ch chan Comment) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// publish never blocks; slow subscribers miss events.
+func (b *commentBroker) publish(comment Comment) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, threadID := range b.subscribers {
+		if threadID != comment.ThreadID {
+			continue
+		}
+		select {
+		case ch <- comment:
+		default:
+		}
+	}
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+func readGraphqlRequest(r *http.Request) (graphqlRequest, error) {
+	var req graphqlRequest
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		return req, err
+	}
+	req.Query = r.URL.Query().Get("query")
+	req.OperationName = r.URL.Query().Get("operationName")
+	if vars := r.URL.Query().Get("variables"); vars != "" {
+		if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+func graphqlContext(r *http.Request) context.Context {
+	ctx := context.WithValue(r.Context(), graphqlLoadersKey, newGraphqlLoaders())
+	if username, _, err := apiUser(r); err == nil {
+		ctx = context.WithValue(ctx, graphqlUserKey, username)
+	}
+	return ctx
+}
+
+func writeGraphqlErrors(w http.ResponseWriter, status int, messages ...string) {
+	errs := make([]map[string]string, len(messages))
+	for i, m := range messages {
+		errs[i] = map[string]string{"message": m}
+	}
+	writeJSON(w, status, map[string]interface{}{"errors": errs})
+}
+
+func serveGraphql(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := readGraphqlRequest(r)
+	if err != nil {
+		writeGraphqlErrors(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	if err := checkGraphqlLimits(req.Query, req.Variables); err != nil {
+		writeGraphqlErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        graphqlContext(r),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// serveGraphqlSubscription runs a subscription operation and streams each
+// result as a server-sent event until the client disconnects.
+func serveGraphqlSubscription(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	req, err := readGraphqlRequest(r)
+	if err != nil {
+		writeGraphqlErrors(w, http.StatusBadRequest, "Invalid request: "+err.Error())
+		return
+	}
+	if err := checkGraphqlLimits(req.Query, req.Variables); err != nil {
+		writeGraphqlErrors(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	results := graphql.Subscribe(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        graphqlContext(r),
+	})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for result := range results {
+		payload, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("GraphQL subscription encoding error: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "event: next\ndata: %s\n\n", payload)
+		flusher.Flush()
+	}
+}
+
+// checkGraphqlLimits rejects queries nested deeper than graphqlMaxDepth or
+// whose estimated cost exceeds graphqlMaxComplexity with the given variables.
+func checkGraphqlLimits(query string, variables map[string]interface{}) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		// Let the executor report syntax errors in the usual format.
+		return nil
+	}
+
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if frag, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[frag.Name.Value] = frag
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		depth, cost := measureSelection(op.SelectionSet, fragments, operationVariables(op, variables), map[string]bool{})
+		if depth > graphqlMaxDepth {
+			return fmt.Errorf("query depth %d exceeds the maximum of %d", depth, graphqlMaxDepth)
+		}
+		if cost > graphqlMaxComplexity {
+			return fmt.Errorf("query complexity %d exceeds the maximum of %d", cost, graphqlMaxComplexity)
+		}
+	}
+	return nil
+}
+
+// operationVariables returns the variables of op: the values sent with the
+// request, or else the defaults op declares.
+func operationVariables(op *ast.OperationDefinition, sent map[string]interface{}) map[string]interface{} {
+	vars := map[string]interface{}{}
+	for _, def := range op.VariableDefinitions {
+		name := def.Variable.Name.Value
+		if v, ok := sent[name]; ok {
+			vars[name] = v
+		} else if def.DefaultValue != nil {
+			vars[name] = def.DefaultValue
+		}
+	}
+	return vars
+}
+
+func measureSelection(set *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition, vars map[string]interface{}, visiting map[string]bool) (int, int) {
+	if set == nil {
+		return 0, 0
+	}
+	maxDepth, cost := 0, 0
+	for _, selection := range set.Selections {
+		var depth, c int
+		switch sel := selection.(type) {
+		case *ast.Field:
+			childDepth, childCost := measureSelection(sel.SelectionSet, fragments, vars, visiting)
+			depth = childDepth + 1
+			c = 1 + childCost*listMultiplier(sel, vars)
+		case *ast.InlineFragment:
+			depth, c = measureSelection(sel.SelectionSet, fragments, vars, visiting)
+		case *ast.FragmentSpread:
+			name := sel.Name.Value
+			frag, ok := fragments[name]
+			if !ok || visiting[name] {
+				continue
+			}
+			visiting[name] = true
+			depth, c = measureSelection(frag.SelectionSet, fragments, vars, visiting)
+			delete(visiting, name)
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		cost += c
+	}
+	return maxDepth, cost
+}
+
+// listMultiplier returns how many items a list field can return, reading its
+// "first" argument, literal or from vars, as the resolvers do with graphqlFirst.
+func listMultiplier(field *ast.Field, vars map[string]interface{}) int {
+	if !graphqlListFields[field.Name.Value] {
+		return 1
+	}
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		var value interface{} = arg.Value
+		if v, ok := arg.Value.(*ast.Variable); ok {
+			if value, ok = vars[v.Name.Value]; !ok {
+				// An unset variable leaves the argument at its default
+				return graphqlListCost
+			}
+		}
+		return graphqlFirst(graphqlInt(value))
+	}
+	return graphqlListCost
+}
+
+// graphqlInt reads an integer from a literal in a query or a variable decoded
+// from JSON, or returns 0.
+func graphqlInt(value interface{}) int {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		n, _ := strconv.Atoi(v.Value)
+		return n
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int(v)
+		}
+	case int:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+func TestGraphqlLimitsResolveVariables(t *testing.T) {
+	const nested = `query($n: Int) { threads(first: $n) { comments(first: $n) { id } } }`
+	tests := []struct {
+		query     string
+		variables map[string]interface{}
+		ok        bool
+	}{
+		// 1 + n*(1 + n) against graphqlMaxComplexity
+		{nested, map[string]interface{}{"n": float64(5)}, true},
+		{nested, map[string]interface{}{"n": float64(100)}, false},
+		{nested, map[string]interface{}{"n": float64(100000)}, false},
+		{nested, map[string]interface{}{"n": float64(0)}, false}, // not positive means apiMaxLimit
+		{nested, map[string]interface{}{"n": "lots"}, false},
+		{nested, nil, true}, // unset: the argument default
+		{`query($n: Int = 100) { threads(first: $n) { comments(first: $n) { id } } }`, nil, false},
+		{`query($n: Int = 100) { threads(first: $n) { comments(first: $n) { id } } }`, map[string]interface{}{"n": float64(5)}, true},
+		{`{ threads(first: 5) { comments(first: 5) { id } } }`, nil, true},
+		{`{ threads(first: 100) { comments(first: 100) { id } } }`, nil, false},
+		{`{ threads(first: -1) { comments(first: -1) { id } } }`, nil, false},
+	}
+	for _, tt := range tests {
+		err := checkGraphqlLimits(tt.query, tt.variables)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkGraphqlLimits(%q, %v) = %v, want ok %v", tt.query, tt.variables, err, tt.ok)
+		}
+	}
+}
+
+func TestGraphqlFirst(t *testing.T) {
+	for first, want := range map[int]int{-5: apiMaxLimit, 0: apiMaxLimit, 1: 1, 20: 20, apiMaxLimit: apiMaxLimit, apiMaxLimit + 1: apiMaxLimit} {
+		if got := graphqlFirst(first); got != want {
+			t.Errorf("graphqlFirst(%d) = %d, want %d", first, got, want)
+		}
+	}
+}
+
+func TestGraphqlListsAreLimitedInSQL(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	var threads []int64
+	for i := 0; i < 2; i++ {
+		id, err := createThread(alice, ThreadInput{Title: fmt.Sprintf("Thread %d", i), Description: "Description"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		threads = append(threads, id)
+		for j := 0; j < 5; j++ {
+			if _, err := createComment(bob, int(id), 0, fmt.Sprintf("Comment %d", j), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Loaded together for both threads, each list keeps its own first comments
+	loaders := newGraphqlLoaders()
+	first := map[string]interface{}{"first": 2}
+	thunks := []func() (interface{}, error){
+		loaders.commentsByThread.load(int(threads[0]), first),
+		loaders.commentsByThread.load(int(threads[1]), first),
+	}
+	for i, thunk := range thunks {
+		v, err := thunk()
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments := v.([]interface{})
+		if len(comments) != 2 {
+			t.Fatalf("thread %d: %d comments loaded, want 2", threads[i], len(comments))
+		}
+		for _, c := range comments {
+			if c.(Comment).ThreadID != int(threads[i]) {
+				t.Errorf("thread %d got comment %d of thread %d", threads[i], c.(Comment).ID, c.(Comment).ThreadID)
+			}
+		}
+		if a, b := comments[0].(Comment).ID, comments[1].(Comment).ID; a >= b {
+			t.Errorf("thread %d: comments %d, %d not oldest first", threads[i], a, b)
+		}
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema: graphqlSchema,
+		RequestString: `query($n: Int) {
+            user(username: "bob") { comments(first: $n) { id } }
+            threads(first: 1) { comments(first: 3) { id } }
+        }`,
+		VariableValues: map[string]interface{}{"n": float64(4)},
+		Context:        context.WithValue(context.Background(), graphqlLoadersKey, newGraphqlLoaders()),
+	})
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	data := result.Data.(map[string]interface{})
+	if got := len(data["user"].(map[string]interface{})["comments"].([]interface{})); got != 4 {
+		t.Errorf("user comments: %d, want 4", got)
+	}
+	threadList := data["threads"].([]interface{})
+	if len(threadList) != 1 {
+		t.Fatalf("threads: %d, want 1", len(threadList))
+	}
+	if got := len(threadList[0].(map[string]interface{})["comments"].([]interface{})); got != 3 {
+		t.Errorf("thread comments: %d, want 3", got)
+	}
+}
+
+func TestGraphqlCategoriesAreLimited(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	var categoryIDs []string
+	for i := 0; i < graphqlListCost+5; i++ {
+		categoryIDs = append(categoryIDs, createTestCategory(t, fmt.Sprintf("Category %d", i)))
+	}
+	if _, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: categoryIDs}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{`{ categories { id } }`, graphqlListCost},
+		{`{ categories(first: 3) { id } }`, 3},
+		{`{ categories(first: 0) { id } }`, graphqlListCost + 5},
+		{`{ threads(first: 1) { categories { id } } }`, graphqlListCost},
+		{`{ threads(first: 1) { categories(first: 2) { id } } }`, 2},
+	}
+	for _, tt := range tests {
+		result := graphql.Do(graphql.Params{
+			Schema:        graphqlSchema,
+			RequestString: tt.query,
+			Context:       context.WithValue(context.Background(), graphqlLoadersKey, newGraphqlLoaders()),
+		})
+		if len(result.Errors) > 0 {
+			t.Fatalf("%s: %v", tt.query, result.Errors)
+		}
+		data := result.Data.(map[string]interface{})
+		list, ok := data["categories"].([]interface{})
+		if !ok {
+			list = data["threads"].([]interface{})[0].(map[string]interface{})["categories"].([]interface{})
+		}
+		if len(list) != tt.want {
+			t.Errorf("%s: %d categories, want %d", tt.query, len(list), tt.want)
+		}
+	}
+
+	// The cost counts each category's threads as many times as categories may be returned
+	if err := checkGraphqlLimits(`{ categories(first: 100) { threads(first: 100) { id } } }`, nil); err == nil {
+		t.Error("checkGraphqlLimits accepted 100 threads of 100 categories")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Emails are not sent while a request is handled. queueMail stores them in
+// mail_queue and the mail worker started by startMailWorker sends them in the
+// background, retrying failures with a growing delay. The worker also queues
+// the digest emails that are due.
+//
+// Where mail goes is set with MAIL_SENDER:
+//   - smtp sends through SMTP_HOST and SMTP_PORT (default 587), logging in with
+//     SMTP_USERNAME and SMTP_PASSWORD when they are set.
+//   - file writes each message as an .eml file to MAIL_DIR (default
+//     mail/outbox), for development and tests.
+//
+// Without MAIL_SENDER, smtp is used when SMTP_HOST is set; otherwise no email
+// is sent at all. MAIL_FROM sets the sender address.
+
+// mailSender delivers a complete message.
+type mailSender interface {
+	Send(from, to string, message []byte) error
+}
+
+// mailer is the configured sender, or nil when email is off.
+var mailer mailSender
+
+// smtpSender delivers through an SMTP server.
+type smtpSender struct {
+	host, port         string
+	username, password string
+}
+
+func (s smtpSender) Send(from, to string, message []byte) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.host, s.port), auth, from, []string{to}, message)
+}
+
+// fileSender writes every message to a file in dir instead of sending it.
+type fileSender struct {
+	dir string
+}
+
+func (s fileSender) Send(from, to string, message []byte) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(s.dir, name), message, 0o644)
+}
+
+// newMailSender returns the sender configured in the environment, or nil.
+func newMailSender() mailSender {
+	kind := os.Getenv("MAIL_SENDER")
+	if kind == "" && os.Getenv("SMTP_HOST") != "" {
+		kind = "smtp"
+	}
+	switch kind {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return smtpSender{
+			host:     os.Getenv("SMTP_HOST"),
+			port:     port,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = filepath.Join("mail", "outbox")
+		}
+		return fileSender{dir: dir}
+	case "":
+		return nil
+	}
+	log.Printf("Ignoring unknown MAIL_SENDER=%q, email is off", kind)
+	return nil
+}
+
+// mailFrom returns the sender address. It can be overridden with MAIL_FROM.
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "forum@localhost"
+}
+
+// siteURL returns the address of the forum used in links sent by email,
+// without a trailing slash. It can be overridden with BASE_URL.
+func siteURL() string {
+	if base := os.Getenv("BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// outgoingMail is an email waiting in mail_queue.
+type outgoingMail struct {
+	ID             int
+	To             string
+	Subject        string
+	Text           string
+	HTML           string
+	UnsubscribeURL string
+	Attempts       int
+}
+
+// queueMail stores an email for the mail worker. It does nothing when email is off.
+func queueMail(m outgoingMail) error {
+	if mailer == nil || m.To == "" {
+		return nil
+	}
+	now := time.Now()
+	_, err := db.Exec(`
+        INSERT INTO mail_queue (recipient, subject, text_body, html_body, unsubscribe_url, next_attempt_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`, m.To, m.Subject, m.Text, m.HTML, m.UnsubscribeURL, now, now)
+	return err
+}
+
+// buildMessage formats an email with a plain text and an HTML part.
+func buildMessage(from string, m outgoingMail, date time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = strings.Trim(from[at+1:], "> ")
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", from},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	if m.UnsubscribeURL != "" {
+		headers = append(headers,
+			[2]string{"List-Unsubscribe", "<" + m.UnsubscribeURL + ">"},
+			[2]string{"List-Unsubscribe-Post", "List-Unsubscribe=One-Click"})
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h[0], h[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// mailRetryDelay is how long to wait before attempt number attempts+1.
+func mailRetryDelay(attempts int) time.Duration {
+	delay := time.Minute << uint(attempts-1)
+	if attempts > 10 || delay > 6*time.Hour {
+		delay = 6 * time.Hour
+	}
+	return delay
+}
+
+// sendDueMail sends the queued emails that are due. A failed email is tried
+// again later until it has had MAIL_MAX_ATTEMPTS attempts (default 8).
+func sendDueMail() error {
+	maxAttempts := envInt("MAIL_MAX_ATTEMPTS", 8)
+	rows, err := db.Query(`
+        SELECT id, recipient, subject, text_body, html_body, unsubscribe_url, attempts FROM mail_queue
+        WHERE sent_at IS NULL AND attempts < ? AND next_attempt_at <= ?
+        ORDER BY next_attempt_at LIMIT 100`, maxAttempts, time.Now())
+	if err != nil {
+		return err
+	}
+	var due []outgoingMail
+	for rows.Next() {
+		var m outgoingMail
+		if err := rows.Scan(&m.ID, &m.To, &m.Subject, &m.Text, &m.HTML, &m.UnsubscribeURL, &m.Attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	from := mailFrom()
+	for _, m := range due {
+		message, err := buildMessage(from, m, time.Now())
+		if err == nil {
+			err = mailer.Send(from, m.To, message)
+		}
+		if err == nil {
+			_, err = db.Exec("UPDATE mail_queue SET sent_at = ?, attempts = attempts + 1, last_error = '' WHERE id = ?", time.Now(), m.ID)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		attempts := m.Attempts + 1
+		if attempts >= maxAttempts {
+			log.Printf("Giving up on email %d to %s after %d attempts: %v", m.ID, m.To, attempts, err)
+		}
+		if _, dbErr := db.Exec("UPDATE mail_queue SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+			attempts, time.Now().Add(mailRetryDelay(attempts)), err.Error(), m.ID); dbErr != nil {
+			return dbErr
+		}
+	}
+	return nil
+}
+
+// startMailWorker sends queued email and queues due digests every
+// MAIL_POLL_SECONDS (default 30) until the process exits. It does nothing
+// when email is off.
+func startMailWorker() {
+	if mailer == nil {
+		log.Println("Email is off: set MAIL_SENDER or SMTP_HOST to send notifications by email")
+		return
+	}
+	interval := time.Duration(envInt("MAIL_POLL_SECONDS", 30)) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		for {
+			if err := queueDueDigests(time.Now()); err != nil {
+				log.Printf("Failed to queue digests: %v", err)
+			}
+			if err := sendDueMail(); err != nil {
+				log.Printf("Failed to send email: %v", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -38,247 +39,406 @@ var db *sql.DB
 var jwtKey = []byte("your_secret_key") // Keep this key secret
 
 type Thread struct {
-	ID          int
-	Title       string
-	Description string
-	Likes       int
-	Dislikes    int
+	ID          int           `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Likes       int           `json:"likes"`
+	Dislikes    int           `json:"dislikes"`
+	UserID      int           `json:"user_id"`
+	Username    string        `json:"username,omitempty"`
+	Categories  []string      `json:"categories,omitempty"`
+	Tags        []string      `json:"tags,omitempty"`
+	CreatedAt   *time.Time    `json:"created_at,omitempty"`
+	EditedAt    *time.Time    `json:"edited_at,omitempty"`
+	PinnedAt    *time.Time    `json:"pinned_at,omitempty"`   // pinned above every other thread
+	LockedAt    *time.Time    `json:"locked_at,omitempty"`   // only moderators can comment
+	ArchivedAt  *time.Time    `json:"archived_at,omitempty"` // read-only
+	PinnedIn    []string      `json:"pinned_in,omitempty"`   // categories it is pinned in, set by getThread
+	Unread      *ThreadUnread `json:"unread,omitempty"`      // for the logged in user
+	Attachments []Attachment  `json:"attachments,omitempty"`
+	Poll        *Poll         `json:"poll,omitempty"`
 }
 type Comment struct {
-	ID       int
-	Content  string
-	Username string
-	ThreadID int
-	Likes    int
-	Dislikes int
-	UserID   int
+	ID          int          `json:"id"`
+	Content     string       `json:"content"`
+	Username    string       `json:"username,omitempty"`
+	ThreadID    int          `json:"thread_id"`
+	Likes       int          `json:"likes"`
+	Dislikes    int          `json:"dislikes"`
+	UserID      int          `json:"user_id"`
+	CreatedAt   *time.Time   `json:"created_at,omitempty"`
+	EditedAt    *time.Time   `json:"edited_at,omitempty"`
+	Deleted     bool         `json:"deleted"`
+	ParentID    *int         `json:"parent_id,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+type Category struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	ParentID    *int   `json:"parent_id,omitempty"`
+	Position    int    `json:"position"`
+	Color       string `json:"color,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	Archived    bool   `json:"archived"`
+	ThreadCount int    `json:"thread_count"` // threads filed directly under the category
+	Depth       int    `json:"-"`            // how deep it is nested, set by listCategories
 }
 type Message struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"` // Ensure field names are correctly capitalized for external visibility
-	Recipient string    `json:"recipient"`
-	Content   string    `json:"content"`
-	Time      time.Time `json:"time"`
+	ID            int             `json:"id"`
+	Username      string          `json:"username"` // Ensure field names are correctly capitalized for external visibility
+	Recipient     string          `json:"recipient"`
+	Content       string          `json:"content"`
+	Time          time.Time       `json:"time"`
+	Reactions     []ReactionCount `json:"reactions,omitempty"`
+	Mentions      []string        `json:"mentions,omitempty"`       // users the content mentions
+	AttachmentIDs []int           `json:"attachment_ids,omitempty"` // uploads to attach when sending
+	Attachments   []Attachment    `json:"attachments,omitempty"`
 }
 
-// ProfileData holds the profile information to be displayed.
+// ProfileData holds the profile information to be displayed. The likes and
+// dislikes of a user are private and only loaded when they view their own profile.
 type ProfileData struct {
 	Username            string
+	IsOwner             bool
+	Details             UserDetails
+	Follows             FollowCounts
+	CanFollow           bool // whether the viewer is logged in and not the owner
+	Following           bool // whether the viewer follows the user
+	Muted               bool // whether the viewer muted the user
+	Reputation          int
+	ReputationHistory   []ReputationEvent
+	Privileges          []PrivilegeStatus
 	UserThreadLikes     []Thread
 	UserThreadDislikes  []Thread
 	UserCommentLikes    []Comment
 	UserCommentDislikes []Comment
 	UserThreads         []Thread
 	UserComments        []Comment
+	Watching            []WatchedThread
+	WatchedCategories   []WatchedCategory
+	NextCursors         map[string]string // cursor of the next page by profile section
+}
+
+// Sections of a profile. Each one is paged on its own and named after the
+// query parameter holding its cursor.
+const (
+	profileThreads           = "threads"
+	profileComments          = "comments"
+	profileLikedThreads      = "liked_threads"
+	profileDislikedThreads   = "disliked_threads"
+	profileLikedComments     = "liked_comments"
+	profileDislikedComments  = "disliked_comments"
+	profileFollowers         = "followers"
+	profileFollowing         = "following"
+	profileWatching          = "watching"
+	profileWatchedCategories = "watched_categories"
+)
+
+// privateProfileSections are only shown to the owner of the profile.
+var privateProfileSections = map[string]bool{
+	profileLikedThreads:      true,
+	profileDislikedThreads:   true,
+	profileLikedComments:     true,
+	profileDislikedComments:  true,
+	profileWatching:          true,
+	profileWatchedCategories: true,
 }
 
-// userProfileHandler handles the profile page logic.
+// profilePageSize is how many items each profile section shows per page.
+const profilePageSize = 10
+
+// userProfileHandler sends the logged in user to their public profile.
 func userProfileHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Assuming userID is retrieved from session or authentication
-		userID := 1 // Replace with actual userID retrieval logic
-
-		profile, err := listProfileData(db, userID)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error fetching profile data: %v", err), http.StatusInternalServerError)
+		username, _ := sessionUser(r)
+		if username == "" {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
+		http.Redirect(w, r, "/u/"+url.PathEscape(username), http.StatusSeeOther)
+	}
+}
 
-		tmpl, err := template.ParseFiles("templates/profile.html")
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
-			return
-		}
+// /u/{username}: public profile page
+func servePublicProfile(w http.ResponseWriter, r *http.Request) {
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", r.PathValue("username")).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching profile data: %v", err), http.StatusInternalServerError)
+		return
+	}
 
-		err = tmpl.Execute(w, profile)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
-			return
+	// Every section reads its own cursor, so paging one keeps the others in place
+	query := r.URL.Query()
+	after := map[string]int{}
+	for _, section := range []string{profileThreads, profileComments, profileLikedThreads, profileDislikedThreads, profileLikedComments, profileDislikedComments, profileWatching} {
+		if v := query.Get(section); v != "" {
+			id, err := decodeCursor(v)
+			if err != nil {
+				http.Error(w, "Invalid page", http.StatusBadRequest)
+				return
+			}
+			after[section] = id
 		}
 	}
+
+	_, viewerID := sessionUser(r)
+	profile, err := listProfileData(db, userID, viewerID, after)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error fetching profile data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	nextPages := map[string]string{}
+	for section, cursor := range profile.NextCursors {
+		next := r.URL.Query()
+		next.Set(section, cursor)
+		nextPages[section] = "?" + next.Encode()
+	}
+
+	tmpl, err := template.ParseFiles("templates/profile.html")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, map[string]interface{}{
+		"Profile":     profile,
+		"NextPages":   nextPages,
+		"WatchLevels": watchLevels,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
 }
 
-// listProfileData retrieves and constructs ProfileData for a given userID.
-func listProfileData(db *sql.DB, userID int) (*ProfileData, error) {
+// listProfileData retrieves and constructs ProfileData for a given userID as
+// seen by viewerID. after holds the cursor of each section that is not on its
+// first page.
+func listProfileData(db *sql.DB, userID, viewerID int, after map[string]int) (*ProfileData, error) {
 	// Fetch username
 	var username string
-	err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	var reputation int
+	err := db.QueryRow("SELECT username, reputation FROM users WHERE id = ?", userID).Scan(&username, &reputation)
 	if err != nil {
 		return nil, err
 	}
 
-	// Fetch threads liked and disliked by the user
-	userThreadLikes, err := fetchThreadsByLikeType(db, userID, 1) // 1 for likes
+	// Fetch recent reputation changes and the privileges they unlocked
+	reputationHistory, err := listReputationEvents(userID, 50)
 	if err != nil {
 		return nil, err
 	}
-
-	userThreadDislikes, err := fetchThreadsByLikeType(db, userID, -1) // -1 for dislikes
+	privileges, err := listPrivileges(userID)
 	if err != nil {
 		return nil, err
 	}
-
-	// Fetch comments liked and disliked by the user
-	userCommentLikes, err := fetchCommentsByLikeType(db, userID, 1) // 1 for likes
+	details, err := getUserDetails(userID)
 	if err != nil {
 		return nil, err
 	}
-
-	userCommentDislikes, err := fetchCommentsByLikeType(db, userID, -1) // -1 for dislikes
+	follows, err := countFollows(userID)
 	if err != nil {
 		return nil, err
 	}
-
-	// Fetch threads and comments created by the user
-	userThreads, err := fetchUserThreads(db, userID)
+	following, err := hasRelation(userFollows, viewerID, userID)
 	if err != nil {
 		return nil, err
 	}
-
-	userComments, err := fetchUserComments(db, userID)
+	muted, err := hasRelation(userMutes, viewerID, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Prepare profile data
 	profile := &ProfileData{
-		Username:            username,
-		UserThreadLikes:     userThreadLikes,
-		UserThreadDislikes:  userThreadDislikes,
-		UserCommentLikes:    userCommentLikes,
-		UserCommentDislikes: userCommentDislikes,
-		UserThreads:         userThreads,
-		UserComments:        userComments,
+		Username:          username,
+		IsOwner:           viewerID != 0 && viewerID == userID,
+		Details:           details,
+		Follows:           follows,
+		CanFollow:         viewerID != 0 && viewerID != userID,
+		Following:         following,
+		Muted:             muted,
+		Reputation:        reputation,
+		ReputationHistory: reputationHistory,
+		Privileges:        privileges,
+		NextCursors:       map[string]string{},
+	}
+
+	var next string
+	setNext := func(section string) {
+		if next != "" {
+			profile.NextCursors[section] = next
+		}
 	}
 
-	return profile, nil
-}
+	// Fetch threads and comments created by the user
+	if profile.UserThreads, next, err = fetchUserThreads(db, userID, profilePageSize, after[profileThreads]); err != nil {
+		return nil, err
+	}
+	setNext(profileThreads)
+	if profile.UserComments, next, err = fetchUserComments(db, userID, profilePageSize, after[profileComments]); err != nil {
+		return nil, err
+	}
+	setNext(profileComments)
 
-// fetchThreadsByLikeType retrieves threads liked or disliked by the user based on like type.
-func fetchThreadsByLikeType(db *sql.DB, userID int, likeType int) ([]Thread, error) {
-	var query string
-	if likeType == 1 {
-		query = `
-			SELECT t.id, t.title, t.description, t.likes, t.dislikes
-			FROM threads t
-			JOIN thread_likes tl ON t.id = tl.thread_id
-			WHERE tl.user_id = ? AND tl.like_type = 1
-		`
-	} else if likeType == -1 {
-		query = `
-			SELECT t.id, t.title, t.description, t.likes, t.dislikes
-			FROM threads t
-			JOIN thread_likes tl ON t.id = tl.thread_id
-			WHERE tl.user_id = ? AND tl.like_type = -1
-		`
-	}
-
-	rows, err := db.Query(query, userID)
-	if err != nil {
+	if !profile.IsOwner {
+		return profile, nil
+	}
+
+	// Fetch threads and comments liked and disliked by the user
+	if profile.UserThreadLikes, next, err = fetchThreadsByLikeType(db, userID, 1, profilePageSize, after[profileLikedThreads]); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	setNext(profileLikedThreads)
+	if profile.UserThreadDislikes, next, err = fetchThreadsByLikeType(db, userID, -1, profilePageSize, after[profileDislikedThreads]); err != nil {
+		return nil, err
+	}
+	setNext(profileDislikedThreads)
+	if profile.UserCommentLikes, next, err = fetchCommentsByLikeType(db, userID, 1, profilePageSize, after[profileLikedComments]); err != nil {
+		return nil, err
+	}
+	setNext(profileLikedComments)
+	if profile.UserCommentDislikes, next, err = fetchCommentsByLikeType(db, userID, -1, profilePageSize, after[profileDislikedComments]); err != nil {
+		return nil, err
+	}
+	setNext(profileDislikedComments)
 
-	var threads []Thread
-	for rows.Next() {
-		var thread Thread
-		if err := rows.Scan(&thread.ID, &thread.Title, &thread.Description, &thread.Likes, &thread.Dislikes); err != nil {
-			return nil, err
-		}
-		threads = append(threads, thread)
+	// Fetch the threads and categories the user watches
+	if profile.Watching, next, err = listWatchedThreads(userID, profilePageSize, after[profileWatching]); err != nil {
+		return nil, err
+	}
+	setNext(profileWatching)
+	if profile.WatchedCategories, err = listWatchedCategories(userID, true); err != nil {
+		return nil, err
 	}
 
-	return threads, nil
+	return profile, nil
 }
 
-// fetchCommentsByLikeType retrieves comments liked or disliked by the user based on like type.
-func fetchCommentsByLikeType(db *sql.DB, userID int, likeType int) ([]Comment, error) {
-	var query string
-	if likeType == 1 {
-		query = `
-			SELECT c.id, c.content, c.user_id, c.thread_id, c.likes, c.dislikes
-			FROM comments c
-			JOIN comment_likes cl ON c.id = cl.comment_id
-			WHERE cl.user_id = ? AND cl.like_type = 1
-		`
-	} else if likeType == -1 {
-		query = `
-			SELECT c.id, c.content, c.user_id, c.thread_id, c.likes, c.dislikes
-			FROM comments c
-			JOIN comment_likes cl ON c.id = cl.comment_id
-			WHERE cl.user_id = ? AND cl.like_type = -1
-		`
-	}
-
-	rows, err := db.Query(query, userID)
+// profileThreadSelect selects the columns scanned by scanProfileThreads.
+const profileThreadSelect = `
+	SELECT t.id, t.title, t.description, t.likes, t.dislikes, t.user_id, u.username
+	FROM threads t
+	JOIN users u ON u.id = t.user_id
+`
+
+// profileCommentSelect selects the columns scanned by scanProfileComments.
+const profileCommentSelect = `
+	SELECT c.id, c.content, c.user_id, u.username, c.thread_id, c.likes, c.dislikes
+	FROM comments c
+	JOIN users u ON u.id = c.user_id
+`
+
+// fetchThreadsByLikeType retrieves threads liked or disliked by the user based on like type.
+func fetchThreadsByLikeType(db *sql.DB, userID, likeType, limit, after int) ([]Thread, string, error) {
+	query := profileThreadSelect + `
+		JOIN item_reactions ir ON ir.item_type = 'thread' AND ir.item_id = t.id
+		JOIN reactions r ON r.id = ir.reaction_id
+		WHERE ir.user_id = ? AND r.score = ? AND (? = 0 OR t.id < ?)
+		ORDER BY t.id DESC LIMIT ?
+	`
+	rows, err := db.Query(query, userID, likeType, after, after, limit+1)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	defer rows.Close()
+	return scanProfileThreads(rows, limit)
+}
 
-	var comments []Comment
-	for rows.Next() {
-		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.UserID, &comment.ThreadID, &comment.Likes, &comment.Dislikes); err != nil {
-			return nil, err
-		}
-		comments = append(comments, comment)
+// fetchCommentsByLikeType retrieves comments liked or disliked by the user based on like type.
+func fetchCommentsByLikeType(db *sql.DB, userID, likeType, limit, after int) ([]Comment, string, error) {
+	query := profileCommentSelect + `
+		JOIN item_reactions ir ON ir.item_type = 'comment' AND ir.item_id = c.id
+		JOIN reactions r ON r.id = ir.reaction_id
+		WHERE ir.user_id = ? AND r.score = ? AND c.deleted_at IS NULL AND (? = 0 OR c.id < ?)
+		ORDER BY c.id DESC LIMIT ?
+	`
+	rows, err := db.Query(query, userID, likeType, after, after, limit+1)
+	if err != nil {
+		return nil, "", err
 	}
-
-	return comments, nil
+	return scanProfileComments(rows, limit)
 }
 
 // fetchUserThreads retrieves threads created by the user.
+func fetchUserThreads(db *sql.DB, userID, limit, after int) ([]Thread, string, error) {
+	query := profileThreadSelect + `
+		WHERE t.user_id = ? AND (? = 0 OR t.id < ?)
+		ORDER BY t.id DESC LIMIT ?
+	`
+	rows, err := db.Query(query, userID, after, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	return scanProfileThreads(rows, limit)
+}
 
-func fetchUserThreads(db *sql.DB, userID int) ([]Thread, error) {
-	// Implement query to fetch threads created by the user
-	query := `
-		SELECT id, title, description, likes, dislikes
-		FROM threads
-		WHERE user_id = ?
+// fetchUserComments retrieves comments created by the user.
+func fetchUserComments(db *sql.DB, userID, limit, after int) ([]Comment, string, error) {
+	query := profileCommentSelect + `
+		WHERE c.user_id = ? AND c.deleted_at IS NULL AND (? = 0 OR c.id < ?)
+		ORDER BY c.id DESC LIMIT ?
 	`
-	rows, err := db.Query(query, userID)
+	rows, err := db.Query(query, userID, after, after, limit+1)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	return scanProfileComments(rows, limit)
+}
+
+// scanProfileThreads reads a page of threads queried with one row more than
+// limit, which tells whether there is a next page.
+func scanProfileThreads(rows *sql.Rows, limit int) ([]Thread, string, error) {
 	defer rows.Close()
 
-	var threads []Thread
+	threads := []Thread{}
 	for rows.Next() {
 		var thread Thread
-		if err := rows.Scan(&thread.ID, &thread.Title, &thread.Description, &thread.Likes, &thread.Dislikes); err != nil {
-			return nil, err
+		if err := rows.Scan(&thread.ID, &thread.Title, &thread.Description, &thread.Likes, &thread.Dislikes, &thread.UserID, &thread.Username); err != nil {
+			return nil, "", err
 		}
 		threads = append(threads, thread)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
 
-	return threads, nil
+	var next string
+	if len(threads) > limit {
+		threads = threads[:limit]
+		next = encodeCursor(threads[limit-1].ID)
+	}
+	return threads, next, nil
 }
 
-// fetchUserComments retrieves comments created by the user.
-func fetchUserComments(db *sql.DB, userID int) ([]Comment, error) {
-	// Implement query to fetch comments created by the user
-	query := `
-		SELECT id, content, user_id, thread_id, likes, dislikes
-		FROM comments
-		WHERE user_id = ?
-	`
-	rows, err := db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
+// scanProfileComments is scanProfileThreads for comments.
+func scanProfileComments(rows *sql.Rows, limit int) ([]Comment, string, error) {
 	defer rows.Close()
 
-	var comments []Comment
+	comments := []Comment{}
 	for rows.Next() {
 		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.UserID, &comment.ThreadID, &comment.Likes, &comment.Dislikes); err != nil {
-			return nil, err
+		if err := rows.Scan(&comment.ID, &comment.Content, &comment.UserID, &comment.Username, &comment.ThreadID, &comment.Likes, &comment.Dislikes); err != nil {
+			return nil, "", err
 		}
 		comments = append(comments, comment)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
 
-	return comments, nil
+	var next string
+	if len(comments) > limit {
+		comments = comments[:limit]
+		next = encodeCursor(comments[limit-1].ID)
+	}
+	return comments, next, nil
 }
 
 func handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
@@ -291,21 +451,21 @@ func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Google callback code: %s", code)
 
 	// Exchange code for access token
-	token, err := googleOauthConfig.Exchange(r.Context(), code)
+	_, err := googleOauthConfig.Exchange(r.Context(), code)
 	if err != nil {
 		http.Error(w, "Failed to exchange Google token", http.StatusInternalServerError)
 		log.Printf("Google token exchange error: %v", err)
 		return
 	}
 
-	// Store token in session
+	// Only the provider is kept in the session, never the token
 	session, err := store.Get(r, "session-name")
 	if err != nil {
 		http.Error(w, "Failed to get session", http.StatusInternalServerError)
 		log.Printf("Session error: %v", err)
 		return
 	}
-	session.Values["googleAccessToken"] = token.AccessToken
+	session.Values["oauthProvider"] = "google"
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, "Failed to save session", http.StatusInternalServerError)
 		log.Printf("Session save error: %v", err)
@@ -324,28 +484,14 @@ func handleProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for Google access token in session
-	googleAccessToken, googleOK := session.Values["googleAccessToken"].(string)
-
-	// Check for GitHub access token in session
-	githubAccessToken, githubOK := session.Values["githubAccessToken"].(string)
-
-	// Example: Using Google access token
-	if googleOK {
-		// Use googleAccessToken to fetch user profile data from Google APIs if needed
-		fmt.Fprintf(w, "Google Profile Page\nAccess Token: %s", googleAccessToken)
-		return
-	}
-
-	// Example: Using GitHub access token
-	if githubOK {
-		// Use githubAccessToken to fetch user profile data from GitHub APIs if needed
-		fmt.Fprintf(w, "GitHub Profile Page\nAccess Token: %s", githubAccessToken)
+	// Provider tokens are never stored; the user is sent to their forum profile
+	if _, ok := session.Values["oauthProvider"].(string); ok {
+		http.Redirect(w, r, "/userProfile", http.StatusSeeOther)
 		return
 	}
 
-	http.Error(w, "Access token not found in session", http.StatusInternalServerError)
-	log.Println("Access token not found in session")
+	http.Error(w, "Not signed in with a provider", http.StatusUnauthorized)
+	log.Println("OAuth provider not found in session")
 }
 
 func handleProtectedEndpoint(w http.ResponseWriter, r *http.Request) {
@@ -356,15 +502,13 @@ func handleProtectedEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accessToken, ok := session.Values["accessToken"].(string)
-	if !ok {
-		http.Error(w, "Access token not found in session", http.StatusInternalServerError)
-		log.Println("Access token not found in session") // Log the error
+	if _, ok := session.Values["oauthProvider"].(string); !ok {
+		http.Error(w, "Not signed in with a provider", http.StatusUnauthorized)
+		log.Println("OAuth provider not found in session") // Log the error
 		return
 	}
 
-	// Use accessToken to make authenticated requests or perform actions
-	fmt.Fprintf(w, "Access Token: %s", accessToken)
+	fmt.Fprint(w, "Access granted")
 }
 
 func handleGitHubLogin(w http.ResponseWriter, r *http.Request) {
@@ -376,21 +520,21 @@ func handleGitHubCallback(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	log.Printf("GitHub callback code: %s", code) // Log the received code
 
-	token, err := githubOauthConfig.Exchange(r.Context(), code)
+	_, err := githubOauthConfig.Exchange(r.Context(), code)
 	if err != nil {
 		http.Error(w, "Failed to exchange GitHub token", http.StatusInternalServerError)
 		log.Printf("GitHub token exchange error: %v", err) // Log the error
 		return
 	}
 
-	// Store token in session
+	// Only the provider is kept in the session, never the token
 	session, err := store.Get(r, "session-name")
 	if err != nil {
 		http.Error(w, "Failed to get session", http.StatusInternalServerError)
 		log.Printf("Session error: %v", err) // Log the error
 		return
 	}
-	session.Values["githubAccessToken"] = token.AccessToken
+	session.Values["oauthProvider"] = "github"
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, "Failed to save session", http.StatusInternalServerError)
 		log.Printf("Session save error: %v", err) // Log the error
@@ -435,14 +579,15 @@ func handleFacebookCallback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Store the user data in the session
+	// Only the provider and the user's id there are kept in the session
 	session, err := store.Get(r, "session-name")
 	if err != nil {
 		http.Error(w, "Failed to get session", http.StatusInternalServerError)
 		log.Printf("Session error: %v", err)
 		return
 	}
-	session.Values["user"] = user
+	session.Values["oauthProvider"] = "facebook"
+	session.Values["oauthUserID"] = user.ID
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, "Failed to save session", http.StatusInternalServerError)
 		log.Printf("Session save error: %v", err)
@@ -454,8 +599,9 @@ func handleFacebookCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 func init() {
+	// main still refuses to start without .env; tests run without one
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		log.Fatalf("Error loading .env file %v", err)
 	}
 
@@ -480,7 +626,19 @@ func init() {
 		Endpoint:     facebook.Endpoint,
 		Scopes:       []string{"email"},
 	}
-	store = sessions.NewCookieStore([]byte("SESSION_SECRET"))
+	store = sessions.NewCookieStore(sessionKeys())
+}
+
+// sessionKeys returns the keys signing and encrypting the OAuth session
+// cookie, derived from SESSION_SECRET. Without it the keys are random and
+// OAuth sessions end when the server restarts.
+func sessionKeys() (hashKey, blockKey []byte) {
+	secret := os.Getenv("SESSION_SECRET")
+	if secret == "" {
+		log.Println("SESSION_SECRET is not set, OAuth sessions will not survive a restart")
+		return generateRandomKey(32), generateRandomKey(32)
+	}
+	return hmacSHA256([]byte(secret), "session hash key"), hmacSHA256([]byte(secret), "session encryption key")
 }
 
 // database load
@@ -490,6 +648,12 @@ func initDB(dataSourceName string) (*sql.DB, error) {
 		return nil, fmt.Errorf("error opening database: %w", err)
 	}
 
+	// Tables schema.sql is about to create may need filling from older data
+	created, err := missingTables(db)
+	if err != nil {
+		return nil, fmt.Errorf("error reading database: %w", err)
+	}
+
 	// Read and execute SQL commands from schema.sql
 	schema, err := ioutil.ReadFile("schema.sql")
 	if err != nil {
@@ -501,6 +665,10 @@ func initDB(dataSourceName string) (*sql.DB, error) {
 		return nil, fmt.Errorf("error executing schema.sql: %w", err)
 	}
 
+	if err := migrateDB(db, created); err != nil {
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
 	log.Println("Database initialized successfully.")
 	return db, nil
 }
@@ -540,6 +708,15 @@ func main() {
 	}
 	defer db.Close()
 
+	blobs = newBlobStore()
+
+	// Maintenance commands run instead of the server
+	if len(os.Args) > 1 {
+		code := runCommand(os.Args[1:])
+		db.Close()
+		os.Exit(code)
+	}
+
 	http.HandleFunc("/", serveHome)
 
 	err = godotenv.Load()
@@ -557,17 +734,49 @@ func main() {
 	http.HandleFunc("/protected", handleProtectedEndpoint)
 	http.HandleFunc("/profile", handleProfile)
 	http.HandleFunc("/userProfile", userProfileHandler(db))
+	http.HandleFunc("GET /u/{username}", servePublicProfile)
+	http.HandleFunc("/settings/profile", serveProfileSettings)
+	http.HandleFunc("GET /avatar/{username}", serveAvatar)
+	http.HandleFunc("/feed", serveFeed)
+	http.HandleFunc("GET /feed.atom", serveFeedAtom)
+	http.HandleFunc("/follow", handleFollow)
+	http.HandleFunc("/mute", handleMute)
+	http.HandleFunc("/watch", handleWatch)
+	http.HandleFunc("/mark-read", handleMarkRead)
+	http.HandleFunc("/poll/vote", handlePollVote)
+	http.HandleFunc("/notifications", serveNotifications)
+	http.HandleFunc("/notifications/open", openNotification)
+	http.HandleFunc("/notifications/read", handleMarkNotificationsRead)
+	http.HandleFunc("GET /notifications/stream", serveNotificationStream)
+	http.HandleFunc("/settings/notifications", serveNotificationSettings)
+	http.HandleFunc("/unsubscribe", serveUnsubscribe)
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.HandleFunc("/static/highlight.css", serveHighlightCSS)
+	http.HandleFunc("GET /attachments/{id}", serveAttachment)
+	http.HandleFunc("GET /attachments/{id}/thumbnail", serveAttachment)
 	http.HandleFunc("/login", serveLogin)
 	http.HandleFunc("/register", serveRegister)
 	http.HandleFunc("/index", serveIndex)
 	http.HandleFunc("/thread", serveThread)
+	http.HandleFunc("/thread/edit", serveEditThread)
+	http.HandleFunc("/thread/moderate", handleModerateThread)
+	http.HandleFunc("/thread/revisions", serveThreadRevisions)
 	http.HandleFunc("/logout", serveLogout)
 	http.HandleFunc("/login-guest", serveLoginGuest)
 	http.HandleFunc("/create-thread", serveCreateThread)
 	http.HandleFunc("/like-dislike", handleLikeDislike)
 	http.HandleFunc("/comment", serveComment)
+	http.HandleFunc("/comment/edit", serveEditComment)
+	http.HandleFunc("/comment/delete", serveDeleteComment)
+	http.HandleFunc("/comment/revisions", serveCommentRevisions)
+	http.HandleFunc("/react", handleReact)
+	http.HandleFunc("/admin/reactions", serveAdminReactions)
+	http.HandleFunc("/admin/categories", serveAdminCategories)
+	http.HandleFunc("/admin/announcements", serveAdminAnnouncements)
+	http.HandleFunc("/admin/moderation", serveModerationLog)
+	http.HandleFunc("/announcements/dismiss", handleDismissAnnouncement)
+	http.HandleFunc("/tag/{name}", serveTag)
 	// Set up routes for CHAT
 	http.HandleFunc("/messages", serveMessages) // Ensure serveMessages is defined somewhere
 	http.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
@@ -595,6 +804,13 @@ func main() {
 	})
 	//chat ended
 	http.HandleFunc("/comment-like-dislike", handleCommentLikeDislike)
+	registerAPIRoutes(http.HandleFunc)
+	http.HandleFunc("/graphql", serveGraphql)
+	http.HandleFunc("/graphql/subscriptions", serveGraphqlSubscription)
+
+	mailer = newMailSender()
+	startMailWorker()
+	startAttachmentJanitor()
 	log.Fatal(http.ListenAndServe(":8080", nil))
 
 	//log.Println("JWT Key:", base64.StdEncoding.EncodeToString(jwtKey))
@@ -709,8 +925,12 @@ func getUserFromSession(tokenString string) (string, int, error) {
 		return jwtKey, nil
 	})
 
+	if err != nil || token == nil {
+		return "", 0, err
+	}
+
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		username := claims["username"].(string)
+		username, _ := claims["username"].(string)
 		if username == "guest" {
 			return username, 0, nil // Return 0 for userID if guest
 		}
@@ -754,6 +974,19 @@ func getUserIDFromCookie(r *http.Request) (int, error) {
 	return userID, nil
 }
 
+// sessionUser returns the logged in user of an HTML request, or 0 for guests.
+func sessionUser(r *http.Request) (string, int) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil {
+		return "", 0
+	}
+	username, userID, err := getUserFromSession(cookie.Value)
+	if err != nil || username == "guest" {
+		return "", 0
+	}
+	return username, userID
+}
+
 // /index goruntuleme
 func serveIndex(w http.ResponseWriter, r *http.Request) {
 	// Attempt to retrieve the session token and username
@@ -769,23 +1002,42 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	categoryFilter := r.URL.Query().Get("category")
+	tagFilters := r.URL.Query()["tag"]
 	likeType := r.URL.Query().Get("likeType") // "like" or "dislike"
 
 	var rows *sql.Rows
+	var queryParams []interface{}
+
+	// Threads pinned in the filtered category come right after the ones pinned everywhere
+	pinnedHere := "0"
+	if categoryFilter != "" {
+		pinnedHere = `EXISTS (SELECT 1 FROM thread_categories tp JOIN categories cp ON cp.id = tp.category_id
+            WHERE tp.thread_id = t.id AND tp.pinned_at IS NOT NULL AND (cp.slug = ? OR cp.name = ?))`
+		queryParams = append(queryParams, categoryFilter, categoryFilter)
+	}
 	baseQuery := `
-        SELECT DISTINCT t.id, t.title, t.description 
+        SELECT DISTINCT t.id, t.title, t.description, u.username, t.pinned_at, t.locked_at, t.archived_at,
+            ` + pinnedHere + ` AS pinned_here
         FROM threads t
+        JOIN users u ON u.id = t.user_id
         LEFT JOIN thread_categories tc ON t.id = tc.thread_id
         LEFT JOIN categories c ON tc.category_id = c.id
     `
-	var queryParams []interface{}
 
 	whereClauses := []string{}
 
-	// Filter by category if specified
+	// Filter by category if specified, given by slug or name, with its subcategories
 	if categoryFilter != "" {
-		whereClauses = append(whereClauses, "c.name = ?")
-		queryParams = append(queryParams, categoryFilter)
+		whereClauses = append(whereClauses, "c.id IN ("+categoryTreeQuery+")")
+		queryParams = append(queryParams, categoryFilter, categoryFilter)
+	}
+
+	// Filter by tags if specified, combined with the category; a thread needs all of them
+	for _, tag := range tagFilters {
+		if tag = normalizeTag(tag); tag != "" {
+			whereClauses = append(whereClauses, tagFilterClause)
+			queryParams = append(queryParams, tag)
+		}
 	}
 
 	// Filter by like or dislike if specified
@@ -796,7 +1048,8 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 		} else if likeType == "dislike" {
 			likeValue = -1
 		}
-		whereClauses = append(whereClauses, "EXISTS (SELECT 1 FROM thread_likes tl WHERE tl.thread_id = t.id AND tl.like_type = ?)")
+		whereClauses = append(whereClauses, `EXISTS (SELECT 1 FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+            WHERE ir.item_type = 'thread' AND ir.item_id = t.id AND r.score = ?)`)
 		queryParams = append(queryParams, likeValue)
 	}
 
@@ -804,6 +1057,7 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 	if len(whereClauses) > 0 {
 		baseQuery += " WHERE " + strings.Join(whereClauses, " AND ")
 	}
+	baseQuery += " ORDER BY t.pinned_at IS NULL, pinned_here DESC, t.id"
 
 	// Execute the query with all parameters
 	rows, err = db.Query(baseQuery, queryParams...)
@@ -814,91 +1068,294 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	var threads []Thread
+	pinned := map[int]bool{}
 	for rows.Next() {
 		var t Thread
-		if err := rows.Scan(&t.ID, &t.Title, &t.Description); err != nil {
+		var pinnedAt, lockedAt, archivedAt sql.NullTime
+		var isPinnedHere bool
+		if err := rows.Scan(&t.ID, &t.Title, &t.Description, &t.Username, &pinnedAt, &lockedAt, &archivedAt, &isPinnedHere); err != nil {
 			http.Error(w, "Failed to read thread data", http.StatusInternalServerError)
 			return
 		}
+		setThreadStates(&t, pinnedAt, lockedAt, archivedAt)
+		pinned[t.ID] = pinnedAt.Valid || isPinnedHere
 		threads = append(threads, t)
 	}
 
+	// Show logged in users what is new since they last read each thread
+	_, viewerID := sessionUser(r)
+	if err := attachUnread(viewerID, threads); err != nil {
+		log.Printf("Failed to fetch unread comments: %v", err)
+	}
+	if err := loadThreadTags(threads); err != nil {
+		log.Printf("Failed to fetch tags: %v", err)
+	}
+	var category Category
+	if categoryFilter != "" {
+		if category, err = findCategory(categoryFilter); err != nil && err != errNotFound {
+			log.Printf("Failed to fetch category: %v", err)
+		}
+	}
+	categories, err := listCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+
+	popularTags, err := suggestTags("", maxTagSuggestions)
+	if err != nil {
+		log.Printf("Failed to fetch tags: %v", err)
+	}
+	tagFilter := ""
+	if len(tagFilters) > 0 {
+		tagFilter = tagFilters[0]
+	}
+
+	// The poll fields are only offered to users who may create polls
+	canCreatePoll, err := hasPrivilege(db, viewerID, privilegeCreatePoll)
+	if err != nil {
+		log.Printf("Failed to check privilege: %v", err)
+	}
+
+	announcements, err := activeAnnouncements(r, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch announcements: %v", err)
+	}
+
 	// Render the page with the filtered threads and username
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
+	tmpl := template.Must(template.ParseFiles("templates/index.html", "templates/announcements.html"))
 	tmpl.Execute(w, map[string]interface{}{
-		"Username": username,
-		"Threads":  threads,
+		"Announcements": announcements,
+		"Username":      username,
+		"Threads":       threads,
+		"Pinned":        pinned,
+		"IsGuest":       viewerID == 0,
+		"CategoryID":    category.ID,
+		"Category":      category.Name,
+		"Categories":    categories,
+		"Tag":           tagFilter,
+		"PopularTags":   popularTags,
+		"MaxTags":       maxThreadTags,
+		"Back":          r.URL.RequestURI(),
+		"CanCreatePoll": canCreatePoll,
+		"PollResults":   pollResults,
 	})
 }
 
 // konu/topic goruntuleme (commentleri ile birlikte)
 func serveThread(w http.ResponseWriter, r *http.Request) {
-	threadID := r.URL.Query().Get("id")
-	if threadID == "" {
+	threadID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
 		http.Error(w, "Thread ID is required", http.StatusBadRequest)
 		return
 	}
 
-	var thread Thread
-	var username string
-	err := db.QueryRow(`
-        SELECT t.id, t.title, t.description, t.likes, t.dislikes, u.username 
-        FROM threads t 
-        JOIN users u ON t.user_id = u.id 
-        WHERE t.id = ?`, threadID).Scan(&thread.ID, &thread.Title, &thread.Description, &thread.Likes, &thread.Dislikes, &username)
+	thread, err := getThread(threadID)
+	if err == errNotFound {
+		// Merged threads lead to the thread they were merged into
+		if newID, redirectErr := threadRedirect(threadID); redirectErr == nil {
+			query := r.URL.Query()
+			query.Set("id", strconv.Itoa(newID))
+			http.Redirect(w, r, "/thread?"+query.Encode(), http.StatusMovedPermanently)
+			return
+		}
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to fetch thread details: %v", err)
 		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
 		return
 	}
 
-	// Fetch categories for the thread
-	categoryRows, err := db.Query("SELECT c.name FROM categories c JOIN thread_categories tc ON c.id = tc.category_id WHERE tc.thread_id = ?", threadID)
+	// Offer edit links to users allowed to edit the thread and comments
+	_, viewerID := sessionUser(r)
+	canEdit := viewerID != 0 && checkThreadEdit(thread, viewerID) == nil
+	viewerRole, _ := getUserRole(viewerID)
+	viewer := &commentViewer{ID: viewerID, IsModerator: isModerator(viewerRole), Archived: thread.ArchivedAt != nil}
+	viewer.CanComment = viewerID != 0 && (viewer.IsModerator || (thread.LockedAt == nil && thread.ArchivedAt == nil))
+	vote, err := getVote(threadVotes, threadID, viewerID)
 	if err != nil {
-		log.Printf("Failed to fetch categories: %v", err)
-		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
-		return
+		log.Printf("Failed to fetch vote: %v", err)
+	}
+	viewer.Votes, err = listThreadCommentVotes(threadID, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch comment votes: %v", err)
+	}
+	watch, err := getThreadWatch(viewerID, threadID)
+	if err != nil {
+		log.Printf("Failed to fetch watch: %v", err)
+	}
+
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != commentSortNewest && sortOrder != commentSortBest {
+		sortOrder = commentSortOldest
 	}
-	defer categoryRows.Close()
 
-	var categories []string
-	for categoryRows.Next() {
-		var categoryName string
-		if err := categoryRows.Scan(&categoryName); err != nil {
-			log.Printf("Failed to read category %v", err)
-			http.Error(w, "Failed to read category data", http.StatusInternalServerError)
+	// A comment permalink shows only that comment and its replies
+	var focus *Comment
+	if v := r.URL.Query().Get("comment"); v != "" {
+		commentID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid comment ID", http.StatusBadRequest)
+			return
+		}
+		comment, err := getComment(commentID)
+		if err == errNotFound || (err == nil && comment.ThreadID != threadID) {
+			http.Error(w, "Comment not found", http.StatusNotFound)
 			return
 		}
-		categories = append(categories, categoryName)
+		if err != nil {
+			http.Error(w, "Failed to fetch comment", http.StatusInternalServerError)
+			return
+		}
+		focus = &comment
+	}
+	rootID := 0
+	if focus != nil {
+		rootID = focus.ID
 	}
 
-	// Fetch comments for the thread, including likes and dislikes
-	rows, err := db.Query("SELECT c.id, c.content, u.username, (SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.like_type = 1) AS likes, (SELECT COUNT(*) FROM comment_likes cl WHERE cl.comment_id = c.id AND cl.like_type = -1) AS dislikes FROM comments c JOIN users u ON u.id = c.user_id WHERE c.thread_id = ?", threadID)
+	// Fetch the comment tree of the thread, including likes and dislikes
+	comments, err := listCommentTree(threadID, rootID, sortOrder, viewer)
 	if err != nil {
 		log.Printf("Failed to fetch comments: %v", err)
 		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var comments []Comment
-	for rows.Next() {
-		var comment Comment
-		if err := rows.Scan(&comment.ID, &comment.Content, &comment.Username, &comment.Likes, &comment.Dislikes); err != nil {
-			log.Printf("Failed to read comment %v", err)
-			http.Error(w, "Failed to read comment data", http.StatusInternalServerError)
-			return
+	// Fetch the reactions of the thread and its comments
+	threadReactions, err := listItemReactions(threadVotes, []int{threadID}, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch reactions: %v", err)
+		http.Error(w, "Failed to fetch reactions", http.StatusInternalServerError)
+		return
+	}
+	commentIDs, authorIDs := []int{}, []int{thread.UserID}
+	for _, node := range comments {
+		node.walk(func(n *commentNode) {
+			commentIDs = append(commentIDs, n.ID)
+			authorIDs = append(authorIDs, n.UserID)
+		})
+	}
+	commentReactions, err := listItemReactions(commentVotes, commentIDs, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch reactions: %v", err)
+		http.Error(w, "Failed to fetch reactions", http.StatusInternalServerError)
+		return
+	}
+	signatures, err := listUserSignatures(authorIDs)
+	if err != nil {
+		log.Printf("Failed to fetch signatures: %v", err)
+		http.Error(w, "Failed to fetch signatures", http.StatusInternalServerError)
+		return
+	}
+	description, err := renderPosts("thread", map[int]string{thread.ID: thread.Description})
+	if err != nil {
+		log.Printf("Failed to render thread: %v", err)
+		http.Error(w, "Failed to render thread", http.StatusInternalServerError)
+		return
+	}
+	sources := map[int]string{}
+	for _, node := range comments {
+		node.walk(func(n *commentNode) {
+			if !n.Deleted {
+				sources[n.ID] = n.Content
+			}
+		})
+	}
+	rendered, err := renderPosts("comment", sources)
+	if err != nil {
+		log.Printf("Failed to render comments: %v", err)
+		http.Error(w, "Failed to fetch comments", http.StatusInternalServerError)
+		return
+	}
+	visible := make([]int, 0, len(sources))
+	for id := range sources {
+		visible = append(visible, id)
+	}
+	commentAttachments, err := listAttachments("comment", visible)
+	if err == nil {
+		threads := []Thread{thread}
+		err = loadThreadAttachments(threads)
+		thread = threads[0]
+	}
+	if err != nil {
+		log.Printf("Failed to fetch attachments: %v", err)
+		http.Error(w, "Failed to fetch attachments", http.StatusInternalServerError)
+		return
+	}
+	lastCommentID := 0
+	for _, node := range comments {
+		node.walk(func(n *commentNode) {
+			n.ReactionBar = newReactionBar(commentVotes, n.ID, commentReactions[n.ID], viewerID != 0 && !n.Deleted && !viewer.Archived)
+			n.Signature = signatures[n.UserID]
+			n.ContentHTML = rendered[n.ID]
+			n.Attachments = commentAttachments[n.ID]
+			if n.ID > lastCommentID {
+				lastCommentID = n.ID
+			}
+		})
+	}
+
+	poll, err := getPoll(threadID, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch poll: %v", err)
+		http.Error(w, "Failed to fetch poll", http.StatusInternalServerError)
+		return
+	}
+
+	var categoryPins []CategoryPin
+	var allCategories []Category
+	inCategory := map[int]bool{}
+	if viewer.IsModerator {
+		if categoryPins, err = listCategoryPins(threadID); err != nil {
+			log.Printf("Failed to fetch category pins: %v", err)
 		}
-		comments = append(comments, comment)
+		for _, pin := range categoryPins {
+			inCategory[pin.ID] = true
+		}
+		if allCategories, err = listCategories(); err != nil {
+			log.Printf("Failed to fetch categories: %v", err)
+		}
+	}
+
+	// The viewer has now seen every comment on the page
+	if err := markThreadRead(viewerID, threadID, lastCommentID); err != nil {
+		log.Printf("Failed to mark thread read: %v", err)
+	}
+
+	announcements, err := activeAnnouncements(r, viewerID)
+	if err != nil {
+		log.Printf("Failed to fetch announcements: %v", err)
 	}
 
 	// Render the thread page with all gathered data
-	tmpl := template.Must(template.ParseFiles("templates/thread.html"))
+	tmpl := template.Must(template.ParseFiles("templates/thread.html", "templates/announcements.html"))
 	tmpl.Execute(w, map[string]interface{}{
-		"Thread":     thread,
-		"Username":   username,
-		"Categories": categories,
-		"Comments":   comments,
+		"Announcements": announcements,
+		"Back":          r.URL.RequestURI(),
+		"Thread":        thread,
+		"Username":      thread.Username,
+		"Categories":    thread.Categories,
+		"Comments":      comments,
+		"CanEdit":       canEdit,
+		"IsGuest":       viewerID == 0,
+		"IsModerator":   viewer.IsModerator,
+		"CanComment":    viewer.CanComment,
+		"CategoryPins":  categoryPins,
+		"AllCategories": allCategories,
+		"InCategory":    inCategory,
+		"Vote":          vote,
+		"ReactionBar":   newReactionBar(threadVotes, threadID, threadReactions[threadID], viewerID != 0 && !viewer.Archived),
+		"Sort":          sortOrder,
+		"SortOrders":    []string{commentSortOldest, commentSortNewest, commentSortBest},
+		"Focus":         focus,
+		"Signature":     signatures[thread.UserID],
+		"Description":   description[thread.ID],
+		"Watch":         watch,
+		"WatchLevels":   watchLevels,
+		"Poll":          poll,
 	})
 }
 
@@ -992,81 +1449,53 @@ func serveRegister(w http.ResponseWriter, r *http.Request) {
 
 // konu like-dislike ve error handling
 func handleLikeDislike(w http.ResponseWriter, r *http.Request) {
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
 
-	threadID := r.FormValue("thread_id")
-	likeTypeParam := r.FormValue("like_type") // This should be either "1" for like or "-1" for dislike
-	likeType, err := strconv.Atoi(likeTypeParam)
-	if err != nil || (likeType != 1 && likeType != -1) {
-		http.Error(w, "Invalid like type", http.StatusBadRequest)
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
 		return
 	}
 
-	userID, err := getUserIDFromCookie(r)
+	threadID, err := strconv.Atoi(r.FormValue("thread_id"))
 	if err != nil {
-		http.Error(w, "Authentication error", http.StatusUnauthorized)
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
 		return
 	}
-
-	username, err := getCurrentUser(r)
+	// 1 likes, -1 dislikes and 0 takes the vote back
+	vote, err := parseVote(r.FormValue("like_type"))
 	if err != nil {
-		// Handle error, maybe log it
-		http.Error(w, "Failed to get current user: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if username == "guest" {
-		// If there's an error or the user is a guest, deny access
-		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		http.Error(w, "Invalid like type", http.StatusBadRequest)
 		return
 	}
 
-	// Start a transaction
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	totals, err := castVote(threadVotes, threadID, userID, vote)
+	if err == errNotFound {
+		http.Error(w, "Thread not found", http.StatusNotFound)
 		return
 	}
-	defer tx.Rollback()
-
-	var existingType int
-	err = tx.QueryRow("SELECT like_type FROM thread_likes WHERE thread_id = ? AND user_id = ?", threadID, userID).Scan(&existingType)
-	if err != nil && err != sql.ErrNoRows {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+	if err == errNeedsReputation {
+		http.Error(w, fmt.Sprintf("You need %d reputation to dislike", privilegeThreshold(privilegeDownvote)), http.StatusForbidden)
 		return
 	}
-
-	if existingType != 0 {
-		http.Error(w, "You have already reacted to this thread", http.StatusForbidden)
+	if err == errThreadArchived {
+		http.Error(w, closedThreadMessage(err), http.StatusForbidden)
 		return
 	}
-
-	_, err = tx.Exec("INSERT INTO thread_likes (thread_id, user_id, like_type) VALUES (?, ?, ?)", threadID, userID, likeType)
 	if err != nil {
+		log.Printf("Failed to record thread vote: %v", err)
 		http.Error(w, "Failed to record reaction", http.StatusInternalServerError)
 		return
 	}
 
-	if likeType == 1 {
-		_, err = tx.Exec("UPDATE threads SET likes = likes + 1 WHERE id = ?", threadID)
-	} else {
-		_, err = tx.Exec("UPDATE threads SET dislikes = dislikes + 1 WHERE id = ?", threadID)
-	}
-	if err != nil {
-		http.Error(w, "Failed to update thread", http.StatusInternalServerError)
-		return
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		http.Error(w, "Failed to commit transaction", http.StatusInternalServerError)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, totals)
 		return
 	}
-
-	http.Redirect(w, r, "/thread?id="+threadID, http.StatusSeeOther)
+	http.Redirect(w, r, "/thread?id="+strconv.Itoa(threadID), http.StatusSeeOther)
 }
 
 // konu olusturma
@@ -1089,31 +1518,37 @@ func serveCreateThread(w http.ResponseWriter, r *http.Request) {
 		//fmt.Printf(username, userID)
 
 		// Proceed with creating the thread since the user is authenticated and not a guest
-		title := r.FormValue("title")
-		description := r.FormValue("description")
-		categories := r.Form["categories"]
-
-		// Insert the new thread
-		result, err := db.Exec("INSERT INTO threads (title, description, user_id) VALUES (?, ?, ?)", title, description, userID)
+		attachmentIDs, err := uploadFormAttachments(w, r, userID)
 		if err != nil {
-			http.Error(w, "Failed to create thread", http.StatusInternalServerError)
+			writeUploadError(w, err)
 			return
 		}
-
-		// Get the last inserted thread ID
-		threadID, err := result.LastInsertId()
+		poll, err := pollFromForm(r, userID)
 		if err != nil {
-			http.Error(w, "Failed to retrieve thread ID", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Insert category associations in the thread_categories table
-		for _, catID := range categories {
-			_, err = db.Exec("INSERT INTO thread_categories (thread_id, category_id) VALUES (?, ?)", threadID, catID)
-			if err != nil {
-				http.Error(w, "Failed to assign categories", http.StatusInternalServerError)
-				return
-			}
+		// Insert the new thread with its category associations, tags, attachments and poll
+		_, err = createThread(userID, ThreadInput{
+			Title:         r.FormValue("title"),
+			Description:   r.FormValue("description"),
+			CategoryIDs:   r.Form["categories"],
+			Tags:          splitTags(r.FormValue("tags")),
+			AttachmentIDs: attachmentIDs,
+			Poll:          poll,
+		})
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errForbidden {
+			http.Error(w, fmt.Sprintf("You need %d reputation to create a poll", privilegeThreshold(privilegeCreatePoll)), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create thread", http.StatusInternalServerError)
+			return
 		}
 
 		// Redirect to the index page after successful creation
@@ -1127,72 +1562,127 @@ func serveCreateThread(w http.ResponseWriter, r *http.Request) {
 // yorumlar kismi
 func serveComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
-		threadID := r.FormValue("thread_id")
-		comment := r.FormValue("comment")
 		cookie, err := r.Cookie("session_token")
 		if err != nil {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-		username, _, err := getUserFromSession(cookie.Value) // Updated to use getUserFromSession
+		username, userID, err := getUserFromSession(cookie.Value) // Updated to use getUserFromSession
 		if err != nil {
 			http.Error(w, "Invalid session", http.StatusUnauthorized)
 			return
 		}
+		if username == "guest" {
+			http.Error(w, "Guests cannot comment, please log in", http.StatusUnauthorized)
+			return
+		}
+
+		// Files are read first, so the form is parsed within the upload limits
+		attachmentIDs, err := uploadFormAttachments(w, r, userID)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		threadID := r.FormValue("thread_id")
+		comment := r.FormValue("comment")
+		parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+
+		id, err := strconv.Atoi(threadID)
+		if err != nil {
+			http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+			return
+		}
 
-		_, err = db.Exec("INSERT INTO comments (content, user_id, thread_id) SELECT ?, id, ? FROM users WHERE username = ?", comment, threadID, username)
+		commentID, err := createComment(userID, id, parentID, comment, attachmentIDs)
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errNotFound {
+			http.Error(w, "Thread not found", http.StatusNotFound)
+			return
+		}
+		if err == errInvalidParent {
+			http.Error(w, "Invalid parent comment", http.StatusBadRequest)
+			return
+		}
+		if msg := closedThreadMessage(err); msg != "" {
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to post comment", http.StatusInternalServerError)
 			return
 		}
-		http.Redirect(w, r, "/thread?id="+threadID, http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/thread?id=%d#comment-%d", id, commentID), http.StatusSeeOther)
 		return
 	}
 }
 
 // yorum like-dislike
+// The voter always comes from the session; any user_id sent with the form is ignored.
 func handleCommentLikeDislike(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
 
-	commentID := r.FormValue("comment_id")
-	userID := r.FormValue("user_id")     // Ensure you are capturing the user ID correctly
-	likeType := r.FormValue("like_type") // Should be '1' for like or '-1' for dislike
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
 
-	username, err := getCurrentUser(r)
-	if err != nil {
-		// Handle error, maybe log it
-		http.Error(w, "Failed to get current user: "+err.Error(), http.StatusInternalServerError)
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil || commentID <= 0 {
+		http.Error(w, "Invalid comment ID", http.StatusBadRequest)
 		return
 	}
-	if username == "guest" {
-		// If there's an error or the user is a guest, deny access
-		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+	// 1 likes, -1 dislikes and 0 takes the vote back
+	vote, err := parseVote(r.FormValue("like_type"))
+	if err != nil {
+		http.Error(w, "Invalid like type", http.StatusBadRequest)
 		return
 	}
 
-	// Check if the user has already liked or disliked the comment
-	var exists int
-	err = db.QueryRow("SELECT COUNT(*) FROM comment_likes WHERE comment_id = ? AND user_id = ?", commentID, userID).Scan(&exists)
+	comment, err := getComment(commentID)
+	if err == errNotFound {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Error checking existing likes/dislikes: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-
-	if exists > 0 {
-		// Update existing record
-		_, err = db.Exec("UPDATE comment_likes SET like_type = ? WHERE comment_id = ? AND user_id = ?", likeType, commentID, userID)
-	} else {
-		// Insert new record
-		_, err = db.Exec("INSERT INTO comment_likes (comment_id, user_id, like_type) VALUES (?, ?, ?)", commentID, userID, likeType)
+	if threadID := r.FormValue("thread_id"); threadID != "" && threadID != strconv.Itoa(comment.ThreadID) {
+		http.Error(w, "Comment does not belong to this thread", http.StatusBadRequest)
+		return
 	}
 
+	totals, err := castVote(commentVotes, commentID, userID, vote)
+	if err == errNotFound {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	if err == errNeedsReputation {
+		http.Error(w, fmt.Sprintf("You need %d reputation to dislike", privilegeThreshold(privilegeDownvote)), http.StatusForbidden)
+		return
+	}
+	if err == errThreadArchived {
+		http.Error(w, closedThreadMessage(err), http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to update comment likes/dislikes: %v", err)
+		log.Printf("Failed to record comment vote: %v", err)
 		http.Error(w, "Failed to update comment", http.StatusInternalServerError)
 		return
 	}
 
-	http.Redirect(w, r, "/thread?id="+r.FormValue("thread_id"), http.StatusSeeOther)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, totals)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/thread?id=%d#comment-%d", comment.ThreadID, commentID), http.StatusSeeOther)
 }
 
 func executeQuery(query string, args ...interface{}) (sql.Result, error) {
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of every user made by createTestUser.
+const testPassword = "password"
+
+// newTestDB points db at a fresh in-memory database with schema.sql applied
+// and restores the previous one when the test ends.
+func newTestDB(t *testing.T) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	testDB, err := initDB(fmt.Sprintf("file:%s?mode=memory&cache=shared", name))
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	// A shared in-memory database lives as long as one connection stays open
+	testDB.SetMaxIdleConns(1)
+	testDB.SetConnMaxIdleTime(0)
+	testDB.SetConnMaxLifetime(0)
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+}
+
+// createTestUser adds a user with testPassword and returns its id.
+func createTestUser(t *testing.T, username string) int {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Exec("INSERT INTO users (username, password, email) VALUES (?, ?, ?)", username, string(hash), username+"@example.com")
+	if err != nil {
+		t.Fatalf("creating user %s: %v", username, err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// setTestRole gives a user made by createTestUser another role.
+func setTestRole(t *testing.T, userID int, role string) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// login signs username in through /login and returns the session cookie.
+func login(t *testing.T, username string) *http.Cookie {
+	t.Helper()
+	form := url.Values{"username": {username}, "password": {testPassword}}
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	serveLogin(w, r)
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "session_token" {
+			return cookie
+		}
+	}
+	t.Fatalf("login as %s: no session cookie, status %d: %s", username, w.Code, w.Body)
+	return nil
+}
+
+// postForm sends form to handler as a POST signed in with cookie, which may be nil.
+func postForm(handler http.HandlerFunc, path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestCommentVoteIgnoresForgedUserID(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	author := createTestUser(t, "carol")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := login(t, "alice")
+
+	w := postForm(handleCommentLikeDislike, "/comment-like-dislike", url.Values{
+		"comment_id": {fmt.Sprint(commentID)},
+		"like_type":  {"1"},
+		"user_id":    {fmt.Sprint(bob)},
+	}, cookie)
+	if w.Code != http.StatusSeeOther && w.Code != http.StatusOK {
+		t.Fatalf("vote: status %d: %s", w.Code, w.Body)
+	}
+
+	voteOf := func(userID int) int {
+		var vote sql.NullInt64
+		err := db.QueryRow(`
+            SELECT r.score FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+            WHERE ir.item_type = ? AND ir.item_id = ? AND ir.user_id = ? AND r.score != 0`,
+			commentVotes.kind, commentID, userID).Scan(&vote)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
+		return int(vote.Int64)
+	}
+	if got := voteOf(alice); got != 1 {
+		t.Errorf("vote of the signed in user = %d, want 1", got)
+	}
+	if got := voteOf(bob); got != 0 {
+		t.Errorf("vote of the forged user_id = %d, want none", got)
+	}
+	var likes int
+	if err := db.QueryRow("SELECT likes FROM comments WHERE id = ?", commentID).Scan(&likes); err != nil {
+		t.Fatal(err)
+	}
+	if likes != 1 {
+		t.Errorf("likes = %d, want 1", likes)
+	}
+}
+
+func TestCommentVoteRejectsBadRequests(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createTestUser(t, "bob")
+	cookie := login(t, "bob")
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/comment-like-dislike?comment_id=%d&like_type=1", commentID), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleCommentLikeDislike(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	for _, likeType := range []string{"", "2", "-2", "like", "1.5"} {
+		w := postForm(handleCommentLikeDislike, "/comment-like-dislike", url.Values{
+			"comment_id": {fmt.Sprint(commentID)},
+			"like_type":  {likeType},
+		}, cookie)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("like_type %q: status %d, want %d", likeType, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	var votes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM item_reactions").Scan(&votes); err != nil {
+		t.Fatal(err)
+	}
+	if votes != 0 {
+		t.Errorf("%d reactions recorded by rejected requests", votes)
+	}
+}
+
+func TestOAuthSessionIsEncrypted(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/auth/google/callback", nil)
+	session, err := store.Get(r, "session-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["oauthProvider"] = "google"
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies set, want 1", len(cookies))
+	}
+	raw, err := base64.URLEncoding.DecodeString(cookies[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("oauthProvider")) || bytes.Contains(raw, []byte("google")) {
+		t.Error("the session cookie can be read without the key")
+	}
+
+	// The cookie reads back with the same store
+	r = httptest.NewRequest(http.MethodGet, "/profile", nil)
+	r.AddCookie(cookies[0])
+	session, err = store.Get(r, "session-name")
+	if err != nil || session.Values["oauthProvider"] != "google" {
+		t.Errorf("session read back as %v, %v", session.Values, err)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// User written markdown is rendered with goldmark, which escapes raw HTML, and
+// the result is sanitized once more so only safe markup reaches a page. Posts
+// support CommonMark with GitHub's tables, strikethrough, task lists and
+// autolinks, fenced code highlighted by language, ||spoilers|| and @mentions
+// of existing users.
+//
+// Rendering is cached with the latest revision of each thread and comment, so
+// a post is rendered once per edit. Mentions are resolved when a revision is
+// rendered. Raise markdownVersion whenever the output changes to render every
+// post again.
+
+// markdownVersion is stored with cached HTML; cache entries of other versions are stale.
+const markdownVersion = 1
+
+// maxPreviewLength limits the markdown the preview endpoint renders.
+const maxPreviewLength = 64 << 10
+
+// highlightStyle is the chroma style of code blocks, served by serveHighlightCSS.
+const highlightStyle = "github"
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.GFM,
+		spoilers{},
+		highlighting.NewHighlighting(
+			highlighting.WithStyle(highlightStyle),
+			highlighting.WithFormatOptions(chromahtml.WithClasses(true)),
+		),
+	),
+	goldmark.WithParserOptions(parser.WithASTTransformers(util.Prioritized(mentionLinker{}, 100))),
+)
+
+var markdownPolicy = newMarkdownPolicy()
+
+// newMarkdownPolicy allows what the renderer produces on top of bluemonday's
+// policy for user generated content: spoilers, mention links and the classes
+// chroma puts on highlighted code.
+func newMarkdownPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^mention$`)).OnElements("a")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(spoiler|[a-z][a-z0-9]{0,3})$`)).OnElements("span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^chroma$`)).OnElements("pre")
+	p.AllowAttrs("type", "checked", "disabled").OnElements("input") // task lists
+	return p
+}
+
+// renderMarkdown turns markdown into sanitized HTML.
+func renderMarkdown(source string) (template.HTML, error) {
+	return renderPost(source, nil)
+}
+
+// renderPost turns the markdown of a thread or comment into sanitized HTML,
+// linking the mentions of the users in mentioned.
+func renderPost(source string, mentioned map[string]int) (template.HTML, error) {
+	ctx := parser.NewContext()
+	ctx.Set(mentionsKey, mentioned)
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf, parser.WithContext(ctx)); err != nil {
+		return "", err
+	}
+	return template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// spoilers is a goldmark extension for ||hidden text||, rendered as a span
+// the stylesheet hides until it is hovered.
+type spoilers struct{}
+
+var kindSpoiler = ast.NewNodeKind("Spoiler")
+
+type spoilerNode struct {
+	ast.BaseInline
+}
+
+func (n *spoilerNode) Kind() ast.NodeKind { return kindSpoiler }
+
+func (n *spoilerNode) Dump(source []byte, level int) { ast.DumpHelper(n, source, level, nil, nil) }
+
+func (spoilers) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(spoilerParser{}, 500)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(spoilerRenderer{}, 500)))
+}
+
+type spoilerParser struct{}
+
+func (spoilerParser) Trigger() []byte { return []byte{'|'} }
+
+// Parse reads a || delimiter; single pipes stay text.
+func (spoilerParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	before := block.PrecendingCharacter()
+	line, segment := block.PeekLine()
+	node := parser.ScanDelimiter(line, before, 2, spoilerDelimiter{})
+	if node == nil || node.OriginalLength != 2 || before == '|' {
+		return nil
+	}
+	node.Segment = segment.WithStop(segment.Start + node.OriginalLength)
+	block.Advance(node.OriginalLength)
+	pc.PushDelimiter(node)
+	return node
+}
+
+type spoilerDelimiter struct{}
+
+func (spoilerDelimiter) IsDelimiter(b byte) bool { return b == '|' }
+
+func (spoilerDelimiter) CanOpenCloser(opener, closer *parser.Delimiter) bool {
+	return opener.Char == closer.Char
+}
+
+func (spoilerDelimiter) OnMatch(consumes int) ast.Node { return &spoilerNode{} }
+
+type spoilerRenderer struct{}
+
+func (spoilerRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindSpoiler, func(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering {
+			w.WriteString(`<span class="spoiler">`)
+		} else {
+			w.WriteString(`</span>`)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// mentionsKey holds the users whose mentions are linked, by username.
+var mentionsKey = parser.NewContextKey()
+
+// mentionLinker turns the @mentions of known users in text into links to
+// their profiles. Code and existing links are left alone.
+type mentionLinker struct{}
+
+func (mentionLinker) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	users, _ := pc.Get(mentionsKey).(map[string]int)
+	if len(users) == 0 {
+		return
+	}
+	source := reader.Source()
+
+	var texts []*ast.Text
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.CodeSpan, *ast.Link, *ast.AutoLink, *ast.Image, *ast.CodeBlock, *ast.FencedCodeBlock, *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			texts = append(texts, n)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, t := range texts {
+		parent := t.Parent()
+		start := t.Segment.Start
+		for _, m := range mentionPattern.FindAllSubmatchIndex(t.Segment.Value(source), -1) {
+			name := string(t.Segment.Value(source)[m[2]:m[3]])
+			if _, ok := users[name]; !ok {
+				continue
+			}
+			at := t.Segment.Start + m[2] - 1 // the @
+			end := t.Segment.Start + m[3]
+			if at > start {
+				parent.InsertBefore(parent, t, ast.NewTextSegment(text.NewSegment(start, at)))
+			}
+			link := ast.NewLink()
+			link.Destination = []byte("/u/" + url.PathEscape(name))
+			link.SetAttributeString("class", []byte("mention"))
+			link.AppendChild(link, ast.NewTextSegment(text.NewSegment(at, end)))
+			parent.InsertBefore(parent, t, link)
+			start = end
+		}
+		// The original node keeps the rest of the text and its line break
+		t.Segment = t.Segment.WithStart(start)
+	}
+}
+
+// revisionTables are where the HTML of threads and comments is cached.
+var revisionTables = map[string]struct{ table, column string }{
+	"thread":  {"thread_revisions", "thread_id"},
+	"comment": {"comment_revisions", "comment_id"},
+}
+
+// renderPosts returns the HTML of threads or comments (kind) by id, given
+// their current markdown. The HTML comes from the cache of their latest
+// revision; revisions not rendered yet are rendered and stored. Posts from
+// before revisions existed are rendered every time.
+func renderPosts(kind string, sources map[int]string) (map[int]template.HTML, error) {
+	rendered := map[int]template.HTML{}
+	if len(sources) == 0 {
+		return rendered, nil
+	}
+	rt := revisionTables[kind]
+	ids := make([]interface{}, 0, len(sources))
+	for id := range sources {
+		ids = append(ids, id)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+        SELECT %[2]s, id, html, html_version FROM %[1]s
+        WHERE id IN (SELECT MAX(id) FROM %[1]s WHERE %[2]s IN (?%[3]s) GROUP BY %[2]s)`,
+		rt.table, rt.column, strings.Repeat(", ?", len(ids)-1)), ids...)
+	if err != nil {
+		return nil, err
+	}
+	revisions := map[int]int{}
+	for rows.Next() {
+		var postID, revisionID, version int
+		var cached string
+		if err := rows.Scan(&postID, &revisionID, &cached, &version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revisions[postID] = revisionID
+		if version == markdownVersion {
+			rendered[postID] = template.HTML(cached)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for id, source := range sources {
+		if _, ok := rendered[id]; !ok {
+			stale = append(stale, source)
+		}
+	}
+	if len(stale) == 0 {
+		return rendered, nil
+	}
+	mentioned, err := resolveMentions(stale...)
+	if err != nil {
+		return nil, err
+	}
+	for id, source := range sources {
+		if _, ok := rendered[id]; ok {
+			continue
+		}
+		html, err := renderPost(source, mentioned)
+		if err != nil {
+			return nil, err
+		}
+		rendered[id] = html
+		if revisionID, ok := revisions[id]; ok {
+			if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET html = ?, html_version = ? WHERE id = ?", rt.table), string(html), markdownVersion, revisionID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rendered, nil
+}
+
+// highlightCSS is the stylesheet of highlighted code, built once from highlightStyle.
+var highlightCSS = func() []byte {
+	var buf bytes.Buffer
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&buf, styles.Get(highlightStyle)); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+// /static/highlight.css: colors of highlighted code blocks
+func serveHighlightCSS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(highlightCSS)
+}
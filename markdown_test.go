@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMarkdownXSSCorpus(t *testing.T) {
+	cases, err := readMarkdownCases("testdata/markdown_xss.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) < 2 {
+		t.Fatalf("only %d cases read from the corpus", len(cases))
+	}
+	for i, source := range cases {
+		t.Run(fmt.Sprint(i+1), func(t *testing.T) {
+			rendered, problems, err := checkMarkdownCase(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(problems) > 0 {
+				t.Errorf("%q rendered as %s, unsafe: %q", source, rendered, problems)
+			}
+		})
+	}
+}
+
+// The corpus only proves something if unsafeMarkup finds what it looks for.
+func TestUnsafeMarkup(t *testing.T) {
+	tests := []struct {
+		fragment string
+		unsafe   bool
+	}{
+		{`<p>Hello <a href="https://example.com">there</a></p>`, false},
+		{`<a href="/threads/1">relative</a> <a href="mailto:a@example.com">mail</a>`, false},
+		{`<input type="checkbox" disabled>`, false},
+		{`<script>alert(1)</script>`, true},
+		{`<img src="x" onerror="alert(1)">`, true},
+		{`<a href="javascript:alert(1)">x</a>`, true},
+		{`<a href=" JavaScript:alert(1)">x</a>`, true},
+		{`<img src="data:text/html,x">`, true},
+		{`<p style="position:fixed">x</p>`, true},
+		{`<svg><circle/></svg>`, true},
+		{`<iframe srcdoc="x"></iframe>`, true},
+		{`<input type="text">`, true},
+	}
+	for _, tt := range tests {
+		problems, err := unsafeMarkup(tt.fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(problems) > 0; got != tt.unsafe {
+			t.Errorf("unsafeMarkup(%q) = %q, want unsafe %v", tt.fragment, problems, tt.unsafe)
+		}
+	}
+}
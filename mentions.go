@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// @username in a thread, comment or message mentions that user: it links to
+// their profile and notifies them. Names are matched exactly against users;
+// anything else after an @ is left as text.
+
+// mentionPattern matches @name where name starts and ends with a letter, digit
+// or underscore, so "@bob." mentions bob. The @ must not follow a word
+// character, which leaves email addresses alone.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@(\w(?:[\w.-]*\w)?)`)
+
+const (
+	// maxMentionNotifications limits how many users one post can notify.
+	maxMentionNotifications = 10
+	// maxMentionSuggestions limits the users offered by the autocomplete.
+	maxMentionSuggestions = 20
+)
+
+// parseMentions returns the names mentioned in text, each once, in order.
+func parseMentions(text string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if name := m[1]; !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// resolveMentions returns the ids of the existing users mentioned in texts, by username.
+func resolveMentions(texts ...string) (map[string]int, error) {
+	users := map[string]int{}
+	var args []interface{}
+	seen := map[string]bool{}
+	for _, text := range texts {
+		for _, name := range parseMentions(text) {
+			if !seen[name] {
+				seen[name] = true
+				args = append(args, name)
+			}
+		}
+	}
+	if len(args) == 0 {
+		return users, nil
+	}
+
+	rows, err := db.Query("SELECT id, username FROM users WHERE username IN (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		users[username] = id
+	}
+	return users, rows.Err()
+}
+
+// notifyMentions notifies the users mentioned in text who were not mentioned
+// in before already, so editing a post only notifies newly mentioned users.
+// The notification points at the thread or comment of the post.
+func notifyMentions(actorID int, before, text string, threadID, commentID int) {
+	users, err := resolveMentions(text)
+	if err != nil {
+		log.Printf("Failed to resolve mentions: %v", err)
+		return
+	}
+	already := map[string]bool{}
+	for _, name := range parseMentions(before) {
+		already[name] = true
+	}
+
+	notified := 0
+	for _, name := range parseMentions(text) {
+		userID, ok := users[name]
+		if !ok || already[name] || userID == actorID {
+			continue
+		}
+		if notified == maxMentionNotifications {
+			break
+		}
+		notify(Notification{
+			Type:      notifyMention,
+			ThreadID:  threadID,
+			CommentID: commentID,
+			Text:      excerpt(text, notificationExcerptLength),
+			userID:    userID,
+			actorID:   actorID,
+		})
+		notified++
+	}
+}
+
+// mentionsUser reports whether text mentions username.
+func mentionsUser(text, username string) bool {
+	for _, name := range parseMentions(text) {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionSuggestion is a user offered while typing a mention.
+type mentionSuggestion struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+// suggestMentions returns the users whose username or display name starts
+// with prefix, for the mention autocomplete. Users the viewer follows come
+// first, then the others by reputation; the viewer is left out.
+func suggestMentions(viewerID int, prefix string, limit int) ([]mentionSuggestion, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+	rows, err := db.Query(`
+        SELECT u.username, u.display_name FROM users u
+        LEFT JOIN user_follows f ON f.follower_id = ?1 AND f.followee_id = u.id
+        WHERE u.id != ?1 AND (u.username LIKE ?2 ESCAPE '\' OR u.display_name LIKE ?2 ESCAPE '\')
+        ORDER BY f.followee_id IS NULL, u.reputation DESC, u.username
+        LIMIT ?3`, viewerID, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []mentionSuggestion{}
+	for rows.Next() {
+		var u mentionSuggestion
+		if err := rows.Scan(&u.Username, &u.DisplayName); err != nil {
+			return nil, err
+		}
+		u.AvatarURL = "/avatar/" + url.PathEscape(u.Username)
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello @bob", []string{"bob"}},
+		{"@bob, @carol and @bob again", []string{"bob", "carol"}},
+		{"thanks @bob.", []string{"bob"}},
+		{"@first.last-name!", []string{"first.last-name"}},
+		{"mail bob@example.com", nil},
+		{"@@bob", nil},
+		{"@ bob", nil},
+		{"(@bob)", []string{"bob"}},
+		{"@_x_", []string{"_x_"}},
+	}
+	for _, tt := range tests {
+		if got := parseMentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseMentions(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderPostLinksMentions(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"hi @bob", `<p>hi <a href="/u/bob" class="mention" rel="nofollow">@bob</a></p>`},
+		{"hi @nobody", `<p>hi @nobody</p>`},
+		{"`@bob` in code", `<p><code>@bob</code> in code</p>`},
+		{"[@bob](/elsewhere)", `<p><a href="/elsewhere" rel="nofollow">@bob</a></p>`},
+		{"@bob and @bob.", `<p><a href="/u/bob" class="mention" rel="nofollow">@bob</a> and <a href="/u/bob" class="mention" rel="nofollow">@bob</a>.</p>`},
+	}
+	for _, tt := range tests {
+		html, err := renderPost(tt.source, map[string]int{"bob": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(html)); got != tt.want {
+			t.Errorf("renderPost(%q) = %s, want %s", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestMentionNotifications(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+	dave := createTestUser(t, "dave")
+	threadID, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(alice, int(threadID), 0, "Nobody yet", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setRelation(userMutes, carol, alice, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setThreadWatch(dave, int(threadID), watchMuted); err != nil {
+		t.Fatal(err)
+	}
+
+	mentions := func(userID int) int {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND type = ?", userID, notifyMention).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	tests := []struct {
+		name string
+		post func() error
+		want map[int]int // mention notifications by user afterwards
+	}{
+		{"new thread", func() error {
+			_, err := createThread(alice, ThreadInput{Title: "Hi", Description: "Hello @bob and @alice"})
+			return err
+		}, map[int]int{bob: 1}},
+		{"muted by the mentioned user", func() error {
+			_, err := createComment(alice, int(threadID), 0, "@carol have a look", nil)
+			return err
+		}, map[int]int{bob: 1}},
+		{"thread muted by the mentioned user", func() error {
+			_, err := createComment(alice, int(threadID), 0, "@dave have a look", nil)
+			return err
+		}, map[int]int{bob: 1}},
+		{"comment edit mentioning someone new", func() error {
+			comment, err := getComment(int(commentID))
+			if err != nil {
+				return err
+			}
+			return editComment(comment, alice, "Now @bob")
+		}, map[int]int{bob: 2}},
+		{"comment edit keeping the mention", func() error {
+			comment, err := getComment(int(commentID))
+			if err != nil {
+				return err
+			}
+			return editComment(comment, alice, "Still @bob, edited")
+		}, map[int]int{bob: 2}},
+		{"mention of a user who does not exist", func() error {
+			_, err := createComment(alice, int(threadID), 0, "@zed?", nil)
+			return err
+		}, map[int]int{bob: 2}},
+	}
+	for _, tt := range tests {
+		if err := tt.post(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for _, userID := range []int{alice, bob, carol, dave} {
+			if got := mentions(userID); got != tt.want[userID] {
+				t.Errorf("%s: user %d has %d mentions, want %d", tt.name, userID, got, tt.want[userID])
+			}
+		}
+	}
+}
+
+func TestMentionNotificationsAreLimited(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	var names []string
+	for i := 0; i < maxMentionNotifications+3; i++ {
+		name := fmt.Sprintf("user%d", i)
+		createTestUser(t, name)
+		names = append(names, "@"+name)
+	}
+	if _, err := createThread(alice, ThreadInput{Title: "Everyone", Description: strings.Join(names, " ")}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE type = ?", notifyMention).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != maxMentionNotifications {
+		t.Errorf("%d users notified, want %d", count, maxMentionNotifications)
+	}
+}
+
+func TestMessageMentions(t *testing.T) {
+	newTestDB(t)
+	createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	createTestUser(t, "carol")
+
+	tests := []struct {
+		message Message
+		want    string // type of bob's newest notification
+	}{
+		{Message{ID: 1, Username: "alice", Recipient: "bob", Content: "Hello"}, notifyMessage},
+		{Message{ID: 2, Username: "alice", Recipient: "bob", Content: "Hello @bob"}, notifyMention},
+		// only the recipient can read the message, so other mentions notify nobody
+		{Message{ID: 3, Username: "alice", Recipient: "bob", Content: "Ask @carol"}, notifyMessage},
+	}
+	for _, tt := range tests {
+		notifyNewMessage(tt.message)
+		notifications, _, err := listNotifications(bob, false, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != 1 || notifications[0].Type != tt.want || notifications[0].MessageID != tt.message.ID {
+			t.Errorf("message %q: notifications %+v, want %s", tt.message.Content, notifications, tt.want)
+		}
+	}
+	var carolNotified int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notifications n JOIN users u ON u.id = n.user_id WHERE u.username = 'carol'").Scan(&carolNotified); err != nil {
+		t.Fatal(err)
+	}
+	if carolNotified != 0 {
+		t.Errorf("carol got %d notifications of a message to bob", carolNotified)
+	}
+}
+
+func TestSuggestMentions(t *testing.T) {
+	newTestDB(t)
+	viewer := createTestUser(t, "bobby")
+	for _, u := range []struct {
+		name       string
+		reputation int
+	}{{"bob", 5}, {"bobcat", 50}, {"bob_ross", 10}, {"bobxross", 0}, {"alice", 100}} {
+		id := createTestUser(t, u.name)
+		if _, err := db.Exec("UPDATE users SET reputation = ? WHERE id = ?", u.reputation, id); err != nil {
+			t.Fatal(err)
+		}
+		if u.name == "bobxross" {
+			if err := setRelation(userFollows, viewer, id, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := db.Exec("UPDATE users SET display_name = 'Bob Alice' WHERE username = 'alice'"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		limit  int
+		want   []string
+	}{
+		// followed users first, then by reputation; never the viewer
+		{"bob", 10, []string{"bobxross", "alice", "bobcat", "bob_ross", "bob"}},
+		{"bob", 2, []string{"bobxross", "alice"}},
+		{"bob_", 10, []string{"bob_ross"}}, // _ is not a wildcard
+		{"BOBC", 10, []string{"bobcat"}},
+		{"zed", 10, []string{}},
+	}
+	for _, tt := range tests {
+		users, err := suggestMentions(viewer, tt.prefix, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, u := range users {
+			got = append(got, u.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("suggestMentions(%q, %d) = %v, want %v", tt.prefix, tt.limit, got, tt.want)
+		}
+	}
+}
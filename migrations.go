@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schema.sql only creates missing tables, so columns added to existing tables
+// are listed here and applied with ALTER TABLE on databases that predate them.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"users", "role", "TEXT NOT NULL DEFAULT 'user'"},
+	{"users", "reputation", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "display_name", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "bio", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "signature", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "location", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "timezone", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "avatar", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "feed_token", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "digest", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "digest_sent_at", "DATETIME"},
+	{"notification_preferences", "email", "INTEGER"},
+	{"threads", "created_at", "DATETIME"},
+	{"threads", "edited_at", "DATETIME"},
+	{"threads", "pinned_at", "DATETIME"},
+	{"threads", "locked_at", "DATETIME"},
+	{"threads", "archived_at", "DATETIME"},
+	{"thread_categories", "pinned_at", "DATETIME"},
+	{"comments", "created_at", "DATETIME"},
+	{"comments", "edited_at", "DATETIME"},
+	{"comments", "deleted_at", "DATETIME"},
+	{"comments", "parent_id", "INTEGER REFERENCES comments(id)"},
+	{"thread_revisions", "html", "TEXT NOT NULL DEFAULT ''"},
+	{"thread_revisions", "html_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"comment_revisions", "html", "TEXT NOT NULL DEFAULT ''"},
+	{"comment_revisions", "html_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"categories", "slug", "TEXT NOT NULL DEFAULT ''"},
+	{"categories", "description", "TEXT NOT NULL DEFAULT ''"},
+	{"categories", "parent_id", "INTEGER REFERENCES categories(id)"},
+	{"categories", "position", "INTEGER NOT NULL DEFAULT 0"},
+	{"categories", "color", "TEXT NOT NULL DEFAULT ''"},
+	{"categories", "icon", "TEXT NOT NULL DEFAULT ''"},
+	{"categories", "archived_at", "DATETIME"},
+}
+
+// columnBackfills fill a column right after it has been added, keyed by table.column.
+var columnBackfills = map[string]func(db *sql.DB) error{
+	"users.reputation": func(db *sql.DB) error {
+		_, err := recalculateReputation(db)
+		return err
+	},
+}
+
+// tableBackfills fill a table the first time schema.sql creates it, keyed by
+// table. missingTables finds them before schema.sql runs.
+var tableBackfills = map[string]func(db *sql.DB) error{
+	"thread_watches": backfillThreadWatches,
+}
+
+// missingTables returns the tables of tableBackfills that do not exist yet.
+func missingTables(db *sql.DB) ([]string, error) {
+	var missing []string
+	for table := range tableBackfills {
+		exists, err := tableExists(db, table)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
+
+// legacyVoteTables held likes and dislikes before reactions existed. Their rows
+// move to item_reactions as like and dislike reactions and the tables are dropped.
+var legacyVoteTables = []struct {
+	table    string
+	column   string
+	itemType string
+}{
+	{"thread_likes", "thread_id", "thread"},
+	{"comment_likes", "comment_id", "comment"},
+}
+
+// indexMigrations run after the column migrations, for indexes on added columns.
+var indexMigrations = []string{
+	"CREATE INDEX IF NOT EXISTS idx_comments_parent ON comments(parent_id)",
+	"CREATE INDEX IF NOT EXISTS idx_users_feed_token ON users(feed_token)",
+	"CREATE INDEX IF NOT EXISTS idx_categories_parent ON categories(parent_id)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS idx_categories_slug ON categories(slug) WHERE slug != ''",
+}
+
+// migrateDB brings a database created by an older version up to date.
+// created lists the tables schema.sql has just created, from missingTables.
+func migrateDB(db *sql.DB, created []string) error {
+	// Backfills run last, once reactions are in place
+	var backfills []string
+	for _, m := range columnMigrations {
+		exists, err := columnExists(db, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("error adding %s.%s: %w", m.table, m.column, err)
+		}
+		if _, ok := columnBackfills[m.table+"."+m.column]; ok {
+			backfills = append(backfills, m.table+"."+m.column)
+		}
+	}
+
+	if err := seedReactions(db); err != nil {
+		return fmt.Errorf("error adding default reactions: %w", err)
+	}
+	if err := migrateLegacyVotes(db); err != nil {
+		return fmt.Errorf("error moving votes to reactions: %w", err)
+	}
+	if err := removeForgedReactions(db); err != nil {
+		return fmt.Errorf("error removing forged votes: %w", err)
+	}
+
+	for _, column := range backfills {
+		if err := columnBackfills[column](db); err != nil {
+			return fmt.Errorf("error filling %s: %w", column, err)
+		}
+	}
+	for _, table := range created {
+		if err := tableBackfills[table](db); err != nil {
+			return fmt.Errorf("error filling %s: %w", table, err)
+		}
+	}
+	if err := fillCategorySlugs(db); err != nil {
+		return fmt.Errorf("error filling category slugs: %w", err)
+	}
+	for _, stmt := range indexMigrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("error creating index: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateLegacyVotes moves the rows of the legacy vote tables into
+// item_reactions and recomputes the vote counters from them.
+func migrateLegacyVotes(db *sql.DB) error {
+	migrated := false
+	for _, m := range legacyVoteTables {
+		exists, err := tableExists(db, m.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		// Rows without a real user, often user_id '', come from the old forged
+		// user_id bug and are dropped
+		if _, err := db.Exec(fmt.Sprintf(`
+            INSERT OR IGNORE INTO item_reactions (item_type, item_id, user_id, reaction_id)
+            SELECT ?, v.%s, v.user_id, r.id
+            FROM %s v JOIN reactions r ON r.name = CASE v.like_type WHEN 1 THEN 'like' ELSE 'dislike' END
+            WHERE v.user_id IN (SELECT id FROM users) AND v.like_type IN (1, -1)`, m.column, m.table), m.itemType); err != nil {
+			return err
+		}
+		if _, err := db.Exec("DROP TABLE " + m.table); err != nil {
+			return err
+		}
+		migrated = true
+	}
+	if !migrated {
+		return nil
+	}
+	_, err := reconcileVoteCounts(db, true)
+	return err
+}
+
+// removeForgedReactions deletes the reactions of users that do not exist,
+// which older versions copied from forged legacy votes, and then brings the
+// vote counters and reputation back in line with the remaining votes.
+func removeForgedReactions(db *sql.DB) error {
+	result, err := db.Exec("DELETE FROM item_reactions WHERE user_id NOT IN (SELECT id FROM users)")
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := reconcileVoteCounts(db, true); err != nil {
+		return err
+	}
+	_, err = recalculateReputation(db)
+	return err
+}
+
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name, kind string
+			notNull    int
+			dflt       sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
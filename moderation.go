@@ -0,0 +1,518 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderators move threads between categories, merge duplicate threads and
+// split comments off into a new thread of their own. A merged thread is
+// removed and its id redirects to the thread it was merged into. These
+// actions, like pins, locks and archiving, are recorded in the moderation log.
+
+// Moderation log actions besides pin, unpin, lock, unlock, archive and unarchive.
+const (
+	moderationMove  = "move"
+	moderationMerge = "merge"
+	moderationSplit = "split"
+)
+
+// moderationLogPageSize is how many entries /admin/moderation shows.
+const moderationLogPageSize = 100
+
+// ModerationEntry is one moderator action in the moderation log.
+type ModerationEntry struct {
+	ID             int       `json:"id"`
+	Moderator      string    `json:"moderator"`
+	Action         string    `json:"action"`
+	ThreadID       int       `json:"thread_id"`
+	TargetThreadID *int      `json:"target_thread_id,omitempty"`
+	Details        string    `json:"details,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// logModeration records a moderator action on a thread. targetID is the
+// thread merged into or split off, or nil.
+func logModeration(e execer, moderatorID int, action string, threadID int, targetID interface{}, details string) error {
+	_, err := e.Exec(`
+        INSERT INTO moderation_log (moderator_id, action, thread_id, target_thread_id, details, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, moderatorID, action, threadID, targetID, details, time.Now())
+	return err
+}
+
+// listModerationLog returns the newest moderation log entries with an id
+// below before (0 for the newest), of one thread when threadID is not 0.
+func listModerationLog(threadID, before, limit int) ([]ModerationEntry, error) {
+	query := `
+        SELECT l.id, u.username, l.action, l.thread_id, l.target_thread_id, l.details, l.created_at
+        FROM moderation_log l JOIN users u ON u.id = l.moderator_id
+        WHERE (?1 = 0 OR l.thread_id = ?1 OR l.target_thread_id = ?1) AND (?2 = 0 OR l.id < ?2)
+        ORDER BY l.id DESC LIMIT ?3`
+	rows, err := db.Query(query, threadID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []ModerationEntry{}
+	for rows.Next() {
+		var e ModerationEntry
+		var targetID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Moderator, &e.Action, &e.ThreadID, &targetID, &e.Details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if targetID.Valid {
+			id := int(targetID.Int64)
+			e.TargetThreadID = &id
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// threadRedirect returns the thread that a merged thread id now leads to.
+func threadRedirect(threadID int) (int, error) {
+	var id int
+	err := db.QueryRow("SELECT thread_id FROM thread_redirects WHERE old_thread_id = ?", threadID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	return id, err
+}
+
+// threadCategoryNames returns the names of a thread's categories, comma separated.
+func threadCategoryNames(q queryRower, threadID int) (string, error) {
+	var names string
+	err := q.QueryRow(`
+        SELECT COALESCE(GROUP_CONCAT(name, ', '), '') FROM (
+            SELECT c.name FROM categories c JOIN thread_categories tc ON c.id = tc.category_id
+            WHERE tc.thread_id = ? ORDER BY c.name)`, threadID).Scan(&names)
+	return names, err
+}
+
+// moveThread puts a thread in categoryIDs instead of its current categories.
+// Pins in the categories it stays in are kept.
+func moveThread(moderatorID, threadID int, categoryIDs []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var authorID int
+	err = tx.QueryRow("SELECT user_id FROM threads WHERE id = ?", threadID).Scan(&authorID)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// A thread may stay in an archived category but not be moved into one
+	current, err := listThreadCategoryIDs(tx, threadID)
+	if err != nil {
+		return err
+	}
+	if categoryIDs, err = checkCategoryIDs(tx, categoryIDs, current); err != nil {
+		return err
+	}
+	if len(categoryIDs) == 0 {
+		return fieldError("Pick at least one category")
+	}
+	before, err := threadCategoryNames(tx, threadID)
+	if err != nil {
+		return err
+	}
+
+	keep := map[string]bool{}
+	for _, id := range categoryIDs {
+		keep[id] = true
+		if _, err := tx.Exec("INSERT OR IGNORE INTO thread_categories (thread_id, category_id) VALUES (?, ?)", threadID, id); err != nil {
+			return err
+		}
+	}
+	for _, id := range current {
+		if keep[id] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM thread_categories WHERE thread_id = ? AND category_id = ?", threadID, id); err != nil {
+			return err
+		}
+	}
+
+	after, err := threadCategoryNames(tx, threadID)
+	if err != nil {
+		return err
+	}
+	if before == after {
+		return nil
+	}
+	if err := logModeration(tx, moderatorID, moderationMove, threadID, nil, before+" → "+after); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notifyModerator(moderatorID, authorID, threadID, 0, "moved your thread")
+	return nil
+}
+
+// mergeThreads moves everything of thread fromID into thread intoID and
+// leaves a redirect from fromID. The opening post of fromID becomes a comment
+// with the comments that answered it as its replies, its votes and its edit
+// history. The poll comes along
+// if intoID has none; categories and tags are those of intoID.
+func mergeThreads(moderatorID, fromID, intoID int) error {
+	if fromID == intoID {
+		return fieldError("A thread cannot be merged into itself")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var fromTitle, intoTitle string
+	var fromAuthor int
+	err = tx.QueryRow("SELECT title, user_id FROM threads WHERE id = ?", fromID).Scan(&fromTitle, &fromAuthor)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("SELECT title FROM threads WHERE id = ?", intoID).Scan(&intoTitle)
+	if err == sql.ErrNoRows {
+		return fieldError(fmt.Sprintf("Thread %d does not exist", intoID))
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+        INSERT INTO comments (content, user_id, thread_id, created_at, edited_at)
+        SELECT description, user_id, ?, created_at, edited_at FROM threads WHERE id = ?`, intoID, fromID)
+	if err != nil {
+		return err
+	}
+	postID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	var intoPolls int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM polls WHERE thread_id = ?", intoID).Scan(&intoPolls); err != nil {
+		return err
+	}
+	if intoPolls == 0 {
+		if _, err := tx.Exec("UPDATE polls SET thread_id = ? WHERE thread_id = ?", intoID, fromID); err != nil {
+			return err
+		}
+	}
+	if err := moveThreadReactions(tx, fromID, int(postID), fromAuthor); err != nil {
+		return err
+	}
+	if err := copyThreadRevisions(tx, fromID, int(postID), fromAuthor); err != nil {
+		return err
+	}
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE comments SET parent_id = ? WHERE thread_id = ? AND parent_id IS NULL", []interface{}{postID, fromID}},
+		{"UPDATE comments SET thread_id = ? WHERE thread_id = ?", []interface{}{intoID, fromID}},
+		{"UPDATE attachments SET thread_id = NULL, comment_id = ? WHERE thread_id = ?", []interface{}{postID, fromID}},
+		{"UPDATE notifications SET thread_id = ? WHERE thread_id = ?", []interface{}{intoID, fromID}},
+		{"UPDATE reputation_events SET thread_id = ? WHERE thread_id = ? AND comment_id IS NOT NULL", []interface{}{intoID, fromID}},
+		{`INSERT OR IGNORE INTO thread_watches (user_id, thread_id, level, auto, created_at)
+            SELECT user_id, ?, level, auto, created_at FROM thread_watches WHERE thread_id = ?`, []interface{}{intoID, fromID}},
+		{"UPDATE thread_redirects SET thread_id = ? WHERE thread_id = ?", []interface{}{intoID, fromID}},
+		{"DELETE FROM thread_watches WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM thread_reads WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM thread_categories WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM thread_tags WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM thread_revisions WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM poll_votes WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = ?)", []interface{}{fromID}},
+		{"DELETE FROM poll_options WHERE poll_id IN (SELECT id FROM polls WHERE thread_id = ?)", []interface{}{fromID}},
+		{"DELETE FROM polls WHERE thread_id = ?", []interface{}{fromID}},
+		{"DELETE FROM threads WHERE id = ?", []interface{}{fromID}},
+		{"INSERT INTO thread_redirects (old_thread_id, thread_id, created_at) VALUES (?, ?, ?)", []interface{}{fromID, intoID, time.Now()}},
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+			return err
+		}
+	}
+
+	details := fmt.Sprintf("%q into %q", fromTitle, intoTitle)
+	if err := logModeration(tx, moderatorID, moderationMerge, fromID, intoID, details); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notifyModerator(moderatorID, fromAuthor, intoID, int(postID), "merged your thread into another")
+	return nil
+}
+
+// moveThreadReactions turns the reactions on thread fromID into reactions on
+// comment postID, which its opening post became. The author keeps the
+// reputation of the votes, now worth what votes on a comment are worth.
+func moveThreadReactions(tx *sql.Tx, fromID, postID, authorID int) error {
+	rows, err := tx.Query(`
+        SELECT ir.user_id, r.score FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+        WHERE ir.item_type = ? AND ir.item_id = ? AND r.score != 0`, threadVotes.kind, fromID)
+	if err != nil {
+		return err
+	}
+	type vote struct{ userID, score int }
+	var votes []vote
+	for rows.Next() {
+		var v vote
+		if err := rows.Scan(&v.userID, &v.score); err != nil {
+			rows.Close()
+			return err
+		}
+		votes = append(votes, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range votes {
+		if err := applyVoteReputation(tx, threadVotes.kind, fromID, authorID, v.userID, v.score, 0); err != nil {
+			return err
+		}
+		if err := applyVoteReputation(tx, commentVotes.kind, postID, authorID, v.userID, 0, v.score); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE item_reactions SET item_type = ?, item_id = ? WHERE item_type = ? AND item_id = ?",
+		commentVotes.kind, postID, threadVotes.kind, fromID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        UPDATE comments SET
+            likes = (SELECT COUNT(*) FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+                WHERE ir.item_type = ?1 AND ir.item_id = ?2 AND r.score > 0),
+            dislikes = (SELECT COUNT(*) FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+                WHERE ir.item_type = ?1 AND ir.item_id = ?2 AND r.score < 0)
+        WHERE id = ?2`, commentVotes.kind, postID)
+	return err
+}
+
+// copyThreadRevisions gives comment postID the description history of thread
+// fromID, whose opening post it became, with the HTML cached for it. Versions
+// that only changed the title are left out.
+func copyThreadRevisions(tx *sql.Tx, fromID, postID, authorID int) error {
+	result, err := tx.Exec(`
+        INSERT INTO comment_revisions (comment_id, editor_id, content, created_at, html, html_version)
+        SELECT ?, editor_id, description, created_at, html, html_version FROM (
+            SELECT *, LAG(description) OVER (ORDER BY id) AS previous FROM thread_revisions WHERE thread_id = ?)
+        WHERE previous IS NULL OR previous != description
+        ORDER BY id`, postID, fromID)
+	if err != nil {
+		return err
+	}
+	// Threads from before revisions existed have no history to copy
+	if n, _ := result.RowsAffected(); n == 0 {
+		return insertCommentRevision(tx, postID, authorID)
+	}
+	return nil
+}
+
+// splitThread moves the comments commentIDs of a thread, with their replies,
+// to a new thread started by the moderator and returns its id. The new thread
+// is in the categories of the old one unless categoryIDs are given.
+func splitThread(moderatorID, threadID int, commentIDs []int, title, description string, categoryIDs []string) (int, error) {
+	title = strings.TrimSpace(title)
+	description = strings.TrimSpace(description)
+	if title == "" {
+		return 0, fieldError("The new thread needs a title")
+	}
+	if len(commentIDs) == 0 {
+		return 0, fieldError("Pick the comments to split off")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var oldTitle string
+	err = tx.QueryRow("SELECT title FROM threads WHERE id = ?", threadID).Scan(&oldTitle)
+	if err == sql.ErrNoRows {
+		return 0, errNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range commentIDs {
+		var commentThreadID int
+		err := tx.QueryRow("SELECT thread_id FROM comments WHERE id = ?", id).Scan(&commentThreadID)
+		if err == sql.ErrNoRows || (err == nil && commentThreadID != threadID) {
+			return 0, fieldError(fmt.Sprintf("Comment %d is not in this thread", id))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if description == "" {
+		description = fmt.Sprintf("Split from [%s](/thread?id=%d).", oldTitle, threadID)
+	}
+
+	current, err := listThreadCategoryIDs(tx, threadID)
+	if err != nil {
+		return 0, err
+	}
+	if len(categoryIDs) == 0 {
+		categoryIDs = current
+	}
+	if categoryIDs, err = checkCategoryIDs(tx, categoryIDs, current); err != nil {
+		return 0, err
+	}
+
+	result, err := tx.Exec("INSERT INTO threads (title, description, user_id, created_at) VALUES (?, ?, ?, ?)", title, description, moderatorID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	newID64, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	newID := int(newID64)
+	for _, catID := range categoryIDs {
+		if _, err := tx.Exec("INSERT INTO thread_categories (thread_id, category_id) VALUES (?, ?)", newID, catID); err != nil {
+			return 0, err
+		}
+	}
+	if err := insertThreadRevision(tx, newID, moderatorID); err != nil {
+		return 0, err
+	}
+
+	// Replies go along with the comments they answer
+	moved := map[int]int{} // comment id -> author
+	var order []int
+	for _, id := range commentIDs {
+		rows, err := tx.Query(`
+            WITH RECURSIVE subtree(id) AS (
+                SELECT ?
+                UNION SELECT c.id FROM comments c JOIN subtree s ON c.parent_id = s.id
+            )
+            SELECT c.id, c.user_id FROM comments c JOIN subtree s ON s.id = c.id ORDER BY c.id`, id)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var commentID, authorID int
+			if err := rows.Scan(&commentID, &authorID); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if _, ok := moved[commentID]; !ok {
+				moved[commentID] = authorID
+				order = append(order, commentID)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range order {
+		for _, query := range []string{
+			"UPDATE comments SET thread_id = ? WHERE id = ?",
+			"UPDATE notifications SET thread_id = ? WHERE comment_id = ?",
+			"UPDATE reputation_events SET thread_id = ? WHERE comment_id = ?",
+		} {
+			if _, err := tx.Exec(query, newID, id); err != nil {
+				return 0, err
+			}
+		}
+		if err := autoWatchThread(tx, moved[id], newID); err != nil {
+			return 0, err
+		}
+	}
+	// Comments whose parent stayed behind start the discussion in the new thread
+	if _, err := tx.Exec("UPDATE comments SET parent_id = NULL WHERE thread_id = ?1 AND parent_id IN (SELECT id FROM comments WHERE thread_id != ?1)", newID); err != nil {
+		return 0, err
+	}
+
+	details := fmt.Sprintf("%d comments of %q to %q", len(order), oldTitle, title)
+	if err := logModeration(tx, moderatorID, moderationSplit, threadID, newID, details); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	notified := map[int]bool{}
+	for _, id := range order {
+		if author := moved[id]; !notified[author] {
+			notified[author] = true
+			notifyModerator(moderatorID, author, newID, id, "moved your comment to a new thread")
+		}
+	}
+	return newID, nil
+}
+
+// moderateThreadForm applies a move, merge or split form of a moderator to
+// a thread and returns the thread to show afterwards.
+func moderateThreadForm(r *http.Request, moderatorID, threadID int, action string) (int, error) {
+	switch action {
+	case moderationMove:
+		return threadID, moveThread(moderatorID, threadID, r.Form["categories"])
+	case moderationMerge:
+		intoID, err := strconv.Atoi(strings.TrimSpace(r.FormValue("into_thread_id")))
+		if err != nil {
+			return 0, fieldError("Enter the id of the thread to merge into")
+		}
+		return intoID, mergeThreads(moderatorID, threadID, intoID)
+	case moderationSplit:
+		var commentIDs []int
+		for _, v := range r.Form["comment_id"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, fieldError("Invalid comment " + v)
+			}
+			commentIDs = append(commentIDs, id)
+		}
+		return splitThread(moderatorID, threadID, commentIDs, r.FormValue("title"), r.FormValue("description"), r.Form["categories"])
+	}
+	return 0, fieldError("Unknown action")
+}
+
+// /admin/moderation: the moderation log, of one thread with ?thread_id=
+func serveModerationLog(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || !isModerator(role) {
+		http.Error(w, "Only moderators can see the moderation log", http.StatusForbidden)
+		return
+	}
+	threadID, _ := strconv.Atoi(r.URL.Query().Get("thread_id"))
+
+	entries, err := listModerationLog(threadID, 0, moderationLogPageSize)
+	if err != nil {
+		log.Printf("Failed to fetch moderation log: %v", err)
+		http.Error(w, "Failed to fetch the moderation log", http.StatusInternalServerError)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/admin_moderation.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Entries":  entries,
+		"ThreadID": threadID,
+	})
+}
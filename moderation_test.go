@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// createTestCategory adds a category and returns its id as the forms send it.
+func createTestCategory(t *testing.T, name string) string {
+	t.Helper()
+	result, err := db.Exec("INSERT INTO categories (name) VALUES (?)", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	return fmt.Sprint(id)
+}
+
+// threadOfComment returns the thread and parent (0 for none) of a comment.
+func threadOfComment(t *testing.T, commentID int) (threadID, parentID int) {
+	t.Helper()
+	comment, err := getComment(commentID)
+	if err != nil {
+		t.Fatalf("comment %d: %v", commentID, err)
+	}
+	if comment.ParentID != nil {
+		parentID = *comment.ParentID
+	}
+	return comment.ThreadID, parentID
+}
+
+func TestMoveThread(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	news, help, off := createTestCategory(t, "News"), createTestCategory(t, "Help"), createTestCategory(t, "Off topic")
+	id, err := createThread(moderator, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: []string{news}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := int(id)
+
+	tests := []struct {
+		categories []string
+		want       []string
+		ok         bool
+	}{
+		{[]string{help, off}, []string{help, off}, true},
+		{[]string{off, help}, []string{help, off}, true}, // no change, not logged
+		{[]string{news}, []string{news}, true},
+		{nil, []string{news}, false},
+		{[]string{"12345"}, []string{news}, false},
+	}
+	for _, tt := range tests {
+		err := moveThread(moderator, threadID, tt.categories)
+		if (err == nil) != tt.ok {
+			t.Errorf("moveThread(%v) = %v, want ok %v", tt.categories, err, tt.ok)
+		}
+		got, err := listThreadCategoryIDs(db, threadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("after moveThread(%v) the thread is in %v, want %v", tt.categories, got, tt.want)
+		}
+	}
+	if got := fmt.Sprint(moderationActions(t, threadID)); got != "[move move]" {
+		t.Errorf("logged %s, want [move move]", got)
+	}
+	if err := moveThread(moderator, threadID+1, []string{news}); err != errNotFound {
+		t.Errorf("moving a missing thread: %v, want errNotFound", err)
+	}
+}
+
+func TestMergeThreads(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+	dave := createTestUser(t, "dave")
+	setTestRole(t, dave, roleModerator) // may dislike from the start
+
+	from, err := createThread(alice, ThreadInput{Title: "Duplicate", Description: "First version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromID := int(from)
+	into, err := createThread(bob, ThreadInput{Title: "Original", Description: "The original"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	intoID := int(into)
+
+	thread, err := getThread(fromID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := editThread(thread, alice, "Duplicate", "Second version", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if thread, err = getThread(fromID); err != nil {
+		t.Fatal(err)
+	}
+	if err := editThread(thread, alice, "Duplicate thread", "Second version", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := createComment(carol, fromID, 0, "An answer", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := createComment(alice, fromID, int(answer), "A reply", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, fromID, carol, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, fromID, dave, -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, intoID, carol, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mergeThreads(moderator, fromID, intoID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old id leads to the thread it was merged into
+	w := httptest.NewRecorder()
+	serveThread(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/thread?id=%d", fromID), nil))
+	if want := fmt.Sprintf("/thread?id=%d", intoID); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+		t.Errorf("old thread: status %d to %q, want %d to %q", w.Code, w.Header().Get("Location"), http.StatusMovedPermanently, want)
+	}
+
+	// The opening post is a comment with the answers below it
+	answerThread, postID := threadOfComment(t, int(answer))
+	if answerThread != intoID || postID == 0 {
+		t.Fatalf("answer is in thread %d under %d, want thread %d under the old opening post", answerThread, postID, intoID)
+	}
+	if replyThread, parent := threadOfComment(t, int(reply)); replyThread != intoID || parent != int(answer) {
+		t.Errorf("reply is in thread %d under %d, want thread %d under %d", replyThread, parent, intoID, answer)
+	}
+	post, err := getComment(postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if post.UserID != alice || post.Content != "Second version" || post.ThreadID != intoID {
+		t.Errorf("opening post became comment by %d in thread %d: %q", post.UserID, post.ThreadID, post.Content)
+	}
+
+	// Its votes went along, and so did their reputation
+	if post.Likes != 1 || post.Dislikes != 1 {
+		t.Errorf("opening post has %d likes and %d dislikes, want 1 and 1", post.Likes, post.Dislikes)
+	}
+	merged, err := getThread(intoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Likes != 1 || merged.Dislikes != 0 {
+		t.Errorf("merged thread has %d likes and %d dislikes, want 1 and 0", merged.Likes, merged.Dislikes)
+	}
+	if got, want := reputationOf(t, alice), reputationWeight("comment", 1)+reputationWeight("comment", -1); got != want {
+		t.Errorf("reputation of the author of the merged thread = %d, want %d", got, want)
+	}
+	if got, want := reputationOf(t, bob), reputationWeight("thread", 1); got != want {
+		t.Errorf("reputation of the author of the thread merged into = %d, want %d", got, want)
+	}
+	checkReputationAddsUp(t)
+
+	// Its edit history too, without the version that only changed the title
+	revisions, err := listCommentRevisions(postID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, rev := range revisions {
+		versions = append(versions, rev.Content)
+	}
+	if fmt.Sprint(versions) != "[First version Second version]" {
+		t.Errorf("opening post revisions %q, want the two versions of the description", versions)
+	}
+
+	if got := fmt.Sprint(moderationActions(t, intoID)); got != "[merge]" {
+		t.Errorf("logged %s, want [merge]", got)
+	}
+	if err := mergeThreads(moderator, intoID, intoID); err == nil {
+		t.Error("a thread was merged into itself")
+	}
+}
+
+func TestSplitThread(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	id, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := int(id)
+	comment := func(parent int, content string) int {
+		id, err := createComment(bob, threadID, parent, content, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	offTopic := comment(0, "Off topic")
+	offTopicReply := comment(offTopic, "Still off topic")
+	onTopic := comment(0, "On topic")
+	strayReply := comment(onTopic, "Off topic again")
+
+	newID, err := splitThread(moderator, threadID, []int{offTopic, strayReply}, "Off topic", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		commentID        int
+		thread, parentID int
+	}{
+		{offTopic, newID, 0},
+		{offTopicReply, newID, offTopic},
+		{onTopic, threadID, 0},
+		{strayReply, newID, 0}, // its parent stayed behind
+	}
+	for _, tt := range tests {
+		if thread, parent := threadOfComment(t, tt.commentID); thread != tt.thread || parent != tt.parentID {
+			t.Errorf("comment %d is in thread %d under %d, want thread %d under %d", tt.commentID, thread, parent, tt.thread, tt.parentID)
+		}
+	}
+	if got := fmt.Sprint(moderationActions(t, threadID)); got != "[split]" {
+		t.Errorf("logged %s, want [split]", got)
+	}
+
+	if _, err := splitThread(moderator, threadID, []int{offTopic}, "Again", "", nil); err == nil {
+		t.Error("a comment of another thread was split off")
+	}
+	if _, err := splitThread(moderator, threadID, []int{onTopic}, " ", "", nil); err == nil {
+		t.Error("a thread was split off without a title")
+	}
+}
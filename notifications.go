@@ -0,0 +1,733 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Notifications are recorded when something happens to a user's threads,
+// comments or messages and pushed to their open pages over server-sent
+// events. Each type can be turned off in the notification settings. Some
+// types are also sent by email, see emails.go.
+
+// Notification types, also the keys of the preferences.
+const (
+	notifyThreadReply  = "thread_reply"  // comment on your thread
+	notifyCommentReply = "comment_reply" // reply to your comment
+	notifyMention      = "mention"
+	notifyVote         = "vote" // like on your thread or comment
+	notifyMessage      = "message"
+	notifyModeration   = "moderation" // a moderator changed your thread or comment
+	notifyWatching     = "watching"   // activity in a thread or category you watch
+)
+
+// notificationTypes lists the types in the order of the settings page.
+var notificationTypes = []struct {
+	Type  string
+	Label string
+}{
+	{notifyThreadReply, "Comments on your threads"},
+	{notifyCommentReply, "Replies to your comments"},
+	{notifyMention, "Mentions of your username"},
+	{notifyVote, "Likes on your threads and comments"},
+	{notifyMessage, "New private messages"},
+	{notifyModeration, "Moderator actions on your posts"},
+	{notifyWatching, "Activity in threads and categories you watch"},
+}
+
+// notificationExcerptLength is how much of a comment or message is kept in its notification.
+const notificationExcerptLength = 140
+
+// Notification is one entry of a user's notifications.
+type Notification struct {
+	ID          int       `json:"id"`
+	Type        string    `json:"type"`
+	Actor       string    `json:"actor,omitempty"` // username of who caused it
+	ThreadID    int       `json:"thread_id,omitempty"`
+	ThreadTitle string    `json:"thread_title,omitempty"`
+	CommentID   int       `json:"comment_id,omitempty"`
+	MessageID   int       `json:"message_id,omitempty"`
+	Text        string    `json:"text"` // excerpt, or the action for moderation
+	Read        bool      `json:"read"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	userID  int // recipient
+	actorID int
+}
+
+// URL returns the path of the page the notification is about.
+func (n Notification) URL() string {
+	switch {
+	case n.MessageID != 0:
+		return "/messages"
+	case n.CommentID != 0 && n.ThreadID != 0:
+		return fmt.Sprintf("/thread?id=%d&comment=%d#comment-%d", n.ThreadID, n.CommentID, n.CommentID)
+	case n.ThreadID != 0:
+		return fmt.Sprintf("/thread?id=%d", n.ThreadID)
+	}
+	return "/notifications"
+}
+
+// Summary describes the notification in one line.
+func (n Notification) Summary() string {
+	on := ""
+	if n.ThreadTitle != "" {
+		on = fmt.Sprintf(" on \"%s\"", n.ThreadTitle)
+	}
+	if n.MessageID != 0 {
+		on = " in a message"
+	}
+	switch n.Type {
+	case notifyThreadReply:
+		return fmt.Sprintf("%s commented on your thread \"%s\"", n.Actor, n.ThreadTitle)
+	case notifyCommentReply:
+		return fmt.Sprintf("%s replied to your comment%s", n.Actor, on)
+	case notifyMention:
+		return fmt.Sprintf("%s mentioned you%s", n.Actor, on)
+	case notifyVote:
+		if n.CommentID != 0 {
+			return fmt.Sprintf("%s liked your comment%s", n.Actor, on)
+		}
+		return fmt.Sprintf("%s liked your thread \"%s\"", n.Actor, n.ThreadTitle)
+	case notifyMessage:
+		return fmt.Sprintf("%s sent you a message", n.Actor)
+	case notifyModeration:
+		return fmt.Sprintf("Moderator %s %s%s", n.Actor, n.Text, on)
+	case notifyWatching:
+		if n.CommentID != 0 {
+			return fmt.Sprintf("%s commented%s", n.Actor, on)
+		}
+		return fmt.Sprintf("%s started \"%s\"", n.Actor, n.ThreadTitle)
+	}
+	return n.Type
+}
+
+// excerpt shortens text to at most max characters.
+func excerpt(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max-1]) + "…"
+}
+
+// nullableID stores 0 as NULL.
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// notify records a notification and pushes it to the open pages of the
+// recipient. Nothing is recorded for the user's own actions, for types they
+// turned off, or from users and threads they muted, except moderator actions.
+// Whether it is also emailed depends on the email setting of the type alone.
+// Failures are only logged so they never fail the action that caused the
+// notification.
+func notify(n Notification) {
+	if err := deliverNotification(&n); err != nil {
+		log.Printf("Failed to notify user %d of %s: %v", n.userID, n.Type, err)
+	}
+}
+
+func deliverNotification(n *Notification) error {
+	if n.userID == 0 || n.userID == n.actorID {
+		return nil
+	}
+	prefs, err := notificationPreferences(n.userID)
+	if err != nil {
+		return err
+	}
+	if n.Type != notifyModeration {
+		muted, err := hasRelation(userMutes, n.userID, n.actorID)
+		if err != nil || muted {
+			return err
+		}
+	}
+	if n.CommentID != 0 && n.ThreadID == 0 {
+		if err := db.QueryRow("SELECT thread_id FROM comments WHERE id = ?", n.CommentID).Scan(&n.ThreadID); err != nil {
+			return err
+		}
+	}
+	if n.ThreadID != 0 && n.Type != notifyModeration {
+		muted, err := threadMuted(n.userID, n.ThreadID)
+		if err != nil || muted {
+			return err
+		}
+	}
+	if !prefs[n.Type] {
+		// Not kept in the app, but it may still be wanted by email
+		if err := db.QueryRow(`
+            SELECT COALESCE((SELECT username FROM users WHERE id = ?), ''), COALESCE((SELECT title FROM threads WHERE id = ?), '')`,
+			n.actorID, n.ThreadID).Scan(&n.Actor, &n.ThreadTitle); err != nil {
+			return err
+		}
+		n.CreatedAt = time.Now()
+		return queueNotificationEmail(*n)
+	}
+	// Taking a like back and giving it again is announced once
+	if n.Type == notifyVote {
+		var seen int
+		if err := db.QueryRow(`
+            SELECT COUNT(*) FROM notifications
+            WHERE user_id = ? AND type = ? AND actor_id = ? AND thread_id IS ? AND comment_id IS ?`,
+			n.userID, n.Type, n.actorID, nullableID(n.ThreadID), nullableID(n.CommentID)).Scan(&seen); err != nil || seen > 0 {
+			return err
+		}
+	}
+
+	result, err := db.Exec(`
+        INSERT INTO notifications (user_id, type, actor_id, thread_id, comment_id, message_id, text, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.userID, n.Type, nullableID(n.actorID), nullableID(n.ThreadID), nullableID(n.CommentID), nullableID(n.MessageID), n.Text, time.Now())
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	stored, err := getNotification(n.userID, int(id))
+	if err != nil {
+		return err
+	}
+	publishNotification(n.userID, &stored)
+	return queueNotificationEmail(stored)
+}
+
+// notifyNewComment tells the author of the thread about a new top level
+// comment, or the author of the parent comment about a reply.
+func notifyNewComment(comment Comment) {
+	n := Notification{
+		Type:      notifyThreadReply,
+		ThreadID:  comment.ThreadID,
+		CommentID: comment.ID,
+		Text:      excerpt(comment.Content, notificationExcerptLength),
+		actorID:   comment.UserID,
+	}
+	query, id := "SELECT user_id FROM threads WHERE id = ?", comment.ThreadID
+	if parentID := parentOf(comment); parentID != 0 {
+		n.Type = notifyCommentReply
+		query, id = "SELECT user_id FROM comments WHERE id = ?", parentID
+	}
+	if err := db.QueryRow(query, id).Scan(&n.userID); err != nil {
+		log.Printf("Failed to find who to notify of comment %d: %v", comment.ID, err)
+		return
+	}
+	notify(n)
+}
+
+// notifyModerator tells ownerID that moderator actorID did action, e.g.
+// "deleted your comment", to their thread or comment. Users changing their own
+// posts are not notified.
+func notifyModerator(actorID, ownerID, threadID, commentID int, action string) {
+	notify(Notification{
+		Type:      notifyModeration,
+		ThreadID:  threadID,
+		CommentID: commentID,
+		Text:      action,
+		userID:    ownerID,
+		actorID:   actorID,
+	})
+}
+
+// notifyCommentDeleted tells the author when a moderator deleted their comment.
+// The notification of a permanent removal points at the thread.
+func notifyCommentDeleted(comment Comment, actorID int, hard bool) {
+	if hard {
+		notifyModerator(actorID, comment.UserID, comment.ThreadID, 0, "removed your comment")
+		return
+	}
+	notifyModerator(actorID, comment.UserID, comment.ThreadID, comment.ID, "deleted your comment")
+}
+
+// notifyNewMessage tells the recipient of a private message about it.
+// Messages to unknown users are left alone.
+func notifyNewMessage(message Message) {
+	var senderID, recipientID int
+	err := db.QueryRow(`
+        SELECT s.id, r.id FROM users s, users r
+        WHERE s.username = ? AND r.username = ?`, message.Username, message.Recipient).Scan(&senderID, &recipientID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to notify of message %d: %v", message.ID, err)
+		return
+	}
+	// Only the recipient can read the message, so mentioning them is the only
+	// mention that notifies anyone
+	kind := notifyMessage
+	if mentionsUser(message.Content, message.Recipient) {
+		kind = notifyMention
+	}
+	notify(Notification{
+		Type:      kind,
+		MessageID: message.ID,
+		Text:      excerpt(message.Content, notificationExcerptLength),
+		userID:    recipientID,
+		actorID:   senderID,
+	})
+}
+
+// notificationSelect selects notifications with the actor and thread title.
+const notificationSelect = `
+    SELECT n.id, n.type, COALESCE(u.username, ''), COALESCE(n.thread_id, 0), COALESCE(t.title, ''),
+        COALESCE(n.comment_id, 0), COALESCE(n.message_id, 0), n.text, n.read_at IS NOT NULL, n.created_at
+    FROM notifications n
+    LEFT JOIN users u ON u.id = n.actor_id
+    LEFT JOIN threads t ON t.id = n.thread_id`
+
+func scanNotification(row scanner) (Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.Type, &n.Actor, &n.ThreadID, &n.ThreadTitle, &n.CommentID, &n.MessageID, &n.Text, &n.Read, &n.CreatedAt)
+	return n, err
+}
+
+// getNotification loads a notification of userID.
+func getNotification(userID, id int) (Notification, error) {
+	n, err := scanNotification(db.QueryRow(notificationSelect+" WHERE n.id = ? AND n.user_id = ?", id, userID))
+	if err == sql.ErrNoRows {
+		return n, errNotFound
+	}
+	n.userID = userID
+	return n, err
+}
+
+// listNotifications returns the notifications of a user, newest first.
+func listNotifications(userID int, unreadOnly bool, limit, after int) ([]Notification, string, error) {
+	query := notificationSelect + " WHERE n.user_id = ?"
+	args := []interface{}{userID}
+	if unreadOnly {
+		query += " AND n.read_at IS NULL"
+	}
+	if after > 0 {
+		query += " AND n.id < ?"
+		args = append(args, after)
+	}
+	query += " ORDER BY n.id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		next = encodeCursor(notifications[limit-1].ID)
+	}
+	return notifications, next, nil
+}
+
+// countUnreadNotifications returns how many notifications a user has not read.
+func countUnreadNotifications(userID int) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+// markNotificationsRead marks notifications of a user as read, all of them
+// when ids is empty. Ids of other users' notifications are ignored.
+func markNotificationsRead(userID int, ids []int) error {
+	query := "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL"
+	args := []interface{}{time.Now(), userID}
+	if len(ids) > 0 {
+		query += " AND id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return err
+	}
+	publishNotification(userID, nil)
+	return nil
+}
+
+// notificationPreferences returns which types a user wants, by type.
+func notificationPreferences(userID int) (map[string]bool, error) {
+	prefs := map[string]bool{}
+	for _, t := range notificationTypes {
+		prefs[t.Type] = true
+	}
+	rows, err := db.Query("SELECT type, in_app FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var on bool
+		if err := rows.Scan(&kind, &on); err != nil {
+			return nil, err
+		}
+		if _, known := prefs[kind]; known {
+			prefs[kind] = on
+		}
+	}
+	return prefs, rows.Err()
+}
+
+// setNotificationPreferences saves the given types and keeps the others.
+func setNotificationPreferences(userID int, prefs map[string]bool) error {
+	known := map[string]bool{}
+	for _, t := range notificationTypes {
+		known[t.Type] = true
+	}
+	for kind := range prefs {
+		if !known[kind] {
+			return fieldError("Unknown notification type " + kind)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for kind, on := range prefs {
+		if _, err := tx.Exec(`
+            INSERT INTO notification_preferences (user_id, type, in_app) VALUES (?, ?, ?)
+            ON CONFLICT (user_id, type) DO UPDATE SET in_app = excluded.in_app`, userID, kind, on); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// notificationEvent is pushed to the open pages of a user when they get a
+// notification or their unread count changes.
+type notificationEvent struct {
+	Unread       int           `json:"unread"`
+	Notification *Notification `json:"notification,omitempty"`
+	Summary      string        `json:"summary,omitempty"`
+	URL          string        `json:"url,omitempty"`
+}
+
+// notificationBroker fans notification events out to the streams of their user.
+type notificationBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan notificationEvent]int
+}
+
+var notificationEvents = &notificationBroker{subscribers: map[chan notificationEvent]int{}}
+
+func (b *notificationBroker) subscribe(userID int) chan notificationEvent {
+	ch := make(chan notificationEvent, 8)
+	b.mu.Lock()
+	b.subscribers[ch] = userID
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *notificationBroker) unsubscribe(ch chan notificationEvent) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+func (b *notificationBroker) listening(userID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, id := range b.subscribers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// publish never blocks; slow subscribers miss events.
+func (b *notificationBroker) publish(userID int, event notificationEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, id := range b.subscribers {
+		if id != userID {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// publishNotification sends the unread count of a user, with n if it is new,
+// to the pages they have open.
+func publishNotification(userID int, n *Notification) {
+	if !notificationEvents.listening(userID) {
+		return
+	}
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		log.Printf("Failed to count notifications: %v", err)
+		return
+	}
+	event := notificationEvent{Unread: unread, Notification: n}
+	if n != nil {
+		event.Summary, event.URL = n.Summary(), n.URL()
+	}
+	notificationEvents.publish(userID, event)
+}
+
+// notificationHeartbeat keeps idle streams from being closed by proxies.
+const notificationHeartbeat = 30 * time.Second
+
+// /notifications/stream: server-sent events with the unread count of the
+// logged in user, starting with the current count
+func serveNotificationStream(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := notificationEvents.subscribe(userID)
+	defer notificationEvents.unsubscribe(events)
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event notificationEvent) bool {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Notification encoding error: %v", err)
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: notification\ndata: %s\n\n", payload); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	if !send(notificationEvent{Unread: unread}) {
+		return
+	}
+
+	heartbeat := time.NewTicker(notificationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if !send(event) {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+const notificationPageSize = 30
+
+// /notifications: the notifications of the logged in user, newest first
+func serveNotifications(w http.ResponseWriter, r *http.Request) {
+	username, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	var after int
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		if after, err = decodeCursor(cursor); err != nil {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+	notifications, next, err := listNotifications(userID, false, notificationPageSize, after)
+	if err != nil {
+		log.Printf("Failed to load notifications: %v", err)
+		http.Error(w, "Failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+	unread, err := countUnreadNotifications(userID)
+	if err != nil {
+		http.Error(w, "Failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/notifications.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Username":      username,
+		"Notifications": notifications,
+		"Unread":        unread,
+		"NextCursor":    next,
+	})
+}
+
+// /notifications/open?id=...: marks a notification read and goes to what it is about
+func openNotification(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Notification ID is required", http.StatusBadRequest)
+		return
+	}
+	n, err := getNotification(userID, id)
+	if err == errNotFound {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+	if err == nil && !n.Read {
+		err = markNotificationsRead(userID, []int{id})
+	}
+	if err != nil {
+		log.Printf("Failed to open notification: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, n.URL(), http.StatusSeeOther)
+}
+
+// /notifications/read: marks the notifications in id, or all with no id, as read
+func handleMarkNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+	r.ParseForm()
+	var ids []int
+	for _, value := range r.Form["id"] {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	if err := markNotificationsRead(userID, ids); err != nil {
+		log.Printf("Failed to mark notifications read: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+}
+
+// /settings/notifications: which notifications the logged in user gets in the
+// app and by email, and how often they get a digest
+func serveNotificationSettings(w http.ResponseWriter, r *http.Request) {
+	username, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		r.ParseForm()
+		prefs := map[string]bool{}
+		for _, t := range notificationTypes {
+			prefs[t.Type] = r.Form.Get(t.Type) == "1"
+		}
+		emailPrefs := map[string]bool{}
+		for kind := range emailNotificationDefaults {
+			emailPrefs[kind] = r.Form.Get("email_"+kind) == "1"
+		}
+		err := setNotificationPreferences(userID, prefs)
+		if err == nil {
+			err = setEmailPreferences(userID, emailPrefs)
+		}
+		if err == nil {
+			err = setDigest(userID, r.Form.Get("digest"))
+		}
+		if _, invalid := err.(fieldError); invalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to save notification settings: %v", err)
+			http.Error(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/settings/notifications", http.StatusSeeOther)
+		return
+	}
+
+	prefs, err := notificationPreferences(userID)
+	if err != nil {
+		http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+	emailPrefs, err := emailPreferences(userID)
+	if err != nil {
+		http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+	to, err := getEmailRecipient(userID)
+	if err != nil {
+		http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+	digest, err := getDigest(userID)
+	if err != nil {
+		http.Error(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+	emailTypes := map[string]bool{}
+	for kind := range emailNotificationDefaults {
+		emailTypes[kind] = true
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/notification_settings.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Username":         username,
+		"Types":            notificationTypes,
+		"Preferences":      prefs,
+		"EmailTypes":       emailTypes,
+		"EmailPreferences": emailPrefs,
+		"Email":            to.Email,
+		"EmailOn":          mailer != nil,
+		"Digest":           digest,
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// notificationsOf lists the notifications of a user, newest first, as "type by actor".
+func notificationsOf(t *testing.T, userID int) []string {
+	t.Helper()
+	notifications, _, err := listNotifications(userID, false, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, n := range notifications {
+		list = append(list, n.Type+" by "+n.Actor)
+	}
+	return list
+}
+
+func TestCommentNotifications(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobComment, err := createComment(bob, int(threadID), 0, "Top level", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Commenting watches the thread; those notifications are tested with the watches
+	for _, id := range []int{author, bob, carol} {
+		if err := setNotificationPreferences(id, map[string]bool{notifyWatching: false}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		setup    func()
+		userID   int
+		parentID int
+		want     map[int][]string // new notifications by recipient
+	}{
+		{"reply to the thread", nil, carol, 0, map[int][]string{author: {"thread_reply by carol"}}},
+		{"reply to a comment", nil, carol, int(bobComment), map[int][]string{bob: {"comment_reply by carol"}}},
+		{"own thread", nil, author, 0, nil},
+		{"own comment", nil, bob, int(bobComment), nil},
+		{"muted author", func() {
+			if err := setRelation(userMutes, author, carol, true); err != nil {
+				t.Fatal(err)
+			}
+		}, carol, 0, nil},
+		{"type turned off", func() {
+			if err := setNotificationPreferences(bob, map[string]bool{notifyCommentReply: false}); err != nil {
+				t.Fatal(err)
+			}
+		}, carol, int(bobComment), nil},
+		{"other types stay on", nil, bob, 0, map[int][]string{author: {"thread_reply by bob"}}},
+	}
+	before := map[int][]string{}
+	for _, id := range []int{author, bob, carol} {
+		before[id] = notificationsOf(t, id)
+	}
+	for _, tt := range tests {
+		if tt.setup != nil {
+			tt.setup()
+		}
+		if _, err := createComment(tt.userID, int(threadID), tt.parentID, "A comment", nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int{author, bob, carol} {
+			got := notificationsOf(t, id)
+			added := got[:len(got)-len(before[id])]
+			want := tt.want[id]
+			if want == nil {
+				want = []string{}
+			}
+			if !reflect.DeepEqual(added, want) {
+				t.Errorf("%s: user %d got %v, want %v", tt.name, id, added, want)
+			}
+			before[id] = got
+		}
+	}
+}
+
+func TestModerationNotificationsIgnoreMutes(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setRelation(userMutes, author, moderator, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := setNotificationPreferences(author, map[string]bool{notifyVote: false}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := castVote(threadVotes, int(threadID), moderator, 1); err != nil {
+		t.Fatal(err)
+	}
+	notifyModerator(moderator, author, int(threadID), 0, "locked your thread")
+	notifyModerator(author, author, int(threadID), 0, "edited your thread")
+	if got, want := notificationsOf(t, author), []string{"moderation by mod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifications %v, want %v", got, want)
+	}
+}
+
+func TestVoteNotificationsAreSentOnce(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	setTestRole(t, voter, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		vote int
+		want int
+	}{
+		{1, 1},
+		{0, 1},
+		{1, 1},  // liked again
+		{-1, 1}, // dislikes are not announced
+		{1, 1},
+	}
+	for i, tt := range tests {
+		if _, err := castVote(threadVotes, int(threadID), voter, tt.vote); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(notificationsOf(t, author)); got != tt.want {
+			t.Errorf("vote %d (%d): %d notifications, want %d", i, tt.vote, got, tt.want)
+		}
+	}
+}
+
+func TestMarkNotificationsRead(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	aliceThread, err := createThread(alice, ThreadInput{Title: "Alice's thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobThread, err := createThread(bob, ThreadInput{Title: "Bob's thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := createComment(bob, int(aliceThread), 0, fmt.Sprintf("Comment %d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := createComment(alice, int(bobThread), 0, "A comment", nil); err != nil {
+		t.Fatal(err)
+	}
+	notifications, _, err := listNotifications(alice, false, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobNotifications, _, err := listNotifications(bob, false, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := login(t, "alice")
+
+	tests := []struct {
+		ids    []int
+		unread int
+		bob    int // unread of bob, whose notification ids are ignored
+	}{
+		{[]int{notifications[0].ID}, 2, 1},
+		{[]int{notifications[0].ID, bobNotifications[0].ID}, 2, 1},
+		{nil, 0, 1},
+	}
+	for i, tt := range tests {
+		form := url.Values{}
+		for _, id := range tt.ids {
+			form.Add("id", fmt.Sprint(id))
+		}
+		if w := postForm(handleMarkNotificationsRead, "/notifications/read", form, cookie); w.Code != http.StatusSeeOther {
+			t.Fatalf("step %d: status %d: %s", i, w.Code, w.Body)
+		}
+		if unread, err := countUnreadNotifications(alice); err != nil || unread != tt.unread {
+			t.Errorf("step %d: alice has %d unread, %v, want %d", i, unread, err, tt.unread)
+		}
+		if unread, err := countUnreadNotifications(bob); err != nil || unread != tt.bob {
+			t.Errorf("step %d: bob has %d unread, %v, want %d", i, unread, err, tt.bob)
+		}
+	}
+
+	unreadOnly, _, err := listNotifications(bob, true, 10, 0)
+	if err != nil || len(unreadOnly) != 1 {
+		t.Errorf("unread notifications of bob: %d, %v", len(unreadOnly), err)
+	}
+	// Opening someone else's notification is refused
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/notifications/open?id=%d", bobNotifications[0].ID), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	openNotification(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("opening bob's notification: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+
+	tests := []struct {
+		set  map[string]bool
+		err  bool
+		want map[string]bool // the preferences that differ from on
+	}{
+		{map[string]bool{}, false, map[string]bool{}},
+		{map[string]bool{notifyVote: false}, false, map[string]bool{notifyVote: false}},
+		{map[string]bool{notifyMention: false}, false, map[string]bool{notifyVote: false, notifyMention: false}},
+		{map[string]bool{notifyVote: true}, false, map[string]bool{notifyMention: false}},
+		{map[string]bool{"birthday": false, notifyMessage: false}, true, map[string]bool{notifyMention: false}},
+	}
+	for i, tt := range tests {
+		err := setNotificationPreferences(alice, tt.set)
+		if _, invalid := err.(fieldError); invalid != tt.err {
+			t.Errorf("step %d: %v, want error %v", i, err, tt.err)
+		}
+		prefs, err := notificationPreferences(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prefs) != len(notificationTypes) {
+			t.Errorf("step %d: %d preferences, want one per type", i, len(prefs))
+		}
+		off := map[string]bool{}
+		for kind, on := range prefs {
+			if !on {
+				off[kind] = false
+			}
+		}
+		if !reflect.DeepEqual(off, tt.want) {
+			t.Errorf("step %d: turned off %v, want %v", i, off, tt.want)
+		}
+	}
+}
+
+func TestNotificationEvents(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := notificationEvents.subscribe(author)
+	defer notificationEvents.unsubscribe(events)
+	others := notificationEvents.subscribe(bob)
+	defer notificationEvents.unsubscribe(others)
+
+	if _, err := createComment(bob, int(threadID), 0, "Hello", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Unread != 1 || event.Notification == nil || event.Summary != `bob commented on your thread "A thread"` {
+			t.Errorf("event %+v", event)
+		}
+	default:
+		t.Fatal("no event for the new notification")
+	}
+
+	if err := markNotificationsRead(author, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Unread != 0 || event.Notification != nil {
+			t.Errorf("event after reading %+v", event)
+		}
+	default:
+		t.Fatal("no event after marking notifications read")
+	}
+	select {
+	case event := <-others:
+		t.Errorf("bob got %+v", event)
+	default:
+	}
+}
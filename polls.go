@@ -0,0 +1,407 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A thread can carry one poll, added when the thread is created by users with
+// the create_poll privilege. Polls take one or several choices, can hide who
+// voted for what, can close at a set time and can let voters change their
+// vote. Their author picks whether results show before voting, only after
+// voting or only once the poll has closed.
+
+// When the results of a poll are shown.
+const (
+	pollResultsAlways = "always" // to everyone, even before they vote
+	pollResultsVoted  = "voted"  // to those who voted, and to everyone once closed
+	pollResultsClosed = "closed" // only once the poll has closed
+)
+
+// pollResults lists the result policies in the order they are offered.
+var pollResults = []struct {
+	Value string
+	Label string
+}{
+	{pollResultsAlways, "Always show results"},
+	{pollResultsVoted, "Show results after voting"},
+	{pollResultsClosed, "Show results when the poll closes"},
+}
+
+// Limits of polls, in options and characters.
+const (
+	minPollOptions        = 2
+	maxPollOptions        = 20
+	maxPollQuestionLength = 300
+	maxPollOptionLength   = 200
+)
+
+// PollInput is a poll as it is asked for when creating a thread.
+type PollInput struct {
+	Question    string     `json:"question"`
+	Options     []string   `json:"options"`
+	Multiple    bool       `json:"multiple"`     // voters may pick several options
+	Anonymous   bool       `json:"anonymous"`    // who voted for what is never shown
+	ChangeVotes bool       `json:"change_votes"` // voters may change or withdraw their vote
+	Results     string     `json:"results"`      // always, voted or closed; always when empty
+	ClosesAt    *time.Time `json:"closes_at"`    // nil for a poll that stays open
+}
+
+// normalize trims the poll and checks it. The errors it returns are meant to
+// be shown to the user.
+func (p *PollInput) normalize(now time.Time) error {
+	p.Question = strings.TrimSpace(p.Question)
+	if p.Question == "" {
+		return fieldError("The poll needs a question")
+	}
+	if utf8.RuneCountInString(p.Question) > maxPollQuestionLength {
+		return fieldError("The poll question is too long")
+	}
+
+	options := []string{}
+	seen := map[string]bool{}
+	for _, option := range p.Options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if utf8.RuneCountInString(option) > maxPollOptionLength {
+			return fieldError("A poll option is too long")
+		}
+		if seen[strings.ToLower(option)] {
+			return fieldError("Poll option " + option + " is given twice")
+		}
+		seen[strings.ToLower(option)] = true
+		options = append(options, option)
+	}
+	if len(options) < minPollOptions || len(options) > maxPollOptions {
+		return fieldError(fmt.Sprintf("A poll needs %d to %d options", minPollOptions, maxPollOptions))
+	}
+	p.Options = options
+
+	if p.Results == "" {
+		p.Results = pollResultsAlways
+	}
+	valid := false
+	for _, r := range pollResults {
+		valid = valid || r.Value == p.Results
+	}
+	if !valid {
+		return fieldError("Unknown poll results setting " + p.Results)
+	}
+	if p.ClosesAt != nil && !p.ClosesAt.After(now) {
+		return fieldError("The poll must close in the future")
+	}
+	if p.ClosesAt == nil && p.Results == pollResultsClosed {
+		return fieldError("A poll that never closes cannot hide its results until it closes")
+	}
+	return nil
+}
+
+// createPoll adds a normalized poll to a thread.
+func createPoll(tx *sql.Tx, threadID int, p PollInput) error {
+	result, err := tx.Exec(`
+        INSERT INTO polls (thread_id, question, multiple, anonymous, change_votes, results, closes_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		threadID, p.Question, p.Multiple, p.Anonymous, p.ChangeVotes, p.Results, p.ClosesAt, time.Now())
+	if err != nil {
+		return err
+	}
+	pollID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, option := range p.Options {
+		if _, err := tx.Exec("INSERT INTO poll_options (poll_id, text, position) VALUES (?, ?, ?)", pollID, option, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Poll is a poll as one viewer sees it. Vote counts and voters are only
+// filled in when the viewer may see the results.
+type Poll struct {
+	ID             int          `json:"id"`
+	ThreadID       int          `json:"thread_id"`
+	Question       string       `json:"question"`
+	Multiple       bool         `json:"multiple"`
+	Anonymous      bool         `json:"anonymous"`
+	ChangeVotes    bool         `json:"change_votes"`
+	Results        string       `json:"results"`
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"`
+	Closed         bool         `json:"closed"`
+	Options        []PollOption `json:"options"`
+	ResultsVisible bool         `json:"results_visible"`
+	Voters         *int         `json:"voters,omitempty"` // how many users voted
+	Voted          []int        `json:"voted"`            // the options the viewer voted for
+	CanVote        bool         `json:"can_vote"`         // whether the viewer can vote now
+}
+
+// PollOption is one of the answers of a poll.
+type PollOption struct {
+	ID      int      `json:"id"`
+	Text    string   `json:"text"`
+	Votes   *int     `json:"votes,omitempty"`
+	Voters  []string `json:"voters,omitempty"` // usernames, unless the poll is anonymous
+	Percent int      `json:"-"`                // share of the voters who picked the option
+	Chosen  bool     `json:"-"`                // whether the viewer voted for it
+}
+
+// getPoll returns the poll of a thread as viewerID (0 for guests) sees it,
+// or nil if the thread has none.
+func getPoll(threadID, viewerID int) (*Poll, error) {
+	p := Poll{ThreadID: threadID, Voted: []int{}}
+	var closesAt sql.NullTime
+	var archived bool
+	err := db.QueryRow(`
+        SELECT p.id, p.question, p.multiple, p.anonymous, p.change_votes, p.results, p.closes_at, t.archived_at IS NOT NULL
+        FROM polls p JOIN threads t ON t.id = p.thread_id
+        WHERE p.thread_id = ?`, threadID).Scan(&p.ID, &p.Question, &p.Multiple, &p.Anonymous, &p.ChangeVotes, &p.Results, &closesAt, &archived)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if closesAt.Valid {
+		p.ClosesAt = &closesAt.Time
+		p.Closed = !time.Now().Before(closesAt.Time)
+	}
+	// Polls of archived threads are closed with them
+	p.Closed = p.Closed || archived
+
+	rows, err := db.Query("SELECT id, text FROM poll_options WHERE poll_id = ? ORDER BY position, id", p.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var o PollOption
+		if err := rows.Scan(&o.ID, &o.Text); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Options = append(p.Options, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if viewerID != 0 {
+		rows, err := db.Query("SELECT option_id FROM poll_votes WHERE poll_id = ? AND user_id = ?", p.ID, viewerID)
+		if err != nil {
+			return nil, err
+		}
+		voted, err := scanIDs(rows)
+		if err != nil {
+			return nil, err
+		}
+		p.Voted = append(p.Voted, voted...)
+	}
+	chosen := map[int]bool{}
+	for _, id := range p.Voted {
+		chosen[id] = true
+	}
+	for i := range p.Options {
+		p.Options[i].Chosen = chosen[p.Options[i].ID]
+	}
+	p.CanVote = viewerID != 0 && !p.Closed && (len(p.Voted) == 0 || p.ChangeVotes)
+	p.ResultsVisible = p.Results == pollResultsAlways || p.Closed || (p.Results == pollResultsVoted && len(p.Voted) > 0)
+	if !p.ResultsVisible {
+		return &p, nil
+	}
+
+	var voters int
+	if err := db.QueryRow("SELECT COUNT(DISTINCT user_id) FROM poll_votes WHERE poll_id = ?", p.ID).Scan(&voters); err != nil {
+		return nil, err
+	}
+	p.Voters = &voters
+	rows, err = db.Query(`
+        SELECT v.option_id, u.username FROM poll_votes v
+        JOIN users u ON u.id = v.user_id
+        WHERE v.poll_id = ?
+        ORDER BY v.created_at, u.username`, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[int]int{}
+	names := map[int][]string{}
+	for rows.Next() {
+		var optionID int
+		var username string
+		if err := rows.Scan(&optionID, &username); err != nil {
+			return nil, err
+		}
+		counts[optionID]++
+		if !p.Anonymous {
+			names[optionID] = append(names[optionID], username)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range p.Options {
+		o := &p.Options[i]
+		votes := counts[o.ID]
+		o.Votes = &votes
+		o.Voters = names[o.ID]
+		if voters > 0 {
+			o.Percent = votes * 100 / voters
+		}
+	}
+	return &p, nil
+}
+
+// votePoll replaces the vote of userID on the poll of a thread with
+// optionIDs. An empty optionIDs withdraws the vote.
+func votePoll(threadID, userID int, optionIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pollID int
+	var multiple, changeVotes bool
+	var closesAt sql.NullTime
+	var archived bool
+	err = tx.QueryRow(`
+        SELECT p.id, p.multiple, p.change_votes, p.closes_at, t.archived_at IS NOT NULL
+        FROM polls p JOIN threads t ON t.id = p.thread_id
+        WHERE p.thread_id = ?`, threadID).Scan(&pollID, &multiple, &changeVotes, &closesAt, &archived)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived || (closesAt.Valid && !time.Now().Before(closesAt.Time)) {
+		return fieldError("The poll is closed")
+	}
+
+	var voted int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID).Scan(&voted); err != nil {
+		return err
+	}
+	if voted > 0 && !changeVotes {
+		return fieldError("You have voted already and this poll does not allow changing votes")
+	}
+	if len(optionIDs) == 0 && voted == 0 {
+		return fieldError("You have not voted on this poll")
+	}
+	if len(optionIDs) > 1 && !multiple {
+		return fieldError("This poll allows a single choice")
+	}
+	if len(optionIDs) > maxPollOptions {
+		return fieldError("Too many options")
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE poll_id = ? AND user_id = ?", pollID, userID); err != nil {
+		return err
+	}
+	now := time.Now()
+	seen := map[int]bool{}
+	for _, optionID := range optionIDs {
+		if seen[optionID] {
+			continue
+		}
+		seen[optionID] = true
+		// Only options of this poll are inserted
+		result, err := tx.Exec(`
+            INSERT INTO poll_votes (poll_id, option_id, user_id, created_at)
+            SELECT poll_id, id, ?, ? FROM poll_options WHERE id = ? AND poll_id = ?`, userID, now, optionID, pollID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fieldError(fmt.Sprintf("Option %d is not part of this poll", optionID))
+		}
+	}
+	return tx.Commit()
+}
+
+// pollFromForm reads the poll fields of the new thread form, or returns nil
+// when no question was given. The closing time is read in the timezone of
+// the user's profile.
+func pollFromForm(r *http.Request, userID int) (*PollInput, error) {
+	question := r.FormValue("poll_question")
+	if strings.TrimSpace(question) == "" {
+		return nil, nil
+	}
+	p := &PollInput{
+		Question:    question,
+		Options:     strings.Split(r.FormValue("poll_options"), "\n"),
+		Multiple:    r.FormValue("poll_multiple") != "",
+		Anonymous:   r.FormValue("poll_anonymous") != "",
+		ChangeVotes: r.FormValue("poll_change_votes") != "",
+		Results:     r.FormValue("poll_results"),
+	}
+	if v := r.FormValue("poll_closes_at"); v != "" {
+		closesAt, err := parseUserTime(userID, v)
+		if err != nil {
+			return nil, fieldError("Invalid poll closing time")
+		}
+		p.ClosesAt = &closesAt
+	}
+	return p, nil
+}
+
+// /poll/vote: votes for the options of the poll of thread_id; withdraw takes
+// the vote back
+func handlePollVote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+	threadID, err := strconv.Atoi(r.FormValue("thread_id"))
+	if err != nil {
+		http.Error(w, "Invalid thread", http.StatusBadRequest)
+		return
+	}
+
+	optionIDs := []int{}
+	if r.FormValue("withdraw") == "" {
+		for _, v := range r.Form["option"] {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid option", http.StatusBadRequest)
+				return
+			}
+			optionIDs = append(optionIDs, id)
+		}
+		if len(optionIDs) == 0 {
+			http.Error(w, "Pick an option to vote for", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = votePoll(threadID, userID, optionIDs)
+	if _, ok := err.(fieldError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to save poll vote: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/thread?id=%d#poll", threadID), http.StatusSeeOther)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestPoll starts a thread by a moderator with the poll p and returns
+// the thread id and the ids of the poll options.
+func createTestPoll(t *testing.T, p PollInput) (int, []int) {
+	t.Helper()
+	var authorID int
+	if err := db.QueryRow("SELECT id FROM users WHERE username = 'pollster'").Scan(&authorID); err != nil {
+		authorID = createTestUser(t, "pollster")
+		setTestRole(t, authorID, roleModerator)
+	}
+	threadID, err := createThread(authorID, ThreadInput{Title: "A poll", Description: "Vote below", Poll: &p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll, err := getPoll(int(threadID), 0)
+	if err != nil || poll == nil {
+		t.Fatalf("poll of thread %d: %v, %v", threadID, poll, err)
+	}
+	var optionIDs []int
+	for _, o := range poll.Options {
+		optionIDs = append(optionIDs, o.ID)
+	}
+	return int(threadID), optionIDs
+}
+
+// closeTestPoll moves the closing time of the poll of a thread into the past.
+func closeTestPoll(t *testing.T, threadID int) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE polls SET closes_at = ? WHERE thread_id = ?", time.Now().Add(-time.Minute), threadID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollInputNormalize(t *testing.T) {
+	now := time.Now()
+	future, past := now.Add(time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		in      PollInput
+		err     bool
+		options []string
+		results string
+	}{
+		{"trimmed", PollInput{Question: " Tea? ", Options: []string{" Yes ", "", "No"}}, false, []string{"Yes", "No"}, pollResultsAlways},
+		{"no question", PollInput{Question: " ", Options: []string{"Yes", "No"}}, true, nil, ""},
+		{"long question", PollInput{Question: strings.Repeat("q", maxPollQuestionLength+1), Options: []string{"Yes", "No"}}, true, nil, ""},
+		{"one option", PollInput{Question: "Tea?", Options: []string{"Yes", " "}}, true, nil, ""},
+		{"duplicate options", PollInput{Question: "Tea?", Options: []string{"Yes", "yes"}}, true, nil, ""},
+		{"long option", PollInput{Question: "Tea?", Options: []string{"Yes", strings.Repeat("o", maxPollOptionLength+1)}}, true, nil, ""},
+		{"too many options", PollInput{Question: "Tea?", Options: strings.Split(strings.Repeat("o\n", maxPollOptions)+"last", "\n")}, true, nil, ""},
+		{"unknown results", PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, Results: "never"}, true, nil, ""},
+		{"closes in the past", PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, ClosesAt: &past}, true, nil, ""},
+		{"results when closed without closing", PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, Results: pollResultsClosed}, true, nil, ""},
+		{"results when closed", PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, Results: pollResultsClosed, ClosesAt: &future}, false, []string{"Yes", "No"}, pollResultsClosed},
+	}
+	for _, tt := range tests {
+		in := tt.in
+		err := in.normalize(now)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(in.Options, tt.options) || in.Results != tt.results || strings.TrimSpace(in.Question) != in.Question {
+			t.Errorf("%s: normalized to %+v", tt.name, in)
+		}
+	}
+}
+
+func TestCreatingPollsNeedsThePrivilege(t *testing.T) {
+	newTestDB(t)
+	user := createTestUser(t, "alice")
+	in := ThreadInput{Title: "A poll", Description: "Vote below", Poll: &PollInput{Question: "Tea?", Options: []string{"Yes", "No"}}}
+	if _, err := createThread(user, in); err != errForbidden {
+		t.Errorf("without reputation: %v, want errForbidden", err)
+	}
+	if _, err := db.Exec("UPDATE users SET reputation = ? WHERE id = ?", privilegeThreshold(privilegeCreatePoll), user); err != nil {
+		t.Fatal(err)
+	}
+	threadID, err := createThread(user, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poll, err := getPoll(int(threadID), user); err != nil || poll == nil || poll.Question != "Tea?" || len(poll.Options) != 2 {
+		t.Errorf("poll %+v, %v", poll, err)
+	}
+}
+
+func TestVotePoll(t *testing.T) {
+	newTestDB(t)
+	voter := createTestUser(t, "alice")
+	single, singleOptions := createTestPoll(t, PollInput{Question: "One?", Options: []string{"A", "B", "C"}})
+	multiple, multipleOptions := createTestPoll(t, PollInput{Question: "Several?", Options: []string{"A", "B", "C"}, Multiple: true, ChangeVotes: true})
+
+	tests := []struct {
+		name     string
+		threadID int
+		options  []int
+		err      bool
+		voted    []int
+	}{
+		{"withdraw before voting", multiple, nil, true, []int{}},
+		{"several on a single choice poll", single, singleOptions[:2], true, []int{}},
+		{"option of another poll", single, multipleOptions[:1], true, []int{}},
+		{"vote", single, singleOptions[1:2], false, singleOptions[1:2]},
+		{"change without the policy", single, singleOptions[:1], true, singleOptions[1:2]},
+		{"withdraw without the policy", single, nil, true, singleOptions[1:2]},
+		{"several", multiple, multipleOptions[:2], false, multipleOptions[:2]},
+		{"the same option twice", multiple, []int{multipleOptions[2], multipleOptions[2]}, false, multipleOptions[2:]},
+		{"withdraw", multiple, nil, false, []int{}},
+	}
+	for _, tt := range tests {
+		err := votePoll(tt.threadID, voter, tt.options)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+		}
+		poll, err := getPoll(tt.threadID, voter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(poll.Voted, tt.voted) {
+			t.Errorf("%s: voted %v, want %v", tt.name, poll.Voted, tt.voted)
+		}
+	}
+
+	if err := votePoll(single+multiple+1, voter, singleOptions[:1]); err != errNotFound {
+		t.Errorf("thread without a poll: %v, want errNotFound", err)
+	}
+}
+
+func TestPollsClose(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	future := time.Now().Add(time.Hour)
+
+	timed, timedOptions := createTestPoll(t, PollInput{Question: "Timed?", Options: []string{"A", "B"}, ClosesAt: &future})
+	archived, archivedOptions := createTestPoll(t, PollInput{Question: "Archived?", Options: []string{"A", "B"}})
+	if err := votePoll(timed, alice, timedOptions[:1]); err != nil {
+		t.Fatal(err)
+	}
+	closeTestPoll(t, timed)
+	if _, err := db.Exec("UPDATE threads SET archived_at = ? WHERE id = ?", time.Now(), archived); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, poll := range []struct {
+		threadID int
+		optionID int
+	}{{timed, timedOptions[1]}, {archived, archivedOptions[0]}} {
+		if err := votePoll(poll.threadID, bob, []int{poll.optionID}); err == nil {
+			t.Errorf("thread %d: voted on a closed poll", poll.threadID)
+		}
+		p, err := getPoll(poll.threadID, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !p.Closed || p.CanVote || !p.ResultsVisible {
+			t.Errorf("thread %d: closed %v, can vote %v, results visible %v", poll.threadID, p.Closed, p.CanVote, p.ResultsVisible)
+		}
+	}
+	if p, _ := getPoll(timed, bob); *p.Voters != 1 || *p.Options[0].Votes != 1 || *p.Options[1].Votes != 0 {
+		t.Errorf("results of the closed poll: %d voters, options %+v", *p.Voters, p.Options)
+	}
+}
+
+func TestPollResultsVisibility(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		results string
+		voted   bool // whether bob voted
+		closed  bool
+		want    bool
+	}{
+		{pollResultsAlways, false, false, true},
+		{pollResultsVoted, false, false, false},
+		{pollResultsVoted, true, false, true},
+		{pollResultsVoted, false, true, true},
+		{pollResultsClosed, true, false, false},
+		{pollResultsClosed, false, true, true},
+	}
+	for _, tt := range tests {
+		threadID, optionIDs := createTestPoll(t, PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, Results: tt.results, ClosesAt: &future})
+		if err := votePoll(threadID, alice, optionIDs[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if tt.voted {
+			if err := votePoll(threadID, bob, optionIDs[1:]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.closed {
+			closeTestPoll(t, threadID)
+		}
+		poll, err := getPoll(threadID, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%s, voted %v, closed %v", tt.results, tt.voted, tt.closed)
+		if poll.ResultsVisible != tt.want {
+			t.Errorf("%s: results visible %v, want %v", name, poll.ResultsVisible, tt.want)
+		}
+		if hidden := poll.Voters == nil && poll.Options[0].Votes == nil; hidden == tt.want {
+			t.Errorf("%s: counts filled in %v, want %v", name, !hidden, tt.want)
+		}
+	}
+}
+
+func TestAnonymousPollsHideVoters(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+
+	for _, anonymous := range []bool{false, true} {
+		threadID, optionIDs := createTestPoll(t, PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, Anonymous: anonymous})
+		if err := votePoll(threadID, alice, optionIDs[:1]); err != nil {
+			t.Fatal(err)
+		}
+		poll, err := getPoll(threadID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"alice"}
+		if anonymous {
+			want = nil
+		}
+		if !reflect.DeepEqual(poll.Options[0].Voters, want) || *poll.Options[0].Votes != 1 || poll.Options[0].Percent != 100 {
+			t.Errorf("anonymous %v: option %+v, want voters %v", anonymous, poll.Options[0], want)
+		}
+		if poll.CanVote {
+			t.Errorf("anonymous %v: guests can vote", anonymous)
+		}
+	}
+}
+
+func TestHandlePollVote(t *testing.T) {
+	newTestDB(t)
+	createTestUser(t, "alice")
+	threadID, optionIDs := createTestPoll(t, PollInput{Question: "Tea?", Options: []string{"Yes", "No"}, ChangeVotes: true})
+	cookie := login(t, "alice")
+	thread := fmt.Sprint(threadID)
+
+	tests := []struct {
+		form   url.Values
+		status int
+	}{
+		{url.Values{"thread_id": {thread}}, http.StatusBadRequest},
+		{url.Values{"thread_id": {thread}, "option": {"yes"}}, http.StatusBadRequest},
+		{url.Values{"thread_id": {"x"}, "option": {fmt.Sprint(optionIDs[0])}}, http.StatusBadRequest},
+		{url.Values{"thread_id": {fmt.Sprint(threadID + 1)}, "option": {fmt.Sprint(optionIDs[0])}}, http.StatusNotFound},
+		{url.Values{"thread_id": {thread}, "option": {fmt.Sprint(optionIDs[0])}}, http.StatusSeeOther},
+		{url.Values{"thread_id": {thread}, "withdraw": {"1"}}, http.StatusSeeOther},
+		{url.Values{"thread_id": {thread}, "withdraw": {"1"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if w := postForm(handlePollVote, "/poll/vote", tt.form, cookie); w.Code != tt.status {
+			t.Errorf("%v: status %d, want %d: %s", tt.form, w.Code, tt.status, w.Body)
+		}
+	}
+}
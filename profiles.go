@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones also work on systems without zoneinfo, e.g. the alpine image
+	"unicode/utf8"
+)
+
+// UserLink is a website or social link on a profile.
+type UserLink struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
+}
+
+// UserDetails is what users fill in about themselves on their profile.
+type UserDetails struct {
+	DisplayName string     `json:"display_name"`
+	Bio         string     `json:"bio"` // markdown
+	Signature   string     `json:"signature"`
+	Location    string     `json:"location"`
+	Timezone    string     `json:"timezone"`
+	Links       []UserLink `json:"links"`
+	Avatar      string     `json:"-"` // file name in the avatar directory
+}
+
+// Limits of the profile fields, in characters.
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 2000
+	maxSignatureLength   = 300
+	maxLocationLength    = 100
+	maxLinkLabelLength   = 50
+	maxLinkURLLength     = 300
+	maxUserLinks         = 5
+)
+
+// BioHTML returns the bio rendered from markdown.
+func (d UserDetails) BioHTML() template.HTML {
+	html, err := renderMarkdown(d.Bio)
+	if err != nil {
+		log.Printf("Failed to render bio: %v", err)
+		return template.HTML(template.HTMLEscapeString(d.Bio))
+	}
+	return html
+}
+
+// LocalTime returns the current time in the user's timezone, or "" if they did not set one.
+func (d UserDetails) LocalTime() string {
+	loc, err := time.LoadLocation(d.Timezone)
+	if d.Timezone == "" || err != nil {
+		return ""
+	}
+	return time.Now().In(loc).Format("15:04 MST")
+}
+
+// parseUserTime reads the value of a datetime-local form field in the
+// timezone of the user, or of the server if they did not set one.
+func parseUserTime(userID int, value string) (time.Time, error) {
+	loc := time.Local
+	if details, err := getUserDetails(userID); err == nil && details.Timezone != "" {
+		if l, err := time.LoadLocation(details.Timezone); err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation("2006-01-02T15:04", value, loc)
+}
+
+// normalize trims the details and checks them against the limits. The
+// errors it returns are meant to be shown to the user.
+func (d *UserDetails) normalize() error {
+	fields := []struct {
+		value *string
+		name  string
+		max   int
+	}{
+		{&d.DisplayName, "Display name", maxDisplayNameLength},
+		{&d.Bio, "Bio", maxBioLength},
+		{&d.Signature, "Signature", maxSignatureLength},
+		{&d.Location, "Location", maxLocationLength},
+		{&d.Timezone, "Timezone", 64},
+	}
+	for _, f := range fields {
+		*f.value = strings.TrimSpace(*f.value)
+		if utf8.RuneCountInString(*f.value) > f.max {
+			return fieldError(f.name + " is too long")
+		}
+	}
+	if d.Timezone != "" {
+		if _, err := time.LoadLocation(d.Timezone); err != nil || d.Timezone == "Local" {
+			return fieldError("Unknown timezone " + d.Timezone)
+		}
+	}
+
+	links := []UserLink{}
+	for _, link := range d.Links {
+		link.Label = strings.TrimSpace(link.Label)
+		link.URL = strings.TrimSpace(link.URL)
+		if link.URL == "" {
+			continue
+		}
+		u, err := url.Parse(link.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fieldError("Links must be http or https URLs")
+		}
+		if link.Label == "" {
+			link.Label = u.Host
+		}
+		if utf8.RuneCountInString(link.Label) > maxLinkLabelLength || len(link.URL) > maxLinkURLLength {
+			return fieldError("Link is too long")
+		}
+		links = append(links, link)
+	}
+	if len(links) > maxUserLinks {
+		return fieldError(fmt.Sprintf("At most %d links are allowed", maxUserLinks))
+	}
+	d.Links = links
+	return nil
+}
+
+// fieldError is a problem with what the user entered.
+type fieldError string
+
+func (e fieldError) Error() string { return string(e) }
+
+// getUserDetails loads the profile details of a user.
+func getUserDetails(userID int) (UserDetails, error) {
+	var d UserDetails
+	err := db.QueryRow(`
+        SELECT display_name, bio, signature, location, timezone, avatar
+        FROM users WHERE id = ?`, userID).Scan(&d.DisplayName, &d.Bio, &d.Signature, &d.Location, &d.Timezone, &d.Avatar)
+	if err != nil {
+		return d, err
+	}
+
+	rows, err := db.Query("SELECT label, url FROM user_links WHERE user_id = ? ORDER BY position, id", userID)
+	if err != nil {
+		return d, err
+	}
+	defer rows.Close()
+
+	d.Links = []UserLink{}
+	for rows.Next() {
+		var link UserLink
+		if err := rows.Scan(&link.Label, &link.URL); err != nil {
+			return d, err
+		}
+		d.Links = append(d.Links, link)
+	}
+	return d, rows.Err()
+}
+
+// updateUserDetails saves normalized profile details. The avatar is changed
+// separately with saveAvatar and removeAvatar.
+func updateUserDetails(userID int, d UserDetails) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+        UPDATE users SET display_name = ?, bio = ?, signature = ?, location = ?, timezone = ?
+        WHERE id = ?`, d.DisplayName, d.Bio, d.Signature, d.Location, d.Timezone, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_links WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for i, link := range d.Links {
+		if _, err := tx.Exec("INSERT INTO user_links (user_id, label, url, position) VALUES (?, ?, ?, ?)", userID, link.Label, link.URL, i); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// listUserSignatures returns the signatures of users by id. Users without one are left out.
+func listUserSignatures(userIDs []int) (map[int]string, error) {
+	signatures := map[int]string{}
+	if len(userIDs) == 0 {
+		return signatures, nil
+	}
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+	rows, err := db.Query("SELECT id, signature FROM users WHERE signature != '' AND id IN (?"+strings.Repeat(", ?", len(userIDs)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var signature string
+		if err := rows.Scan(&id, &signature); err != nil {
+			return nil, err
+		}
+		signatures[id] = signature
+	}
+	return signatures, rows.Err()
+}
+
+// /settings/profile: form to edit the profile of the logged in user
+func serveProfileSettings(w http.ResponseWriter, r *http.Request) {
+	username, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	details, err := getUserDetails(userID)
+	if err != nil {
+		log.Printf("Failed to load profile: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var formError string
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, (maxAvatarUploadMiB+1)<<20)
+		err = saveProfileSettings(r, userID, &details)
+		if err == nil {
+			http.Redirect(w, r, "/u/"+url.PathEscape(username), http.StatusSeeOther)
+			return
+		}
+		_, invalid := err.(fieldError)
+		switch {
+		case invalid, err == errInvalidImage, err == errImageTooLarge:
+			formError = err.Error()
+		default:
+			log.Printf("Failed to save profile: %v", err)
+			http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Always offer the full number of link rows
+	links := details.Links
+	for len(links) < maxUserLinks {
+		links = append(links, UserLink{})
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/profile_settings.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Username":  username,
+		"Details":   details,
+		"Links":     links,
+		"Error":     formError,
+		"MaxAvatar": maxAvatarUploadMiB,
+	})
+}
+
+// saveProfileSettings applies a submitted settings form to details and saves it.
+func saveProfileSettings(r *http.Request, userID int, details *UserDetails) error {
+	if err := r.ParseMultipartForm((maxAvatarUploadMiB + 1) << 20); err != nil && err != http.ErrNotMultipart {
+		return errImageTooLarge
+	}
+	details.DisplayName = r.FormValue("display_name")
+	details.Bio = r.FormValue("bio")
+	details.Signature = r.FormValue("signature")
+	details.Location = r.FormValue("location")
+	details.Timezone = r.FormValue("timezone")
+	labels, urls := r.Form["link_label"], r.Form["link_url"]
+	details.Links = nil
+	for i, u := range urls {
+		link := UserLink{URL: u}
+		if i < len(labels) {
+			link.Label = labels[i]
+		}
+		details.Links = append(details.Links, link)
+	}
+	if err := details.normalize(); err != nil {
+		return err
+	}
+
+	// Check the avatar before anything is saved
+	var avatar []byte
+	if file, _, err := r.FormFile("avatar"); err == nil {
+		defer file.Close()
+		if avatar, err = processAvatar(file); err != nil {
+			return err
+		}
+	}
+
+	if err := updateUserDetails(userID, *details); err != nil {
+		return err
+	}
+	switch {
+	case avatar != nil:
+		return saveAvatar(userID, avatar)
+	case r.FormValue("remove_avatar") == "1":
+		return removeAvatar(userID)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeUserDetails(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    UserDetails
+		want  UserDetails
+		error string
+	}{
+		{
+			name: "trimmed",
+			in:   UserDetails{DisplayName: "  Alice ", Bio: "Hi\n", Timezone: " Europe/Istanbul "},
+			want: UserDetails{DisplayName: "Alice", Bio: "Hi", Timezone: "Europe/Istanbul", Links: []UserLink{}},
+		},
+		{
+			name: "link labels default to the host and empty links are dropped",
+			in:   UserDetails{Links: []UserLink{{URL: " https://example.com/me "}, {Label: "Nothing"}, {Label: " Blog ", URL: "http://blog.example.com"}}},
+			want: UserDetails{Links: []UserLink{{Label: "example.com", URL: "https://example.com/me"}, {Label: "Blog", URL: "http://blog.example.com"}}},
+		},
+		{name: "display name too long", in: UserDetails{DisplayName: strings.Repeat("é", maxDisplayNameLength+1)}, error: "Display name is too long"},
+		{name: "display name at the limit", in: UserDetails{DisplayName: strings.Repeat("é", maxDisplayNameLength)}, want: UserDetails{DisplayName: strings.Repeat("é", maxDisplayNameLength), Links: []UserLink{}}},
+		{name: "signature too long", in: UserDetails{Signature: strings.Repeat("x", maxSignatureLength+1)}, error: "Signature is too long"},
+		{name: "unknown timezone", in: UserDetails{Timezone: "Mars/Olympus"}, error: "Unknown timezone Mars/Olympus"},
+		{name: "server timezone", in: UserDetails{Timezone: "Local"}, error: "Unknown timezone Local"},
+		{name: "javascript link", in: UserDetails{Links: []UserLink{{URL: "javascript:alert(1)"}}}, error: "Links must be http or https URLs"},
+		{name: "link without host", in: UserDetails{Links: []UserLink{{URL: "https://"}}}, error: "Links must be http or https URLs"},
+		{name: "link label too long", in: UserDetails{Links: []UserLink{{Label: strings.Repeat("x", maxLinkLabelLength+1), URL: "https://example.com"}}}, error: "Link is too long"},
+		{name: "too many links", in: UserDetails{Links: []UserLink{
+			{URL: "https://a.example"}, {URL: "https://b.example"}, {URL: "https://c.example"},
+			{URL: "https://d.example"}, {URL: "https://e.example"}, {URL: "https://f.example"},
+		}}, error: "At most 5 links are allowed"},
+	}
+	for _, tt := range tests {
+		d := tt.in
+		err := d.normalize()
+		if tt.error != "" {
+			if err == nil || err.Error() != tt.error {
+				t.Errorf("%s: %v, want %q", tt.name, err, tt.error)
+			}
+			if _, ok := err.(fieldError); !ok {
+				t.Errorf("%s: %T is not a fieldError", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(d, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.name, d, tt.want)
+		}
+	}
+}
+
+func TestProfileSettings(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	cookie := login(t, "alice")
+
+	tests := []struct {
+		form   url.Values
+		status int
+		want   UserDetails
+	}{
+		{
+			url.Values{
+				"display_name": {"Alice A."}, "bio": {"I **like** Go"}, "signature": {"-- alice"},
+				"location": {"Ankara"}, "timezone": {"Europe/Istanbul"},
+				"link_label": {"Site", ""}, "link_url": {"https://alice.example", "https://code.example/alice"},
+			},
+			http.StatusSeeOther,
+			UserDetails{
+				DisplayName: "Alice A.", Bio: "I **like** Go", Signature: "-- alice", Location: "Ankara", Timezone: "Europe/Istanbul",
+				Links: []UserLink{{Label: "Site", URL: "https://alice.example"}, {Label: "code.example", URL: "https://code.example/alice"}},
+			},
+		},
+		// an invalid form shows the error and saves nothing
+		{
+			url.Values{"display_name": {"Someone else"}, "timezone": {"Nowhere"}},
+			http.StatusOK,
+			UserDetails{
+				DisplayName: "Alice A.", Bio: "I **like** Go", Signature: "-- alice", Location: "Ankara", Timezone: "Europe/Istanbul",
+				Links: []UserLink{{Label: "Site", URL: "https://alice.example"}, {Label: "code.example", URL: "https://code.example/alice"}},
+			},
+		},
+		{
+			url.Values{"display_name": {"Alice"}},
+			http.StatusSeeOther,
+			UserDetails{DisplayName: "Alice", Links: []UserLink{}},
+		},
+	}
+	for i, tt := range tests {
+		w := postForm(serveProfileSettings, "/settings/profile", tt.form, cookie)
+		if w.Code != tt.status {
+			t.Fatalf("form %d: status %d, want %d: %s", i, w.Code, tt.status, w.Body)
+		}
+		got, err := getUserDetails(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("form %d: saved %+v, want %+v", i, got, tt.want)
+		}
+	}
+
+	if _, err := db.Exec("UPDATE users SET signature = '-- bob' WHERE id = ?", bob); err != nil {
+		t.Fatal(err)
+	}
+	signatures, err := listUserSignatures([]int{alice, bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]string{bob: "-- bob"}; !reflect.DeepEqual(signatures, want) {
+		t.Errorf("signatures %v, want %v", signatures, want)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the built in reactions that count as votes.
+const (
+	reactionLike    = "like"
+	reactionDislike = "dislike"
+)
+
+// Reaction is an emoji users can react with. Reactions with a score are votes.
+type Reaction struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Emoji    string `json:"emoji"`
+	Score    int    `json:"score"`
+	Position int    `json:"position"`
+	Custom   bool   `json:"custom"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// defaultReactions are created on startup when missing. Admins can change their
+// emoji, order or disable them, except for like and dislike which keep the
+// likes and dislikes counters going.
+var defaultReactions = []Reaction{
+	{Name: reactionLike, Emoji: "👍", Score: 1},
+	{Name: reactionDislike, Emoji: "👎", Score: -1},
+	{Name: "heart", Emoji: "❤️"},
+	{Name: "laugh", Emoji: "😂"},
+	{Name: "tada", Emoji: "🎉"},
+	{Name: "thinking", Emoji: "🤔"},
+}
+
+var reactionNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+func seedReactions(db *sql.DB) error {
+	for i, r := range defaultReactions {
+		if _, err := db.Exec("INSERT OR IGNORE INTO reactions (name, emoji, score, position) VALUES (?, ?, ?, ?)", r.Name, r.Emoji, r.Score, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const reactionSelect = "SELECT id, name, emoji, score, position, custom, disabled FROM reactions"
+
+func scanReaction(row scanner) (Reaction, error) {
+	var r Reaction
+	err := row.Scan(&r.ID, &r.Name, &r.Emoji, &r.Score, &r.Position, &r.Custom, &r.Disabled)
+	return r, err
+}
+
+// listReactions returns the reactions in display order.
+func listReactions(includeDisabled bool) ([]Reaction, error) {
+	query := reactionSelect
+	if !includeDisabled {
+		query += " WHERE disabled = 0"
+	}
+	rows, err := db.Query(query + " ORDER BY position, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []Reaction{}
+	for rows.Next() {
+		r, err := scanReaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
+
+// getReaction loads an enabled reaction by id or, with id 0, by name.
+func getReaction(id int, name string) (Reaction, error) {
+	r, err := scanReaction(db.QueryRow(reactionSelect+" WHERE (id = ? OR (? = 0 AND name = ?)) AND disabled = 0", id, id, name))
+	if err == sql.ErrNoRows {
+		return r, errNotFound
+	}
+	return r, err
+}
+
+// ReactionCount is how often a reaction was used on an item and by whom.
+type ReactionCount struct {
+	Reaction
+	Count   int      `json:"count"`
+	Users   []string `json:"users"`
+	Reacted bool     `json:"reacted"` // whether the viewer used it
+}
+
+// Who lists the users who reacted, for the button tooltip.
+func (c ReactionCount) Who() string {
+	return strings.Join(c.Users, ", ")
+}
+
+// listItemReactions returns the reaction counts of items of one kind by item
+// id. Every enabled reaction is listed for every item, unused ones with count 0.
+func listItemReactions(target voteTarget, itemIDs []int, viewerID int) (map[int][]ReactionCount, error) {
+	reactions, err := listReactions(false)
+	if err != nil {
+		return nil, err
+	}
+	position := map[int]int{}
+	for i, r := range reactions {
+		position[r.ID] = i
+	}
+
+	counts := map[int][]ReactionCount{}
+	args := []interface{}{target.kind}
+	for _, id := range itemIDs {
+		list := make([]ReactionCount, len(reactions))
+		for i, r := range reactions {
+			list[i] = ReactionCount{Reaction: r, Users: []string{}}
+		}
+		counts[id] = list
+		args = append(args, id)
+	}
+	if len(itemIDs) == 0 {
+		return counts, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT ir.item_id, ir.reaction_id, ir.user_id, u.username
+        FROM item_reactions ir JOIN users u ON u.id = ir.user_id
+        WHERE ir.item_type = ? AND ir.item_id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(itemIDs)), ",")+`)
+        ORDER BY ir.created_at, ir.user_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemID, reactionID, userID int
+		var username string
+		if err := rows.Scan(&itemID, &reactionID, &userID, &username); err != nil {
+			return nil, err
+		}
+		i, ok := position[reactionID]
+		if !ok {
+			continue // disabled reaction
+		}
+		c := &counts[itemID][i]
+		c.Count++
+		c.Users = append(c.Users, username)
+		if userID == viewerID {
+			c.Reacted = true
+		}
+	}
+	return counts, rows.Err()
+}
+
+// checkReactionAccess returns errNotFound unless the item exists and userID
+// may see it. Messages are only visible to their sender and recipient.
+func checkReactionAccess(target voteTarget, itemID, userID int) error {
+	var count int
+	var err error
+	if target == messageReactions {
+		err = db.QueryRow(`
+            SELECT COUNT(*) FROM messages m JOIN users u ON u.id = ?
+            WHERE m.id = ? AND (m.username = u.username OR m.recipient = u.username)`, userID, itemID).Scan(&count)
+	} else {
+		err = db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND %s", target.table, target.live), itemID).Scan(&count)
+	}
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// setReaction adds (on) or removes a reaction of userID on an item. Adding a
+// reaction with a score replaces the user's previous vote.
+func setReaction(target voteTarget, itemID, userID int, reaction Reaction, on bool) (VoteTotals, error) {
+	return changeReactions(target, itemID, userID, func(tx *sql.Tx) error {
+		if !on {
+			_, err := tx.Exec("DELETE FROM item_reactions WHERE item_type = ? AND item_id = ? AND user_id = ? AND reaction_id = ?", target.kind, itemID, userID, reaction.ID)
+			return err
+		}
+		if reaction.Score != 0 {
+			if err := removeVote(tx, target, itemID, userID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`
+            INSERT OR IGNORE INTO item_reactions (item_type, item_id, user_id, reaction_id, created_at)
+            VALUES (?, ?, ?, ?, ?)`, target.kind, itemID, userID, reaction.ID, time.Now())
+		return err
+	})
+}
+
+// ReactionState is the state of an item after a reaction changed.
+type ReactionState struct {
+	VoteTotals
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// reactionBar is the row of reaction buttons under a thread, comment or
+// message. Like and dislike have their own buttons and are left out.
+type reactionBar struct {
+	ItemType  string
+	ItemID    int
+	Reactions []ReactionCount
+	CanReact  bool
+}
+
+func newReactionBar(target voteTarget, itemID int, counts []ReactionCount, canReact bool) reactionBar {
+	return reactionBar{ItemType: target.kind, ItemID: itemID, Reactions: unscoredReactions(counts), CanReact: canReact}
+}
+
+func unscoredReactions(counts []ReactionCount) []ReactionCount {
+	var unscored []ReactionCount
+	for _, c := range counts {
+		if c.Score == 0 {
+			unscored = append(unscored, c)
+		}
+	}
+	return unscored
+}
+
+// /react: add or remove a reaction on a thread, comment or message
+func handleReact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	target, ok := voteTargets[r.FormValue("item_type")]
+	if !ok {
+		http.Error(w, "Invalid item type", http.StatusBadRequest)
+		return
+	}
+	itemID, err := strconv.Atoi(r.FormValue("item_id"))
+	if err != nil {
+		http.Error(w, "Invalid item ID", http.StatusBadRequest)
+		return
+	}
+	reactionID, err := strconv.Atoi(r.FormValue("reaction_id"))
+	if err != nil {
+		http.Error(w, "Invalid reaction", http.StatusBadRequest)
+		return
+	}
+	on := r.FormValue("on") != "0"
+
+	reaction, err := getReaction(reactionID, "")
+	if err == nil {
+		err = checkReactionAccess(target, itemID, userID)
+	}
+	if err == nil {
+		_, err = setReaction(target, itemID, userID, reaction, on)
+	}
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	case errNeedsReputation:
+		http.Error(w, fmt.Sprintf("You need %d reputation to dislike", privilegeThreshold(privilegeDownvote)), http.StatusForbidden)
+		return
+	case errThreadArchived:
+		http.Error(w, closedThreadMessage(err), http.StatusForbidden)
+		return
+	default:
+		log.Printf("Failed to react: %v", err)
+		http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		state, err := reactionState(target, itemID, userID)
+		if err != nil {
+			log.Printf("Failed to load reactions: %v", err)
+			http.Error(w, "Failed to load reactions", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+		return
+	}
+	http.Redirect(w, r, reactionRedirect(target, itemID), http.StatusSeeOther)
+}
+
+// reactionState loads the totals and reaction counts of an item for userID.
+func reactionState(target voteTarget, itemID, userID int) (ReactionState, error) {
+	var state ReactionState
+	if target.votes {
+		err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(likes, 0), COALESCE(dislikes, 0) FROM %s WHERE id = ?", target.table), itemID).Scan(&state.Likes, &state.Dislikes)
+		if err != nil {
+			return state, err
+		}
+	}
+	vote, err := getVote(target, itemID, userID)
+	if err != nil {
+		return state, err
+	}
+	state.Vote = vote
+	counts, err := listItemReactions(target, []int{itemID}, userID)
+	if err != nil {
+		return state, err
+	}
+	state.Reactions = counts[itemID]
+	return state, nil
+}
+
+// reactionRedirect is where a reaction form sends the browser back to.
+func reactionRedirect(target voteTarget, itemID int) string {
+	switch target {
+	case threadVotes:
+		return "/thread?id=" + strconv.Itoa(itemID)
+	case commentVotes:
+		if comment, err := getComment(itemID); err == nil {
+			return fmt.Sprintf("/thread?id=%d#comment-%d", comment.ThreadID, itemID)
+		}
+	case messageReactions:
+		return "/messages"
+	}
+	return "/"
+}
+
+// /admin/reactions: list, add, change and disable reactions, admins only
+func serveAdminReactions(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || role != roleAdmin {
+		http.Error(w, "Only admins can manage reactions", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := updateReactions(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/admin/reactions", http.StatusSeeOther)
+		return
+	}
+
+	reactions, err := listReactions(true)
+	if err != nil {
+		http.Error(w, "Failed to fetch reactions", http.StatusInternalServerError)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("templates/admin_reactions.html"))
+	tmpl.Execute(w, reactions)
+}
+
+// updateReactions applies an admin form: action is create, update, disable or enable.
+func updateReactions(r *http.Request) error {
+	emoji := strings.TrimSpace(r.FormValue("emoji"))
+	if r.FormValue("action") == "create" {
+		name := strings.TrimSpace(r.FormValue("name"))
+		if !reactionNamePattern.MatchString(name) {
+			return fmt.Errorf("name must be 1-32 lowercase letters, digits or underscores")
+		}
+		if emoji == "" || len(emoji) > 32 {
+			return fmt.Errorf("emoji is required and must be short")
+		}
+		var position int
+		if err := db.QueryRow("SELECT COALESCE(MAX(position), 0) + 1 FROM reactions").Scan(&position); err != nil {
+			return err
+		}
+		if _, err := db.Exec("INSERT INTO reactions (name, emoji, position, custom) VALUES (?, ?, ?, 1)", name, emoji, position); err != nil {
+			return fmt.Errorf("a reaction named %q already exists", name)
+		}
+		return nil
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return fmt.Errorf("invalid reaction")
+	}
+	var name string
+	if err := db.QueryRow("SELECT name FROM reactions WHERE id = ?", id).Scan(&name); err != nil {
+		return fmt.Errorf("invalid reaction")
+	}
+
+	switch r.FormValue("action") {
+	case "update":
+		position, err := strconv.Atoi(r.FormValue("position"))
+		if err != nil {
+			return fmt.Errorf("invalid position")
+		}
+		if emoji == "" || len(emoji) > 32 {
+			return fmt.Errorf("emoji is required and must be short")
+		}
+		_, err = db.Exec("UPDATE reactions SET emoji = ?, position = ? WHERE id = ?", emoji, position, id)
+		return err
+	case "disable", "enable":
+		if name == reactionLike || name == reactionDislike {
+			return fmt.Errorf("like and dislike cannot be disabled")
+		}
+		_, err := db.Exec("UPDATE reactions SET disabled = ? WHERE id = ?", r.FormValue("action") == "disable", id)
+		return err
+	}
+	return fmt.Errorf("unknown action")
+}
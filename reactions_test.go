@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// testReaction loads an enabled reaction by name.
+func testReaction(t *testing.T, name string) Reaction {
+	t.Helper()
+	r, err := getReaction(0, name)
+	if err != nil {
+		t.Fatalf("reaction %s: %v", name, err)
+	}
+	return r
+}
+
+func TestSetReaction(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+	setTestRole(t, bob, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		userID   int
+		reaction string
+		on       bool
+		totals   VoteTotals          // of the reacting user
+		users    map[string][]string // who used each reaction afterwards
+	}{
+		{bob, "heart", true, VoteTotals{}, map[string][]string{"heart": {"bob"}}},
+		{carol, "heart", true, VoteTotals{}, map[string][]string{"heart": {"bob", "carol"}}},
+		{bob, "heart", true, VoteTotals{}, map[string][]string{"heart": {"bob", "carol"}}},
+		{bob, "laugh", true, VoteTotals{}, map[string][]string{"heart": {"bob", "carol"}, "laugh": {"bob"}}},
+		{bob, "like", true, VoteTotals{Likes: 1, Vote: 1}, map[string][]string{"heart": {"bob", "carol"}, "laugh": {"bob"}, "like": {"bob"}}},
+		// a vote replaces the previous vote but leaves the other reactions
+		{bob, "dislike", true, VoteTotals{Dislikes: 1, Vote: -1}, map[string][]string{"heart": {"bob", "carol"}, "laugh": {"bob"}, "dislike": {"bob"}}},
+		{bob, "heart", false, VoteTotals{Dislikes: 1, Vote: -1}, map[string][]string{"heart": {"carol"}, "laugh": {"bob"}, "dislike": {"bob"}}},
+		{bob, "dislike", false, VoteTotals{}, map[string][]string{"heart": {"carol"}, "laugh": {"bob"}}},
+		{carol, "dislike", true, VoteTotals{}, nil}, // carol lacks the reputation to dislike
+	}
+	for i, tt := range tests {
+		totals, err := setReaction(threadVotes, int(threadID), tt.userID, testReaction(t, tt.reaction), tt.on)
+		if tt.users == nil {
+			if err != errNeedsReputation {
+				t.Errorf("step %d: %v, want errNeedsReputation", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if totals != tt.totals {
+			t.Errorf("step %d: %+v, want %+v", i, totals, tt.totals)
+		}
+
+		counts, err := listItemReactions(threadVotes, []int{int(threadID)}, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts[int(threadID)]) != len(defaultReactions) {
+			t.Fatalf("step %d: %d reactions listed, want every enabled one", i, len(counts[int(threadID)]))
+		}
+		for _, c := range counts[int(threadID)] {
+			want := tt.users[c.Name]
+			if want == nil {
+				want = []string{}
+			}
+			if c.Count != len(want) || !reflect.DeepEqual(c.Users, want) {
+				t.Errorf("step %d: %s used %d times by %v, want %v", i, c.Name, c.Count, c.Users, want)
+			}
+			reacted := false
+			for _, name := range want {
+				reacted = reacted || name == "bob"
+			}
+			if c.Reacted != reacted {
+				t.Errorf("step %d: %s reacted by the viewer = %v, want %v", i, c.Name, c.Reacted, reacted)
+			}
+		}
+	}
+	checkReputationAddsUp(t)
+}
+
+func TestMessageReactionsAreForParticipants(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	carol := createTestUser(t, "carol")
+	result, err := db.Exec("INSERT INTO messages (username, recipient, content) VALUES ('alice', 'bob', 'Hello')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageID, _ := result.LastInsertId()
+
+	tests := []struct {
+		userID    int
+		messageID int
+		want      error
+	}{
+		{alice, int(messageID), nil},
+		{bob, int(messageID), nil},
+		{carol, int(messageID), errNotFound},
+		{alice, int(messageID) + 1, errNotFound},
+	}
+	for _, tt := range tests {
+		if err := checkReactionAccess(messageReactions, tt.messageID, tt.userID); err != tt.want {
+			t.Errorf("user %d reacting to message %d: %v, want %v", tt.userID, tt.messageID, err, tt.want)
+		}
+	}
+
+	// Reactions on messages are not votes and leave reputation alone
+	totals, err := setReaction(messageReactions, int(messageID), bob, testReaction(t, "like"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if totals != (VoteTotals{Vote: 1}) {
+		t.Errorf("like on a message: %+v", totals)
+	}
+	if got := reputationOf(t, alice); got != 0 {
+		t.Errorf("reputation from a message reaction = %d, want 0", got)
+	}
+}
+
+func TestAdminReactions(t *testing.T) {
+	newTestDB(t)
+	admin := createTestUser(t, "admin")
+	setTestRole(t, admin, roleAdmin)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	heart := testReaction(t, "heart")
+	like := testReaction(t, "like")
+
+	tests := []struct {
+		user   string
+		form   url.Values
+		status int
+	}{
+		{"mod", url.Values{"action": {"create"}, "name": {"fire"}, "emoji": {"🔥"}}, http.StatusForbidden},
+		{"admin", url.Values{"action": {"create"}, "name": {"fire"}, "emoji": {"🔥"}}, http.StatusSeeOther},
+		{"admin", url.Values{"action": {"create"}, "name": {"fire"}, "emoji": {"🔥"}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"create"}, "name": {"Big Fire"}, "emoji": {"🔥"}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"create"}, "name": {"empty"}, "emoji": {""}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"disable"}, "id": {fmt.Sprint(like.ID)}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"disable"}, "id": {fmt.Sprint(heart.ID)}}, http.StatusSeeOther},
+		{"admin", url.Values{"action": {"update"}, "id": {fmt.Sprint(like.ID)}, "emoji": {"✅"}, "position": {"9"}}, http.StatusSeeOther},
+		{"admin", url.Values{"action": {"update"}, "id": {fmt.Sprint(like.ID)}, "emoji": {"✅"}, "position": {"last"}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"rename"}, "id": {fmt.Sprint(like.ID)}}, http.StatusBadRequest},
+		{"admin", url.Values{"action": {"disable"}, "id": {"999"}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := postForm(serveAdminReactions, "/admin/reactions", tt.form, login(t, tt.user))
+		if w.Code != tt.status {
+			t.Errorf("%s %v: status %d, want %d: %s", tt.user, tt.form, w.Code, tt.status, w.Body)
+		}
+	}
+
+	fire := testReaction(t, "fire")
+	if !fire.Custom || fire.Score != 0 || fire.Emoji != "🔥" {
+		t.Errorf("created reaction %+v", fire)
+	}
+	if _, err := getReaction(heart.ID, ""); err != errNotFound {
+		t.Errorf("disabled reaction: %v, want errNotFound", err)
+	}
+	if like = testReaction(t, "like"); like.Emoji != "✅" || like.Position != 9 {
+		t.Errorf("updated reaction %+v", like)
+	}
+	enabled, err := listReactions(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := listReactions(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enabled) != len(all)-1 {
+		t.Errorf("%d enabled of %d reactions, want all but the disabled one", len(enabled), len(all))
+	}
+	if last := enabled[len(enabled)-1]; last.Name != "like" {
+		t.Errorf("last reaction %s, want like moved to the end", last.Name)
+	}
+}
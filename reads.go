@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A comment is unread until the user has seen it. thread_reads keeps the last
+// comment a user saw in each thread they opened, and read_marks the comment
+// up to which they marked a category, or everything (category 0), as read.
+// Marking thousands of threads read is therefore a single row. Comment ids
+// only grow, so a comment is unread when its id is above every mark that
+// applies to its thread. The user's own comments are never unread.
+
+// ThreadUnread counts the comments of a thread a user has not read.
+type ThreadUnread struct {
+	Comments       int `json:"comments"`
+	FirstCommentID int `json:"first_comment_id"`
+}
+
+// markThreadRead records that userID has read a thread up to commentID.
+// The mark never moves back.
+func markThreadRead(userID, threadID, commentID int) error {
+	if userID == 0 || commentID == 0 {
+		return nil
+	}
+	_, err := db.Exec(`
+        INSERT INTO thread_reads (user_id, thread_id, comment_id, read_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id, thread_id) DO UPDATE SET
+            comment_id = MAX(comment_id, excluded.comment_id), read_at = excluded.read_at`,
+		userID, threadID, commentID, time.Now())
+	return err
+}
+
+// markAllRead marks every comment posted so far as read for userID, in one
+// category or, when categoryID is 0, everywhere.
+func markAllRead(userID, categoryID int) error {
+	if categoryID != 0 {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM categories WHERE id = ?", categoryID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errNotFound
+		}
+	}
+	_, err := db.Exec(`
+        INSERT INTO read_marks (user_id, category_id, comment_id, marked_at)
+        VALUES (?1, ?2, (SELECT COALESCE(MAX(id), 0) FROM comments), ?3)
+        ON CONFLICT (user_id, category_id) DO UPDATE SET
+            comment_id = excluded.comment_id, marked_at = excluded.marked_at`,
+		userID, categoryID, time.Now())
+	return err
+}
+
+// listUnread returns what userID has not read, by thread, leaving out threads
+// they have read entirely. Only comments above the user's global mark are
+// looked at, so the cost follows what is new rather than the size of the forum.
+func listUnread(userID int) (map[int]ThreadUnread, error) {
+	unread := map[int]ThreadUnread{}
+	if userID == 0 {
+		return unread, nil
+	}
+	var globalMark int
+	err := db.QueryRow("SELECT comment_id FROM read_marks WHERE user_id = ? AND category_id = 0", userID).Scan(&globalMark)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+        SELECT c.thread_id, COUNT(*), MIN(c.id) FROM comments c
+        LEFT JOIN thread_reads r ON r.user_id = ?1 AND r.thread_id = c.thread_id
+        WHERE c.id > ?2 AND c.id > COALESCE(r.comment_id, 0)
+            AND c.user_id != ?1 AND c.deleted_at IS NULL
+            AND NOT EXISTS (
+                SELECT 1 FROM thread_categories tc
+                JOIN read_marks m ON m.user_id = ?1 AND m.category_id = tc.category_id
+                WHERE tc.thread_id = c.thread_id AND m.comment_id >= c.id)
+        GROUP BY c.thread_id`, userID, globalMark)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var threadID int
+		var u ThreadUnread
+		if err := rows.Scan(&threadID, &u.Comments, &u.FirstCommentID); err != nil {
+			return nil, err
+		}
+		unread[threadID] = u
+	}
+	return unread, rows.Err()
+}
+
+// attachUnread sets the unread comments of each thread for userID.
+func attachUnread(userID int, threads []Thread) error {
+	if userID == 0 || len(threads) == 0 {
+		return nil
+	}
+	unread, err := listUnread(userID)
+	if err != nil {
+		return err
+	}
+	for i := range threads {
+		u := unread[threads[i].ID]
+		threads[i].Unread = &u
+	}
+	return nil
+}
+
+// /mark-read: marks the category_id of the form, or everything, as read
+func handleMarkRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	categoryID := 0
+	if v := r.FormValue("category_id"); v != "" {
+		var err error
+		if categoryID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+	}
+	switch err := markAllRead(userID, categoryID); err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to mark threads read: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	back := r.FormValue("redirect")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/index"
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
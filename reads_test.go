@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestListUnread(t *testing.T) {
+	newTestDB(t)
+	reader := createTestUser(t, "reader")
+	alice := createTestUser(t, "alice")
+	news := createTestCategory(t, "News")
+	newsID, _ := strconv.Atoi(news)
+	newsThread, err := createThread(alice, ThreadInput{Title: "In news", Description: "Its description", CategoryIDs: []string{news}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherThread, err := createThread(alice, ThreadInput{Title: "Elsewhere", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comment := func(userID int, threadID int64) int {
+		t.Helper()
+		id, err := createComment(userID, int(threadID), 0, "A comment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	first := comment(alice, newsThread)
+	second := comment(alice, newsThread)
+	other := comment(alice, otherThread)
+	var third int
+
+	tests := []struct {
+		name string
+		do   func() error
+		want func() map[int]ThreadUnread // evaluated after do
+	}{
+		{"nothing read", func() error { return nil }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(newsThread): {2, first}, int(otherThread): {1, other}}
+		}},
+		{"own comments", func() error { comment(reader, newsThread); return nil }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(newsThread): {2, first}, int(otherThread): {1, other}}
+		}},
+		{"read up to a comment", func() error { return markThreadRead(reader, int(newsThread), first) }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(newsThread): {1, second}, int(otherThread): {1, other}}
+		}},
+		{"the mark never moves back", func() error { return markThreadRead(reader, int(newsThread), first-1) }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(newsThread): {1, second}, int(otherThread): {1, other}}
+		}},
+		{"category marked read", func() error { return markAllRead(reader, newsID) }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(otherThread): {1, other}}
+		}},
+		{"new comment in the category", func() error { third = comment(alice, newsThread); return nil }, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{
+				int(newsThread): {1, third}, int(otherThread): {1, other}}
+		}},
+		{"deleted comments", func() error {
+			return softDeleteComment(comment(alice, otherThread))
+		}, func() map[int]ThreadUnread {
+			return map[int]ThreadUnread{int(newsThread): {1, third}, int(otherThread): {1, other}}
+		}},
+		{"everything marked read", func() error { return markAllRead(reader, 0) }, func() map[int]ThreadUnread { return map[int]ThreadUnread{} }},
+		{"a missing category", func() error {
+			if err := markAllRead(reader, newsID+100); err != errNotFound {
+				return fmt.Errorf("marking a missing category read: %v, want errNotFound", err)
+			}
+			return nil
+		}, func() map[int]ThreadUnread { return map[int]ThreadUnread{} }},
+	}
+	for _, tt := range tests {
+		if err := tt.do(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		unread, err := listUnread(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.want(); !reflect.DeepEqual(unread, want) {
+			t.Errorf("%s: unread %v, want %v", tt.name, unread, want)
+		}
+	}
+
+	// Other users keep their own marks
+	if unread, err := listUnread(createTestUser(t, "bob")); err != nil || len(unread) != 2 {
+		t.Errorf("unread of a new user: %v, %v, want both threads", unread, err)
+	}
+}
+
+func TestOpeningAThreadMarksItRead(t *testing.T) {
+	newTestDB(t)
+	reader := createTestUser(t, "reader")
+	alice := createTestUser(t, "alice")
+	threadID, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := createComment(alice, int(threadID), 0, fmt.Sprintf("Comment %d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cookie := login(t, "reader")
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/thread?id=%d", threadID), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	serveThread(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if unread, err := listUnread(reader); err != nil || len(unread) != 0 {
+		t.Errorf("unread after opening the thread: %v, %v", unread, err)
+	}
+}
+
+func TestHandleMarkRead(t *testing.T) {
+	newTestDB(t)
+	createTestUser(t, "reader")
+	news := createTestCategory(t, "News")
+	cookie := login(t, "reader")
+
+	tests := []struct {
+		form     url.Values
+		status   int
+		location string
+	}{
+		{url.Values{}, http.StatusSeeOther, "/index"},
+		{url.Values{"category_id": {news}, "redirect": {"/category/news"}}, http.StatusSeeOther, "/category/news"},
+		{url.Values{"redirect": {"//elsewhere.example"}}, http.StatusSeeOther, "/index"},
+		{url.Values{"category_id": {"news"}}, http.StatusBadRequest, ""},
+		{url.Values{"category_id": {"999"}}, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := postForm(handleMarkRead, "/mark-read", tt.form, cookie)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%v: status %d to %q, want %d to %q", tt.form, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+	if w := postForm(handleMarkRead, "/mark-read", url.Values{}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("signed out: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+var errInvalidParent = errors.New("the comment being replied to does not belong to this thread")
+
+// defaultCommentMaxDepth is how deeply replies may nest below a top level comment.
+const defaultCommentMaxDepth = 5
+
+// commentMaxDepth returns the maximum reply depth. It can be overridden with
+// COMMENT_MAX_DEPTH; 0 disables replies altogether.
+func commentMaxDepth() int {
+	if value := os.Getenv("COMMENT_MAX_DEPTH"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err == nil && n >= 0 {
+			return n
+		}
+		log.Printf("Ignoring invalid COMMENT_MAX_DEPTH=%q", value)
+	}
+	return defaultCommentMaxDepth
+}
+
+// replyParent returns the comment a reply to parentID is stored under. Replies
+// that would nest deeper than the maximum depth are attached to the deepest
+// allowed ancestor instead; 0 means the reply becomes a top level comment.
+func replyParent(tx *sql.Tx, threadID, parentID int) (int, error) {
+	rows, err := tx.Query(`
+        WITH RECURSIVE ancestors(id, parent_id, thread_id, level) AS (
+            SELECT id, parent_id, thread_id, 0 FROM comments WHERE id = ?
+            UNION ALL
+            SELECT c.id, c.parent_id, c.thread_id, a.level + 1
+            FROM comments c JOIN ancestors a ON c.id = a.parent_id
+        )
+        SELECT id, thread_id FROM ancestors ORDER BY level DESC`, parentID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// path runs from the top level comment down to parentID
+	var path []int
+	for rows.Next() {
+		var id, commentThreadID int
+		if err := rows.Scan(&id, &commentThreadID); err != nil {
+			return 0, err
+		}
+		if commentThreadID != threadID {
+			return 0, errInvalidParent
+		}
+		path = append(path, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(path) == 0 {
+		return 0, errInvalidParent
+	}
+
+	if max := commentMaxDepth(); len(path) > max {
+		path = path[:max]
+	}
+	if len(path) == 0 {
+		return 0, nil
+	}
+	return path[len(path)-1], nil
+}
+
+// Sort orders for the siblings of a comment tree.
+const (
+	commentSortOldest = "oldest"
+	commentSortNewest = "newest"
+	commentSortBest   = "best"
+)
+
+// commentViewer is the logged in user looking at a comment tree.
+type commentViewer struct {
+	ID          int
+	IsModerator bool
+	CanComment  bool        // false on locked and archived threads, except for moderators
+	Archived    bool        // whether the thread is archived, which freezes votes
+	Votes       map[int]int // the viewer's votes by comment id
+}
+
+// commentNode is a comment with its replies as shown on the thread page.
+type commentNode struct {
+	Comment
+	Depth       int
+	Replies     []*commentNode
+	Viewer      *commentViewer
+	ReactionBar reactionBar
+	Signature   string        // of the author
+	ContentHTML template.HTML // the content rendered from markdown
+}
+
+// CanChange reports whether the viewer may edit or delete the comment.
+func (n *commentNode) CanChange() bool {
+	return n.Viewer.ID != 0 && ((n.UserID == n.Viewer.ID && !n.Viewer.Archived) || n.Viewer.IsModerator)
+}
+
+// Vote returns the viewer's vote on the comment: 1, -1, or 0 for none.
+func (n *commentNode) Vote() int {
+	return n.Viewer.Votes[n.ID]
+}
+
+// walk calls fn for the node and every comment below it.
+func (n *commentNode) walk(fn func(*commentNode)) {
+	fn(n)
+	for _, reply := range n.Replies {
+		reply.walk(fn)
+	}
+}
+
+// ReplyCount returns the number of comments below this one.
+func (n *commentNode) ReplyCount() int {
+	count := len(n.Replies)
+	for _, reply := range n.Replies {
+		count += reply.ReplyCount()
+	}
+	return count
+}
+
+// listCommentTree loads the comments of a thread as a tree in one query. With a
+// non zero rootID only that comment and its replies are loaded.
+func listCommentTree(threadID, rootID int, order string, viewer *commentViewer) ([]*commentNode, error) {
+	anchor, args := "thread_id = ? AND parent_id IS NULL", []interface{}{threadID}
+	if rootID != 0 {
+		anchor, args = "thread_id = ? AND id = ?", []interface{}{threadID, rootID}
+	}
+	comments, err := queryComments(`
+        WITH RECURSIVE tree(id) AS (
+            SELECT id FROM comments WHERE `+anchor+`
+            UNION ALL
+            SELECT c.id FROM comments c JOIN tree ON c.parent_id = tree.id
+        )`+commentSelect+`
+        JOIN tree ON tree.id = c.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[int]*commentNode, len(comments))
+	for _, comment := range comments {
+		nodes[comment.ID] = &commentNode{Comment: comment, Viewer: viewer}
+	}
+	var roots []*commentNode
+	for _, comment := range comments {
+		node := nodes[comment.ID]
+		if parent, ok := nodes[parentOf(comment)]; ok && comment.ID != rootID {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	sortCommentTree(roots, order, 0)
+	return roots, nil
+}
+
+func parentOf(comment Comment) int {
+	if comment.ParentID == nil {
+		return 0
+	}
+	return *comment.ParentID
+}
+
+// sortCommentTree orders siblings at every level and sets their depth.
+// Best sorts by likes minus dislikes; ties and unknown orders fall back to oldest.
+func sortCommentTree(nodes []*commentNode, order string, depth int) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		switch order {
+		case commentSortNewest:
+			return a.ID > b.ID
+		case commentSortBest:
+			if sa, sb := a.Likes-a.Dislikes, b.Likes-b.Dislikes; sa != sb {
+				return sa > sb
+			}
+		}
+		return a.ID < b.ID
+	})
+	for _, node := range nodes {
+		node.Depth = depth
+		sortCommentTree(node.Replies, order, depth+1)
+	}
+}
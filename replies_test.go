@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCommentMaxDepth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", defaultCommentMaxDepth},
+		{"3", 3},
+		{"0", 0},
+		{"-1", defaultCommentMaxDepth},
+		{"deep", defaultCommentMaxDepth},
+	}
+	for _, tt := range tests {
+		t.Setenv("COMMENT_MAX_DEPTH", tt.value)
+		if got := commentMaxDepth(); got != tt.want {
+			t.Errorf("COMMENT_MAX_DEPTH=%q: commentMaxDepth() = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRepliesNestUpToTheMaximumDepth(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherThreadID, err := createThread(author, ThreadInput{Title: "Another thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherComment, err := createComment(author, int(otherThreadID), 0, "Elsewhere", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chain[i] is a comment at depth i
+	t.Setenv("COMMENT_MAX_DEPTH", "2")
+	var chain []int
+	parentID := 0
+	for i := 0; i < 3; i++ {
+		id, err := createComment(author, int(threadID), parentID, fmt.Sprintf("Depth %d", i), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, int(id))
+		parentID = int(id)
+	}
+
+	tests := []struct {
+		maxDepth string
+		replyTo  int
+		want     int // the parent the reply is stored under
+		err      error
+	}{
+		{"2", chain[0], chain[0], nil},
+		{"2", chain[1], chain[1], nil},
+		{"2", chain[2], chain[1], nil}, // would be at depth 3
+		{"1", chain[1], chain[0], nil},
+		{"0", chain[0], 0, nil},
+		{"2", int(otherComment), 0, errInvalidParent},
+		{"2", int(otherComment) + 100, 0, errInvalidParent},
+	}
+	for _, tt := range tests {
+		t.Setenv("COMMENT_MAX_DEPTH", tt.maxDepth)
+		id, err := createComment(author, int(threadID), tt.replyTo, "A reply", nil)
+		if err != tt.err {
+			t.Errorf("max depth %s, reply to %d: %v, want %v", tt.maxDepth, tt.replyTo, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, parent := threadOfComment(t, int(id)); parent != tt.want {
+			t.Errorf("max depth %s, reply to %d: stored under %d, want %d", tt.maxDepth, tt.replyTo, parent, tt.want)
+		}
+	}
+	if _, parent := threadOfComment(t, chain[2]); parent != chain[1] {
+		t.Errorf("comment at depth 2 stored under %d, want %d", parent, chain[1])
+	}
+}
+
+func TestListCommentTree(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newComment := func(parentID, likes, dislikes int) int {
+		t.Helper()
+		id, err := createComment(author, int(threadID), parentID, "A comment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE comments SET likes = ?, dislikes = ? WHERE id = ?", likes, dislikes, id); err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	first := newComment(0, 1, 0)
+	second := newComment(0, 5, 1)
+	third := newComment(0, 1, 0)
+	replyA := newComment(first, 0, 2)
+	replyB := newComment(first, 3, 0)
+	nested := newComment(replyA, 0, 0)
+
+	// ids lists a tree depth first as "id@depth"
+	var ids func(nodes []*commentNode) []string
+	ids = func(nodes []*commentNode) []string {
+		list := []string{}
+		for _, n := range nodes {
+			list = append(list, fmt.Sprintf("%d@%d", n.ID, n.Depth))
+			list = append(list, ids(n.Replies)...)
+		}
+		return list
+	}
+	at := func(id, depth int) string { return fmt.Sprintf("%d@%d", id, depth) }
+
+	tests := []struct {
+		order  string
+		rootID int
+		want   []string
+	}{
+		{commentSortOldest, 0, []string{at(first, 0), at(replyA, 1), at(nested, 2), at(replyB, 1), at(second, 0), at(third, 0)}},
+		{commentSortNewest, 0, []string{at(third, 0), at(second, 0), at(first, 0), at(replyB, 1), at(replyA, 1), at(nested, 2)}},
+		// ties keep the oldest first
+		{commentSortBest, 0, []string{at(second, 0), at(first, 0), at(replyB, 1), at(replyA, 1), at(nested, 2), at(third, 0)}},
+		{"unknown", 0, []string{at(first, 0), at(replyA, 1), at(nested, 2), at(replyB, 1), at(second, 0), at(third, 0)}},
+		// a permalink loads the comment with its replies as the root
+		{commentSortOldest, replyA, []string{at(replyA, 0), at(nested, 1)}},
+		{commentSortOldest, nested, []string{at(nested, 0)}},
+	}
+	for _, tt := range tests {
+		roots, err := listCommentTree(int(threadID), tt.rootID, tt.order, &commentViewer{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(roots); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("order %s, root %d: %v, want %v", tt.order, tt.rootID, got, tt.want)
+		}
+	}
+
+	roots, err := listCommentTree(int(threadID), 0, commentSortOldest, &commentViewer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{3, 0, 0} {
+		if got := roots[i].ReplyCount(); got != want {
+			t.Errorf("comment %d: %d replies, want %d", roots[i].ID, got, want)
+		}
+	}
+}
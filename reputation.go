@@ -0,0 +1,334 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Authors earn reputation from the votes on their threads and comments. Every
+// change is recorded in reputation_events and added to users.reputation, so the
+// history of a user always sums up to their reputation.
+
+var errNeedsReputation = errors.New("not enough reputation")
+
+// defaultReputationWeights is what a like or dislike is worth to the author.
+var defaultReputationWeights = map[string]int{
+	"thread_like":     5,
+	"thread_dislike":  -2,
+	"comment_like":    2,
+	"comment_dislike": -1,
+}
+
+// reputationWeight returns what a vote on a thread or comment is worth. The
+// weights can be overridden with REPUTATION_THREAD_LIKE, REPUTATION_THREAD_DISLIKE,
+// REPUTATION_COMMENT_LIKE and REPUTATION_COMMENT_DISLIKE.
+func reputationWeight(kind string, vote int) int {
+	var key string
+	switch vote {
+	case 1:
+		key = kind + "_like"
+	case -1:
+		key = kind + "_dislike"
+	default:
+		return 0
+	}
+	return envInt("REPUTATION_"+strings.ToUpper(key), defaultReputationWeights[key])
+}
+
+// Privileges unlocked by reputation. Moderators have all of them.
+const (
+	privilegeDownvote   = "downvote"
+	privilegeCreatePoll = "create_poll"
+	privilegeCreateTag  = "create_tag" // tag threads with tags nobody has used yet
+)
+
+// privileges lists the privileges in the order they are shown on profiles.
+var privileges = []string{privilegeDownvote, privilegeCreateTag, privilegeCreatePoll}
+
+var defaultPrivilegeThresholds = map[string]int{
+	privilegeDownvote:   15,
+	privilegeCreatePoll: 50,
+	privilegeCreateTag:  20,
+}
+
+// privilegeThreshold returns the reputation needed for a privilege. It can be
+// overridden with REPUTATION_PRIVILEGE_DOWNVOTE, REPUTATION_PRIVILEGE_CREATE_POLL
+// and REPUTATION_PRIVILEGE_CREATE_TAG.
+func privilegeThreshold(privilege string) int {
+	return envInt("REPUTATION_PRIVILEGE_"+strings.ToUpper(privilege), defaultPrivilegeThresholds[privilege])
+}
+
+func envInt(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(value)
+		if err == nil {
+			return n
+		}
+		log.Printf("Ignoring invalid %s=%q", name, value)
+	}
+	return fallback
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// hasPrivilege reports whether a user has reached the threshold of a privilege.
+func hasPrivilege(q queryRower, userID int, privilege string) (bool, error) {
+	var role string
+	var reputation int
+	err := q.QueryRow("SELECT role, reputation FROM users WHERE id = ?", userID).Scan(&role, &reputation)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isModerator(role) || reputation >= privilegeThreshold(privilege), nil
+}
+
+// ReputationEvent is one change to the reputation of a user.
+type ReputationEvent struct {
+	ID        int       `json:"id"`
+	Amount    int       `json:"amount"`
+	Reason    string    `json:"reason"`
+	ThreadID  *int      `json:"thread_id,omitempty"`
+	CommentID *int      `json:"comment_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var reputationReasons = map[string]string{
+	"thread_like":           "Thread liked",
+	"thread_dislike":        "Thread disliked",
+	"thread_vote_removed":   "Thread vote removed",
+	"comment_like":          "Comment liked",
+	"comment_dislike":       "Comment disliked",
+	"comment_vote_removed":  "Comment vote removed",
+	reputationRecalculation: "Recalculated",
+}
+
+const reputationRecalculation = "recalculation"
+
+// Description returns a readable form of the reason.
+func (e ReputationEvent) Description() string {
+	if text, ok := reputationReasons[e.Reason]; ok {
+		return text
+	}
+	return e.Reason
+}
+
+// addReputation records a reputation change for a user.
+func addReputation(tx *sql.Tx, userID, amount int, reason string, threadID, commentID interface{}) error {
+	if amount == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`
+        INSERT INTO reputation_events (user_id, amount, reason, thread_id, comment_id, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, userID, amount, reason, threadID, commentID, time.Now()); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE users SET reputation = reputation + ? WHERE id = ?", amount, userID)
+	return err
+}
+
+// applyVoteReputation credits the author of a voted item with the difference
+// between the worth of the old and the new vote of voterID. Votes on your own
+// posts and votes of users that do not exist count for nothing.
+func applyVoteReputation(tx *sql.Tx, kind string, itemID, authorID, voterID, previous, vote int) error {
+	if voterID == authorID {
+		return nil
+	}
+	var voters int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", voterID).Scan(&voters); err != nil || voters == 0 {
+		return err
+	}
+	amount := reputationWeight(kind, vote) - reputationWeight(kind, previous)
+	reason := kind + "_vote_removed"
+	switch vote {
+	case 1:
+		reason = kind + "_like"
+	case -1:
+		reason = kind + "_dislike"
+	}
+
+	var threadID, commentID interface{}
+	if kind == "thread" {
+		threadID = itemID
+	} else {
+		commentID = itemID
+		var commentThreadID int
+		if err := tx.QueryRow("SELECT thread_id FROM comments WHERE id = ?", itemID).Scan(&commentThreadID); err != nil {
+			return err
+		}
+		threadID = commentThreadID
+	}
+	return addReputation(tx, authorID, amount, reason, threadID, commentID)
+}
+
+// takeBackVoteReputation withdraws the reputation that the votes on the items
+// of target matching where (over item_reactions ir and the items t) earned
+// their authors. It is called before the items are deleted, so their authors
+// do not keep reputation for content that is gone.
+func takeBackVoteReputation(tx *sql.Tx, target voteTarget, where string, args ...interface{}) error {
+	rows, err := tx.Query(`
+        SELECT ir.item_id, t.user_id, ir.user_id, r.score
+        FROM item_reactions ir
+        JOIN reactions r ON r.id = ir.reaction_id
+        JOIN `+target.table+` t ON t.id = ir.item_id
+        WHERE ir.item_type = ? AND r.score != 0 AND `+where, append([]interface{}{target.kind}, args...)...)
+	if err != nil {
+		return err
+	}
+	type vote struct{ itemID, authorID, voterID, score int }
+	var votes []vote
+	for rows.Next() {
+		var v vote
+		if err := rows.Scan(&v.itemID, &v.authorID, &v.voterID, &v.score); err != nil {
+			rows.Close()
+			return err
+		}
+		votes = append(votes, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range votes {
+		if err := applyVoteReputation(tx, target.kind, v.itemID, v.authorID, v.voterID, v.score, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listReputationEvents returns the most recent reputation changes of a user.
+func listReputationEvents(userID, limit int) ([]ReputationEvent, error) {
+	rows, err := db.Query(`
+        SELECT id, amount, reason, thread_id, comment_id, created_at
+        FROM reputation_events WHERE user_id = ?
+        ORDER BY id DESC LIMIT ?`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ReputationEvent{}
+	for rows.Next() {
+		var e ReputationEvent
+		var threadID, commentID sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.Amount, &e.Reason, &threadID, &commentID, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if threadID.Valid {
+			id := int(threadID.Int64)
+			e.ThreadID = &id
+		}
+		if commentID.Valid {
+			id := int(commentID.Int64)
+			e.CommentID = &id
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// PrivilegeStatus tells whether a user has unlocked a privilege.
+type PrivilegeStatus struct {
+	Name      string `json:"name"`
+	Threshold int    `json:"threshold"`
+	Unlocked  bool   `json:"unlocked"`
+}
+
+// listPrivileges returns every privilege with whether the user has it.
+func listPrivileges(userID int) ([]PrivilegeStatus, error) {
+	statuses := make([]PrivilegeStatus, len(privileges))
+	for i, privilege := range privileges {
+		unlocked, err := hasPrivilege(db, userID, privilege)
+		if err != nil {
+			return nil, err
+		}
+		statuses[i] = PrivilegeStatus{Name: privilege, Threshold: privilegeThreshold(privilege), Unlocked: unlocked}
+	}
+	return statuses, nil
+}
+
+// reputationChange is a user whose stored reputation differed from the votes.
+type reputationChange struct {
+	UserID   int
+	Username string
+	Stored   int
+	Actual   int
+}
+
+// recalculateReputation recomputes the reputation of every user from the
+// current votes and weights. Differences are recorded as recalculation events
+// so the history still adds up.
+func recalculateReputation(db *sql.DB) ([]reputationChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	actual := map[int]int{}
+	for _, target := range []voteTarget{threadVotes, commentVotes} {
+		rows, err := tx.Query(`
+            SELECT t.user_id, r.score, COUNT(*)
+            FROM item_reactions ir
+            JOIN reactions r ON r.id = ir.reaction_id
+            JOIN users u ON u.id = ir.user_id
+            JOIN `+target.table+` t ON t.id = ir.item_id
+            WHERE ir.item_type = ? AND r.score != 0 AND ir.user_id != t.user_id
+            GROUP BY t.user_id, r.score`, target.kind)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var userID, vote, count int
+			if err := rows.Scan(&userID, &vote, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			actual[userID] += count * reputationWeight(target.kind, vote)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query("SELECT id, username, reputation FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	var changes []reputationChange
+	for rows.Next() {
+		var c reputationChange
+		if err := rows.Scan(&c.UserID, &c.Username, &c.Stored); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Actual = actual[c.UserID]
+		if c.Actual != c.Stored {
+			changes = append(changes, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, c := range changes {
+		if err := addReputation(tx, c.UserID, c.Actual-c.Stored, reputationRecalculation, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	return changes, tx.Commit()
+}
@@ -0,0 +1,261 @@
+package main
+
+import "testing"
+
+// reputationOf returns the stored reputation of a user.
+func reputationOf(t *testing.T, userID int) int {
+	t.Helper()
+	var reputation int
+	if err := db.QueryRow("SELECT reputation FROM users WHERE id = ?", userID).Scan(&reputation); err != nil {
+		t.Fatal(err)
+	}
+	return reputation
+}
+
+// checkReputationAddsUp fails the test when recalculating would change anyone's reputation.
+func checkReputationAddsUp(t *testing.T) {
+	t.Helper()
+	changes, err := recalculateReputation(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		t.Errorf("%s has %d reputation stored but earned %d", c.Username, c.Stored, c.Actual)
+	}
+}
+
+func TestDeletingTakesBackReputation(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var comments []int
+	for i := 0; i < 2; i++ {
+		id, err := createComment(author, int(threadID), 0, "A comment", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		comments = append(comments, int(id))
+	}
+	if _, err := castVote(threadVotes, int(threadID), voter, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range comments {
+		if _, err := castVote(commentVotes, id, voter, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	threadLike, commentLike := reputationWeight("thread", 1), reputationWeight("comment", 1)
+	if got, want := reputationOf(t, author), threadLike+2*commentLike; got != want {
+		t.Fatalf("reputation after the votes = %d, want %d", got, want)
+	}
+
+	if err := hardDeleteComment(comments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reputationOf(t, author), threadLike+commentLike; got != want {
+		t.Errorf("reputation after deleting a comment = %d, want %d", got, want)
+	}
+	checkReputationAddsUp(t)
+
+	if err := deleteThread(int(threadID)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reputationOf(t, author); got != 0 {
+		t.Errorf("reputation after deleting the thread = %d, want 0", got)
+	}
+	checkReputationAddsUp(t)
+}
+
+func TestReputationWeight(t *testing.T) {
+	tests := []struct {
+		kind string
+		vote int
+		env  string // REPUTATION_THREAD_LIKE
+		want int
+	}{
+		{"thread", 1, "", 5},
+		{"thread", -1, "", -2},
+		{"thread", 0, "", 0},
+		{"comment", 1, "", 2},
+		{"comment", -1, "", -1},
+		{"thread", 1, "10", 10},
+		{"thread", 1, "ten", 5},
+		{"comment", 1, "10", 2},
+	}
+	for _, tt := range tests {
+		t.Setenv("REPUTATION_THREAD_LIKE", tt.env)
+		if got := reputationWeight(tt.kind, tt.vote); got != tt.want {
+			t.Errorf("REPUTATION_THREAD_LIKE=%q: reputationWeight(%s, %d) = %d, want %d", tt.env, tt.kind, tt.vote, got, tt.want)
+		}
+	}
+}
+
+func TestVotesChangeReputation(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	setTestRole(t, voter, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target voteTarget
+		itemID int
+		userID int
+		vote   int
+		want   int // the author's reputation afterwards
+		reason string
+	}{
+		{threadVotes, int(threadID), voter, 1, 5, "thread_like"},
+		{threadVotes, int(threadID), voter, 1, 5, ""},
+		{threadVotes, int(threadID), voter, -1, -2, "thread_dislike"},
+		{threadVotes, int(threadID), voter, 0, 0, "thread_vote_removed"},
+		{commentVotes, int(commentID), voter, 1, 2, "comment_like"},
+		{commentVotes, int(commentID), voter, -1, -1, "comment_dislike"},
+		{commentVotes, int(commentID), voter, 0, 0, "comment_vote_removed"},
+		// votes on your own posts count for nothing
+		{threadVotes, int(threadID), author, 1, 0, ""},
+		{commentVotes, int(commentID), author, 1, 0, ""},
+	}
+	for i, tt := range tests {
+		var eventsBefore int
+		db.QueryRow("SELECT COUNT(*) FROM reputation_events").Scan(&eventsBefore)
+		if _, err := castVote(tt.target, tt.itemID, tt.userID, tt.vote); err != nil {
+			t.Fatalf("vote %d: %v", i, err)
+		}
+		if got := reputationOf(t, author); got != tt.want {
+			t.Errorf("vote %d: %s %d by %d: reputation %d, want %d", i, tt.target.kind, tt.vote, tt.userID, got, tt.want)
+		}
+		events, err := listReputationEvents(author, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var eventsAfter int
+		db.QueryRow("SELECT COUNT(*) FROM reputation_events").Scan(&eventsAfter)
+		switch {
+		case tt.reason == "" && eventsAfter != eventsBefore:
+			t.Errorf("vote %d: recorded a reputation event for a vote worth nothing", i)
+		case tt.reason != "" && (eventsAfter != eventsBefore+1 || events[0].Reason != tt.reason):
+			t.Errorf("vote %d: latest event %+v, want reason %s", i, events, tt.reason)
+		}
+		checkReputationAddsUp(t)
+	}
+}
+
+func TestPrivilegesUnlockAtThresholds(t *testing.T) {
+	newTestDB(t)
+	user := createTestUser(t, "alice")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+
+	tests := []struct {
+		userID     int
+		reputation int
+		env        string // REPUTATION_PRIVILEGE_DOWNVOTE
+		privilege  string
+		want       bool
+	}{
+		{user, 0, "", privilegeDownvote, false},
+		{user, 14, "", privilegeDownvote, false},
+		{user, 15, "", privilegeDownvote, true},
+		{user, 19, "", privilegeCreateTag, false},
+		{user, 20, "", privilegeCreateTag, true},
+		{user, 49, "", privilegeCreatePoll, false},
+		{user, 50, "", privilegeCreatePoll, true},
+		{user, 15, "30", privilegeDownvote, false},
+		{user, 0, "0", privilegeDownvote, true},
+		{moderator, -10, "", privilegeDownvote, true},
+		{moderator, 0, "", privilegeCreatePoll, true},
+		{user + moderator + 1, 100, "", privilegeDownvote, false}, // no such user
+	}
+	for _, tt := range tests {
+		t.Setenv("REPUTATION_PRIVILEGE_DOWNVOTE", tt.env)
+		if _, err := db.Exec("UPDATE users SET reputation = ? WHERE id = ?", tt.reputation, tt.userID); err != nil {
+			t.Fatal(err)
+		}
+		got, err := hasPrivilege(db, tt.userID, tt.privilege)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("user %d with %d reputation, threshold %q: %s = %v, want %v", tt.userID, tt.reputation, tt.env, tt.privilege, got, tt.want)
+		}
+	}
+}
+
+func TestDislikeNeedsReputation(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := castVote(threadVotes, int(threadID), voter, -1); err != errNeedsReputation {
+		t.Fatalf("dislike without reputation: %v, want errNeedsReputation", err)
+	}
+	if vote, _ := getVote(threadVotes, int(threadID), voter); vote != 0 {
+		t.Errorf("refused dislike left vote %d", vote)
+	}
+	if _, err := db.Exec("UPDATE users SET reputation = ? WHERE id = ?", privilegeThreshold(privilegeDownvote), voter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, int(threadID), voter, -1); err != nil {
+		t.Fatalf("dislike at the threshold: %v", err)
+	}
+	// Losing the privilege later does not take back a dislike already cast
+	if _, err := db.Exec("UPDATE users SET reputation = 0 WHERE id = ?", voter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, int(threadID), voter, -1); err != nil {
+		t.Errorf("repeating a dislike: %v", err)
+	}
+}
+
+func TestRecalculateReputation(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, int(threadID), voter, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE users SET reputation = 40 WHERE id = ?", author); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REPUTATION_THREAD_LIKE", "7")
+
+	changes, err := recalculateReputation(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []reputationChange{{UserID: author, Username: "alice", Stored: 40, Actual: 7}}
+	if len(changes) != 1 || changes[0] != want[0] {
+		t.Errorf("changes %+v, want %+v", changes, want)
+	}
+	if got := reputationOf(t, author); got != 7 {
+		t.Errorf("reputation after recalculating = %d, want 7", got)
+	}
+	events, err := listReputationEvents(author, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Reason != reputationRecalculation || events[0].Amount != -33 {
+		t.Errorf("latest event %+v, want a recalculation of -33", events)
+	}
+	checkReputationAddsUp(t)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errEditWindowClosed = errors.New("the edit window for this thread has closed")
+
+// ThreadRevision is one saved version of a thread.
+type ThreadRevision struct {
+	ID          int       `json:"id"`
+	ThreadID    int       `json:"thread_id"`
+	EditorID    int       `json:"editor_id"`
+	EditorName  string    `json:"editor"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Categories  string    `json:"categories"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// checkThreadEdit reports whether userID may edit the thread. Authors may edit
+// within the edit window of their role; moderators may edit any thread within
+// theirs. Threads from before created_at was recorded have no known age, so no
+// window applies to them.
+func checkThreadEdit(thread Thread, userID int) error {
+	role, err := getUserRole(userID)
+	if err != nil {
+		return err
+	}
+	if thread.UserID != userID && !isModerator(role) {
+		return errForbidden
+	}
+	if thread.ArchivedAt != nil && !isModerator(role) {
+		return errThreadArchived
+	}
+
+	window := threadEditWindow(role)
+	if window == 0 {
+		return nil
+	}
+	if thread.CreatedAt != nil && time.Since(*thread.CreatedAt) > window {
+		return errEditWindowClosed
+	}
+	return nil
+}
+
+// insertThreadRevision snapshots the current state of a thread.
+func insertThreadRevision(tx *sql.Tx, threadID, editorID int) error {
+	_, err := tx.Exec(`
+        INSERT INTO thread_revisions (thread_id, editor_id, title, description, categories, created_at)
+        SELECT t.id, ?, t.title, t.description,
+            COALESCE((SELECT GROUP_CONCAT(name, ', ') FROM (
+                SELECT c.name FROM categories c JOIN thread_categories tc ON tc.category_id = c.id
+                WHERE tc.thread_id = t.id ORDER BY c.name)), ''),
+            ?
+        FROM threads t WHERE t.id = ?`, editorID, time.Now(), threadID)
+	return err
+}
+
+// editThread saves new content for a thread and records it as a revision.
+func editThread(thread Thread, editorID int, title, description string, categoryIDs, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Threads created before revisions existed get their original version saved first
+	var revisions int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM thread_revisions WHERE thread_id = ?", thread.ID).Scan(&revisions); err != nil {
+		return err
+	}
+	if revisions == 0 {
+		if err := insertThreadRevision(tx, thread.ID, thread.UserID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE threads SET title = ?, description = ?, edited_at = ? WHERE id = ?", title, description, time.Now(), thread.ID); err != nil {
+		return err
+	}
+	// A thread may stay in an archived category but not be moved into one
+	current, err := listThreadCategoryIDs(tx, thread.ID)
+	if err != nil {
+		return err
+	}
+	if categoryIDs, err = checkCategoryIDs(tx, categoryIDs, current); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM thread_categories WHERE thread_id = ?", thread.ID); err != nil {
+		return err
+	}
+	for _, catID := range categoryIDs {
+		if _, err := tx.Exec("INSERT INTO thread_categories (thread_id, category_id) VALUES (?, ?)", thread.ID, catID); err != nil {
+			return err
+		}
+	}
+
+	if err := setThreadTags(tx, editorID, thread.ID, tags); err != nil {
+		return err
+	}
+
+	if err := insertThreadRevision(tx, thread.ID, editorID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	notifyModerator(editorID, thread.UserID, thread.ID, 0, "edited your thread")
+	notifyMentions(editorID, thread.Description, description, thread.ID, 0)
+	return nil
+}
+
+// listThreadRevisions returns the revisions of a thread, oldest first.
+func listThreadRevisions(threadID int) ([]ThreadRevision, error) {
+	rows, err := db.Query(`
+        SELECT r.id, r.thread_id, r.editor_id, u.username, r.title, r.description, r.categories, r.created_at
+        FROM thread_revisions r
+        JOIN users u ON u.id = r.editor_id
+        WHERE r.thread_id = ?
+        ORDER BY r.id`, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ThreadRevision{}
+	for rows.Next() {
+		var rev ThreadRevision
+		if err := rows.Scan(&rev.ID, &rev.ThreadID, &rev.EditorID, &rev.EditorName, &rev.Title, &rev.Description, &rev.Categories, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// diffOp is one run of a word level diff: "equal", "insert" or "delete".
+type diffOp struct {
+	Kind string
+	Text string
+}
+
+// diffMaxTokens bounds the work of a diff; longer texts are shown as a full replacement.
+const diffMaxTokens = 3000
+
+// diffWords computes a word level diff between two texts with Myers'
+// algorithm in linear space. Whitespace is kept as separate tokens.
+func diffWords(from, to string) []diffOp {
+	a, b := tokenizeWords(from), tokenizeWords(to)
+	if len(a) > diffMaxTokens || len(b) > diffMaxTokens {
+		return appendDiffOp(appendDiffOp(nil, "delete", from), "insert", to)
+	}
+	return diffTokens(nil, a, b)
+}
+
+// diffTokens appends the diff of a and b to ops, splitting them at the
+// middle snake of a shortest edit path until one side is empty.
+func diffTokens(ops []diffOp, a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, token := range a[:prefix] {
+		ops = appendDiffOp(ops, "equal", token)
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, token := range b {
+			ops = appendDiffOp(ops, "insert", token)
+		}
+	case len(b) == 0:
+		for _, token := range a {
+			ops = appendDiffOp(ops, "delete", token)
+		}
+	default:
+		// Both sides differ at their ends, so each half has at least one edit
+		x, y, u, v := middleSnake(a, b)
+		ops = diffTokens(ops, a[:x], b[:y])
+		for _, token := range a[x:u] {
+			ops = appendDiffOp(ops, "equal", token)
+		}
+		ops = diffTokens(ops, a[u:], b[v:])
+	}
+	for _, token := range common {
+		ops = appendDiffOp(ops, "equal", token)
+	}
+	return ops
+}
+
+// middleSnake returns the start (x, y) and end (u, v) of the run of equal
+// tokens in the middle of a shortest edit path from a to b, found by
+// searching from both ends at once. Diagonal k holds the points with x-y = k;
+// forward[k] is the furthest x reached on it from the start and backward[k]
+// the furthest distance from the end on diagonal k of the reversed texts.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	delta := n - m
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	forward := make([]int, 2*maxD+3)
+	backward := make([]int, 2*maxD+3)
+
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			if back := delta - k; delta%2 != 0 && back >= -(d-1) && back <= d-1 && u+backward[offset+back] >= n {
+				return x, y, u, v
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var rx int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				rx = backward[offset+k+1]
+			} else {
+				rx = backward[offset+k-1] + 1
+			}
+			ry := rx - k
+			sx, sy := rx, ry
+			for rx < n && ry < m && a[n-1-rx] == b[m-1-ry] {
+				rx++
+				ry++
+			}
+			backward[offset+k] = rx
+			if fwd := delta - k; delta%2 == 0 && fwd >= -d && fwd <= d && forward[offset+fwd]+rx >= n {
+				return n - rx, m - ry, n - sx, m - sy
+			}
+		}
+	}
+	// Not reached: a path of at most n+m edits always exists
+	return 0, 0, 0, 0
+}
+
+// appendDiffOp merges consecutive runs of the same kind.
+func appendDiffOp(ops []diffOp, kind, text string) []diffOp {
+	if text == "" {
+		return ops
+	}
+	if n := len(ops); n > 0 && ops[n-1].Kind == kind {
+		ops[n-1].Text += text
+		return ops
+	}
+	return append(ops, diffOp{Kind: kind, Text: text})
+}
+
+func tokenizeWords(s string) []string {
+	var tokens []string
+	start := 0
+	for i, r := range s {
+		if r == ' ' || r == '\n' || r == '\t' || r == '\r' {
+			if start < i {
+				tokens = append(tokens, s[start:i])
+			}
+			tokens = append(tokens, string(r))
+			start = i + len(string(r))
+		}
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// /thread/edit: form to edit a thread and the handler saving it
+func serveEditThread(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	threadID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Thread ID is required", http.StatusBadRequest)
+		return
+	}
+	thread, err := getThread(threadID)
+	if err == errNotFound {
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+		return
+	}
+
+	switch err := checkThreadEdit(thread, userID); err {
+	case nil:
+	case errForbidden:
+		http.Error(w, "You cannot edit this thread", http.StatusForbidden)
+		return
+	case errEditWindowClosed:
+		http.Error(w, "The edit window for this thread has closed", http.StatusForbidden)
+		return
+	case errThreadArchived:
+		http.Error(w, closedThreadMessage(err), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		title := strings.TrimSpace(r.FormValue("title"))
+		description := strings.TrimSpace(r.FormValue("description"))
+		if title == "" || description == "" {
+			http.Error(w, "Title and description are required", http.StatusBadRequest)
+			return
+		}
+		err := editThread(thread, userID, title, description, r.Form["categories"], splitTags(r.FormValue("tags")))
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to edit thread: %v", err)
+			http.Error(w, "Failed to edit thread", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/thread?id="+strconv.Itoa(threadID), http.StatusSeeOther)
+		return
+	}
+
+	categories, err := listCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+	selected := map[string]bool{}
+	for _, name := range thread.Categories {
+		selected[name] = true
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/edit_thread.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Thread":     thread,
+		"Categories": categories,
+		"Selected":   selected,
+		"Tags":       strings.Join(thread.Tags, ", "),
+	})
+}
+
+// /thread/revisions: revision history of a thread, with a diff between two revisions
+func serveThreadRevisions(w http.ResponseWriter, r *http.Request) {
+	threadID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Thread ID is required", http.StatusBadRequest)
+		return
+	}
+	thread, err := getThread(threadID)
+	if err == errNotFound {
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch thread", http.StatusInternalServerError)
+		return
+	}
+
+	revisions, err := listThreadRevisions(threadID)
+	if err != nil {
+		log.Printf("Failed to fetch revisions: %v", err)
+		http.Error(w, "Failed to fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Thread":    thread,
+		"Revisions": revisions,
+		"FromID":    0,
+		"ToID":      0,
+	}
+
+	// The last revision and the one before it are selected for comparing; a
+	// diff is only computed once the viewer asks for one with from and to
+	if n := len(revisions); n >= 2 {
+		data["FromID"] = revisions[n-2].ID
+		data["ToID"] = revisions[n-1].ID
+	}
+	byID := map[int]int{}
+	for i, rev := range revisions {
+		byID[rev.ID] = i
+	}
+	fromID, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	toID, _ := strconv.Atoi(r.URL.Query().Get("to"))
+	from, okFrom := byID[fromID]
+	to, okTo := byID[toID]
+	if okFrom && okTo && from != to {
+		a, b := revisions[from], revisions[to]
+		data["From"] = a
+		data["To"] = b
+		data["FromID"] = a.ID
+		data["ToID"] = b.ID
+		data["TitleDiff"] = diffWords(a.Title, b.Title)
+		data["DescriptionDiff"] = diffWords(a.Description, b.Description)
+		data["CategoriesDiff"] = diffWords(a.Categories, b.Categories)
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/thread_revisions.html"))
+	tmpl.Execute(w, data)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// applyDiff returns the texts a diff leads from and to.
+func applyDiff(ops []diffOp) (from, to string) {
+	var a, b strings.Builder
+	for _, op := range ops {
+		if op.Kind != "insert" {
+			a.WriteString(op.Text)
+		}
+		if op.Kind != "delete" {
+			b.WriteString(op.Text)
+		}
+	}
+	return a.String(), b.String()
+}
+
+// editCount returns the number of tokens a diff inserts or deletes.
+func editCount(ops []diffOp) int {
+	n := 0
+	for _, op := range ops {
+		if op.Kind != "equal" {
+			n += len(tokenizeWords(op.Text))
+		}
+	}
+	return n
+}
+
+// lcsLength is the quadratic longest common subsequence, to check diffWords against.
+func lcsLength(a, b []string) int {
+	row := make([]int, len(b)+1)
+	for i := range a {
+		diagonal := 0
+		for j := range b {
+			above := row[j+1]
+			if a[i] == b[j] {
+				row[j+1] = diagonal + 1
+			} else if row[j] > row[j+1] {
+				row[j+1] = row[j]
+			}
+			diagonal = above
+		}
+	}
+	return row[len(b)]
+}
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     []diffOp
+	}{
+		{"", "", nil},
+		{"same text", "same text", []diffOp{{"equal", "same text"}}},
+		{"", "new", []diffOp{{"insert", "new"}}},
+		{"old", "", []diffOp{{"delete", "old"}}},
+		{"the quick fox", "the slow fox", []diffOp{{"equal", "the "}, {"delete", "quick"}, {"insert", "slow"}, {"equal", " fox"}}},
+		{"a b c", "a c", []diffOp{{"equal", "a "}, {"delete", "b "}, {"equal", "c"}}},
+	}
+	for _, tt := range tests {
+		got := diffWords(tt.from, tt.to)
+		if len(got) != len(tt.want) {
+			t.Errorf("diffWords(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("diffWords(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDiffWordsIsShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	words := []string{"a", "b", "c", "d", " ", " ", "\n"}
+	text := func() string {
+		var s strings.Builder
+		for i := rng.Intn(40); i > 0; i-- {
+			s.WriteString(words[rng.Intn(len(words))])
+		}
+		return s.String()
+	}
+	for i := 0; i < 2000; i++ {
+		from, to := text(), text()
+		ops := diffWords(from, to)
+		if a, b := applyDiff(ops); a != from || b != to {
+			t.Fatalf("diffWords(%q, %q) = %q, which leads from %q to %q", from, to, ops, a, b)
+		}
+		a, b := tokenizeWords(from), tokenizeWords(to)
+		if got, want := editCount(ops), len(a)+len(b)-2*lcsLength(a, b); got != want {
+			t.Fatalf("diffWords(%q, %q) = %q has %d edits, want %d", from, to, ops, got, want)
+		}
+	}
+}
+
+func TestDiffWordsLongTexts(t *testing.T) {
+	// Two texts at the token limit with nothing in common, the worst case
+	from := strings.Repeat("x ", diffMaxTokens/2)
+	to := strings.Repeat("y ", diffMaxTokens/2)
+	ops := diffWords(from, to)
+	if a, b := applyDiff(ops); a != from || b != to {
+		t.Fatal("diff of long texts does not lead from one to the other")
+	}
+
+	over := strings.Repeat("x ", diffMaxTokens)
+	ops = diffWords(over, over+"y")
+	if len(ops) != 2 || ops[0].Kind != "delete" || ops[1].Kind != "insert" {
+		t.Errorf("texts over the limit diffed as %d runs, want a full replacement", len(ops))
+	}
+}
+
+func TestCheckThreadEdit(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	other := createTestUser(t, "bob")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	id, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := int(id)
+
+	tests := []struct {
+		name      string
+		createdAt interface{} // nil for a thread from before created_at
+		archived  bool
+		userID    int
+		want      error
+	}{
+		{"author within the window", time.Now().Add(-time.Minute), false, author, nil},
+		{"author after the window", time.Now().Add(-2 * time.Hour), false, author, errEditWindowClosed},
+		{"author of a thread of unknown age", nil, false, author, nil},
+		{"another user", time.Now(), false, other, errForbidden},
+		{"another user of a thread of unknown age", nil, false, other, errForbidden},
+		{"moderator after the window", time.Now().Add(-48 * time.Hour), false, moderator, nil},
+		{"author of an archived thread", time.Now(), true, author, errThreadArchived},
+		{"moderator of an archived thread", time.Now(), true, moderator, nil},
+	}
+	for _, tt := range tests {
+		var archivedAt interface{}
+		if tt.archived {
+			archivedAt = time.Now()
+		}
+		if _, err := db.Exec("UPDATE threads SET created_at = ?, archived_at = ? WHERE id = ?", tt.createdAt, archivedAt, threadID); err != nil {
+			t.Fatal(err)
+		}
+		thread, err := getThread(threadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkThreadEdit(thread, tt.userID); err != tt.want {
+			t.Errorf("%s: checkThreadEdit = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestThreadRevisionsDiffOnlyWhenAsked(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	threadID, err := createThread(author, ThreadInput{Title: "First title", Description: "First description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread, err := getThread(int(threadID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := editThread(thread, author, "Second title", "Second description", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := listThreadRevisions(int(threadID))
+	if err != nil || len(revisions) != 2 {
+		t.Fatalf("revisions %v, %v; want two", revisions, err)
+	}
+
+	get := func(query string) string {
+		w := httptest.NewRecorder()
+		serveThreadRevisions(w, httptest.NewRequest(http.MethodGet, "/thread/revisions?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", query, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	page := get(fmt.Sprintf("id=%d", threadID))
+	if strings.Contains(page, "<ins>") || strings.Contains(page, "Changes from") {
+		t.Error("a diff was computed without from and to")
+	}
+	if !strings.Contains(page, fmt.Sprintf(`name="from" value="%d" checked`, revisions[0].ID)) ||
+		!strings.Contains(page, fmt.Sprintf(`name="to" value="%d" checked`, revisions[1].ID)) {
+		t.Error("the last two revisions are not selected for comparing")
+	}
+
+	page = get(fmt.Sprintf("id=%d&from=%d&to=%d", threadID, revisions[0].ID, revisions[1].ID))
+	if !strings.Contains(page, "<del>First</del><ins>Second</ins>") {
+		t.Errorf("the asked for diff is missing:\n%s", page)
+	}
+}
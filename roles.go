@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// User roles stored in users.role.
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// getUserRole returns the role of a user, or "" for guests and unknown users.
+func getUserRole(userID int) (string, error) {
+	if userID == 0 {
+		return "", nil
+	}
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func isModerator(role string) bool {
+	return role == roleModerator || role == roleAdmin
+}
+
+// defaultThreadEditWindows is how long after creation each role may edit a
+// thread. Zero means no limit.
+var defaultThreadEditWindows = map[string]time.Duration{
+	roleUser:      time.Hour,
+	roleModerator: 0,
+	roleAdmin:     0,
+}
+
+// threadEditWindow returns the edit window of a role. It can be overridden with
+// THREAD_EDIT_WINDOW_USER, THREAD_EDIT_WINDOW_MODERATOR and
+// THREAD_EDIT_WINDOW_ADMIN, e.g. "30m" or "0" for no limit.
+func threadEditWindow(role string) time.Duration {
+	env := "THREAD_EDIT_WINDOW_" + strings.ToUpper(role)
+	if value := os.Getenv(env); value != "" {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			return d
+		}
+		log.Printf("Ignoring invalid %s=%q: %v", env, value, err)
+	}
+	return defaultThreadEditWindows[role]
+}
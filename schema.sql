@@ -3,9 +3,31 @@ CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     username TEXT NOT NULL UNIQUE,
     password TEXT NOT NULL,
-    email TEXT NOT NULL UNIQUE
+    email TEXT NOT NULL UNIQUE,
+    role TEXT NOT NULL DEFAULT 'user', -- user, moderator or admin
+    reputation INTEGER NOT NULL DEFAULT 0, -- sum of the user's reputation_events
+    display_name TEXT NOT NULL DEFAULT '',
+    bio TEXT NOT NULL DEFAULT '', -- markdown
+    signature TEXT NOT NULL DEFAULT '',
+    location TEXT NOT NULL DEFAULT '',
+    timezone TEXT NOT NULL DEFAULT '', -- IANA name, e.g. Europe/Istanbul
+    avatar TEXT NOT NULL DEFAULT '', -- file name in the avatar directory, '' for an identicon
+    feed_token TEXT NOT NULL DEFAULT '', -- secret in the Atom feed URL, created on first use
+    digest TEXT NOT NULL DEFAULT '', -- digest email frequency: '', daily or weekly
+    digest_sent_at DATETIME -- end of the period covered by the last digest
 );
 
+-- Website and social links shown on a profile
+CREATE TABLE IF NOT EXISTS user_links (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    label TEXT NOT NULL,
+    url TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+CREATE INDEX IF NOT EXISTS idx_user_links_user ON user_links(user_id, position);
+
 -- Create threads table
 CREATE TABLE IF NOT EXISTS threads (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -14,6 +36,11 @@ CREATE TABLE IF NOT EXISTS threads (
     user_id INTEGER NOT NULL,
     likes INTEGER DEFAULT 0,
     dislikes INTEGER DEFAULT 0,
+    created_at DATETIME,
+    edited_at DATETIME,
+    pinned_at DATETIME, -- set when pinned above every other thread
+    locked_at DATETIME, -- set when locked; only moderators can comment
+    archived_at DATETIME, -- set when archived; the thread is read-only
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
@@ -25,39 +52,59 @@ CREATE TABLE IF NOT EXISTS comments (
     thread_id INTEGER NOT NULL,
     likes INTEGER DEFAULT 0,
     dislikes INTEGER DEFAULT 0,
+    created_at DATETIME,
+    edited_at DATETIME,
+    deleted_at DATETIME, -- set when soft deleted, the content is then hidden
+    parent_id INTEGER, -- the comment this one replies to, NULL for top level comments
     FOREIGN KEY (user_id) REFERENCES users(id),
-    FOREIGN KEY (thread_id) REFERENCES threads(id)
+    FOREIGN KEY (thread_id) REFERENCES threads(id),
+    FOREIGN KEY (parent_id) REFERENCES comments(id)
 );
 
-CREATE TABLE IF NOT EXISTS comment_likes (
-    comment_id INTEGER,
-    user_id INTEGER,
-    like_type INTEGER, -- 1 for like, -1 for dislike
-    likes INTEGER DEFAULT 0,
-    dislikes INTEGER DEFAULT 0,
-    PRIMARY KEY (comment_id, user_id),
-    FOREIGN KEY (comment_id) REFERENCES comments(id),
-    FOREIGN KEY (user_id) REFERENCES users(id)
+-- The reactions users can pick from. Like and dislike carry a score and are
+-- the votes behind the likes and dislikes counters; admins can add more.
+CREATE TABLE IF NOT EXISTS reactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    emoji TEXT NOT NULL,
+    score INTEGER NOT NULL DEFAULT 0, -- 1 counts as a like, -1 as a dislike
+    position INTEGER NOT NULL DEFAULT 0,
+    custom INTEGER NOT NULL DEFAULT 0, -- added by an admin
+    disabled INTEGER NOT NULL DEFAULT 0
 );
 
--- Create table to track individual likes and dislikes
-CREATE TABLE IF NOT EXISTS thread_likes (
-    thread_id INTEGER,
-    user_id INTEGER,
-    like_type INTEGER, -- 1 for like, -1 for dislike
-    PRIMARY KEY (thread_id, user_id),
-    FOREIGN KEY (thread_id) REFERENCES threads(id),
-    FOREIGN KEY (user_id) REFERENCES users(id)
+-- Reactions of users on threads, comments and messages
+CREATE TABLE IF NOT EXISTS item_reactions (
+    item_type TEXT NOT NULL, -- thread, comment or message
+    item_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    reaction_id INTEGER NOT NULL,
+    created_at DATETIME,
+    PRIMARY KEY (item_type, item_id, user_id, reaction_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (reaction_id) REFERENCES reactions(id)
 );
 
+CREATE INDEX IF NOT EXISTS idx_item_reactions_user ON item_reactions (user_id);
+
+-- Categories form a tree through parent_id; siblings are ordered by position
 CREATE TABLE IF NOT EXISTS categories (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT NOT NULL UNIQUE
+    name TEXT NOT NULL UNIQUE,
+    slug TEXT NOT NULL DEFAULT '', -- used in URLs, filled in from the name when empty
+    description TEXT NOT NULL DEFAULT '',
+    parent_id INTEGER, -- NULL for top level categories
+    position INTEGER NOT NULL DEFAULT 0,
+    color TEXT NOT NULL DEFAULT '', -- #rrggbb, '' for none
+    icon TEXT NOT NULL DEFAULT '', -- usually an emoji
+    archived_at DATETIME, -- set when archived; archived categories take no new threads
+    FOREIGN KEY (parent_id) REFERENCES categories(id)
 );
 
 CREATE TABLE IF NOT EXISTS thread_categories (
     thread_id INTEGER,
     category_id INTEGER,
+    pinned_at DATETIME, -- set when pinned at the top of the category
     PRIMARY KEY (thread_id, category_id),
     FOREIGN KEY (thread_id) REFERENCES threads(id),
     FOREIGN KEY (category_id) REFERENCES categories(id)
@@ -69,4 +116,338 @@ CREATE TABLE IF NOT EXISTS messages (
     content TEXT NOT NULL,
     recipient TEXT NOT NULL,
     time DATETIME
-);
\ No newline at end of file
+);
+
+-- Every saved version of a thread, oldest first
+CREATE TABLE IF NOT EXISTS thread_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    thread_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL,
+    categories TEXT NOT NULL DEFAULT '', -- comma separated category names
+    created_at DATETIME NOT NULL,
+    html TEXT NOT NULL DEFAULT '', -- rendered description, see markdownVersion
+    html_version INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (thread_id) REFERENCES threads(id),
+    FOREIGN KEY (editor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_revisions_thread ON thread_revisions (thread_id);
+
+-- Every saved version of a comment, oldest first
+CREATE TABLE IF NOT EXISTS comment_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    comment_id INTEGER NOT NULL,
+    editor_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    html TEXT NOT NULL DEFAULT '', -- rendered content, see markdownVersion
+    html_version INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (comment_id) REFERENCES comments(id),
+    FOREIGN KEY (editor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_comment_revisions_comment ON comment_revisions (comment_id);
+
+-- Every change to the reputation of a user
+CREATE TABLE IF NOT EXISTS reputation_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    reason TEXT NOT NULL, -- e.g. thread_like, comment_vote_removed or recalculation
+    thread_id INTEGER,
+    comment_id INTEGER,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reputation_events_user ON reputation_events (user_id);
+
+-- Users following other users and categories, and users they muted. The feed
+-- is built from these when it is read.
+CREATE TABLE IF NOT EXISTS user_follows (
+    follower_id INTEGER NOT NULL,
+    followee_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (follower_id, followee_id),
+    FOREIGN KEY (follower_id) REFERENCES users(id),
+    FOREIGN KEY (followee_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_follows_followee ON user_follows (followee_id);
+
+CREATE TABLE IF NOT EXISTS category_follows (
+    user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, category_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (category_id) REFERENCES categories(id)
+);
+
+CREATE TABLE IF NOT EXISTS user_mutes (
+    user_id INTEGER NOT NULL,
+    muted_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, muted_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (muted_id) REFERENCES users(id)
+);
+
+-- Lookups of the feed by author and category
+CREATE INDEX IF NOT EXISTS idx_threads_user ON threads (user_id);
+CREATE INDEX IF NOT EXISTS idx_comments_user ON comments (user_id);
+CREATE INDEX IF NOT EXISTS idx_thread_categories_category ON thread_categories (category_id);
+
+-- In-app notifications. actor_id is the user whose action caused it; thread,
+-- comment and message point at what it is about and are NULL when unrelated.
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL, -- thread_reply, comment_reply, mention, vote, message, moderation or watching
+    actor_id INTEGER,
+    thread_id INTEGER,
+    comment_id INTEGER,
+    message_id INTEGER,
+    text TEXT NOT NULL DEFAULT '', -- excerpt of the comment or message, or the moderator action
+    created_at DATETIME NOT NULL,
+    read_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (actor_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications (user_id) WHERE read_at IS NULL;
+
+-- Notification types a user changed from the default. Missing rows are on in
+-- the app; email is NULL when the type's default applies.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    in_app INTEGER NOT NULL DEFAULT 1,
+    email INTEGER,
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Outgoing emails. The mail worker sends due rows and retries failures with
+-- a growing delay until they are sent or run out of attempts.
+CREATE TABLE IF NOT EXISTS mail_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    recipient TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    text_body TEXT NOT NULL,
+    html_body TEXT NOT NULL,
+    unsubscribe_url TEXT NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    sent_at DATETIME,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_mail_queue_due ON mail_queue (next_attempt_at) WHERE sent_at IS NULL;
+
+-- Secrets generated on first use that must survive restarts, e.g. the key
+-- signing unsubscribe links.
+CREATE TABLE IF NOT EXISTS app_secrets (
+    name TEXT PRIMARY KEY,
+    value BLOB NOT NULL
+);
+
+-- Threads and categories users watch. level is all (every new comment, and
+-- new threads of a category), mentions (only replies and mentions) or muted
+-- (nothing). auto is set on watches added by posting in the thread.
+CREATE TABLE IF NOT EXISTS thread_watches (
+    user_id INTEGER NOT NULL,
+    thread_id INTEGER NOT NULL,
+    level TEXT NOT NULL,
+    auto INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, thread_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (thread_id) REFERENCES threads(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_watches_thread ON thread_watches (thread_id);
+
+CREATE TABLE IF NOT EXISTS category_watches (
+    user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    level TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, category_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (category_id) REFERENCES categories(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_category_watches_category ON category_watches (category_id);
+
+-- What users have read: the last comment seen in each thread they opened,
+-- and the comment up to which they marked a category, or everything when
+-- category_id is 0, as read.
+CREATE TABLE IF NOT EXISTS thread_reads (
+    user_id INTEGER NOT NULL,
+    thread_id INTEGER NOT NULL,
+    comment_id INTEGER NOT NULL,
+    read_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, thread_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (thread_id) REFERENCES threads(id)
+);
+
+CREATE TABLE IF NOT EXISTS read_marks (
+    user_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    comment_id INTEGER NOT NULL,
+    marked_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, category_id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+-- Comments are counted by thread for unread badges
+CREATE INDEX IF NOT EXISTS idx_comments_thread ON comments (thread_id);
+
+-- Files attached to a thread, a comment or a message; none of the three is set
+-- until the upload is posted. blob_key and thumb_key name the stored file and
+-- its thumbnail by the SHA-256 of their content, so uploads of the same file
+-- share them.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    blob_key TEXT NOT NULL,
+    thumb_key TEXT NOT NULL DEFAULT '',
+    filename TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    width INTEGER NOT NULL DEFAULT 0,
+    height INTEGER NOT NULL DEFAULT 0,
+    thread_id INTEGER,
+    comment_id INTEGER,
+    message_id INTEGER,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (thread_id) REFERENCES threads(id),
+    FOREIGN KEY (comment_id) REFERENCES comments(id),
+    FOREIGN KEY (message_id) REFERENCES messages(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_thread ON attachments (thread_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_comment ON attachments (comment_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id);
+CREATE INDEX IF NOT EXISTS idx_attachments_blob ON attachments (blob_key);
+CREATE INDEX IF NOT EXISTS idx_attachments_thumb ON attachments (thumb_key);
+
+-- Polls of threads, at most one per thread. Votes are one row per chosen
+-- option, so a multiple choice vote has several rows.
+CREATE TABLE IF NOT EXISTS polls (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    thread_id INTEGER NOT NULL UNIQUE,
+    question TEXT NOT NULL,
+    multiple INTEGER NOT NULL DEFAULT 0, -- voters may pick several options
+    anonymous INTEGER NOT NULL DEFAULT 0, -- who voted for what is never shown
+    change_votes INTEGER NOT NULL DEFAULT 0, -- voters may change or withdraw their vote
+    results TEXT NOT NULL DEFAULT 'always', -- when results are shown: always, voted or closed
+    closes_at DATETIME, -- NULL for polls that stay open
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (thread_id) REFERENCES threads(id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_options (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    poll_id INTEGER NOT NULL,
+    text TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (poll_id) REFERENCES polls(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_poll_options_poll ON poll_options (poll_id, position);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+    poll_id INTEGER NOT NULL,
+    option_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (option_id, user_id),
+    FOREIGN KEY (poll_id) REFERENCES polls(id),
+    FOREIGN KEY (option_id) REFERENCES poll_options(id),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_poll_votes_poll_user ON poll_votes (poll_id, user_id);
+
+-- Free-form tags users put on threads. A tag with synonym_of set is a synonym
+-- kept so the name still works; it has no threads or followers of its own.
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    synonym_of INTEGER, -- the tag this name stands for, NULL for tags in use
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (synonym_of) REFERENCES tags(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tags_synonym_of ON tags (synonym_of);
+
+CREATE TABLE IF NOT EXISTS thread_tags (
+    thread_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (thread_id, tag_id),
+    FOREIGN KEY (thread_id) REFERENCES threads(id),
+    FOREIGN KEY (tag_id) REFERENCES tags(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_thread_tags_tag ON thread_tags (tag_id);
+
+CREATE TABLE IF NOT EXISTS tag_follows (
+    user_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, tag_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (tag_id) REFERENCES tags(id)
+);
+
+-- Site-wide announcements, shown as a banner until they expire or each user
+-- dismisses them. Guests dismiss them with a cookie.
+CREATE TABLE IF NOT EXISTS announcements (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL DEFAULT '',
+    user_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME, -- NULL for announcements shown until removed
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS announcement_dismissals (
+    user_id INTEGER NOT NULL,
+    announcement_id INTEGER NOT NULL,
+    dismissed_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, announcement_id),
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (announcement_id) REFERENCES announcements(id)
+);
+
+-- Moderator actions on threads: pins, locks, archiving, moves, merges and
+-- splits. target_thread_id is the thread merged into or split off.
+CREATE TABLE IF NOT EXISTS moderation_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    moderator_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    thread_id INTEGER NOT NULL,
+    target_thread_id INTEGER,
+    details TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (moderator_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_moderation_log_thread ON moderation_log (thread_id);
+
+-- Threads merged into another thread; links to the old id lead to the new one.
+CREATE TABLE IF NOT EXISTS thread_redirects (
+    old_thread_id INTEGER PRIMARY KEY,
+    thread_id INTEGER NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (thread_id) REFERENCES threads(id)
+);
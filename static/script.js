@@ -1,44 +1,203 @@
 // scripts.js
-document.addEventListener('DOMContentLoaded', function() {
-    const likeButton = document.getElementById('likeButton');
-    const dislikeButton = document.getElementById('dislikeButton');
+// Vote forms are sent in the background and their totals updated in place.
+// Each button carries its vote in data-type; clicking the active one sends 0
+// to take the vote back.
+document.addEventListener('submit', function(event) {
+    const form = event.target;
+    if (!form.classList.contains('vote-form')) {
+        return;
+    }
+    event.preventDefault();
 
-    likeButton.addEventListener('click', function(event) {
-        event.preventDefault();
-        sendLikeDislikeRequest('like');
+    const body = new URLSearchParams(new FormData(form));
+    if (event.submitter && event.submitter.name) {
+        body.set(event.submitter.name, event.submitter.value);
+    }
+    fetch(form.action, {
+        method: 'POST',
+        headers: {
+            'Accept': 'application/json',
+        },
+        body: body
+    })
+    .then(response => {
+        if (!response.ok) {
+            throw new Error('Vote failed: ' + response.status);
+        }
+        return response.json();
+    })
+    .then(totals => updateVoteForm(form, totals))
+    .catch((error) => {
+        console.error('Error:', error);
     });
+});
 
-    dislikeButton.addEventListener('click', function(event) {
-        event.preventDefault();
-        sendLikeDislikeRequest('dislike');
+function updateVoteForm(form, totals) {
+    form.querySelector('.vote-likes').textContent = totals.likes;
+    form.querySelector('.vote-dislikes').textContent = totals.dislikes;
+    form.querySelectorAll('button[data-type]').forEach(button => {
+        const type = Number(button.dataset.type);
+        const active = totals.vote === type;
+        button.classList.toggle('active', active);
+        button.value = active ? 0 : type;
     });
-});
+}
 
-function sendLikeDislikeRequest(type) {
-    const threadId = document.querySelector('input[name="thread_id"]').value;
-    fetch('/like-dislike', {
+// Reaction forms work the same way: the button sends on=1 to add the reaction
+// and on=0 to take it back, and the whole bar is refreshed from the answer.
+document.addEventListener('submit', function(event) {
+    const form = event.target;
+    if (!form.classList.contains('reaction-form')) {
+        return;
+    }
+    event.preventDefault();
+
+    const body = new URLSearchParams(new FormData(form));
+    if (event.submitter && event.submitter.name) {
+        body.set(event.submitter.name, event.submitter.value);
+    }
+    fetch(form.action, {
         method: 'POST',
         headers: {
-            'Content-Type': 'application/x-www-form-urlencoded',
+            'Accept': 'application/json',
         },
-        body: `thread_id=${threadId}&like_type=${type}`
+        body: body
     })
-    .then(response => response.json())
-    .then(data => {
-        console.log('Success:', data);
-        // Update UI based on response
+    .then(response => {
+        if (!response.ok) {
+            throw new Error('Reaction failed: ' + response.status);
+        }
+        return response.json();
     })
+    .then(state => updateReactions(form.closest('.reactions'), state.reactions))
     .catch((error) => {
         console.error('Error:', error);
     });
+});
+
+function updateReactions(bar, reactions) {
+    reactions.forEach(reaction => {
+        const form = bar.querySelector(`.reaction-form[data-reaction-id="${reaction.id}"]`);
+        if (!form) {
+            return;
+        }
+        const button = form.querySelector('button');
+        form.querySelector('.reaction-count').textContent = reaction.count;
+        button.classList.toggle('active', reaction.reacted);
+        button.value = reaction.reacted ? 0 : 1;
+        button.title = reaction.users.join(', ');
+    });
 }
 
+// reactionBar builds the reaction buttons of a chat message.
+function reactionBar(itemType, itemID, reactions) {
+    const bar = document.createElement('div');
+    bar.className = 'reactions';
+    reactions.forEach(reaction => {
+        const form = document.createElement('form');
+        form.className = 'reaction-form';
+        form.method = 'post';
+        form.action = '/react';
+        form.dataset.reactionId = reaction.id;
+        [['item_type', itemType], ['item_id', itemID], ['reaction_id', reaction.id]].forEach(([name, value]) => {
+            const input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = name;
+            input.value = value;
+            form.appendChild(input);
+        });
+        const button = document.createElement('button');
+        button.type = 'submit';
+        button.name = 'on';
+        button.textContent = reaction.emoji + ' ';
+        const count = document.createElement('span');
+        count.className = 'reaction-count';
+        button.appendChild(count);
+        form.appendChild(button);
+        bar.appendChild(form);
+    });
+    updateReactions(bar, reactions);
+    return bar;
+}
+
+
+// linkMentions builds the text of a message with the mentions of known users
+// linked to their profiles, without ever parsing the text as HTML.
+function linkMentions(text, names) {
+    const fragment = document.createDocumentFragment();
+    const pattern = /(^|[^\w@])@(\w(?:[\w.-]*\w)?)/g;
+    let last = 0;
+    let match;
+    while ((match = pattern.exec(text)) !== null) {
+        const name = match[2];
+        if (!names.includes(name)) {
+            continue;
+        }
+        const start = match.index + match[1].length;
+        fragment.append(text.slice(last, start));
+        const link = document.createElement('a');
+        link.className = 'mention';
+        link.href = '/u/' + encodeURIComponent(name);
+        link.textContent = '@' + name;
+        fragment.appendChild(link);
+        last = start + 1 + name.length;
+    }
+    fragment.append(text.slice(last));
+    return fragment;
+}
+
+// attachmentList builds the list of files attached to a message: images as
+// thumbnails linking to the full image, other files as links.
+function attachmentList(attachments) {
+    const list = document.createElement('ul');
+    list.className = 'attachments';
+    attachments.forEach(attachment => {
+        const item = document.createElement('li');
+        const link = document.createElement('a');
+        link.href = attachment.url;
+        if (attachment.content_type.startsWith('image/')) {
+            const img = document.createElement('img');
+            img.src = attachment.thumbnail_url || attachment.url;
+            img.alt = attachment.filename;
+            link.appendChild(img);
+        } else {
+            link.textContent = attachment.filename;
+        }
+        item.appendChild(link);
+        list.appendChild(item);
+    });
+    return list;
+}
+
+// uploadAttachments uploads files one by one and resolves to their ids.
+function uploadAttachments(files) {
+    return Array.from(files).reduce((ids, file) => ids.then(list => {
+        const form = new FormData();
+        form.append('file', file);
+        return fetch('/api/v1/attachments', {
+            method: 'POST',
+            headers: { 'X-Requested-With': 'fetch' },
+            body: form
+        })
+        .then(response => response.json())
+        .then(body => {
+            if (body.error) {
+                throw new Error(file.name + ': ' + body.error.message);
+            }
+            return list.concat(body.data.id);
+        });
+    }), Promise.resolve([]));
+}
 
 //chat starts
 document.addEventListener('DOMContentLoaded', function() {
     const messageForm = document.getElementById('message-form');
     const recipientInput = document.getElementById('recipient');
     const contentInput = document.getElementById('message-content');
+    const filesInput = document.getElementById('message-files');
+    if (!messageForm) {
+        return; // not on the messages page
+    }
 
     let currentUsername = ''; // Initialize as empty
 
@@ -62,21 +221,31 @@ document.addEventListener('DOMContentLoaded', function() {
         const recipient = recipientInput.value;
         const content = contentInput.value;
 
-        fetch('/api/messages', {
+        // Files are uploaded first and sent with the message by id
+        uploadAttachments(filesInput ? filesInput.files : [])
+        .then(attachmentIDs => fetch('/api/messages', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
             },
             body: JSON.stringify({
-                username: currentUsername,
                 recipient: recipient,
-                content: content
+                content: content,
+                attachment_ids: attachmentIDs
             })
+        }))
+        .then(response => {
+            if (!response.ok) {
+                return response.text().then(text => { throw new Error(text); });
+            }
+            return response.json();
         })
-        .then(response => response.json())
         .then(data => {
             console.log('Message sent!');
             contentInput.value = ''; // Clear the message input
+            if (filesInput) {
+                filesInput.value = '';
+            }
             loadMessages(); // Refresh the message list
         })
         .catch(error => console.error('Error:', error));
@@ -91,7 +260,16 @@ document.addEventListener('DOMContentLoaded', function() {
             messages.forEach(message => {
                 const messageDiv = document.createElement('div');
                 messageDiv.className = 'message';
-                messageDiv.innerHTML = `<strong>From:</strong> ${message.username} <br> ${message.content}`;
+                const from = document.createElement('strong');
+                from.textContent = 'From:';
+                messageDiv.append(from, ' ' + message.username, document.createElement('br'));
+                messageDiv.appendChild(linkMentions(message.content, message.mentions || []));
+                if (message.attachments) {
+                    messageDiv.appendChild(attachmentList(message.attachments));
+                }
+                if (message.reactions) {
+                    messageDiv.appendChild(reactionBar('message', message.id, message.reactions));
+                }
                 messageList.appendChild(messageDiv);
             });
         })
@@ -103,4 +281,204 @@ document.addEventListener('DOMContentLoaded', function() {
         sendMessage();
     });
 });
-//chat ends
\ No newline at end of file
+//chat ends
+
+// Notification bell: the unread count is pushed over server-sent events while the page is open
+document.addEventListener('DOMContentLoaded', function() {
+    const counts = document.querySelectorAll('.bell-count');
+    if (counts.length === 0 || !window.EventSource) {
+        return; // no bell on this page
+    }
+
+    const stream = new EventSource('/notifications/stream');
+    stream.addEventListener('notification', function(event) {
+        const data = JSON.parse(event.data);
+        counts.forEach(function(count) {
+            count.textContent = data.unread > 0 ? data.unread : '';
+            count.closest('.bell').classList.toggle('has-unread', data.unread > 0);
+        });
+        if (data.summary) {
+            document.querySelectorAll('.bell').forEach(function(bell) {
+                bell.title = data.summary;
+            });
+        }
+    });
+    stream.onerror = function() {
+        if (stream.readyState === EventSource.CLOSED) {
+            console.error('Notification stream closed');
+        }
+    };
+});
+
+// Mention autocomplete: typing @ and a few letters in a textarea marked with
+// data-mentions lists matching users; picking one completes the name.
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('textarea[data-mentions]').forEach(function(textarea) {
+        const list = document.createElement('ul');
+        list.className = 'mention-suggestions';
+        list.hidden = true;
+        textarea.insertAdjacentElement('afterend', list);
+        let request = 0;
+
+        // mentionAtCursor returns the start of the @name being typed and the name so far
+        function mentionAtCursor() {
+            const before = textarea.value.slice(0, textarea.selectionStart);
+            const match = /(?:^|[^\w@])@([\w.-]*)$/.exec(before);
+            return match ? { start: before.length - match[1].length - 1, prefix: match[1] } : null;
+        }
+
+        function complete(username) {
+            const mention = mentionAtCursor();
+            if (!mention) {
+                return;
+            }
+            const value = textarea.value;
+            const cursor = textarea.selectionStart;
+            const inserted = '@' + username + ' ';
+            textarea.value = value.slice(0, mention.start) + inserted + value.slice(cursor);
+            textarea.selectionStart = textarea.selectionEnd = mention.start + inserted.length;
+            list.hidden = true;
+            textarea.focus();
+        }
+
+        textarea.addEventListener('input', function() {
+            const mention = mentionAtCursor();
+            if (!mention || mention.prefix === '') {
+                list.hidden = true;
+                return;
+            }
+            const current = ++request;
+            fetch('/api/v1/users?limit=8&q=' + encodeURIComponent(mention.prefix))
+            .then(response => response.ok ? response.json() : { data: [] })
+            .then(body => {
+                if (current !== request) {
+                    return; // a newer request is on its way
+                }
+                list.replaceChildren();
+                body.data.forEach(user => {
+                    const item = document.createElement('li');
+                    const button = document.createElement('button');
+                    button.type = 'button';
+                    button.textContent = '@' + user.username + (user.display_name ? ' (' + user.display_name + ')' : '');
+                    button.addEventListener('mousedown', function(event) {
+                        event.preventDefault(); // keep the focus in the textarea
+                        complete(user.username);
+                    });
+                    item.appendChild(button);
+                    list.appendChild(item);
+                });
+                list.hidden = body.data.length === 0;
+            })
+            .catch(error => console.error('Error loading users:', error));
+        });
+        textarea.addEventListener('blur', function() {
+            list.hidden = true;
+        });
+    });
+});
+
+// Tag autocomplete: inputs marked with data-tags list tags starting with the
+// tag being typed, after the last comma, or with the whole value for inputs
+// also marked data-single. Picking one completes it.
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('input[data-tags]').forEach(function(input) {
+        const list = document.createElement('ul');
+        list.className = 'mention-suggestions';
+        list.hidden = true;
+        input.insertAdjacentElement('afterend', list);
+        const single = input.hasAttribute('data-single');
+        let request = 0;
+
+        // typedTag returns the start of the tag being typed and the tag so far
+        function typedTag() {
+            const start = single ? 0 : input.value.lastIndexOf(',') + 1;
+            return { start: start, prefix: input.value.slice(start).trim() };
+        }
+
+        function complete(name) {
+            const start = typedTag().start;
+            input.value = input.value.slice(0, start) + (start > 0 ? ' ' : '') + name + (single ? '' : ', ');
+            list.hidden = true;
+            input.focus();
+        }
+
+        input.addEventListener('input', function() {
+            const tag = typedTag();
+            if (tag.prefix === '') {
+                list.hidden = true;
+                return;
+            }
+            const current = ++request;
+            fetch('/api/v1/tags?limit=8&q=' + encodeURIComponent(tag.prefix))
+            .then(response => response.ok ? response.json() : { data: [] })
+            .then(body => {
+                if (current !== request) {
+                    return; // a newer request is on its way
+                }
+                list.replaceChildren();
+                body.data.forEach(suggestion => {
+                    const item = document.createElement('li');
+                    const button = document.createElement('button');
+                    button.type = 'button';
+                    button.textContent = suggestion.name + ' (' + suggestion.thread_count + ')';
+                    button.addEventListener('mousedown', function(event) {
+                        event.preventDefault(); // keep the focus in the input
+                        complete(suggestion.name);
+                    });
+                    item.appendChild(button);
+                    list.appendChild(item);
+                });
+                list.hidden = body.data.length === 0;
+            })
+            .catch(error => console.error('Error loading tags:', error));
+        });
+        input.addEventListener('blur', function() {
+            list.hidden = true;
+        });
+    });
+});
+
+// Markdown preview: textareas marked with data-preview get a Preview button
+// that shows the text rendered by the server, already sanitized, below them.
+document.addEventListener('DOMContentLoaded', function() {
+    document.querySelectorAll('textarea[data-preview]').forEach(function(textarea) {
+        const button = document.createElement('button');
+        button.type = 'button';
+        button.className = 'preview-button';
+        button.textContent = 'Preview';
+        const preview = document.createElement('div');
+        preview.className = 'markdown preview';
+        preview.hidden = true;
+        textarea.insertAdjacentElement('afterend', preview);
+        textarea.insertAdjacentElement('afterend', button);
+
+        button.addEventListener('click', function() {
+            if (!preview.hidden) {
+                preview.hidden = true;
+                button.textContent = 'Preview';
+                return;
+            }
+            fetch('/api/v1/markdown/preview', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json', 'X-Requested-With': 'fetch' },
+                body: JSON.stringify({ markdown: textarea.value })
+            })
+            .then(response => response.json())
+            .then(body => {
+                if (body.error) {
+                    preview.textContent = body.error.message;
+                } else {
+                    preview.innerHTML = body.data.html;
+                }
+                preview.hidden = false;
+                button.textContent = 'Hide preview';
+            })
+            .catch(error => console.error('Error rendering preview:', error));
+        });
+        // The preview is out of date as soon as the text changes
+        textarea.addEventListener('input', function() {
+            preview.hidden = true;
+            button.textContent = 'Preview';
+        });
+    });
+});
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Attachments are stored as blobs named by the SHA-256 of their content, so
+// an identical file uploaded twice is stored once. Where blobs go is set with
+// ATTACHMENT_STORE:
+//   - disk (the default) keeps them under ATTACHMENT_DIR (default
+//     uploads/attachments), in two levels of directories named after the
+//     start of the key.
+//   - s3 keeps them in the S3_BUCKET bucket of any S3 compatible service at
+//     S3_ENDPOINT, e.g. http://localhost:9000 for a local MinIO, signing
+//     requests with S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY for S3_REGION
+//     (default us-east-1). Buckets are addressed by path, which every S3
+//     compatible service supports.
+//
+// "./forum check-storage" stores, reads back and deletes a blob to check the
+// configuration.
+
+// blobStore keeps blobs by key. Put with a key that exists already is allowed
+// and leaves the blob as it is; Open and Delete of a missing key return errNotFound.
+type blobStore interface {
+	Put(key, contentType string, data []byte) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// blobs is the configured store.
+var blobs blobStore
+
+// blobKey returns the key of a blob with the given content.
+func blobKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validBlobKey reports whether key could have come from blobKey, so it is
+// safe in a path.
+func validBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// diskStore keeps blobs in a directory.
+type diskStore struct {
+	dir string
+}
+
+func (s diskStore) path(key string) (string, error) {
+	if !validBlobKey(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key[:2], key[2:4], key), nil
+}
+
+func (s diskStore) Put(key, contentType string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Written to a temporary file first so a blob is never seen half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (s diskStore) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	return f, err
+}
+
+func (s diskStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return errNotFound
+	}
+	return err
+}
+
+// s3Store keeps blobs in a bucket of an S3 compatible service.
+type s3Store struct {
+	endpoint  string // scheme and host, without a trailing slash
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s s3Store) Put(key, contentType string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, contentType, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s s3Store) Open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errNotFound
+	}
+	defer resp.Body.Close()
+	return nil, s3Error(resp)
+}
+
+// Delete asks for the object first, as S3 answers a delete with 204 whether
+// or not the object existed.
+func (s s3Store) Delete(key string) error {
+	head, err := s.do(http.MethodHead, key, "", nil)
+	if err != nil {
+		return err
+	}
+	head.Body.Close()
+	switch head.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errNotFound
+	default:
+		return fmt.Errorf("s3: %s", head.Status) // a HEAD response has no body to explain it
+	}
+
+	resp, err := s.do(http.MethodDelete, key, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return errNotFound
+	}
+	return s3Error(resp)
+}
+
+// do sends a request for an object, signed with AWS Signature Version 4.
+func (s s3Store) do(method, key, contentType string, body []byte) (*http.Response, error) {
+	if !validBlobKey(key) {
+		return nil, fmt.Errorf("invalid blob key %q", key)
+	}
+	req, err := http.NewRequest(method, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the headers of AWS Signature Version 4 to req. Only the host and
+// the x-amz headers are signed.
+func (s s3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + hex.EncodeToString(payloadHash[:]) + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error turns an unexpected response into an error with the start of its body,
+// which holds the code and message of S3 errors.
+func s3Error(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// newBlobStore returns the store configured in the environment. An invalid
+// configuration is logged and falls back to the disk.
+func newBlobStore() blobStore {
+	dir := os.Getenv("ATTACHMENT_DIR")
+	if dir == "" {
+		dir = filepath.Join("uploads", "attachments")
+	}
+	switch kind := os.Getenv("ATTACHMENT_STORE"); kind {
+	case "", "disk":
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		store := s3Store{
+			endpoint:  strings.TrimRight(os.Getenv("S3_ENDPOINT"), "/"),
+			bucket:    os.Getenv("S3_BUCKET"),
+			region:    region,
+			accessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+		if store.endpoint != "" && store.bucket != "" {
+			return store
+		}
+		log.Printf("ATTACHMENT_STORE=s3 needs S3_ENDPOINT and S3_BUCKET, storing attachments in %s", dir)
+	default:
+		log.Printf("Ignoring unknown ATTACHMENT_STORE=%q, storing attachments in %s", kind, dir)
+	}
+	return diskStore{dir: dir}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBucket is an S3 compatible service holding one bucket in memory. It
+// checks that requests carry a Signature Version 4 authorization and a
+// payload hash matching the body.
+type fakeBucket struct {
+	t         *testing.T
+	bucket    string
+	accessKey string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	types   map[string]string
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential="+b.accessKey+"/") {
+		b.t.Errorf("%s %s: authorization %q", r.Method, r.URL.Path, r.Header.Get("Authorization"))
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(sum[:]) {
+		b.t.Errorf("%s %s: payload hash %q does not match the body", r.Method, r.URL.Path, got)
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+b.bucket+"/")
+	if !ok {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		b.objects[key] = body
+		b.types[key] = r.Header.Get("Content-Type")
+	case http.MethodGet, http.MethodHead:
+		data, ok := b.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		// S3 answers 204 whether or not the object existed
+		delete(b.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// readBlob reads the whole blob of key from store.
+func readBlob(t *testing.T, store blobStore, key string) []byte {
+	t.Helper()
+	rc, err := store.Open(key)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", key, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestS3Store(t *testing.T) {
+	bucket := &fakeBucket{t: t, bucket: "forum", accessKey: "key-id", objects: map[string][]byte{}, types: map[string]string{}}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	store := s3Store{endpoint: server.URL, bucket: "forum", region: "us-east-1", accessKey: "key-id", secretKey: "secret", client: server.Client()}
+
+	data := []byte("the content of a blob")
+	key := blobKey(data)
+	if err := store.Put(key, "text/plain", data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := bucket.types[key]; got != "text/plain" {
+		t.Errorf("stored content type %q, want text/plain", got)
+	}
+	if got := readBlob(t, store, key); !bytes.Equal(got, data) {
+		t.Errorf("Open read %q, want %q", got, data)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Open(key); err != errNotFound {
+		t.Errorf("Open after Delete: %v, want errNotFound", err)
+	}
+	if len(bucket.objects) != 0 {
+		t.Errorf("%d objects left in the bucket", len(bucket.objects))
+	}
+	if err := store.Delete(key); err != errNotFound {
+		t.Errorf("second Delete: %v, want errNotFound", err)
+	}
+
+	if err := store.Put("../other-bucket/x", "text/plain", data); err == nil {
+		t.Error("Put accepted a key that is not a content hash")
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	store := diskStore{dir: dir}
+
+	data := []byte("the content of a blob")
+	key := blobKey(data)
+	for i := 0; i < 2; i++ {
+		if err := store.Put(key, "text/plain", data); err != nil {
+			t.Fatalf("Put %d: %v", i+1, err)
+		}
+	}
+	path := filepath.Join(dir, key[:2], key[2:4], key)
+	if stored, err := os.ReadFile(path); err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("blob at %s: %q, %v", path, stored, err)
+	}
+	temporary, _ := filepath.Glob(filepath.Join(dir, key[:2], key[2:4], "*.tmp"))
+	if len(temporary) != 0 {
+		t.Errorf("temporary files left behind: %v", temporary)
+	}
+	if got := readBlob(t, store, key); !bytes.Equal(got, data) {
+		t.Errorf("Open read %q, want %q", got, data)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Open(key); err != errNotFound {
+		t.Errorf("Open after Delete: %v, want errNotFound", err)
+	}
+	if err := store.Delete(key); err != errNotFound {
+		t.Errorf("second Delete: %v, want errNotFound", err)
+	}
+	if _, err := store.Open("../../etc/passwd"); err == nil || err == errNotFound {
+		t.Errorf("Open of a path: %v, want an invalid key error", err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Tags are free-form labels users put on threads next to the categories,
+// which admins manage. Tagging a thread with a name nobody has used yet
+// creates the tag, which needs the create_tag privilege. Moderators can make
+// a tag a synonym of another, so its name keeps working but stands for the
+// other tag, or merge it into another, which removes the name. Both move the
+// threads and followers of the tag to the other one.
+
+// Limits of tags.
+const (
+	maxThreadTags     = 5
+	maxTagLength      = 30 // in characters
+	maxTagSuggestions = 20
+	tagPageSize       = 30 // threads per page of /tag/{name}
+)
+
+// tagNamePattern matches normalized tag names such as go, c++ or node.js.
+var tagNamePattern = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N}.+#-]*$`)
+
+// tagFilterClause matches threads tagged with the tag of a name, given once,
+// or with the tag it is a synonym of.
+const tagFilterClause = `EXISTS (SELECT 1 FROM thread_tags tt WHERE tt.thread_id = t.id
+    AND tt.tag_id = (SELECT COALESCE(synonym_of, id) FROM tags WHERE name = ?))`
+
+// Tag is a tag in use, with how many threads have it and how many users follow it.
+type Tag struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	ThreadCount int      `json:"thread_count"`
+	Followers   int      `json:"followers"`
+	Synonyms    []string `json:"synonyms,omitempty"` // set by getTag
+	Followed    bool     `json:"followed,omitempty"` // by the caller, set by getTag
+}
+
+const tagSelect = `
+    SELECT g.id, g.name,
+        (SELECT COUNT(*) FROM thread_tags tt WHERE tt.tag_id = g.id),
+        (SELECT COUNT(*) FROM tag_follows f WHERE f.tag_id = g.id)
+    FROM tags g`
+
+func scanTag(row scanner) (Tag, error) {
+	var t Tag
+	err := row.Scan(&t.ID, &t.Name, &t.ThreadCount, &t.Followers)
+	return t, err
+}
+
+// normalizeTag returns name the way tags are stored: lowercase, without a
+// leading #, and with dashes for spaces.
+func normalizeTag(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// splitTags reads the comma separated tags of a form field.
+func splitTags(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// normalizeTagNames normalizes and checks the tags given for a thread,
+// dropping empty and repeated ones.
+func normalizeTagNames(names []string) ([]string, error) {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, name := range names {
+		tag := normalizeTag(name)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fieldError(fmt.Sprintf("Tags must be at most %d characters", maxTagLength))
+		}
+		if !tagNamePattern.MatchString(tag) {
+			return nil, fieldError(fmt.Sprintf("%q is not a valid tag: use letters, digits and . + # -", tag))
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxThreadTags {
+		return nil, fieldError(fmt.Sprintf("A thread can have at most %d tags", maxThreadTags))
+	}
+	return tags, nil
+}
+
+// resolveTagIDs returns the ids of the tags with the given normalized names,
+// following synonyms. Names nobody has used yet are created if userID has
+// the create_tag privilege.
+func resolveTagIDs(tx *sql.Tx, userID int, names []string) ([]int, error) {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, name := range names {
+		var id int
+		err := tx.QueryRow("SELECT COALESCE(synonym_of, id) FROM tags WHERE name = ?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			allowed, err := hasPrivilege(tx, userID, privilegeCreateTag)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				return nil, fieldError(fmt.Sprintf("There is no tag %q yet, and you need %d reputation to create tags", name, privilegeThreshold(privilegeCreateTag)))
+			}
+			result, err := tx.Exec("INSERT INTO tags (name, created_at) VALUES (?, ?)", name, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			newID, err := result.LastInsertId()
+			if err != nil {
+				return nil, err
+			}
+			id = int(newID)
+		} else if err != nil {
+			return nil, err
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// setThreadTags replaces the tags of a thread, tagged by userID.
+func setThreadTags(tx *sql.Tx, userID, threadID int, names []string) error {
+	names, err := normalizeTagNames(names)
+	if err != nil {
+		return err
+	}
+	ids, err := resolveTagIDs(tx, userID, names)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM thread_tags WHERE thread_id = ?", threadID); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("INSERT INTO thread_tags (thread_id, tag_id) VALUES (?, ?)", threadID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadThreadTags sets the tag names of each thread, in alphabetical order.
+func loadThreadTags(threads []Thread) error {
+	if len(threads) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(threads))
+	args := make([]interface{}, len(threads))
+	index := map[int][]int{}
+	for i, t := range threads {
+		placeholders[i] = "?"
+		args[i] = t.ID
+		index[t.ID] = append(index[t.ID], i)
+	}
+	rows, err := db.Query(`
+        SELECT tt.thread_id, g.name FROM thread_tags tt JOIN tags g ON g.id = tt.tag_id
+        WHERE tt.thread_id IN (`+strings.Join(placeholders, ", ")+`)
+        ORDER BY g.name`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var threadID int
+		var name string
+		if err := rows.Scan(&threadID, &name); err != nil {
+			return err
+		}
+		for _, i := range index[threadID] {
+			threads[i].Tags = append(threads[i].Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+// findTag returns the tag with a name, or the tag the name is a synonym of.
+func findTag(name string) (Tag, error) {
+	t, err := scanTag(db.QueryRow(tagSelect+" WHERE g.id = (SELECT COALESCE(synonym_of, id) FROM tags WHERE name = ?)", normalizeTag(name)))
+	if err == sql.ErrNoRows {
+		return t, errNotFound
+	}
+	return t, err
+}
+
+// getTag is findTag with the synonyms of the tag and whether viewerID follows it.
+func getTag(name string, viewerID int) (Tag, error) {
+	t, err := findTag(name)
+	if err != nil {
+		return t, err
+	}
+	rows, err := db.Query("SELECT name FROM tags WHERE synonym_of = ? ORDER BY name", t.ID)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var synonym string
+		if err := rows.Scan(&synonym); err != nil {
+			return t, err
+		}
+		t.Synonyms = append(t.Synonyms, synonym)
+	}
+	if err := rows.Err(); err != nil {
+		return t, err
+	}
+	t.Followed, err = hasRelation(tagFollows, viewerID, t.ID)
+	return t, err
+}
+
+// suggestTags returns the tags whose name, or the name of one of their
+// synonyms, starts with prefix, most used first. An empty prefix lists the
+// most used tags.
+func suggestTags(prefix string, limit int) ([]Tag, error) {
+	pattern := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(normalizeTag(prefix)) + "%"
+	rows, err := db.Query(`
+        SELECT * FROM (`+tagSelect+`
+            WHERE g.synonym_of IS NULL
+                AND g.id IN (SELECT COALESCE(synonym_of, id) FROM tags WHERE name LIKE ? ESCAPE '\'))
+        ORDER BY 3 DESC, 2
+        LIMIT ?`, pattern, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		t, err := scanTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// mergeTag moves the threads, followers and synonyms of the tag from into the
+// tag into, which is created for moderatorID if needed. With synonym set the
+// name of from is kept as a synonym of into, otherwise it is removed.
+func mergeTag(moderatorID int, from, into string, synonym bool) error {
+	source, err := findTag(from)
+	if err != nil {
+		return err
+	}
+	into = normalizeTag(into)
+	if into == "" {
+		return fieldError("The tag to merge into is required")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names, err := normalizeTagNames([]string{into})
+	if err != nil {
+		return err
+	}
+	ids, err := resolveTagIDs(tx, moderatorID, names)
+	if err != nil {
+		return err
+	}
+	target := ids[0]
+	if target == source.ID {
+		return fieldError("A tag cannot be merged into itself")
+	}
+
+	statements := []string{
+		"INSERT OR IGNORE INTO thread_tags (thread_id, tag_id) SELECT thread_id, ?2 FROM thread_tags WHERE tag_id = ?1",
+		"DELETE FROM thread_tags WHERE tag_id = ?1",
+		"INSERT OR IGNORE INTO tag_follows (user_id, tag_id, created_at) SELECT user_id, ?2, created_at FROM tag_follows WHERE tag_id = ?1",
+		"DELETE FROM tag_follows WHERE tag_id = ?1",
+		"UPDATE tags SET synonym_of = ?2 WHERE synonym_of = ?1",
+	}
+	if synonym {
+		statements = append(statements, "UPDATE tags SET synonym_of = ?2 WHERE id = ?1")
+	} else {
+		statements = append(statements, "DELETE FROM tags WHERE id = ?1")
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, source.ID, target); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteTag removes a tag name. A tag in use is taken off its threads and
+// removed with its synonyms; a synonym is removed alone.
+func deleteTag(name string) error {
+	var id int
+	var synonymOf sql.NullInt64
+	err := db.QueryRow("SELECT id, synonym_of FROM tags WHERE name = ?", normalizeTag(name)).Scan(&id, &synonymOf)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if synonymOf.Valid {
+		_, err := db.Exec("DELETE FROM tags WHERE id = ?", id)
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		"DELETE FROM thread_tags WHERE tag_id = ?",
+		"DELETE FROM tag_follows WHERE tag_id = ?",
+		"DELETE FROM tags WHERE synonym_of = ?",
+		"DELETE FROM tags WHERE id = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// listFollowedTags returns the tags a user follows, by name.
+func listFollowedTags(userID int) ([]Tag, error) {
+	rows, err := db.Query(tagSelect+" WHERE g.id IN (SELECT tag_id FROM tag_follows WHERE user_id = ?) ORDER BY g.name", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		t, err := scanTag(rows)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// /tag/{name}: the threads of a tag, newest first. Moderators can make the
+// tag a synonym of another, merge it or delete it from here.
+func serveTag(w http.ResponseWriter, r *http.Request) {
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	name := r.PathValue("name")
+
+	if r.Method == http.MethodPost {
+		if !isModerator(role) {
+			http.Error(w, "Only moderators can change tags", http.StatusForbidden)
+			return
+		}
+		back, err := updateTag(r, userID, name)
+		if _, ok := err.(fieldError); ok {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err {
+		case nil:
+		case errNotFound:
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		default:
+			log.Printf("Failed to change tag: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	tag, err := getTag(name, userID)
+	if err == errNotFound {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch tag: %v", err)
+		http.Error(w, "Failed to fetch tag", http.StatusInternalServerError)
+		return
+	}
+	// Synonyms and names typed differently lead to the page of the tag
+	if tag.Name != name {
+		http.Redirect(w, r, "/tag/"+url.PathEscape(tag.Name), http.StatusMovedPermanently)
+		return
+	}
+
+	after := 0
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if after, err = decodeCursor(v); err != nil {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+	}
+	threads, next, err := queryThreads(apiThreadSelect+`
+        WHERE t.id IN (SELECT thread_id FROM thread_tags WHERE tag_id = ?) AND (? = 0 OR t.id < ?)
+        ORDER BY t.id DESC LIMIT ?`, tagPageSize, tag.ID, after, after)
+	if err == nil {
+		err = loadThreadTags(threads)
+	}
+	if err == nil {
+		err = attachUnread(userID, threads)
+	}
+	if err != nil {
+		log.Printf("Failed to fetch threads: %v", err)
+		http.Error(w, "Failed to fetch threads", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.ParseFiles("templates/tag.html"))
+	tmpl.Execute(w, map[string]interface{}{
+		"Tag":         tag,
+		"Threads":     threads,
+		"NextCursor":  next,
+		"IsGuest":     userID == 0,
+		"IsModerator": isModerator(role),
+		"Back":        r.URL.RequestURI(),
+	})
+}
+
+// updateTag applies a moderator form for the tag name: action is synonym,
+// merge or delete, into names the other tag. It returns where to go next.
+func updateTag(r *http.Request, moderatorID int, name string) (string, error) {
+	into := r.FormValue("into")
+	switch r.FormValue("action") {
+	case "synonym", "merge":
+		if err := mergeTag(moderatorID, name, into, r.FormValue("action") == "synonym"); err != nil {
+			return "", err
+		}
+		return "/tag/" + url.PathEscape(normalizeTag(into)), nil
+	case "delete":
+		if err := deleteTag(name); err != nil {
+			return "", err
+		}
+		// Deleting a synonym stays on the page of its tag
+		if tag, err := findTag(r.FormValue("tag")); err == nil {
+			return "/tag/" + url.PathEscape(tag.Name), nil
+		}
+		return "/index", nil
+	}
+	return "", fieldError("Unknown action")
+}
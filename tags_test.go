@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tagsOf returns the tag names of a thread in alphabetical order.
+func tagsOf(t *testing.T, threadID int) []string {
+	t.Helper()
+	threads := []Thread{{ID: threadID}}
+	if err := loadThreadTags(threads); err != nil {
+		t.Fatal(err)
+	}
+	return threads[0].Tags
+}
+
+func TestNormalizeTagNames(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []string
+		err   bool
+	}{
+		{[]string{"Go", " #go ", "Node.js", "c++", "Machine  Learning", ""}, []string{"go", "node.js", "c++", "machine-learning"}, false},
+		{splitTags(" "), []string{}, false},
+		{splitTags("a,b,c,d,e"), []string{"a", "b", "c", "d", "e"}, false},
+		{splitTags("a,b,c,d,e,f"), nil, true},
+		{splitTags("a,b,c,d,e,a,A"), []string{"a", "b", "c", "d", "e"}, false},
+		{[]string{"-go"}, nil, true},
+		{[]string{"go!"}, nil, true},
+		{[]string{strings.Repeat("é", maxTagLength)}, []string{strings.Repeat("é", maxTagLength)}, false},
+		{[]string{strings.Repeat("é", maxTagLength+1)}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTagNames(tt.names)
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("normalizeTagNames(%q): %v, want error %v", tt.names, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeTagNames(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestCreatingTagsNeedsThePrivilege(t *testing.T) {
+	newTestDB(t)
+	newcomer := createTestUser(t, "alice")
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+
+	tests := []struct {
+		name   string
+		userID int
+		tags   []string
+		err    bool
+	}{
+		{"new tag without reputation", newcomer, []string{"go"}, true},
+		{"new tag by a moderator", moderator, []string{"Go"}, false},
+		{"existing tag without reputation", newcomer, []string{"GO"}, false},
+		{"existing and new tags without reputation", newcomer, []string{"go", "rust"}, true},
+	}
+	for _, tt := range tests {
+		id, err := createThread(tt.userID, ThreadInput{Title: tt.name, Description: "Its description", Tags: tt.tags})
+		if _, invalid := err.(fieldError); invalid != tt.err || (err != nil && !tt.err) {
+			t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(tagsOf(t, int(id)), []string{"go"}) {
+			t.Errorf("%s: tags %v, want [go]", tt.name, tagsOf(t, int(id)))
+		}
+	}
+	if _, err := findTag("rust"); err != errNotFound {
+		t.Errorf("tag of a refused thread: %v, want errNotFound", err)
+	}
+}
+
+func TestMergeTag(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	follower := createTestUser(t, "alice")
+	newThread := func(tags ...string) int {
+		t.Helper()
+		id, err := createThread(moderator, ThreadInput{Title: "Tagged " + strings.Join(tags, " "), Description: "Its description", Tags: tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(id)
+	}
+	golang := newThread("golang")
+	both := newThread("golang", "go")
+	js := newThread("js")
+	for _, name := range []string{"golang", "go"} {
+		tag, _ := findTag(name)
+		if err := setRelation(tagFollows, follower, tag.ID, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		from    string
+		into    string
+		synonym bool
+		err     error  // a fieldError stands for any of them
+		tag     string // what from is found as afterwards, if anything
+		threads map[int][]string
+	}{
+		{"synonym", "golang", "go", true, nil, "go", map[int][]string{golang: {"go"}, both: {"go"}}},
+		{"synonym into its own tag", "golang", "go", true, fieldError(""), "go", nil},
+		{"into nothing", "go", " ", false, fieldError(""), "go", nil},
+		{"missing tag", "python", "go", false, errNotFound, "", nil},
+		{"merge into a new tag", "js", "JavaScript", false, nil, "", map[int][]string{js: {"javascript"}}},
+	}
+	for _, tt := range tests {
+		err := mergeTag(moderator, tt.from, tt.into, tt.synonym)
+		if _, invalid := tt.err.(fieldError); invalid {
+			if _, ok := err.(fieldError); !ok {
+				t.Errorf("%s: %v, want a field error", tt.name, err)
+			}
+		} else if err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.tag != "" {
+			if tag, err := findTag(tt.from); err != nil || tag.Name != tt.tag {
+				t.Errorf("%s: %s is found as %q, %v, want %q", tt.name, tt.from, tag.Name, err, tt.tag)
+			}
+		}
+		for threadID, want := range tt.threads {
+			if got := tagsOf(t, threadID); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: thread %d tagged %v, want %v", tt.name, threadID, got, want)
+			}
+		}
+	}
+
+	// The synonym still tags threads with go, and its followers follow go
+	if got := tagsOf(t, newThread("Golang")); !reflect.DeepEqual(got, []string{"go"}) {
+		t.Errorf("thread tagged with a synonym has %v, want [go]", got)
+	}
+	tag, err := getTag("golang", follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "go" || tag.ThreadCount != 3 || tag.Followers != 1 || !tag.Followed || !reflect.DeepEqual(tag.Synonyms, []string{"golang"}) {
+		t.Errorf("go after the merges: %+v", tag)
+	}
+	if _, err := findTag("js"); err != errNotFound {
+		t.Errorf("merged tag: %v, want errNotFound", err)
+	}
+
+	// A tag made a synonym takes its own synonyms along
+	if err := mergeTag(moderator, "go", "programming", true); err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := getTag("programming", 0); err != nil || !reflect.DeepEqual(tag.Synonyms, []string{"go", "golang"}) {
+		t.Errorf("programming: %+v, %v, want synonyms go and golang", tag, err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	threadID, err := createThread(moderator, ThreadInput{Title: "Tagged", Description: "Its description", Tags: []string{"go", "rust"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, synonym := range []string{"golang", "go-lang"} {
+		if _, err := createThread(moderator, ThreadInput{Title: synonym, Description: "Its description", Tags: []string{synonym}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mergeTag(moderator, synonym, "go", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		tag   string
+		err   error
+		found map[string]bool
+	}{
+		{"synonym", "go-lang", nil, map[string]bool{"go": true, "golang": true, "go-lang": false}},
+		{"tag with a synonym", "go", nil, map[string]bool{"go": false, "golang": false, "rust": true}},
+		{"missing", "go", errNotFound, map[string]bool{"rust": true}},
+	}
+	for _, tt := range tests {
+		if err := deleteTag(tt.tag); err != tt.err {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.err)
+		}
+		for name, want := range tt.found {
+			if _, err := findTag(name); (err == nil) != want {
+				t.Errorf("%s: finding %s: %v, want found %v", tt.name, name, err, want)
+			}
+		}
+	}
+	if got := tagsOf(t, int(threadID)); !reflect.DeepEqual(got, []string{"rust"}) {
+		t.Errorf("thread tags %v, want [rust]", got)
+	}
+}
+
+func TestSuggestTags(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	for _, tags := range [][]string{{"go", "gopher"}, {"go", "golang-nuts"}, {"go"}, {"gopher"}} {
+		if _, err := createThread(moderator, ThreadInput{Title: "Tagged", Description: "Its description", Tags: tags}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mergeTag(moderator, "golang-nuts", "go", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		limit  int
+		want   []string
+	}{
+		{"go", 10, []string{"go", "gopher"}}, // most used first, synonyms left out
+		{"GO", 1, []string{"go"}},
+		{"golang", 10, []string{"go"}}, // found through its synonym
+		{"g_", 10, []string{}},         // _ is not a wildcard
+		{"", 10, []string{"go", "gopher"}},
+		{"rust", 10, []string{}},
+	}
+	for _, tt := range tests {
+		tags, err := suggestTags(tt.prefix, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, tag := range tags {
+			got = append(got, tag.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("suggestTags(%q, %d) = %v, want %v", tt.prefix, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestFilterThreadsByTagsAndCategory(t *testing.T) {
+	newTestDB(t)
+	mux, _ := newAPIMux()
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	news := createTestCategory(t, "News")
+	titles := map[int]string{}
+	for _, thread := range []struct {
+		title    string
+		category bool
+		tags     []string
+	}{
+		{"go news", true, []string{"go"}},
+		{"go and rust news", true, []string{"go", "rust"}},
+		{"go elsewhere", false, []string{"golang"}},
+		{"untagged news", true, nil},
+	} {
+		in := ThreadInput{Title: thread.title, Description: "Its description", Tags: thread.tags}
+		if thread.category {
+			in.CategoryIDs = []string{news}
+		}
+		id, err := createThread(moderator, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		titles[int(id)] = thread.title
+	}
+	if err := mergeTag(moderator, "golang", "go", true); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"tag=go", []string{"go elsewhere", "go and rust news", "go news"}},
+		{"tag=golang", []string{"go elsewhere", "go and rust news", "go news"}},
+		{"tag=go&tag=rust", []string{"go and rust news"}},
+		{"tag=go&category=News", []string{"go and rust news", "go news"}},
+		{"tag=python", []string{}},
+	}
+	for _, tt := range tests {
+		status, body := apiGet(t, mux, "/api/v1/threads?"+tt.query)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status %d, error %+v", tt.query, status, body.Error)
+		}
+		var threads []struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(body.Data, &threads); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, thread := range threads {
+			got = append(got, titles[thread.ID])
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestServeTag(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	setTestRole(t, moderator, roleModerator)
+	createTestUser(t, "alice")
+	for _, tag := range []string{"golang", "js"} {
+		if _, err := createThread(moderator, ThreadInput{Title: "Tagged", Description: "Its description", Tags: []string{tag}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modCookie, userCookie := login(t, "mod"), login(t, "alice")
+
+	// postTag posts form to /tag/{name}
+	postTag := func(name string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/tag/"+name, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetPathValue("name", name)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		serveTag(w, r)
+		return w
+	}
+	tests := []struct {
+		name     string
+		form     url.Values
+		cookie   *http.Cookie
+		status   int
+		location string
+	}{
+		{"golang", url.Values{"action": {"synonym"}, "into": {"go"}}, userCookie, http.StatusForbidden, ""},
+		{"golang", url.Values{"action": {"synonym"}, "into": {"Go"}}, modCookie, http.StatusSeeOther, "/tag/go"},
+		{"golang", url.Values{"action": {"rename"}}, modCookie, http.StatusBadRequest, ""},
+		{"python", url.Values{"action": {"merge"}, "into": {"go"}}, modCookie, http.StatusNotFound, ""},
+		{"golang", url.Values{"action": {"delete"}, "tag": {"go"}}, modCookie, http.StatusSeeOther, "/tag/go"},
+		{"js", url.Values{"action": {"delete"}}, modCookie, http.StatusSeeOther, "/index"},
+	}
+	for _, tt := range tests {
+		w := postTag(tt.name, tt.form, tt.cookie)
+		if w.Code != tt.status || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %v: status %d to %q, want %d to %q", tt.name, tt.form, w.Code, w.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+
+	// Names typed differently lead to the page of the tag
+	r := httptest.NewRequest(http.MethodGet, "/tag/GO", nil)
+	r.SetPathValue("name", "GO")
+	w := httptest.NewRecorder()
+	serveTag(w, r)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/tag/go" {
+		t.Errorf("GET /tag/GO: status %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderators pin threads above the others, on every listing or only in one
+// of their categories, lock threads so only moderators can comment, and
+// archive threads to make them read-only: votes are frozen and only
+// moderators can comment on them or change them. "./forum archive-threads"
+// archives threads that have been quiet for a while.
+
+var (
+	errThreadLocked   = errors.New("the thread is locked")
+	errThreadArchived = errors.New("the thread is archived")
+)
+
+// States of a thread, each stored as the time it was set in a column of threads.
+const (
+	threadPinned   = "pinned_at"
+	threadLocked   = "locked_at"
+	threadArchived = "archived_at"
+)
+
+// threadStates maps the names used in forms and the API to their column.
+var threadStates = map[string]string{
+	"pin":     threadPinned,
+	"lock":    threadLocked,
+	"archive": threadArchived,
+}
+
+// stateAction returns the moderation log action for setting (on) or clearing a state.
+func stateAction(state string, on bool) string {
+	for name, column := range threadStates {
+		if column == state && on {
+			return name
+		}
+		if column == state {
+			return "un" + name
+		}
+	}
+	return state
+}
+
+// setThreadState sets (on) or clears a state of a thread for a moderator.
+// Setting the state the thread is already in changes and logs nothing.
+func setThreadState(moderatorID, threadID int, state string, on bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current bool
+	err = tx.QueryRow(fmt.Sprintf("SELECT %s IS NOT NULL FROM threads WHERE id = ?", state), threadID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil || current == on {
+		return err
+	}
+
+	var at interface{}
+	if on {
+		at = time.Now()
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE threads SET %s = ? WHERE id = ?", state), at, threadID); err != nil {
+		return err
+	}
+	if err := logModeration(tx, moderatorID, stateAction(state, on), threadID, nil, ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pinThreadInCategory pins (on) or unpins a thread at the top of one of its
+// categories, changing and logging nothing if it already is.
+func pinThreadInCategory(moderatorID, threadID, categoryID int, on bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current bool
+	err = tx.QueryRow("SELECT pinned_at IS NOT NULL FROM thread_categories WHERE thread_id = ? AND category_id = ?", threadID, categoryID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil || current == on {
+		return err
+	}
+
+	var pinnedAt interface{}
+	if on {
+		pinnedAt = time.Now()
+	}
+	if _, err := tx.Exec("UPDATE thread_categories SET pinned_at = ? WHERE thread_id = ? AND category_id = ?", pinnedAt, threadID, categoryID); err != nil {
+		return err
+	}
+	var name string
+	if err := tx.QueryRow("SELECT name FROM categories WHERE id = ?", categoryID).Scan(&name); err != nil {
+		return err
+	}
+	if err := logModeration(tx, moderatorID, stateAction(threadPinned, on), threadID, nil, "in "+name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// listPinnedCategories returns the names of the categories a thread is pinned in.
+func listPinnedCategories(threadID int) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT c.name FROM categories c JOIN thread_categories tc ON c.id = tc.category_id
+        WHERE tc.thread_id = ? AND tc.pinned_at IS NOT NULL ORDER BY c.name`, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// CategoryPin is one of the categories of a thread and whether the thread is pinned in it.
+type CategoryPin struct {
+	ID     int
+	Name   string
+	Pinned bool
+}
+
+// listCategoryPins returns the categories of a thread with their pin state, for the moderator forms.
+func listCategoryPins(threadID int) ([]CategoryPin, error) {
+	rows, err := db.Query(`
+        SELECT c.id, c.name, tc.pinned_at IS NOT NULL FROM categories c JOIN thread_categories tc ON c.id = tc.category_id
+        WHERE tc.thread_id = ? ORDER BY c.name`, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []CategoryPin
+	for rows.Next() {
+		var pin CategoryPin
+		if err := rows.Scan(&pin.ID, &pin.Name, &pin.Pinned); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+// setThreadStates sets the state times of a thread from their columns.
+func setThreadStates(t *Thread, pinnedAt, lockedAt, archivedAt sql.NullTime) {
+	if pinnedAt.Valid {
+		t.PinnedAt = &pinnedAt.Time
+	}
+	if lockedAt.Valid {
+		t.LockedAt = &lockedAt.Time
+	}
+	if archivedAt.Valid {
+		t.ArchivedAt = &archivedAt.Time
+	}
+}
+
+// checkNotArchived returns errThreadArchived if the thread is archived.
+func checkNotArchived(q queryRower, threadID int) error {
+	var archived bool
+	err := q.QueryRow("SELECT archived_at IS NOT NULL FROM threads WHERE id = ?", threadID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err == nil && archived {
+		return errThreadArchived
+	}
+	return err
+}
+
+// checkCanComment returns errThreadLocked or errThreadArchived if userID may
+// not comment on the thread. Moderators may comment on any thread.
+func checkCanComment(threadID, userID int) error {
+	var locked, archived bool
+	err := db.QueryRow("SELECT locked_at IS NOT NULL, archived_at IS NOT NULL FROM threads WHERE id = ?", threadID).Scan(&locked, &archived)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil || (!locked && !archived) {
+		return err
+	}
+	role, err := getUserRole(userID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case isModerator(role):
+		return nil
+	case archived:
+		return errThreadArchived
+	}
+	return errThreadLocked
+}
+
+// closedThreadMessage returns the message shown for errThreadLocked and
+// errThreadArchived, and "" for other errors.
+func closedThreadMessage(err error) string {
+	switch err {
+	case errThreadLocked:
+		return "This thread is locked"
+	case errThreadArchived:
+		return "This thread is archived and read-only"
+	}
+	return ""
+}
+
+// archiveInactiveThreads archives the threads that are neither pinned nor
+// archived yet and have had no new thread or comment since before. Threads
+// from before timestamps were recorded count as inactive. With dryRun the
+// threads are only counted.
+func archiveInactiveThreads(db *sql.DB, before time.Time, dryRun bool) ([]int, error) {
+	rows, err := db.Query(`
+        SELECT t.id, CAST(COALESCE(MAX(c.created_at), t.created_at, '') AS TEXT), CAST(COALESCE(t.created_at, '') AS TEXT)
+        FROM threads t LEFT JOIN comments c ON c.thread_id = t.id
+        WHERE t.pinned_at IS NULL AND t.archived_at IS NULL
+        GROUP BY t.id`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var lastComment, created string
+		if err := rows.Scan(&id, &lastComment, &created); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		last := parseStoredTime(created)
+		if t := parseStoredTime(lastComment); t.After(last) {
+			last = t
+		}
+		if last.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return ids, nil
+	}
+
+	now := time.Now()
+	for _, id := range ids {
+		if _, err := db.Exec("UPDATE threads SET archived_at = ? WHERE id = ? AND archived_at IS NULL", now, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// /thread/moderate: form posts of moderators acting on a thread. action is
+// pin, unpin, lock, unlock, archive or unarchive, where a pin with
+// category_id is only in that category, or move, merge or split (see
+// moderateThreadForm).
+func handleModerateThread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	role, err := getUserRole(userID)
+	if err != nil || !isModerator(role) {
+		http.Error(w, "Only moderators can do this", http.StatusForbidden)
+		return
+	}
+	threadID, err := strconv.Atoi(r.FormValue("thread_id"))
+	if err != nil {
+		http.Error(w, "Invalid thread ID", http.StatusBadRequest)
+		return
+	}
+
+	action := r.FormValue("action")
+	name := strings.TrimPrefix(action, "un")
+	state, isState := threadStates[name]
+	on := name == action
+	showID := threadID
+	switch {
+	case action == moderationMove || action == moderationMerge || action == moderationSplit:
+		showID, err = moderateThreadForm(r, userID, threadID, action)
+	case !isState:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	case r.FormValue("category_id") != "" && state == threadPinned:
+		categoryID, convErr := strconv.Atoi(r.FormValue("category_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+		err = pinThreadInCategory(userID, threadID, categoryID, on)
+	default:
+		err = setThreadState(userID, threadID, state, on)
+	}
+	if _, ok := err.(fieldError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Thread not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to %s thread: %v", action, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/thread?id="+strconv.Itoa(showID), http.StatusSeeOther)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// moderationActions returns the actions logged for a thread, oldest first.
+func moderationActions(t *testing.T, threadID int) []string {
+	t.Helper()
+	entries, err := listModerationLog(threadID, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make([]string, len(entries))
+	for i, e := range entries {
+		actions[len(entries)-1-i] = e.Action
+	}
+	return actions
+}
+
+func TestSetThreadStateLogsOnlyChanges(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	id, err := createThread(moderator, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := int(id)
+
+	steps := []bool{true, true, false, false}
+	for _, on := range steps {
+		if err := setThreadState(moderator, threadID, threadLocked, on); err != nil {
+			t.Fatalf("setThreadState(%v): %v", on, err)
+		}
+	}
+	if got := fmt.Sprint(moderationActions(t, threadID)); got != "[lock unlock]" {
+		t.Errorf("logged %s, want [lock unlock]", got)
+	}
+
+	if err := setThreadState(moderator, threadID, threadLocked, true); err != nil {
+		t.Fatal(err)
+	}
+	thread, err := getThread(threadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockedAt := *thread.LockedAt
+	if err := setThreadState(moderator, threadID, threadLocked, true); err != nil {
+		t.Fatal(err)
+	}
+	if thread, err = getThread(threadID); err != nil {
+		t.Fatal(err)
+	}
+	if !thread.LockedAt.Equal(lockedAt) {
+		t.Errorf("locking again moved the lock time from %v to %v", lockedAt, *thread.LockedAt)
+	}
+
+	if err := setThreadState(moderator, threadID+1, threadLocked, true); err != errNotFound {
+		t.Errorf("locking a missing thread: %v, want errNotFound", err)
+	}
+}
+
+func TestPinThreadInCategoryLogsOnlyChanges(t *testing.T) {
+	newTestDB(t)
+	moderator := createTestUser(t, "mod")
+	result, err := db.Exec("INSERT INTO categories (name) VALUES ('News')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	categoryID, _ := result.LastInsertId()
+	id, err := createThread(moderator, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: []string{fmt.Sprint(categoryID)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadID := int(id)
+
+	for _, on := range []bool{false, true, true, false, false} {
+		if err := pinThreadInCategory(moderator, threadID, int(categoryID), on); err != nil {
+			t.Fatalf("pinThreadInCategory(%v): %v", on, err)
+		}
+	}
+	if got := fmt.Sprint(moderationActions(t, threadID)); got != "[pin unpin]" {
+		t.Errorf("logged %s, want [pin unpin]", got)
+	}
+
+	if err := pinThreadInCategory(moderator, threadID, int(categoryID)+1, true); err != errNotFound {
+		t.Errorf("pinning in a category of another thread: %v, want errNotFound", err)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Likes and dislikes are the like and dislike reactions in item_reactions, or
+// any other reaction with a score. A user holds at most one scored reaction per
+// item, which is their vote. Every reaction change goes through changeReactions,
+// which keeps the likes and dislikes counters of threads and comments in step
+// with the votes. Those counters are what every page and API reads; reactions
+// are only ever written there or deleted together with their item.
+// reconcileVoteCounts repairs counters that drifted anyway, e.g. after manual
+// database edits.
+
+// voteTarget describes something users can react to.
+type voteTarget struct {
+	kind  string // item_type in item_reactions
+	table string
+	live  string // condition an item must meet to be reacted to
+	votes bool   // whether votes update likes/dislikes counters and reputation
+}
+
+var (
+	threadVotes      = voteTarget{"thread", "threads", "1 = 1", true}
+	commentVotes     = voteTarget{"comment", "comments", "deleted_at IS NULL", true}
+	messageReactions = voteTarget{"message", "messages", "1 = 1", false}
+)
+
+// voteTargets maps item_type values to their target.
+var voteTargets = map[string]voteTarget{
+	"thread":  threadVotes,
+	"comment": commentVotes,
+	"message": messageReactions,
+}
+
+// VoteTotals is the state of an item after a vote.
+type VoteTotals struct {
+	Likes    int `json:"likes"`
+	Dislikes int `json:"dislikes"`
+	Vote     int `json:"vote"` // the voter's vote: 1, -1, or 0 for none
+}
+
+// userVoteQuery selects the vote of a user on an item: the score of their scored reaction.
+const userVoteQuery = `
+    SELECT COALESCE(SUM(r.score), 0) FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+    WHERE ir.item_type = ? AND ir.item_id = ? AND ir.user_id = ? AND r.score != 0`
+
+// changeReactions runs change in a transaction and then brings the counters of
+// the item and the reputation of its author in line with the resulting vote.
+// Switching to a dislike needs the downvote privilege.
+func changeReactions(target voteTarget, itemID, userID int, change func(tx *sql.Tx) error) (VoteTotals, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return VoteTotals{}, err
+	}
+	defer tx.Rollback()
+
+	var authorID int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND %s", target.table, target.live)
+	if target.votes {
+		query = fmt.Sprintf("SELECT user_id FROM %s WHERE id = ? AND %s", target.table, target.live)
+	}
+	err = tx.QueryRow(query, itemID).Scan(&authorID)
+	if err == sql.ErrNoRows || (err == nil && !target.votes && authorID == 0) {
+		return VoteTotals{}, errNotFound
+	}
+	if err != nil {
+		return VoteTotals{}, err
+	}
+
+	// Votes and reactions on archived threads and their comments are frozen
+	if target == threadVotes || target == commentVotes {
+		threadID := itemID
+		if target == commentVotes {
+			if err := tx.QueryRow("SELECT thread_id FROM comments WHERE id = ?", itemID).Scan(&threadID); err != nil {
+				return VoteTotals{}, err
+			}
+		}
+		if err := checkNotArchived(tx, threadID); err != nil {
+			return VoteTotals{}, err
+		}
+	}
+
+	var previous, vote int
+	if err := tx.QueryRow(userVoteQuery, target.kind, itemID, userID).Scan(&previous); err != nil {
+		return VoteTotals{}, err
+	}
+	if err := change(tx); err != nil {
+		return VoteTotals{}, err
+	}
+	if err := tx.QueryRow(userVoteQuery, target.kind, itemID, userID).Scan(&vote); err != nil {
+		return VoteTotals{}, err
+	}
+	totals := VoteTotals{Vote: vote}
+	if !target.votes {
+		return totals, tx.Commit()
+	}
+
+	if vote == -1 && previous != -1 {
+		allowed, err := hasPrivilege(tx, userID, privilegeDownvote)
+		if err != nil {
+			return VoteTotals{}, err
+		}
+		if !allowed {
+			return VoteTotals{}, errNeedsReputation
+		}
+	}
+
+	if previous != vote {
+		if err := applyVoteReputation(tx, target.kind, itemID, authorID, userID, previous, vote); err != nil {
+			return VoteTotals{}, err
+		}
+	}
+
+	// Writing the reaction took the write lock, so the counts cannot change under us
+	if err := tx.QueryRow(`
+        SELECT COUNT(CASE WHEN r.score > 0 THEN 1 END), COUNT(CASE WHEN r.score < 0 THEN 1 END)
+        FROM item_reactions ir JOIN reactions r ON r.id = ir.reaction_id
+        WHERE ir.item_type = ? AND ir.item_id = ?`, target.kind, itemID).Scan(&totals.Likes, &totals.Dislikes); err != nil {
+		return VoteTotals{}, err
+	}
+	query = fmt.Sprintf("UPDATE %s SET likes = ?, dislikes = ? WHERE id = ?", target.table)
+	if _, err := tx.Exec(query, totals.Likes, totals.Dislikes, itemID); err != nil {
+		return VoteTotals{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return VoteTotals{}, err
+	}
+
+	// Only new likes are announced to the author
+	if vote == 1 && previous != 1 {
+		n := Notification{Type: notifyVote, userID: authorID, actorID: userID}
+		if target == commentVotes {
+			n.CommentID = itemID
+		} else {
+			n.ThreadID = itemID
+		}
+		notify(n)
+	}
+	return totals, nil
+}
+
+// removeVote deletes the scored reaction of a user on an item.
+func removeVote(tx *sql.Tx, target voteTarget, itemID, userID int) error {
+	_, err := tx.Exec(`
+        DELETE FROM item_reactions
+        WHERE item_type = ? AND item_id = ? AND user_id = ?
+            AND reaction_id IN (SELECT id FROM reactions WHERE score != 0)`, target.kind, itemID, userID)
+	return err
+}
+
+// castVote sets the vote of userID on an item: 1 likes, -1 dislikes and 0
+// retracts the vote. Repeating a request changes nothing, so clients toggle a
+// vote off by sending 0 and switch it by sending the other value.
+func castVote(target voteTarget, itemID, userID, vote int) (VoteTotals, error) {
+	if vote != 1 && vote != -1 && vote != 0 {
+		return VoteTotals{}, errInvalidLikeType
+	}
+	return changeReactions(target, itemID, userID, func(tx *sql.Tx) error {
+		if err := removeVote(tx, target, itemID, userID); err != nil || vote == 0 {
+			return err
+		}
+		name := reactionLike
+		if vote == -1 {
+			name = reactionDislike
+		}
+		_, err := tx.Exec(`
+            INSERT INTO item_reactions (item_type, item_id, user_id, reaction_id, created_at)
+            SELECT ?, ?, ?, id, ? FROM reactions WHERE name = ?`, target.kind, itemID, userID, time.Now(), name)
+		return err
+	})
+}
+
+// getVote returns the vote of userID on an item, or 0 if there is none.
+func getVote(target voteTarget, itemID, userID int) (int, error) {
+	if userID == 0 {
+		return 0, nil
+	}
+	var vote int
+	err := db.QueryRow(userVoteQuery, target.kind, itemID, userID).Scan(&vote)
+	return vote, err
+}
+
+// voteDrift is an item whose counters disagree with its votes.
+type voteDrift struct {
+	Table          string
+	ID             int
+	Likes          int
+	Dislikes       int
+	ActualLikes    int
+	ActualDislikes int
+}
+
+// reconcileVoteCounts recomputes the counters of every thread and comment from
+// their scored reactions and returns the items that drifted. With fix
+// set the counters are corrected in one transaction.
+func reconcileVoteCounts(db *sql.DB, fix bool) ([]voteDrift, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var drifts []voteDrift
+	for _, target := range []voteTarget{threadVotes, commentVotes} {
+		rows, err := tx.Query(fmt.Sprintf(`
+            SELECT t.id, COALESCE(t.likes, 0), COALESCE(t.dislikes, 0),
+                COUNT(CASE WHEN r.score > 0 THEN 1 END), COUNT(CASE WHEN r.score < 0 THEN 1 END)
+            FROM %s t
+            LEFT JOIN item_reactions ir ON ir.item_type = ? AND ir.item_id = t.id
+            LEFT JOIN reactions r ON r.id = ir.reaction_id
+            GROUP BY t.id
+            HAVING COALESCE(t.likes, 0) != COUNT(CASE WHEN r.score > 0 THEN 1 END)
+                OR COALESCE(t.dislikes, 0) != COUNT(CASE WHEN r.score < 0 THEN 1 END)
+            ORDER BY t.id`, target.table), target.kind)
+		if err != nil {
+			return nil, err
+		}
+		var found []voteDrift
+		for rows.Next() {
+			d := voteDrift{Table: target.table}
+			if err := rows.Scan(&d.ID, &d.Likes, &d.Dislikes, &d.ActualLikes, &d.ActualDislikes); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found = append(found, d)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		if fix {
+			query := fmt.Sprintf("UPDATE %s SET likes = ?, dislikes = ? WHERE id = ?", target.table)
+			for _, d := range found {
+				if _, err := tx.Exec(query, d.ActualLikes, d.ActualDislikes, d.ID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		drifts = append(drifts, found...)
+	}
+
+	if !fix {
+		return drifts, nil
+	}
+	return drifts, tx.Commit()
+}
+
+// listThreadCommentVotes returns the votes of userID on the comments of a thread by comment id.
+func listThreadCommentVotes(threadID, userID int) (map[int]int, error) {
+	votes := map[int]int{}
+	if userID == 0 {
+		return votes, nil
+	}
+	rows, err := db.Query(`
+        SELECT ir.item_id, r.score
+        FROM item_reactions ir
+        JOIN reactions r ON r.id = ir.reaction_id
+        JOIN comments c ON c.id = ir.item_id
+        WHERE ir.item_type = 'comment' AND r.score != 0 AND c.thread_id = ? AND ir.user_id = ?`, threadID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var commentID, vote int
+		if err := rows.Scan(&commentID, &vote); err != nil {
+			return nil, err
+		}
+		votes[commentID] = vote
+	}
+	return votes, rows.Err()
+}
+
+// parseVote reads a like_type form value, which must be 1, -1 or 0.
+func parseVote(value string) (int, error) {
+	vote, err := strconv.Atoi(value)
+	if err != nil || (vote != 1 && vote != -1 && vote != 0) {
+		return 0, errInvalidLikeType
+	}
+	return vote, nil
+}
+
+// wantsJSON reports whether a form post was sent by script.js, which asks for
+// the new totals instead of a redirect.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
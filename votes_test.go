@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCastVote(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	other := createTestUser(t, "carol")
+	// Moderators may dislike without the reputation for it
+	setTestRole(t, voter, roleModerator)
+	setTestRole(t, other, roleModerator)
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []struct {
+		voteTarget
+		id int
+	}{{threadVotes, int(threadID)}, {commentVotes, int(commentID)}} {
+		tests := []struct {
+			name   string
+			userID int
+			vote   int
+			want   VoteTotals
+		}{
+			{"like", voter, 1, VoteTotals{Likes: 1, Vote: 1}},
+			{"like again", voter, 1, VoteTotals{Likes: 1, Vote: 1}},
+			{"switch to dislike", voter, -1, VoteTotals{Dislikes: 1, Vote: -1}},
+			{"another user likes", other, 1, VoteTotals{Likes: 1, Dislikes: 1, Vote: 1}},
+			{"switch back to like", voter, 1, VoteTotals{Likes: 2, Vote: 1}},
+			{"retract", voter, 0, VoteTotals{Likes: 1}},
+			{"retract again", voter, 0, VoteTotals{Likes: 1}},
+			{"other user retracts", other, 0, VoteTotals{}},
+		}
+		for _, tt := range tests {
+			totals, err := castVote(target.voteTarget, target.id, tt.userID, tt.vote)
+			if err != nil {
+				t.Fatalf("%s %s: %v", target.kind, tt.name, err)
+			}
+			if totals != tt.want {
+				t.Errorf("%s %s: %+v, want %+v", target.kind, tt.name, totals, tt.want)
+			}
+			if vote, err := getVote(target.voteTarget, target.id, tt.userID); err != nil || vote != tt.want.Vote {
+				t.Errorf("%s %s: getVote = %d, %v, want %d", target.kind, tt.name, vote, err, tt.want.Vote)
+			}
+			var likes, dislikes int
+			if err := db.QueryRow("SELECT likes, dislikes FROM "+target.table+" WHERE id = ?", target.id).Scan(&likes, &dislikes); err != nil {
+				t.Fatal(err)
+			}
+			if likes != tt.want.Likes || dislikes != tt.want.Dislikes {
+				t.Errorf("%s %s: stored %d likes, %d dislikes, want %d, %d", target.kind, tt.name, likes, dislikes, tt.want.Likes, tt.want.Dislikes)
+			}
+		}
+	}
+
+	if _, err := castVote(threadVotes, int(threadID), voter, 2); err != errInvalidLikeType {
+		t.Errorf("vote 2: %v, want errInvalidLikeType", err)
+	}
+	if _, err := castVote(threadVotes, int(threadID)+100, voter, 1); err != errNotFound {
+		t.Errorf("vote on a missing thread: %v, want errNotFound", err)
+	}
+	if err := softDeleteComment(int(commentID)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(commentVotes, int(commentID), voter, 1); err != errNotFound {
+		t.Errorf("vote on a deleted comment: %v, want errNotFound", err)
+	}
+}
+
+func TestThreadVoteRespondsWithTotals(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := login(t, "bob")
+
+	tests := []struct {
+		likeType string
+		json     bool
+		status   int
+		want     VoteTotals
+	}{
+		{"1", true, http.StatusOK, VoteTotals{Likes: 1, Vote: 1}},
+		{"1", true, http.StatusOK, VoteTotals{Likes: 1, Vote: 1}},
+		{"0", false, http.StatusSeeOther, VoteTotals{}},
+		{"-1", true, http.StatusForbidden, VoteTotals{}}, // bob lacks the reputation to dislike
+		{"like", true, http.StatusBadRequest, VoteTotals{}},
+	}
+	for _, tt := range tests {
+		form := url.Values{"thread_id": {fmt.Sprint(threadID)}, "like_type": {tt.likeType}}
+		r := httptest.NewRequest(http.MethodPost, "/like-dislike", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.json {
+			r.Header.Set("Accept", "application/json")
+		}
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handleLikeDislike(w, r)
+		if w.Code != tt.status {
+			t.Errorf("like_type %s: status %d, want %d: %s", tt.likeType, w.Code, tt.status, w.Body)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var totals VoteTotals
+		if err := json.NewDecoder(w.Body).Decode(&totals); err != nil {
+			t.Fatalf("like_type %s: %v", tt.likeType, err)
+		}
+		if totals != tt.want {
+			t.Errorf("like_type %s: %+v, want %+v", tt.likeType, totals, tt.want)
+		}
+	}
+}
+
+func TestReconcileVoteCounts(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	voter := createTestUser(t, "bob")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, err := createComment(author, int(threadID), 0, "A comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(threadVotes, int(threadID), voter, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := castVote(commentVotes, int(commentID), voter, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		setup string // statement that makes the counters drift
+		want  []voteDrift
+	}{
+		{"consistent", "", nil},
+		{"thread likes", "UPDATE threads SET likes = 7", []voteDrift{
+			{Table: "threads", ID: int(threadID), Likes: 7, ActualLikes: 1},
+		}},
+		{"null counters", "UPDATE threads SET likes = NULL, dislikes = NULL", []voteDrift{
+			{Table: "threads", ID: int(threadID), Likes: 0, ActualLikes: 1},
+		}},
+		{"comment counters", "UPDATE comments SET likes = 0, dislikes = 3", []voteDrift{
+			{Table: "comments", ID: int(commentID), Likes: 0, Dislikes: 3, ActualLikes: 1},
+		}},
+	}
+	for _, tt := range tests {
+		if tt.setup != "" {
+			if _, err := db.Exec(tt.setup); err != nil {
+				t.Fatal(err)
+			}
+		}
+		drifts, err := reconcileVoteCounts(db, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(drifts, tt.want) {
+			t.Errorf("%s: dry run found %+v, want %+v", tt.name, drifts, tt.want)
+		}
+		// A dry run leaves the drift in place
+		if again, _ := reconcileVoteCounts(db, false); len(again) != len(tt.want) {
+			t.Errorf("%s: %d drifts after a dry run, want %d", tt.name, len(again), len(tt.want))
+		}
+
+		if drifts, err = reconcileVoteCounts(db, true); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(drifts, tt.want) {
+			t.Errorf("%s: fix found %+v, want %+v", tt.name, drifts, tt.want)
+		}
+		if again, _ := reconcileVoteCounts(db, false); len(again) != 0 {
+			t.Errorf("%s: drift left after fixing: %+v", tt.name, again)
+		}
+	}
+}
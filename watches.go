@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users watch threads and categories to hear about new activity. Posting a
+// thread or a comment watches the thread automatically; anything else is set
+// by hand. A watch on a thread wins over the watches on its categories, and
+// without any watch a user only hears about replies to them and mentions.
+
+// Watch levels.
+const (
+	watchAll      = "all"      // every new comment, and new threads in a category
+	watchMentions = "mentions" // only replies to you and mentions, as without a watch
+	watchMuted    = "muted"    // nothing at all, not even replies and mentions
+)
+
+// watchLevels lists the levels in the order they are offered.
+var watchLevels = []struct {
+	Level string
+	Label string
+}{
+	{watchAll, "All activity"},
+	{watchMentions, "Mentions only"},
+	{watchMuted, "Muted"},
+}
+
+func validWatchLevel(level string) bool {
+	for _, l := range watchLevels {
+		if l.Level == level {
+			return true
+		}
+	}
+	return false
+}
+
+// watchLevelRank orders the levels of several category watches; the highest wins.
+var watchLevelRank = map[string]int{watchMuted: 1, watchMentions: 2, watchAll: 3}
+
+// autoWatchThread makes userID watch a thread they posted in, unless they set
+// a level for it already.
+func autoWatchThread(tx *sql.Tx, userID, threadID int) error {
+	_, err := tx.Exec(`
+        INSERT OR IGNORE INTO thread_watches (user_id, thread_id, level, auto, created_at)
+        VALUES (?, ?, ?, 1, ?)`, userID, threadID, watchAll, time.Now())
+	return err
+}
+
+// setThreadWatch sets the level at which userID watches a thread, or removes
+// the watch when level is "".
+func setThreadWatch(userID, threadID int, level string) error {
+	return setWatch("thread_watches", "thread_id", "threads", userID, threadID, level)
+}
+
+// setCategoryWatch is setThreadWatch for categories.
+func setCategoryWatch(userID, categoryID int, level string) error {
+	return setWatch("category_watches", "category_id", "categories", userID, categoryID, level)
+}
+
+func setWatch(table, column, targetTable string, userID, targetID int, level string) error {
+	if level == "" {
+		_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND %s = ?", table, column), userID, targetID)
+		return err
+	}
+	if !validWatchLevel(level) {
+		return fieldError("level must be all, mentions or muted")
+	}
+	var exists int
+	if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", targetTable), targetID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errNotFound
+	}
+	extra := ""
+	if table == "thread_watches" {
+		extra = ", auto = 0" // chosen by hand from now on
+	}
+	_, err := db.Exec(fmt.Sprintf(`
+        INSERT INTO %[1]s (user_id, %[2]s, level, created_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT (user_id, %[2]s) DO UPDATE SET level = excluded.level%[3]s`, table, column, extra),
+		userID, targetID, level, time.Now())
+	return err
+}
+
+// ThreadWatch is how a user watches a thread and where the level comes from.
+type ThreadWatch struct {
+	Level  string `json:"level"`            // "" when the thread is not watched
+	Source string `json:"source,omitempty"` // thread or category
+	Auto   bool   `json:"auto"`             // set by posting in the thread
+}
+
+// getThreadWatch returns the level at which userID watches a thread.
+func getThreadWatch(userID, threadID int) (ThreadWatch, error) {
+	var w ThreadWatch
+	if userID == 0 {
+		return w, nil
+	}
+	err := db.QueryRow("SELECT level, auto FROM thread_watches WHERE user_id = ? AND thread_id = ?", userID, threadID).Scan(&w.Level, &w.Auto)
+	if err == nil {
+		w.Source = "thread"
+		return w, nil
+	}
+	if err != sql.ErrNoRows {
+		return w, err
+	}
+
+	rows, err := db.Query(`
+        SELECT cw.level FROM category_watches cw
+        JOIN thread_categories tc ON tc.category_id = cw.category_id
+        WHERE cw.user_id = ? AND tc.thread_id = ?`, userID, threadID)
+	if err != nil {
+		return w, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var level string
+		if err := rows.Scan(&level); err != nil {
+			return w, err
+		}
+		if watchLevelRank[level] > watchLevelRank[w.Level] {
+			w.Level, w.Source = level, "category"
+		}
+	}
+	return w, rows.Err()
+}
+
+// threadMuted reports whether userID muted a thread, directly or through its categories.
+func threadMuted(userID, threadID int) (bool, error) {
+	w, err := getThreadWatch(userID, threadID)
+	return w.Level == watchMuted, err
+}
+
+// watcherQuery selects the users who watch thread ?1 at the all level, either
+// directly or through a category when the thread itself has no watch of theirs.
+const watcherQuery = `
+    SELECT user_id FROM thread_watches WHERE thread_id = ?1 AND level = 'all'
+    UNION
+    SELECT cw.user_id FROM category_watches cw
+    JOIN thread_categories tc ON tc.category_id = cw.category_id
+    WHERE tc.thread_id = ?1 AND cw.level = 'all'
+        AND cw.user_id NOT IN (SELECT user_id FROM thread_watches WHERE thread_id = ?1)`
+
+// notifyWatchers tells the users watching the thread of a new comment about
+// it. Users already notified of the comment, as the author replied to or a
+// mentioned user, are not told twice.
+func notifyWatchers(comment Comment) {
+	rows, err := db.Query(watcherQuery+`
+        EXCEPT SELECT user_id FROM notifications WHERE comment_id = ?2`, comment.ThreadID, comment.ID)
+	if err != nil {
+		log.Printf("Failed to find the watchers of thread %d: %v", comment.ThreadID, err)
+		return
+	}
+	userIDs, err := scanIDs(rows)
+	if err != nil {
+		log.Printf("Failed to find the watchers of thread %d: %v", comment.ThreadID, err)
+		return
+	}
+	for _, userID := range userIDs {
+		notify(Notification{
+			Type:      notifyWatching,
+			ThreadID:  comment.ThreadID,
+			CommentID: comment.ID,
+			Text:      excerpt(comment.Content, notificationExcerptLength),
+			userID:    userID,
+			actorID:   comment.UserID,
+		})
+	}
+}
+
+// notifyCategoryWatchers tells the users watching a category at the all level
+// about a new thread in it.
+func notifyCategoryWatchers(userID, threadID int, description string) {
+	rows, err := db.Query(`
+        SELECT DISTINCT cw.user_id FROM category_watches cw
+        JOIN thread_categories tc ON tc.category_id = cw.category_id
+        WHERE tc.thread_id = ?1 AND cw.level = 'all'
+        EXCEPT SELECT user_id FROM notifications WHERE thread_id = ?1`, threadID)
+	if err != nil {
+		log.Printf("Failed to find the watchers of thread %d: %v", threadID, err)
+		return
+	}
+	userIDs, err := scanIDs(rows)
+	if err != nil {
+		log.Printf("Failed to find the watchers of thread %d: %v", threadID, err)
+		return
+	}
+	for _, watcherID := range userIDs {
+		notify(Notification{
+			Type:     notifyWatching,
+			ThreadID: threadID,
+			Text:     excerpt(description, notificationExcerptLength),
+			userID:   watcherID,
+			actorID:  userID,
+		})
+	}
+}
+
+// scanIDs reads a single column of ids and closes rows.
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// WatchedThread is an entry of the Watching list of a profile.
+type WatchedThread struct {
+	ThreadID int       `json:"thread_id"`
+	Title    string    `json:"title"`
+	Level    string    `json:"level"`
+	Auto     bool      `json:"auto"`
+	Since    time.Time `json:"since"`
+}
+
+// listWatchedThreads returns the threads a user watches, most recently watched
+// first, paged by watch.
+func listWatchedThreads(userID, limit, after int) ([]WatchedThread, string, error) {
+	rows, err := db.Query(`
+        SELECT w.rowid, w.thread_id, t.title, w.level, w.auto, w.created_at
+        FROM thread_watches w JOIN threads t ON t.id = w.thread_id
+        WHERE w.user_id = ? AND (? = 0 OR w.rowid < ?)
+        ORDER BY w.rowid DESC LIMIT ?`, userID, after, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var ids []int
+	watches := []WatchedThread{}
+	for rows.Next() {
+		var id int
+		var w WatchedThread
+		if err := rows.Scan(&id, &w.ThreadID, &w.Title, &w.Level, &w.Auto, &w.Since); err != nil {
+			return nil, "", err
+		}
+		ids = append(ids, id)
+		watches = append(watches, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(watches) > limit {
+		watches = watches[:limit]
+		next = encodeCursor(ids[limit-1])
+	}
+	return watches, next, nil
+}
+
+// WatchedCategory is a category with the level a user watches it at, "" for none.
+type WatchedCategory struct {
+	Category
+	Level string `json:"level"`
+}
+
+// listWatchedCategories returns the categories with the level userID watches
+// them at. Unless all is set, categories they do not watch are left out.
+func listWatchedCategories(userID int, all bool) ([]WatchedCategory, error) {
+	rows, err := db.Query(`
+        SELECT c.id, c.name, COALESCE(w.level, '') FROM categories c
+        LEFT JOIN category_watches w ON w.category_id = c.id AND w.user_id = ?
+        WHERE ? OR w.level IS NOT NULL
+        ORDER BY c.name`, userID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []WatchedCategory{}
+	for rows.Next() {
+		var c WatchedCategory
+		if err := rows.Scan(&c.ID, &c.Name, &c.Level); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// /watch: sets the watch level of the thread_id or category_id of the form;
+// an empty level stops watching
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	_, userID := sessionUser(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+
+	level := r.FormValue("level")
+	var err error
+	if v := r.FormValue("category_id"); v != "" {
+		categoryID, convErr := strconv.Atoi(v)
+		if convErr != nil {
+			http.Error(w, "Invalid category", http.StatusBadRequest)
+			return
+		}
+		err = setCategoryWatch(userID, categoryID, level)
+	} else {
+		threadID, convErr := strconv.Atoi(r.FormValue("thread_id"))
+		if convErr != nil {
+			http.Error(w, "Invalid thread", http.StatusBadRequest)
+			return
+		}
+		err = setThreadWatch(userID, threadID, level)
+	}
+	if _, ok := err.(fieldError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch err {
+	case nil:
+	case errNotFound:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	default:
+		log.Printf("Failed to save watch: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	back := r.FormValue("redirect")
+	if !strings.HasPrefix(back, "/") || strings.HasPrefix(back, "//") || strings.HasPrefix(back, "/\\") {
+		back = "/userProfile"
+	}
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// backfillThreadWatches makes authors and commenters watch the threads they
+// posted in before watches existed.
+func backfillThreadWatches(db *sql.DB) error {
+	_, err := db.Exec(`
+        INSERT OR IGNORE INTO thread_watches (user_id, thread_id, level, auto, created_at)
+        SELECT user_id, id, ?1, 1, COALESCE(created_at, ?2) FROM threads
+        UNION ALL
+        SELECT user_id, thread_id, ?1, 1, MIN(COALESCE(created_at, ?2)) FROM comments
+        WHERE deleted_at IS NULL GROUP BY user_id, thread_id`, watchAll, time.Now())
+	return err
+}
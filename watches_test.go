@@ -0,0 +1,214 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestSetThreadWatch(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	threadID, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		userID   int
+		threadID int
+		level    string
+		err      bool
+		want     ThreadWatch
+	}{
+		{"the author watches automatically", alice, int(threadID), "", false, ThreadWatch{Level: watchAll, Source: "thread", Auto: true}},
+		{"watch by hand", alice, int(threadID), watchMentions, false, ThreadWatch{Level: watchMentions, Source: "thread"}},
+		{"mute", alice, int(threadID), watchMuted, false, ThreadWatch{Level: watchMuted, Source: "thread"}},
+		{"invalid level", alice, int(threadID), "loud", true, ThreadWatch{Level: watchMuted, Source: "thread"}},
+		{"missing thread", bob, int(threadID) + 1, watchAll, true, ThreadWatch{}},
+		{"watch another thread", bob, int(threadID), watchAll, false, ThreadWatch{Level: watchAll, Source: "thread"}},
+	}
+	for i, tt := range tests {
+		if i > 0 {
+			err := setThreadWatch(tt.userID, tt.threadID, tt.level)
+			if (err != nil) != tt.err {
+				t.Errorf("%s: %v, want error %v", tt.name, err, tt.err)
+			}
+		}
+		w, err := getThreadWatch(tt.userID, tt.threadID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, w, tt.want)
+		}
+	}
+
+	// Posting again keeps the level chosen by hand
+	if _, err := createComment(alice, int(threadID), 0, "A comment", nil); err != nil {
+		t.Fatal(err)
+	}
+	if muted, err := threadMuted(alice, int(threadID)); err != nil || !muted {
+		t.Errorf("after commenting: muted %v, %v, want still muted", muted, err)
+	}
+	if err := setThreadWatch(alice, int(threadID), ""); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := getThreadWatch(alice, int(threadID)); w != (ThreadWatch{}) {
+		t.Errorf("after removing the watch: %+v", w)
+	}
+}
+
+func TestThreadWatchesWinOverCategories(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	news := createTestCategory(t, "News")
+	sport := createTestCategory(t, "Sport")
+	threadID, err := createThread(alice, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: []string{news, sport}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	categoryID := func(id string) int {
+		n, _ := strconv.Atoi(id)
+		return n
+	}
+
+	tests := []struct {
+		name string
+		set  func() error
+		want ThreadWatch
+	}{
+		{"no watch", func() error { return nil }, ThreadWatch{}},
+		{"one category", func() error { return setCategoryWatch(bob, categoryID(news), watchMuted) }, ThreadWatch{Level: watchMuted, Source: "category"}},
+		{"the higher category level", func() error { return setCategoryWatch(bob, categoryID(sport), watchAll) }, ThreadWatch{Level: watchAll, Source: "category"}},
+		{"the thread watch", func() error { return setThreadWatch(bob, int(threadID), watchMentions) }, ThreadWatch{Level: watchMentions, Source: "thread"}},
+		{"the thread watch removed", func() error { return setThreadWatch(bob, int(threadID), "") }, ThreadWatch{Level: watchAll, Source: "category"}},
+	}
+	for _, tt := range tests {
+		if err := tt.set(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		w, err := getThreadWatch(bob, int(threadID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, w, tt.want)
+		}
+	}
+
+	categories, err := listWatchedCategories(bob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var levels []string
+	for _, c := range categories {
+		levels = append(levels, c.Name+" "+c.Level)
+	}
+	if want := []string{"News muted", "Sport all"}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("watched categories %v, want %v", levels, want)
+	}
+}
+
+func TestWatchLevelsDecideNotifications(t *testing.T) {
+	newTestDB(t)
+	author := createTestUser(t, "alice")
+	commenter := createTestUser(t, "bob")
+	watcher := createTestUser(t, "carol")
+	news := createTestCategory(t, "News")
+	threadID, err := createThread(author, ThreadInput{Title: "A thread", Description: "Its description", CategoryIDs: []string{news}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	carolComment, err := createComment(watcher, int(threadID), 0, "Carol was here", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		level    string
+		content  string
+		parentID int
+		want     []string // carol's new notifications
+	}{
+		{watchAll, "Anyone there?", 0, []string{"watching by bob"}},
+		{watchAll, "Reply to carol", int(carolComment), []string{"comment_reply by bob"}}, // told once
+		{watchMentions, "Anyone there?", 0, []string{}},
+		{watchMentions, "Reply to carol", int(carolComment), []string{"comment_reply by bob"}},
+		{watchMentions, "Hello @carol", 0, []string{"mention by bob"}},
+		{watchMuted, "Reply to carol", int(carolComment), []string{}},
+		{watchMuted, "Hello @carol", 0, []string{}},
+		// without a watch of their own carol only hears about replies and mentions
+		{"", "Anyone there?", 0, []string{}},
+		{"", "Reply to carol", int(carolComment), []string{"comment_reply by bob"}},
+	}
+	before := notificationsOf(t, watcher)
+	for _, tt := range tests {
+		if err := setThreadWatch(watcher, int(threadID), tt.level); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := createComment(commenter, int(threadID), tt.parentID, tt.content, nil); err != nil {
+			t.Fatal(err)
+		}
+		got := notificationsOf(t, watcher)
+		if added := got[:len(got)-len(before)]; !reflect.DeepEqual(added, tt.want) {
+			t.Errorf("level %q, %q: %v, want %v", tt.level, tt.content, added, tt.want)
+		}
+		before = got
+	}
+
+	// Watching a category at the all level announces its new threads
+	newsID, _ := strconv.Atoi(news)
+	if err := setCategoryWatch(watcher, newsID, watchAll); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createThread(commenter, ThreadInput{Title: "Breaking", Description: "News", CategoryIDs: []string{news}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createThread(commenter, ThreadInput{Title: "Elsewhere", Description: "Not news"}); err != nil {
+		t.Fatal(err)
+	}
+	got := notificationsOf(t, watcher)
+	if added := got[:len(got)-len(before)]; !reflect.DeepEqual(added, []string{"watching by bob"}) {
+		t.Errorf("new threads: %v, want one in the watched category", added)
+	}
+}
+
+func TestListWatchedThreads(t *testing.T) {
+	newTestDB(t)
+	alice := createTestUser(t, "alice")
+	var titles []string
+	for _, title := range []string{"First", "Second", "Third"} {
+		if _, err := createThread(alice, ThreadInput{Title: title, Description: "Its description"}); err != nil {
+			t.Fatal(err)
+		}
+		titles = append([]string{title}, titles...)
+	}
+
+	var got []string
+	after := 0
+	for page := 0; page < 5; page++ {
+		watches, next, err := listWatchedThreads(alice, 2, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range watches {
+			if !w.Auto || w.Level != watchAll {
+				t.Errorf("%s: watched at %s, auto %v", w.Title, w.Level, w.Auto)
+			}
+			got = append(got, w.Title)
+		}
+		if next == "" {
+			break
+		}
+		if after, err = decodeCursor(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(got, titles) {
+		t.Errorf("watched threads %v, want %v", got, titles)
+	}
+}